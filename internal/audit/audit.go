@@ -0,0 +1,117 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// LevelMetadata records the identity and the request attributes, without the groups list and the full URL.
+	LevelMetadata = "metadata"
+	// LevelFull records the groups list and the full URL too.
+	LevelFull = "full"
+
+	DecisionAllowed  = "allowed"
+	DecisionFiltered = "filtered"
+	DecisionDenied   = "denied"
+	DecisionError    = "error"
+)
+
+// Event is the audit record of a single proxied request, emitted as a JSON line.
+type Event struct {
+	Timestamp   time.Time `json:"timestamp"`
+	RequestID   string    `json:"requestID,omitempty"`
+	Username    string    `json:"username,omitempty"`
+	Groups      []string  `json:"groups,omitempty"`
+	GroupsCount int       `json:"groupsCount"`
+	AuthType    string    `json:"authType,omitempty"`
+	Verb        string    `json:"verb,omitempty"`
+	APIGroup    string    `json:"apiGroup,omitempty"`
+	Resource    string    `json:"resource,omitempty"`
+	Subresource string    `json:"subresource,omitempty"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Name        string    `json:"name,omitempty"`
+	URL         string    `json:"url,omitempty"`
+	Decision    string    `json:"decision"`
+	Code        int       `json:"code"`
+}
+
+// SetIdentity records the identity resolved for the request, it's a no-op on a nil Event.
+func (e *Event) SetIdentity(username string, groups []string, authType string) {
+	if e == nil {
+		return
+	}
+
+	e.Username, e.Groups, e.GroupsCount, e.AuthType = username, groups, len(groups), authType
+}
+
+// SetDecision records the proxy decision for the request, it's a no-op on a nil Event.
+func (e *Event) SetDecision(decision string) {
+	if e == nil {
+		return
+	}
+
+	e.Decision = decision
+}
+
+type Logger struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+	level   string
+}
+
+// NewLogger returns the Logger writing the events to the given sink, either stdout or a file path, opened in append mode.
+func NewLogger(sink, level string) (*Logger, error) {
+	if level != LevelMetadata && level != LevelFull {
+		return nil, fmt.Errorf("unsupported audit level %s", level)
+	}
+
+	var w io.Writer = os.Stdout
+
+	if sink != "stdout" && sink != "-" {
+		f, err := os.OpenFile(sink, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open the audit log file: %w", err)
+		}
+
+		w = f
+	}
+
+	return newLogger(w, level), nil
+}
+
+func newLogger(w io.Writer, level string) *Logger {
+	return &Logger{encoder: json.NewEncoder(w), level: level}
+}
+
+func (l *Logger) Log(event *Event) {
+	if l.level == LevelMetadata {
+		event.Groups, event.URL = nil, ""
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_ = l.encoder.Encode(event)
+}
+
+type contextKey struct{}
+
+func withEvent(ctx context.Context, event *Event) context.Context {
+	return context.WithValue(ctx, contextKey{}, event)
+}
+
+// EventFrom returns the audit Event of the request context, nil when the audit is disabled.
+func EventFrom(ctx context.Context) *Event {
+	event, _ := ctx.Value(contextKey{}).(*Event)
+
+	return event
+}
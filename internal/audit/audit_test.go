@@ -0,0 +1,147 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+// nolint:testpackage
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	req "github.com/clastix/capsule-proxy/internal/request"
+)
+
+func serve(t *testing.T, level string, handler http.HandlerFunc, target string) Event {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	logger := newLogger(&buf, level)
+
+	func() {
+		defer func() {
+			_ = recover()
+		}()
+
+		logger.Middleware("access_token")(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}()
+
+	var event Event
+	if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+		t.Fatalf("cannot decode the audit event %q: %s", buf.String(), err)
+	}
+
+	return event
+}
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+
+	identity := func(writer http.ResponseWriter, request *http.Request) {
+		EventFrom(request.Context()).SetIdentity("alice", []string{"capsule.clastix.io", "dev"}, "jwt")
+	}
+
+	testCases := []struct {
+		name     string
+		level    string
+		handler  http.HandlerFunc
+		decision string
+		code     int
+	}{
+		{"allowed", LevelFull, identity, DecisionAllowed, http.StatusOK},
+		{"filtered", LevelMetadata, func(writer http.ResponseWriter, request *http.Request) {
+			identity(writer, request)
+			EventFrom(request.Context()).SetDecision(DecisionFiltered)
+		}, DecisionFiltered, http.StatusOK},
+		{"denied", LevelMetadata, func(writer http.ResponseWriter, request *http.Request) {
+			writer.WriteHeader(http.StatusForbidden)
+			panic("forbidden")
+		}, DecisionDenied, http.StatusForbidden},
+		{"error", LevelMetadata, func(writer http.ResponseWriter, request *http.Request) {
+			writer.WriteHeader(http.StatusInternalServerError)
+		}, DecisionError, http.StatusInternalServerError},
+	}
+
+	for _, tc := range testCases {
+		test := tc
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			event := serve(t, test.level, test.handler, "/api/v1/namespaces/oil/pods/nginx?watch=false")
+
+			if event.Decision != test.decision || event.Code != test.code {
+				t.Errorf("got decision %s and code %d, want %s and %d", event.Decision, event.Code, test.decision, test.code)
+			}
+
+			if event.Verb != "get" || event.Resource != "pods" || event.Namespace != "oil" || event.Name != "nginx" {
+				t.Errorf("unexpected request attributes %+v", event)
+			}
+		})
+	}
+}
+
+func TestLevel(t *testing.T) {
+	t.Parallel()
+
+	handler := func(writer http.ResponseWriter, request *http.Request) {
+		EventFrom(request.Context()).SetIdentity("alice", []string{"capsule.clastix.io", "dev"}, "jwt")
+	}
+
+	full := serve(t, LevelFull, handler, "/api/v1/nodes")
+	if len(full.Groups) != 2 || full.URL != "/api/v1/nodes" || full.AuthType != "jwt" {
+		t.Errorf("full level event is missing attributes: %+v", full)
+	}
+
+	metadata := serve(t, LevelMetadata, handler, "/api/v1/nodes")
+	if len(metadata.Groups) > 0 || len(metadata.URL) > 0 || metadata.GroupsCount != 2 || metadata.Username != "alice" {
+		t.Errorf("metadata level event is unexpected: %+v", metadata)
+	}
+}
+
+func TestRedactedToken(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]string{
+		"/api/v1/namespaces/oil/pods/nginx/exec?access_token=secret&command=sh": "/api/v1/namespaces/oil/pods/nginx/exec?access_token=REDACTED&command=sh",
+		"/api/v1/nodes?watch=true": "/api/v1/nodes?watch=true",
+		"/api/v1/nodes":            "/api/v1/nodes",
+	}
+
+	for target, want := range testCases {
+		event := serve(t, LevelFull, func(http.ResponseWriter, *http.Request) {}, target)
+		if event.URL != want {
+			t.Errorf("got URL %q for %s, want %q", event.URL, target, want)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/nodes", nil)
+	r = r.WithContext(req.WithRequestID(r.Context(), "3f6c1e2a-trace"))
+
+	newLogger(&buf, LevelMetadata).Middleware("")(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(httptest.NewRecorder(), r)
+
+	var event Event
+	if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+		t.Fatalf("cannot decode the audit event %q: %s", buf.String(), err)
+	}
+
+	if event.RequestID != "3f6c1e2a-trace" {
+		t.Errorf("got request ID %q, want 3f6c1e2a-trace", event.RequestID)
+	}
+}
+
+func TestNewLoggerLevel(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewLogger("stdout", "verbose"); err == nil {
+		t.Error("expected an error for an unsupported level")
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package audit
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/endpoints/request"
+
+	req "github.com/clastix/capsule-proxy/internal/request"
+	"github.com/clastix/capsule-proxy/internal/responsewriter"
+)
+
+// nolint:gochecknoglobals
+var requestInfoFactory = &request.RequestInfoFactory{
+	APIPrefixes:          sets.NewString("api", "apis"),
+	GrouplessAPIPrefixes: sets.NewString("api"),
+}
+
+// Middleware emits an Event for each request: the handlers record the identity and the decision on the Event
+// retrieved with EventFrom, while the denied and failed requests are inferred by the response status code.
+// The value of the token query parameter, if any, is redacted from the recorded URL.
+func (l *Logger) Middleware(tokenQueryParameter string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return l.middleware(next, tokenQueryParameter)
+	}
+}
+
+func (l *Logger) middleware(next http.Handler, tokenQueryParameter string) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		event := &Event{Timestamp: time.Now(), RequestID: req.RequestIDFrom(r.Context()), URL: redactedURI(r.URL, tokenQueryParameter), Decision: DecisionAllowed}
+
+		if info, err := requestInfoFactory.NewRequestInfo(r); err == nil {
+			event.Verb, event.APIGroup, event.Resource, event.Subresource = info.Verb, info.APIGroup, info.Resource, info.Subresource
+			event.Namespace, event.Name = info.Namespace, info.Name
+		}
+
+		rw := responsewriter.NewStatusRecorder(writer)
+		// The error handlers are panicking, the Event must be emitted anyway
+		panicked := true
+
+		defer func() {
+			event.Code = rw.StatusCode
+
+			switch {
+			case rw.StatusCode >= http.StatusInternalServerError:
+				event.Decision = DecisionError
+			case rw.StatusCode >= http.StatusBadRequest, panicked:
+				event.Decision = DecisionDenied
+			}
+
+			l.Log(event)
+		}()
+
+		next.ServeHTTP(rw, r.WithContext(withEvent(r.Context(), event)))
+
+		panicked = false
+	})
+}
+
+// redactedURI returns the request URI with the value of the token query parameter redacted, carrying the bearer
+// token of the clients unable to set the Authorization header, such as the WebSocket ones.
+func redactedURI(u *url.URL, tokenQueryParameter string) string {
+	q := u.Query()
+	if len(tokenQueryParameter) == 0 || !q.Has(tokenQueryParameter) {
+		return u.RequestURI()
+	}
+
+	q.Set(tokenQueryParameter, "REDACTED")
+
+	redacted := *u
+	redacted.RawQuery = q.Encode()
+
+	return redacted.RequestURI()
+}
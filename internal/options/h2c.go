@@ -0,0 +1,78 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package options
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/http2"
+)
+
+const (
+	UpstreamProtocolHTTP1 = "http1"
+	UpstreamProtocolHTTP2 = "http2"
+	UpstreamProtocolH2C   = "h2c"
+)
+
+const (
+	// The streams multiplexed on a single connection are lost altogether when it's broken:
+	// the connection is health checked to detect it as soon as possible.
+	http2ReadIdleTimeout = 30 * time.Second
+	http2PingTimeout     = 15 * time.Second
+)
+
+// upgradeTransport multiplexes the requests on a single HTTP/2 connection: the upgraded connections, such as exec,
+// attach, and port-forward, are not supported by HTTP/2, thus these are sent with the HTTP/1.1 only transport.
+type upgradeTransport struct {
+	http1 http.RoundTripper
+	http2 http.RoundTripper
+}
+
+// newH2CTransport speaks HTTP/2 over cleartext, with prior knowledge.
+func newH2CTransport(http1 *http.Transport, dialer *net.Dialer) http.RoundTripper {
+	return &upgradeTransport{
+		http1: http1,
+		http2: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.Dial(network, addr)
+			},
+			ReadIdleTimeout: http2ReadIdleTimeout,
+			PingTimeout:     http2PingTimeout,
+		},
+	}
+}
+
+// newHTTP2Transport negotiates HTTP/2 over TLS with ALPN: the upgrade requests are sent by a copy of the transport
+// negotiating HTTP/1.1 only, the API server would otherwise select HTTP/2 for their connections too.
+func newHTTP2Transport(t *http.Transport) (http.RoundTripper, error) {
+	http1 := t.Clone()
+	// A non-nil empty map disables HTTP/2
+	http1.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+
+	if http1.TLSClientConfig != nil {
+		http1.TLSClientConfig.NextProtos = []string{"http/1.1"}
+	}
+
+	t2, err := http2.ConfigureTransports(t)
+	if err != nil {
+		return nil, err
+	}
+
+	t2.ReadIdleTimeout, t2.PingTimeout = http2ReadIdleTimeout, http2PingTimeout
+
+	return &upgradeTransport{http1: http1, http2: t}, nil
+}
+
+func (u *upgradeTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if httpguts.HeaderValuesContainsToken(request.Header.Values("Connection"), "upgrade") {
+		return u.http1.RoundTrip(request)
+	}
+
+	return u.http2.RoundTrip(request)
+}
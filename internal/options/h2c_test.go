@@ -0,0 +1,138 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package options
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"k8s.io/client-go/rest"
+)
+
+func TestH2CTransport(t *testing.T) {
+	t.Parallel()
+
+	var newConns int64
+
+	srv := httptest.NewUnstartedServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+		// Streaming the watch events
+		for i := 0; i < 3; i++ {
+			_, _ = fmt.Fprintf(w, "event-%d\n", i)
+			w.(http.Flusher).Flush()
+		}
+	}), &http2.Server{}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&newConns, 1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	rt, err := kubeOpts{config: &rest.Config{Host: srv.URL}, upstreamProtocol: UpstreamProtocolH2C}.ReverseProxyTransport()
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+
+	client := &http.Client{Transport: rt}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			res, err := client.Get(srv.URL + "/api/v1/pods?watch=true") // nolint:noctx
+			if err != nil {
+				t.Errorf("got error: %v", err)
+
+				return
+			}
+			defer res.Body.Close()
+
+			body, _ := io.ReadAll(res.Body)
+			if proto := res.Header.Get("X-Proto"); proto != "HTTP/2.0" || string(body) != "event-0\nevent-1\nevent-2\n" {
+				t.Errorf("got %s and body %q, want the events streamed over HTTP/2.0", proto, body)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if got := atomic.LoadInt64(&newConns); got != 1 {
+		t.Errorf("got %d connections, want the requests multiplexed on a single one", got)
+	}
+
+	r, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/namespaces/default/pods/nginx/exec", nil) // nolint:noctx
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "SPDY/3.1")
+
+	res, err := client.Do(r)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	defer res.Body.Close()
+
+	if proto := res.Header.Get("X-Proto"); proto != "HTTP/1.1" {
+		t.Errorf("got %s, want the upgrade request sent with HTTP/1.1", proto)
+	}
+}
+
+func TestHTTP2TransportUpgrade(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	rt, err := kubeOpts{config: &rest.Config{Host: srv.URL, TLSClientConfig: rest.TLSClientConfig{CAData: ca}}, upstreamProtocol: UpstreamProtocolHTTP2}.ReverseProxyTransport()
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		upgrade   bool
+		wantProto string
+	}{
+		{"multiplexed request", false, "HTTP/2.0"},
+		{"upgrade request", true, "HTTP/1.1"},
+	}
+
+	for _, eachTest := range tests {
+		r, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/namespaces/default/pods/nginx/exec", nil) // nolint:noctx
+		if eachTest.upgrade {
+			r.Header.Set("Connection", "Upgrade")
+			r.Header.Set("Upgrade", "SPDY/3.1")
+		}
+
+		res, err := rt.RoundTrip(r)
+		if err != nil {
+			t.Fatalf("%s: got error: %v", eachTest.name, err)
+		}
+
+		_ = res.Body.Close()
+
+		if proto := res.Header.Get("X-Proto"); proto != eachTest.wantProto {
+			t.Errorf("%s: got %s, want %s", eachTest.name, proto, eachTest.wantProto)
+		}
+	}
+}
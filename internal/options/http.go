@@ -7,32 +7,92 @@ import (
 	"crypto/x509"
 	"fmt"
 	"os"
+	"time"
 
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/util/cert"
 )
 
 type httpOptions struct {
-	isTLS   bool
-	port    uint
-	crtPath string
-	keyPath string
-	caPool  *x509.CertPool
+	isTLS             bool
+	port              uint
+	crtPath           string
+	keyPath           string
+	caPool            *x509.CertPool
+	clientCAPool      *x509.CertPool
+	tlsMinVersion     uint16
+	tlsCipherSuites   []uint16
+	verboseAuthErrors bool
+	trustClientIP     bool
+	realm             string
+	maxBodyBytes      int64
+	identityHeaders   bool
+	filteredWarning   bool
+	readOnly          bool
+	readOnlyMessage   string
+	rateLimitQPS      float64
+	rateLimitBurst    int
+	rateLimitGroups   []string
+	shutdownTimeout   time.Duration
+	streamsGrace      time.Duration
+	tokenHeader       string
+	unauthenticated   string
 }
 
-func NewServer(isTLS bool, port uint, crtPath string, keyPath string, config *rest.Config) (ServerOptions, error) {
+// Server are the flags configuring the proxy listener and the handling of the requests, see the ServerOptions
+// getters for their meaning.
+type Server struct {
+	TLS               bool
+	Port              uint
+	CertPath          string
+	KeyPath           string
+	ClientCAPath      string
+	TLSMinVersion     string
+	TLSCipherSuites   []string
+	VerboseAuthErrors bool
+	TrustClientIP     bool
+	Realm             string
+	MaxBodyBytes      int64
+	IdentityHeaders   bool
+	FilteredWarning   bool
+	ReadOnly          bool
+	ReadOnlyMessage   string
+	ShutdownTimeout   time.Duration
+	StreamsGrace      time.Duration
+	TokenHeader       string
+	Unauthenticated   string
+	RateLimitQPS      float64
+	RateLimitBurst    int
+	RateLimitGroups   []string
+}
+
+func NewServer(opts Server, config *rest.Config) (ServerOptions, error) {
 	var err error
 
-	if isTLS {
-		if _, err = os.Stat(crtPath); err != nil {
+	if opts.TLS {
+		if _, err = os.Stat(opts.CertPath); err != nil {
 			return nil, fmt.Errorf("cannot lookup TLS certificate file: %w", err)
 		}
 
-		if _, err = os.Stat(keyPath); err != nil {
+		if _, err = os.Stat(opts.KeyPath); err != nil {
 			return nil, fmt.Errorf("cannot lookup TLS certificate key file: %w", err)
 		}
 	}
 
+	minVersion, err := parseTLSMinVersion(opts.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	cipherSuites, err := parseTLSCipherSuites(opts.TLSCipherSuites, minVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.RateLimitQPS < 0 || (opts.RateLimitQPS > 0 && opts.RateLimitBurst < 1) {
+		return nil, fmt.Errorf("the rate limit of %v requests per second with a burst of %d is not valid", opts.RateLimitQPS, opts.RateLimitBurst)
+	}
+
 	var caPool *x509.CertPool
 
 	if caPool, err = cert.NewPool(config.CAFile); err != nil {
@@ -41,7 +101,126 @@ func NewServer(isTLS bool, port uint, crtPath string, keyPath string, config *re
 		}
 	}
 
-	return &httpOptions{isTLS: isTLS, port: port, crtPath: crtPath, keyPath: keyPath, caPool: caPool}, nil
+	var clientCAPool *x509.CertPool
+
+	if len(opts.ClientCAPath) > 0 {
+		if clientCAPool, err = cert.NewPool(opts.ClientCAPath); err != nil {
+			return nil, fmt.Errorf("cannot load the client certificates CA: %w", err)
+		}
+	}
+
+	return &httpOptions{
+		isTLS:             opts.TLS,
+		port:              opts.Port,
+		crtPath:           opts.CertPath,
+		keyPath:           opts.KeyPath,
+		caPool:            caPool,
+		clientCAPool:      clientCAPool,
+		tlsMinVersion:     minVersion,
+		tlsCipherSuites:   cipherSuites,
+		verboseAuthErrors: opts.VerboseAuthErrors,
+		trustClientIP:     opts.TrustClientIP,
+		realm:             opts.Realm,
+		maxBodyBytes:      opts.MaxBodyBytes,
+		identityHeaders:   opts.IdentityHeaders,
+		filteredWarning:   opts.FilteredWarning,
+		readOnly:          opts.ReadOnly,
+		readOnlyMessage:   opts.ReadOnlyMessage,
+		rateLimitQPS:      opts.RateLimitQPS,
+		rateLimitBurst:    opts.RateLimitBurst,
+		rateLimitGroups:   opts.RateLimitGroups,
+		shutdownTimeout:   opts.ShutdownTimeout,
+		streamsGrace:      opts.StreamsGrace,
+		tokenHeader:       opts.TokenHeader,
+		unauthenticated:   opts.Unauthenticated,
+	}, nil
+}
+
+// TLSMinVersion returns the minimum TLS version accepted by the listener.
+func (h httpOptions) TLSMinVersion() uint16 {
+	return h.tlsMinVersion
+}
+
+// TLSCipherSuites returns the cipher suites allowed by the listener up to TLS 1.2, the Go defaults when empty.
+func (h httpOptions) TLSCipherSuites() []uint16 {
+	return h.tlsCipherSuites
+}
+
+// UnauthenticatedMessage returns the reason of the requests rejected for the missing credentials.
+func (h httpOptions) UnauthenticatedMessage() string {
+	return h.unauthenticated
+}
+
+// TokenHeader returns the header the bearer token is read from, Authorization unless forwarded by a gateway.
+func (h httpOptions) TokenHeader() string {
+	return h.tokenHeader
+}
+
+// ShutdownTimeout returns the time the in-flight requests are waited for upon shutdown, before closing the connections.
+func (h httpOptions) ShutdownTimeout() time.Duration {
+	return h.shutdownTimeout
+}
+
+// StreamsGracePeriod returns the time the long-running requests, such as watches, are kept open upon shutdown.
+func (h httpOptions) StreamsGracePeriod() time.Duration {
+	return h.streamsGrace
+}
+
+// ForwardIdentityHeaders returns if the resolved identity must be forwarded to the upstream with the
+// X-Capsule-Proxy-User and X-Capsule-Proxy-Groups headers: these are meant for trusted internal networks only.
+func (h httpOptions) ForwardIdentityHeaders() bool {
+	return h.identityHeaders
+}
+
+// FilteredListWarning returns if a Warning header must be appended to the list responses filtered to the Tenants
+// resources, next to the API server ones.
+func (h httpOptions) FilteredListWarning() bool {
+	return h.filteredWarning
+}
+
+// ReadOnly returns if the write requests must be rejected, such as during the cluster maintenance.
+func (h httpOptions) ReadOnly() bool {
+	return h.readOnly
+}
+
+// ReadOnlyMessage returns the reason of the write requests rejected in the read-only mode.
+func (h httpOptions) ReadOnlyMessage() string {
+	return h.readOnlyMessage
+}
+
+// RateLimitQPS returns the requests per second allowed to each user, zero when not limited.
+func (h httpOptions) RateLimitQPS() float64 {
+	return h.rateLimitQPS
+}
+
+// RateLimitBurst returns the requests allowed in a burst on top of the RateLimitQPS ones.
+func (h httpOptions) RateLimitBurst() int {
+	return h.rateLimitBurst
+}
+
+// RateLimitGroups returns the groups whose members share a rate limit as well, on top of their own one.
+func (h httpOptions) RateLimitGroups() []string {
+	return h.rateLimitGroups
+}
+
+// MaxRequestBodyBytes returns the size limit of the write requests body, zero when not limited.
+func (h httpOptions) MaxRequestBodyBytes() int64 {
+	return h.maxBodyBytes
+}
+
+// AuthenticateRealm returns the realm of the WWW-Authenticate challenge of the 401 responses, if any.
+func (h httpOptions) AuthenticateRealm() string {
+	return h.realm
+}
+
+// TrustClientIP returns if the client IP, along with the X-Forwarded-For chain, must be forwarded to the upstream.
+func (h httpOptions) TrustClientIP() bool {
+	return h.trustClientIP
+}
+
+// GetClientCertificateAuthorityPool returns the CA the client certificates must be issued by, if configured.
+func (h httpOptions) GetClientCertificateAuthorityPool() *x509.CertPool {
+	return h.clientCAPool
 }
 
 func (h httpOptions) GetCertificateAuthorityPool() *x509.CertPool {
@@ -63,3 +242,7 @@ func (h httpOptions) TLSCertificatePath() string {
 func (h httpOptions) TLSCertificateKeyPath() string {
 	return h.keyPath
 }
+
+func (h httpOptions) VerboseAuthErrors() bool {
+	return h.verboseAuthErrors
+}
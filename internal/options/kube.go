@@ -9,6 +9,9 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -17,23 +20,227 @@ import (
 )
 
 type kubeOpts struct {
-	url           url.URL
-	ignoredGroups []string
-	claimName     string
-	config        *rest.Config
+	url                url.URL
+	ignoredGroups      []string
+	audiences          []string
+	requiredAudiences  []string
+	claimNames         []string
+	groupsClaimNames   []string
+	usernamePrefix     string
+	groupsPrefix       string
+	groupsSeparator    string
+	requireGroupsClaim bool
+	fallbackToSub      bool
+	lowercaseEmail     bool
+	certUsernameSource string
+	certGroupsSources  []string
+	certURIPattern     string
+	certURITemplate    string
+	noCertAuth         bool
+	trustedProxies     []string
+	tokenQueryParam    string
+	anonymousPaths     []string
+	clockSkew          time.Duration
+	saLeeway           time.Duration
+	saIssuers          []string
+	upstreamTimeout    time.Duration
+	trRetries          int
+	trRetryBackoff     time.Duration
+	authGroup          bool
+	additionalGroups   []string
+	issuersConfig      string
+	strictIssuers      bool
+	trustedIssuers     []string
+	noImpersonation    bool
+	noSAImpersonation  bool
+	nsImpersonation    bool
+	forwardUserExtra   bool
+	impersonateSep     string
+	bypassUsers        []string
+	deniedUsers        []string
+	deniedGroups       []string
+	namespaceLabels    []string
+	groupsAllow        *regexp.Regexp
+	groupsDeny         *regexp.Regexp
+	userInfoURL        string
+	discoverUserInfo   bool
+	userInfoCacheTTL   time.Duration
+	introspection      introspectionOpts
+	groupsURL          string
+	groupsCacheTTL     time.Duration
+	upstreamProtocol   string
+	upstreamsConfig    string
+	config             *rest.Config
 }
 
-func NewKube(ignoredGroups []string, claimName string, config *rest.Config) (ListenerOpts, error) {
+// introspectionOpts configures the OAuth2 token introspection endpoint, disabled when the URL is empty.
+type introspectionOpts struct {
+	url            string
+	clientID       string
+	clientSecret   string
+	usernameClaims []string
+	groupsClaims   []string
+	cacheTTL       time.Duration
+}
+
+// Kube are the flags configuring the authentication and the proxying of the requests to the API server, see the
+// ListenerOpts getters for their meaning.
+type Kube struct {
+	IgnoredGroups                 []string
+	Audiences                     []string
+	RequiredAudiences             []string
+	UsernameClaims                []string
+	GroupsClaims                  []string
+	UsernamePrefix                string
+	GroupsPrefix                  string
+	GroupsSeparator               string
+	RequireGroupsClaim            bool
+	UsernameFallbackToSub         bool
+	UsernameLowercaseEmail        bool
+	CertUsernameSource            string
+	CertGroupsSources             []string
+	CertURIPattern                string
+	CertURITemplate               string
+	CertAuthDisabled              bool
+	TrustedProxies                []string
+	TokenQueryParameter           string
+	AnonymousPaths                []string
+	ClockSkew                     time.Duration
+	ServiceAccountLeeway          time.Duration
+	ServiceAccountIssuers         []string
+	UpstreamTimeout               time.Duration
+	TokenReviewRetries            int
+	TokenReviewRetryBackoff       time.Duration
+	AuthenticatedGroup            bool
+	AdditionalGroups              []string
+	IssuersConfig                 string
+	TrustedIssuers                []string
+	StrictIssuers                 bool
+	ImpersonationDisabled         bool
+	SAImpersonationDisabled       bool
+	NamespacedImpersonation       bool
+	ForwardUserExtra              bool
+	ImpersonateGroupsSeparator    string
+	BypassUsers                   []string
+	DeniedUsers                   []string
+	DeniedGroups                  []string
+	NamespaceLabels               []string
+	GroupsAllowRegex              string
+	GroupsDenyRegex               string
+	UserInfoURL                   string
+	DiscoverUserInfo              bool
+	UserInfoCacheTTL              time.Duration
+	IntrospectionURL              string
+	IntrospectionClientID         string
+	IntrospectionClientSecretPath string
+	IntrospectionUsernameClaims   []string
+	IntrospectionGroupsClaims     []string
+	IntrospectionCacheTTL         time.Duration
+	GroupResolverURL              string
+	GroupResolverCacheTTL         time.Duration
+	UpstreamProtocol              string
+	UpstreamsConfig               string
+}
+
+func NewKube(opts Kube, config *rest.Config) (ListenerOpts, error) {
 	u, err := url.Parse(config.Host)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create Kubernetes Options due to failed URL parsing: %w", err)
 	}
 
+	switch opts.UpstreamProtocol {
+	case UpstreamProtocolHTTP1, UpstreamProtocolHTTP2:
+	case UpstreamProtocolH2C:
+		if u.Scheme != "http" {
+			return nil, fmt.Errorf("cannot use the %s upstream protocol with the %s scheme, plaintext http is required", opts.UpstreamProtocol, u.Scheme)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported upstream protocol %s, expected one of %s, %s, %s", opts.UpstreamProtocol, UpstreamProtocolHTTP1, UpstreamProtocolHTTP2, UpstreamProtocolH2C)
+	}
+
+	var groupsAllow, groupsDeny *regexp.Regexp
+
+	if len(opts.GroupsAllowRegex) > 0 {
+		if groupsAllow, err = regexp.Compile(opts.GroupsAllowRegex); err != nil {
+			return nil, fmt.Errorf("cannot compile the groups allow regex: %w", err)
+		}
+	}
+
+	if len(opts.GroupsDenyRegex) > 0 {
+		if groupsDeny, err = regexp.Compile(opts.GroupsDenyRegex); err != nil {
+			return nil, fmt.Errorf("cannot compile the groups deny regex: %w", err)
+		}
+	}
+
+	introspection := introspectionOpts{
+		url:            opts.IntrospectionURL,
+		clientID:       opts.IntrospectionClientID,
+		usernameClaims: opts.IntrospectionUsernameClaims,
+		groupsClaims:   opts.IntrospectionGroupsClaims,
+		cacheTTL:       opts.IntrospectionCacheTTL,
+	}
+
+	if len(opts.IntrospectionClientSecretPath) > 0 {
+		secret, err := os.ReadFile(opts.IntrospectionClientSecretPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the introspection client secret: %w", err)
+		}
+
+		introspection.clientSecret = strings.TrimSpace(string(secret))
+	}
+
 	return &kubeOpts{
-		url:           *u,
-		ignoredGroups: ignoredGroups,
-		claimName:     claimName,
-		config:        config,
+		url:                *u,
+		ignoredGroups:      opts.IgnoredGroups,
+		audiences:          opts.Audiences,
+		requiredAudiences:  opts.RequiredAudiences,
+		claimNames:         opts.UsernameClaims,
+		groupsClaimNames:   opts.GroupsClaims,
+		usernamePrefix:     opts.UsernamePrefix,
+		groupsPrefix:       opts.GroupsPrefix,
+		groupsSeparator:    opts.GroupsSeparator,
+		requireGroupsClaim: opts.RequireGroupsClaim,
+		fallbackToSub:      opts.UsernameFallbackToSub,
+		lowercaseEmail:     opts.UsernameLowercaseEmail,
+		certUsernameSource: opts.CertUsernameSource,
+		certGroupsSources:  opts.CertGroupsSources,
+		certURIPattern:     opts.CertURIPattern,
+		certURITemplate:    opts.CertURITemplate,
+		noCertAuth:         opts.CertAuthDisabled,
+		trustedProxies:     opts.TrustedProxies,
+		tokenQueryParam:    opts.TokenQueryParameter,
+		anonymousPaths:     opts.AnonymousPaths,
+		clockSkew:          opts.ClockSkew,
+		saLeeway:           opts.ServiceAccountLeeway,
+		saIssuers:          opts.ServiceAccountIssuers,
+		upstreamTimeout:    opts.UpstreamTimeout,
+		trRetries:          opts.TokenReviewRetries,
+		trRetryBackoff:     opts.TokenReviewRetryBackoff,
+		authGroup:          opts.AuthenticatedGroup,
+		additionalGroups:   opts.AdditionalGroups,
+		issuersConfig:      opts.IssuersConfig,
+		strictIssuers:      opts.StrictIssuers,
+		trustedIssuers:     opts.TrustedIssuers,
+		noImpersonation:    opts.ImpersonationDisabled,
+		noSAImpersonation:  opts.SAImpersonationDisabled,
+		nsImpersonation:    opts.NamespacedImpersonation,
+		forwardUserExtra:   opts.ForwardUserExtra,
+		impersonateSep:     opts.ImpersonateGroupsSeparator,
+		bypassUsers:        opts.BypassUsers,
+		deniedUsers:        opts.DeniedUsers,
+		deniedGroups:       opts.DeniedGroups,
+		namespaceLabels:    opts.NamespaceLabels,
+		groupsAllow:        groupsAllow,
+		groupsDeny:         groupsDeny,
+		userInfoURL:        opts.UserInfoURL,
+		discoverUserInfo:   opts.DiscoverUserInfo,
+		userInfoCacheTTL:   opts.UserInfoCacheTTL,
+		introspection:      introspection,
+		groupsURL:          opts.GroupResolverURL,
+		groupsCacheTTL:     opts.GroupResolverCacheTTL,
+		upstreamProtocol:   opts.UpstreamProtocol,
+		upstreamsConfig:    opts.UpstreamsConfig,
+		config:             config,
 	}, nil
 }
 
@@ -49,11 +256,242 @@ func (k kubeOpts) IgnoredGroupNames() []string {
 	return k.ignoredGroups
 }
 
-func (k kubeOpts) PreferredUsernameClaim() string {
-	return k.claimName
+func (k kubeOpts) Audiences() []string {
+	return k.audiences
+}
+
+func (k kubeOpts) JWTRequiredAudiences() []string {
+	return k.requiredAudiences
+}
+
+func (k kubeOpts) PreferredUsernameClaims() []string {
+	return k.claimNames
+}
+
+func (k kubeOpts) GroupsClaims() []string {
+	return k.groupsClaimNames
+}
+
+func (k kubeOpts) UsernamePrefix() string {
+	return k.usernamePrefix
+}
+
+func (k kubeOpts) GroupsPrefix() string {
+	return k.groupsPrefix
+}
+
+func (k kubeOpts) GroupsSeparator() string {
+	return k.groupsSeparator
+}
+
+func (k kubeOpts) UsernameClaimFallbackSub() bool {
+	return k.fallbackToSub
+}
+
+// UsernameLowercaseEmail returns if the email-shaped usernames must be lowercased.
+func (k kubeOpts) UsernameLowercaseEmail() bool {
+	return k.lowercaseEmail
+}
+
+func (k kubeOpts) RequireGroupsClaim() bool {
+	return k.requireGroupsClaim
+}
+
+// ClientCertificateAuthDisabled returns if the client certificates must be ignored, authenticating the requests
+// with the bearer tokens only, even when a certificate is presented.
+func (k kubeOpts) ClientCertificateAuthDisabled() bool {
+	return k.noCertAuth
+}
+
+func (k kubeOpts) CertificateUsernameSource() string {
+	return k.certUsernameSource
+}
+
+func (k kubeOpts) CertificateGroupsSources() []string {
+	return k.certGroupsSources
+}
+
+// CertificateURIPattern returns the regular expression the URI SAN must match when used as the username source.
+func (k kubeOpts) CertificateURIPattern() string {
+	return k.certURIPattern
+}
+
+// CertificateURIUsernameTemplate returns the template expanded with the URI SAN pattern submatches into the username.
+func (k kubeOpts) CertificateURIUsernameTemplate() string {
+	return k.certURITemplate
+}
+
+func (k kubeOpts) TrustedProxyCommonNames() []string {
+	return k.trustedProxies
+}
+
+func (k kubeOpts) TokenQueryParameter() string {
+	return k.tokenQueryParam
+}
+
+func (k kubeOpts) AnonymousAllowedPaths() []string {
+	return k.anonymousPaths
+}
+
+func (k kubeOpts) ClockSkew() time.Duration {
+	return k.clockSkew
+}
+
+func (k kubeOpts) ServiceAccountTokenLeeway() time.Duration {
+	return k.saLeeway
+}
+
+// ServiceAccountIssuers returns the issuers of the projected service account tokens, the only JWT mapped to the
+// service accounts along with the legacy ones.
+func (k kubeOpts) ServiceAccountIssuers() []string {
+	return k.saIssuers
+}
+
+func (k kubeOpts) UpstreamTimeout() time.Duration {
+	return k.upstreamTimeout
+}
+
+// TokenReviewRetries returns the number of the retries of the TokenReview requests failed for transient errors.
+func (k kubeOpts) TokenReviewRetries() int {
+	return k.trRetries
+}
+
+// TokenReviewRetryBackoff returns the delay of the first TokenReview retry, doubled at each one.
+func (k kubeOpts) TokenReviewRetryBackoff() time.Duration {
+	return k.trRetryBackoff
+}
+
+func (k kubeOpts) AddAuthenticatedGroup() bool {
+	return k.authGroup
+}
+
+// AdditionalGroups returns the groups added to the ones of every authenticated user.
+func (k kubeOpts) AdditionalGroups() []string {
+	return k.additionalGroups
+}
+
+func (k kubeOpts) IssuersConfigPath() string {
+	return k.issuersConfig
+}
+
+func (k kubeOpts) StrictIssuers() bool {
+	return k.strictIssuers
+}
+
+// TrustedIssuers returns the issuers of the accepted OIDC JWT, along with the ones of the issuers configuration:
+// any is accepted when empty.
+func (k kubeOpts) TrustedIssuers() []string {
+	return k.trustedIssuers
+}
+
+func (k kubeOpts) ImpersonationBypassUsers() []string {
+	return k.bypassUsers
+}
+
+// ImpersonationDeniedUsers returns the users that cannot be impersonated, regardless of the RBAC policy.
+func (k kubeOpts) ImpersonationDeniedUsers() []string {
+	return k.deniedUsers
+}
+
+// ImpersonationDeniedGroups returns the groups that cannot be impersonated, regardless of the RBAC policy.
+func (k kubeOpts) ImpersonationDeniedGroups() []string {
+	return k.deniedGroups
+}
+
+func (k kubeOpts) ServiceAccountNamespaceLabels() []string {
+	return k.namespaceLabels
+}
+
+func (k kubeOpts) GroupsAllowRegex() *regexp.Regexp {
+	return k.groupsAllow
+}
+
+func (k kubeOpts) GroupsDenyRegex() *regexp.Regexp {
+	return k.groupsDeny
+}
+
+func (k kubeOpts) IntrospectionURL() string {
+	return k.introspection.url
+}
+
+func (k kubeOpts) IntrospectionClientID() string {
+	return k.introspection.clientID
+}
+
+func (k kubeOpts) IntrospectionClientSecret() string {
+	return k.introspection.clientSecret
+}
+
+func (k kubeOpts) IntrospectionUsernameClaims() []string {
+	return k.introspection.usernameClaims
+}
+
+func (k kubeOpts) IntrospectionGroupsClaims() []string {
+	return k.introspection.groupsClaims
 }
 
-func (k kubeOpts) ReverseProxyTransport() (*http.Transport, error) {
+func (k kubeOpts) IntrospectionCacheTTL() time.Duration {
+	return k.introspection.cacheTTL
+}
+
+// GroupResolverURL returns the URL of the group-membership service resolving the groups of the users whose
+// credentials carry none, disabled when empty.
+func (k kubeOpts) GroupResolverURL() string {
+	return k.groupsURL
+}
+
+func (k kubeOpts) GroupResolverCacheTTL() time.Duration {
+	return k.groupsCacheTTL
+}
+
+func (k kubeOpts) UpstreamsConfigPath() string {
+	return k.upstreamsConfig
+}
+
+func (k kubeOpts) ImpersonationDisabled() bool {
+	return k.noImpersonation
+}
+
+// ForwardUserExtra returns if the UID and the extras of the user, such as the TokenReview ones, must be forwarded
+// to the upstream with the Impersonate-Uid and Impersonate-Extra-* headers.
+func (k kubeOpts) ForwardUserExtra() bool {
+	return k.forwardUserExtra
+}
+
+// ImpersonateGroupsSeparator returns the separator splitting each Impersonate-Group header into multiple groups,
+// empty when each header is a single group.
+func (k kubeOpts) ImpersonateGroupsSeparator() string {
+	return k.impersonateSep
+}
+
+// NamespacedImpersonationChecks returns if the impersonation of the namespaced requests must be checked
+// in their Namespace, rather than cluster-wide.
+func (k kubeOpts) NamespacedImpersonationChecks() bool {
+	return k.nsImpersonation
+}
+
+// ServiceAccountImpersonationDisabled returns if the requests authenticated with a service account token
+// must be rejected when carrying the Impersonate-* headers.
+func (k kubeOpts) ServiceAccountImpersonationDisabled() bool {
+	return k.noSAImpersonation
+}
+
+func (k kubeOpts) UserInfoURL() string {
+	return k.userInfoURL
+}
+
+// DiscoverUserInfo returns if the UserInfo endpoint of the OIDC discovery document must resolve the opaque tokens,
+// when not configured explicitly.
+func (k kubeOpts) DiscoverUserInfo() bool {
+	return k.discoverUserInfo
+}
+
+func (k kubeOpts) UserInfoCacheTTL() time.Duration {
+	return k.userInfoCacheTTL
+}
+
+// ReverseProxyTransport returns the transport of the proxied requests, speaking the configured upstream protocol.
+func (k kubeOpts) ReverseProxyTransport() (http.RoundTripper, error) {
 	transportConfig, err := k.config.TransportConfig()
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot get transport configuration")
@@ -64,15 +502,31 @@ func (k kubeOpts) ReverseProxyTransport() (*http.Transport, error) {
 		return nil, errors.Wrap(err, "cannot create tls configuration")
 	}
 
-	return &http.Transport{
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	t := &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
 		DialContext: func(ctx context.Context, network, addr string) (conn net.Conn, e error) {
-			return (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext(ctx, network, addr)
+			return dialer.DialContext(ctx, network, addr)
 		},
 		TLSHandshakeTimeout: 10 * time.Second,
 		TLSClientConfig:     tlsConfig,
-	}, nil
+	}
+
+	switch k.upstreamProtocol {
+	case UpstreamProtocolHTTP2:
+		rt, err := newHTTP2Transport(t)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot configure the HTTP/2 transport")
+		}
+
+		return rt, nil
+	case UpstreamProtocolH2C:
+		return newH2CTransport(t, dialer), nil
+	}
+
+	return t, nil
 }
@@ -6,12 +6,65 @@ package options
 import (
 	"net/http"
 	"net/url"
+	"regexp"
+	"time"
 )
 
 type ListenerOpts interface {
 	KubernetesControlPlaneURL() *url.URL
 	IgnoredGroupNames() []string
-	PreferredUsernameClaim() string
-	ReverseProxyTransport() (*http.Transport, error)
+	Audiences() []string
+	JWTRequiredAudiences() []string
+	PreferredUsernameClaims() []string
+	GroupsClaims() []string
+	UsernamePrefix() string
+	UsernameLowercaseEmail() bool
+	GroupsPrefix() string
+	GroupsSeparator() string
+	RequireGroupsClaim() bool
+	UsernameClaimFallbackSub() bool
+	ClientCertificateAuthDisabled() bool
+	CertificateUsernameSource() string
+	CertificateGroupsSources() []string
+	CertificateURIPattern() string
+	CertificateURIUsernameTemplate() string
+	TrustedProxyCommonNames() []string
+	TokenQueryParameter() string
+	AnonymousAllowedPaths() []string
+	ClockSkew() time.Duration
+	ServiceAccountTokenLeeway() time.Duration
+	ServiceAccountIssuers() []string
+	UpstreamTimeout() time.Duration
+	TokenReviewRetries() int
+	TokenReviewRetryBackoff() time.Duration
+	AddAuthenticatedGroup() bool
+	AdditionalGroups() []string
+	IssuersConfigPath() string
+	StrictIssuers() bool
+	TrustedIssuers() []string
+	ImpersonationBypassUsers() []string
+	ImpersonationDeniedUsers() []string
+	ImpersonationDeniedGroups() []string
+	ImpersonationDisabled() bool
+	ServiceAccountImpersonationDisabled() bool
+	NamespacedImpersonationChecks() bool
+	ForwardUserExtra() bool
+	ImpersonateGroupsSeparator() string
+	ServiceAccountNamespaceLabels() []string
+	GroupsAllowRegex() *regexp.Regexp
+	GroupsDenyRegex() *regexp.Regexp
+	UserInfoURL() string
+	DiscoverUserInfo() bool
+	UserInfoCacheTTL() time.Duration
+	IntrospectionURL() string
+	IntrospectionClientID() string
+	IntrospectionClientSecret() string
+	IntrospectionUsernameClaims() []string
+	IntrospectionGroupsClaims() []string
+	IntrospectionCacheTTL() time.Duration
+	GroupResolverURL() string
+	GroupResolverCacheTTL() time.Duration
+	UpstreamsConfigPath() string
+	ReverseProxyTransport() (http.RoundTripper, error)
 	BearerToken() string
 }
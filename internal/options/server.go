@@ -5,6 +5,7 @@ package options
 
 import (
 	"crypto/x509"
+	"time"
 )
 
 type ServerOptions interface {
@@ -12,5 +13,23 @@ type ServerOptions interface {
 	ListeningPort() uint
 	TLSCertificatePath() string
 	TLSCertificateKeyPath() string
+	TLSMinVersion() uint16
+	TLSCipherSuites() []uint16
 	GetCertificateAuthorityPool() *x509.CertPool
+	GetClientCertificateAuthorityPool() *x509.CertPool
+	VerboseAuthErrors() bool
+	TrustClientIP() bool
+	AuthenticateRealm() string
+	MaxRequestBodyBytes() int64
+	ForwardIdentityHeaders() bool
+	FilteredListWarning() bool
+	ReadOnly() bool
+	ReadOnlyMessage() string
+	RateLimitQPS() float64
+	RateLimitBurst() int
+	RateLimitGroups() []string
+	ShutdownTimeout() time.Duration
+	StreamsGracePeriod() time.Duration
+	TokenHeader() string
+	UnauthenticatedMessage() string
 }
@@ -0,0 +1,89 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package options
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+const (
+	TLSVersion12 = "VersionTLS12"
+	TLSVersion13 = "VersionTLS13"
+)
+
+// parseTLSMinVersion returns the minimum TLS version of the listener: the versions older than TLS 1.2 are insecure,
+// thus rejected.
+func parseTLSMinVersion(version string) (uint16, error) {
+	switch version {
+	case "", TLSVersion12:
+		return tls.VersionTLS12, nil
+	case TLSVersion13:
+		return tls.VersionTLS13, nil
+	case "VersionTLS10", "VersionTLS11":
+		return 0, fmt.Errorf("the TLS version %s is insecure, use %s or %s", version, TLSVersion12, TLSVersion13)
+	default:
+		return 0, fmt.Errorf("unknown TLS version %s, use %s or %s", version, TLSVersion12, TLSVersion13)
+	}
+}
+
+// parseTLSCipherSuites returns the IDs of the cipher suites allowed on the listener, by their IANA name, such as
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256: the insecure ones are rejected, as well as the list not including the
+// cipher suites required by HTTP/2. These apply up to TLS 1.2, since the TLS 1.3 ones are not configurable.
+func parseTLSCipherSuites(names []string, minVersion uint16) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	if minVersion == tls.VersionTLS13 {
+		return nil, fmt.Errorf("the cipher suites are not configurable with the minimum TLS version %s", TLSVersion13)
+	}
+
+	secure := map[string]*tls.CipherSuite{}
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite
+	}
+
+	insecure := map[string]bool{}
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+
+	ids := make([]uint16, 0, len(names))
+
+	var http2 bool
+
+	for _, name := range names {
+		suite, ok := secure[name]
+
+		switch {
+		case insecure[name]:
+			return nil, fmt.Errorf("the cipher suite %s is insecure", name)
+		case !ok:
+			return nil, fmt.Errorf("unknown cipher suite %s", name)
+		case !supportsTLS12(suite):
+			return nil, fmt.Errorf("the TLS 1.3 cipher suite %s is not configurable", name)
+		}
+
+		ids = append(ids, suite.ID)
+		// The HTTP/2 server refuses to start without any of these
+		http2 = http2 || suite.ID == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || suite.ID == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	}
+
+	if !http2 {
+		return nil, fmt.Errorf("the cipher suites must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, as required by HTTP/2")
+	}
+
+	return ids, nil
+}
+
+func supportsTLS12(suite *tls.CipherSuite) bool {
+	for _, version := range suite.SupportedVersions {
+		if version == tls.VersionTLS12 {
+			return true
+		}
+	}
+
+	return false
+}
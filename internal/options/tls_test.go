@@ -0,0 +1,85 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package options
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+)
+
+func TestParseTLSMinVersion(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		version string
+		want    uint16
+		err     bool
+	}{
+		{"", tls.VersionTLS12, false},
+		{TLSVersion12, tls.VersionTLS12, false},
+		{TLSVersion13, tls.VersionTLS13, false},
+		{"VersionTLS10", 0, true},
+		{"VersionTLS11", 0, true},
+		{"TLS1.2", 0, true},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.version, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseTLSMinVersion(eachTest.version)
+			if (err != nil) != eachTest.err {
+				t.Fatalf("got error %v, want error %t", err, eachTest.err)
+			}
+
+			if got != eachTest.want {
+				t.Errorf("got version %x, want %x", got, eachTest.want)
+			}
+		})
+	}
+}
+
+func TestParseTLSCipherSuites(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		suites     []string
+		minVersion uint16
+		want       []uint16
+		err        bool
+	}{
+		{"defaults", nil, tls.VersionTLS12, nil, false},
+		{
+			"secure",
+			[]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+			tls.VersionTLS12,
+			[]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+			false,
+		},
+		{"insecure", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_RSA_WITH_RC4_128_SHA"}, tls.VersionTLS12, nil, true},
+		{"unknown", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_NULL"}, tls.VersionTLS12, nil, true},
+		{"TLS 1.3 suite", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_AES_128_GCM_SHA256"}, tls.VersionTLS12, nil, true},
+		{"missing HTTP/2 required suite", []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}, tls.VersionTLS12, nil, true},
+		{"TLS 1.3 minimum version", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}, tls.VersionTLS13, nil, true},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseTLSCipherSuites(eachTest.suites, eachTest.minVersion)
+			if (err != nil) != eachTest.err {
+				t.Fatalf("got error %v, want error %t", err, eachTest.err)
+			}
+
+			if !reflect.DeepEqual(got, eachTest.want) {
+				t.Errorf("got cipher suites %v, want %v", got, eachTest.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package options
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/transport"
+)
+
+const (
+	// Same as the client-go transport
+	defaultMaxIdleConns = 25
+	defaultKeepAlive    = 30 * time.Second
+)
+
+// UpstreamConfig returns a copy of the given configuration using a transport tuned with the
+// idle connections pool and keepalive settings, in order to reuse the connections to the API server
+// under load instead of performing a TLS handshake for each TokenReview and SubjectAccessReview.
+// The zero values keep the client-go defaults: when all of them are zero the configuration is returned as it is.
+func UpstreamConfig(config *rest.Config, maxIdleConns int, idleConnTimeout, keepAlive time.Duration) (*rest.Config, error) {
+	if maxIdleConns == 0 && idleConnTimeout == 0 && keepAlive == 0 {
+		return config, nil
+	}
+
+	transportConfig, err := config.TransportConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get transport configuration")
+	}
+
+	tlsConfig, err := transport.TLSConfigFor(transportConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create tls configuration")
+	}
+
+	if maxIdleConns == 0 {
+		maxIdleConns = defaultMaxIdleConns
+	}
+
+	if keepAlive == 0 {
+		keepAlive = defaultKeepAlive
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: keepAlive,
+	}
+
+	t := utilnet.SetTransportDefaults(&http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConns:        maxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConns,
+		IdleConnTimeout:     idleConnTimeout,
+	})
+
+	upstream := rest.CopyConfig(config)
+	// client-go refuses a custom transport along with the TLS options, already part of the transport
+	upstream.TLSClientConfig = rest.TLSClientConfig{}
+	upstream.Transport = t
+
+	return upstream, nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package options
+
+import (
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+func newUpstreamServer(newConns *int64) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Simulating the TokenReview round-trip
+		time.Sleep(time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(newConns, 1)
+		}
+	}
+	srv.StartTLS()
+
+	return srv
+}
+
+func upstreamRestConfig(srv *httptest.Server) *rest.Config {
+	return &rest.Config{
+		Host:        srv.URL,
+		BearerToken: "secret",
+		TLSClientConfig: rest.TLSClientConfig{
+			CAData: pemCertificate(srv),
+		},
+	}
+}
+
+func pemCertificate(srv *httptest.Server) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+}
+
+func TestUpstreamConfig(t *testing.T) {
+	t.Parallel()
+
+	var newConns int64
+
+	srv := newUpstreamServer(&newConns)
+	defer srv.Close()
+
+	config := upstreamRestConfig(srv)
+
+	unchanged, err := UpstreamConfig(config, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+
+	if unchanged != config {
+		t.Error("expected the configuration to be unchanged with the zero values")
+	}
+
+	tuned, err := UpstreamConfig(config, 64, time.Minute, 0)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+
+	tr, ok := tuned.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("got transport %T, want *http.Transport", tuned.Transport)
+	}
+
+	if tr.MaxIdleConnsPerHost != 64 || tr.IdleConnTimeout != time.Minute {
+		t.Errorf("got %d idle connections per host and %s idle timeout, want 64 and 1m0s", tr.MaxIdleConnsPerHost, tr.IdleConnTimeout)
+	}
+
+	if len(config.TLSClientConfig.CAData) == 0 {
+		t.Error("expected the original configuration to be left untouched")
+	}
+
+	client, err := rest.HTTPClientFor(tuned)
+	if err != nil {
+		t.Fatalf("cannot create the HTTP client: %v", err)
+	}
+
+	res, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("cannot reach the upstream: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("got status code %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+}
+
+// BenchmarkUpstreamConfig reports the TLS handshakes performed against the upstream under concurrent load,
+// comparing the client-go default pool with a tuned one.
+func BenchmarkUpstreamConfig(b *testing.B) {
+	for _, bench := range []struct {
+		name         string
+		maxIdleConns int
+	}{
+		{"default", 0},
+		{"tuned", 256},
+	} {
+		bench := bench
+		b.Run(bench.name, func(b *testing.B) {
+			var newConns int64
+
+			srv := newUpstreamServer(&newConns)
+			defer srv.Close()
+
+			config, err := UpstreamConfig(upstreamRestConfig(srv), bench.maxIdleConns, 0, 0)
+			if err != nil {
+				b.Fatalf("got error: %v", err)
+			}
+
+			client, err := rest.HTTPClientFor(config)
+			if err != nil {
+				b.Fatalf("cannot create the HTTP client: %v", err)
+			}
+
+			b.SetParallelism(128)
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					res, err := client.Post(srv.URL, "application/json", nil)
+					if err != nil {
+						b.Errorf("got error: %v", err)
+
+						return
+					}
+
+					_ = res.Body.Close()
+				}
+			})
+
+			b.ReportMetric(float64(atomic.LoadInt64(&newConns)), "handshakes")
+		})
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request
+
+import (
+	"crypto/x509"
+	"errors"
+	h "net/http"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ErrNoCredentials is returned by an Authenticator when the request doesn't carry any credential it can handle,
+// letting the next Authenticator of the chain try resolving the identity.
+var ErrNoCredentials = errors.New("no credentials provided")
+
+const (
+	AuthTypeCertificate   = "certificate"
+	AuthTypeJWT           = "jwt"
+	AuthTypeBearer        = "bearer"
+	AuthTypeUserInfo      = "userinfo"
+	AuthTypeIntrospection = "introspection"
+	AuthTypeAnonymous     = "anonymous"
+)
+
+// Authenticator resolves the identity of the requester: implementations are tried in order, until the first one
+// not returning ErrNoCredentials, allowing to plug custom token formats next to the default ones.
+type Authenticator interface {
+	Resolve(request *h.Request) (username string, groups []string, err error)
+	// AuthType identifies the authentication method in metrics and logs, such as AuthTypeJWT.
+	AuthType() string
+}
+
+// UserExtraAuthenticator is the Authenticator resolving the UID and the extras of the user as well, such as the
+// TokenReview one: these are returned along with the Identity.
+type UserExtraAuthenticator interface {
+	Authenticator
+	ResolveUser(request *h.Request) (authenticationv1.UserInfo, error)
+}
+
+// AuthenticatorOptions configures the default Authenticator chain, see DefaultAuthenticators.
+type AuthenticatorOptions struct {
+	CertificateMapping   CertificateMapping
+	ClientCAs            *x509.CertPool
+	ClaimMappings        ClaimMappings
+	KeySet               *KeySet
+	RequiredAudiences    []string
+	ClockSkew            time.Duration
+	ServiceAccountLeeway time.Duration
+	TokenReviewCache     *TokenReviewCache
+	CircuitBreaker       *CircuitBreaker
+	Retry                wait.Backoff
+	// Audiences are the ones the tokens verified by the TokenReview API must be issued for.
+	Audiences           []string
+	TokenQueryParameter string
+	Timeout             time.Duration
+	NamespaceLabels     []string
+	// ServiceAccountIssuers are the issuers of the projected service account tokens.
+	ServiceAccountIssuers []string
+	Client                client.Client
+}
+
+// DefaultAuthenticators returns the chain made of the certificate, JWT, and TokenReview authenticators: the JWT not
+// verified with the KeySet are verified by the TokenReview Authenticator, before their claims are trusted.
+func DefaultAuthenticators(opts AuthenticatorOptions) []Authenticator {
+	tokenReview := NewTokenReviewAuthenticator(opts.TokenReviewCache, opts.CircuitBreaker, opts.Retry, opts.Audiences, opts.TokenQueryParameter, opts.Timeout, opts.Client)
+
+	return []Authenticator{
+		NewCertificateAuthenticator(opts.CertificateMapping, opts.ClientCAs),
+		NewJWTAuthenticator(JWTOptions{
+			ClaimMappings:         opts.ClaimMappings,
+			KeySet:                opts.KeySet,
+			RequiredAudiences:     opts.RequiredAudiences,
+			ClockSkew:             opts.ClockSkew,
+			ServiceAccountLeeway:  opts.ServiceAccountLeeway,
+			TokenQueryParameter:   opts.TokenQueryParameter,
+			NamespaceLabels:       opts.NamespaceLabels,
+			ServiceAccountIssuers: opts.ServiceAccountIssuers,
+			TokenReview:           tokenReview,
+			Client:                opts.Client,
+		}),
+		tokenReview,
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	h "net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/serviceaccount"
+)
+
+const (
+	CertificateUsernameCommonName = "cn"
+	CertificateUsernameEmail      = "email"
+	CertificateUsernameURI        = "uri"
+
+	// DefaultCertificateURIPattern matches the SPIFFE IDs of the workloads following the Istio convention,
+	// such as spiffe://cluster.local/ns/oil-production/sa/robot.
+	DefaultCertificateURIPattern = `^spiffe://[^/]+/ns/(?P<namespace>[^/]+)/sa/(?P<name>[^/]+)$`
+	// DefaultCertificateURIUsernameTemplate maps the SPIFFE ID to the username of the service account.
+	DefaultCertificateURIUsernameTemplate = "system:serviceaccount:${namespace}:${name}"
+
+	CertificateGroupsOrganization     = "o"
+	CertificateGroupsOrganizationUnit = "ou"
+)
+
+// CertificateMapping defines how the user identity is extracted from the client certificate: the username source
+// is the Common Name, the first email SAN, the first URI SAN matching the URI pattern, or the dotted OID of a subject
+// attribute, while the groups are either the Organizations and/or the Organizational Units, merged when both are
+// configured. The URI SAN, such as a SPIFFE ID, is mapped to the username expanding the template with the pattern
+// submatches, as ${namespace}: the service accounts get their groups too.
+// The certificates with a Common Name among the trusted proxies ones identify an intermediary, such as an ingress
+// terminating mTLS, rather than the user: these are skipped, letting the bearer token resolve the identity.
+type CertificateMapping struct {
+	UsernameSource string
+	GroupsSources  []string
+	TrustedProxies []string
+	URIPattern     string
+	URITemplate    string
+}
+
+func (c CertificateMapping) Validate() error {
+	switch c.UsernameSource {
+	case CertificateUsernameCommonName, CertificateUsernameEmail:
+	case CertificateUsernameURI:
+		if _, err := regexp.Compile(c.uriPattern()); err != nil {
+			return fmt.Errorf("invalid certificate URI pattern: %w", err)
+		}
+	default:
+		if _, err := parseOID(c.UsernameSource); err != nil {
+			return fmt.Errorf("unsupported certificate username source %s: %w", c.UsernameSource, err)
+		}
+	}
+
+	if len(c.GroupsSources) == 0 {
+		return fmt.Errorf("missing certificate groups source")
+	}
+
+	for _, source := range c.GroupsSources {
+		switch source {
+		case CertificateGroupsOrganization, CertificateGroupsOrganizationUnit:
+		default:
+			return fmt.Errorf("unsupported certificate groups source %s", source)
+		}
+	}
+
+	return nil
+}
+
+func (c CertificateMapping) uriPattern() string {
+	if len(c.URIPattern) == 0 {
+		return DefaultCertificateURIPattern
+	}
+
+	return c.URIPattern
+}
+
+func (c CertificateMapping) uriTemplate() string {
+	if len(c.URITemplate) == 0 {
+		return DefaultCertificateURIUsernameTemplate
+	}
+
+	return c.URITemplate
+}
+
+type certificate struct {
+	mapping    CertificateMapping
+	uriPattern *regexp.Regexp
+	clientCAs  *x509.CertPool
+}
+
+// NewCertificateAuthenticator returns the Authenticator resolving the identity from the client certificate,
+// following by default the Kubernetes convention: the Common Name is the username, the Organizations are the groups.
+// When the client CAs are provided, the certificate must chain to them, regardless of the TLS layer verification.
+func NewCertificateAuthenticator(mapping CertificateMapping, clientCAs *x509.CertPool) Authenticator {
+	c := &certificate{mapping: mapping, clientCAs: clientCAs}
+	// The pattern is checked by the mapping validation, an invalid one doesn't match any URI
+	if mapping.UsernameSource == CertificateUsernameURI {
+		c.uriPattern, _ = regexp.Compile(mapping.uriPattern())
+	}
+
+	return c
+}
+
+func (c certificate) AuthType() string {
+	return AuthTypeCertificate
+}
+
+func (c certificate) Resolve(request *h.Request) (username string, groups []string, err error) {
+	if request.TLS == nil || len(request.TLS.PeerCertificates) == 0 {
+		return "", nil, ErrNoCredentials
+	}
+
+	pc := request.TLS.PeerCertificates[0]
+
+	if err = c.verify(request.TLS.PeerCertificates); err != nil {
+		return "", nil, NewErrUnauthorized(fmt.Sprintf("cannot verify the client certificate: %s", err.Error()))
+	}
+
+	if sets.NewString(c.mapping.TrustedProxies...).Has(pc.Subject.CommonName) {
+		return "", nil, ErrNoCredentials
+	}
+
+	if username, err = c.username(pc); err != nil {
+		return "", nil, err
+	}
+
+	groups = c.groups(pc)
+	// The service accounts identified by their SPIFFE ID are members of the service accounts groups
+	if namespace, _, saErr := serviceaccount.SplitUsername(username); saErr == nil && c.mapping.UsernameSource == CertificateUsernameURI {
+		groups = append(groups, serviceaccount.MakeGroupNames(namespace)...)
+	}
+
+	return username, groups, nil
+}
+
+func (c certificate) groups(pc *x509.Certificate) []string {
+	sources := c.mapping.GroupsSources
+	if len(sources) == 0 {
+		sources = []string{CertificateGroupsOrganization}
+	}
+
+	groups, seen := []string{}, sets.NewString()
+
+	for _, source := range sources {
+		values := pc.Subject.Organization
+		if source == CertificateGroupsOrganizationUnit {
+			values = pc.Subject.OrganizationalUnit
+		}
+
+		for _, group := range values {
+			if !seen.Has(group) {
+				seen.Insert(group)
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	return groups
+}
+
+// verify checks the leaf certificate chains to the client CAs, using the other peer certificates as intermediates.
+func (c certificate) verify(peerCertificates []*x509.Certificate) error {
+	if c.clientCAs == nil {
+		return nil
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, pc := range peerCertificates[1:] {
+		intermediates.AddCert(pc)
+	}
+
+	_, err := peerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         c.clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	return err
+}
+
+func (c certificate) username(pc *x509.Certificate) (string, error) {
+	switch c.mapping.UsernameSource {
+	case "", CertificateUsernameCommonName:
+		return pc.Subject.CommonName, nil
+	case CertificateUsernameEmail:
+		if len(pc.EmailAddresses) == 0 {
+			return "", NewErrUnauthorized("missing email SAN in client certificate")
+		}
+
+		return pc.EmailAddresses[0], nil
+	case CertificateUsernameURI:
+		return c.uriUsername(pc)
+	}
+
+	oid, err := parseOID(c.mapping.UsernameSource)
+	if err != nil {
+		return "", err
+	}
+
+	for _, name := range pc.Subject.Names {
+		if value, ok := name.Value.(string); ok && name.Type.Equal(oid) {
+			return value, nil
+		}
+	}
+
+	return "", NewErrUnauthorized(fmt.Sprintf("missing subject attribute %s in client certificate", oid))
+}
+
+// uriUsername expands the username template with the first URI SAN matching the pattern.
+func (c certificate) uriUsername(pc *x509.Certificate) (string, error) {
+	for _, uri := range pc.URIs {
+		if c.uriPattern == nil {
+			break
+		}
+
+		value := uri.String()
+
+		match := c.uriPattern.FindStringSubmatchIndex(value)
+		if match == nil {
+			continue
+		}
+
+		username := string(c.uriPattern.ExpandString(nil, c.mapping.uriTemplate(), value, match))
+		if len(username) == 0 {
+			return "", NewErrUnauthorized(fmt.Sprintf("the URI SAN %s is mapped to an empty username", value))
+		}
+
+		return username, nil
+	}
+
+	return "", NewErrUnauthorized("missing URI SAN matching the pattern in client certificate")
+}
+
+func parseOID(value string) (oid asn1.ObjectIdentifier, err error) {
+	parts := strings.Split(value, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("%s is not a dotted OID", value)
+	}
+
+	for _, part := range parts {
+		var n int
+
+		if n, err = strconv.Atoi(part); err != nil || n < 0 {
+			return nil, fmt.Errorf("%s is not a dotted OID", value)
+		}
+
+		oid = append(oid, n)
+	}
+
+	return oid, nil
+}
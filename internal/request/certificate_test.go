@@ -0,0 +1,337 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+// nolint:testpackage
+package request
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	h "net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCertificateMapping(t *testing.T) {
+	t.Parallel()
+
+	pc := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "alice",
+			Organization:       []string{"capsule.clastix.io"},
+			OrganizationalUnit: []string{"platform"},
+			Names: []pkix.AttributeTypeAndValue{
+				{Type: asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}, Value: "alice-uid"},
+			},
+		},
+		EmailAddresses: []string{"alice@example.com"},
+	}
+
+	tests := []struct {
+		name         string
+		mapping      CertificateMapping
+		wantUsername string
+		wantGroups   []string
+		err          bool
+	}{
+		{"default", CertificateMapping{UsernameSource: "cn", GroupsSources: []string{"o"}}, "alice", []string{"capsule.clastix.io"}, false},
+		{"email and organizational unit", CertificateMapping{UsernameSource: "email", GroupsSources: []string{"ou"}}, "alice@example.com", []string{"platform"}, false},
+		{"oid", CertificateMapping{UsernameSource: "0.9.2342.19200300.100.1.1", GroupsSources: []string{"o"}}, "alice-uid", []string{"capsule.clastix.io"}, false},
+		{"organization and organizational unit", CertificateMapping{UsernameSource: "cn", GroupsSources: []string{"o", "ou"}}, "alice", []string{"capsule.clastix.io", "platform"}, false},
+		{"missing oid", CertificateMapping{UsernameSource: "2.5.4.5", GroupsSources: []string{"o"}}, "", nil, true},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			if err := eachTest.mapping.Validate(); err != nil {
+				t.Fatalf("got validation error: %v", err)
+			}
+
+			r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{pc}}
+
+			username, groups, err := NewCertificateAuthenticator(eachTest.mapping, nil).Resolve(r)
+			if eachTest.err {
+				if err == nil {
+					t.Errorf("expected error, got username %s", username)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if username != eachTest.wantUsername {
+				t.Errorf("got username %s, want %s", username, eachTest.wantUsername)
+			}
+
+			if !reflect.DeepEqual(groups, eachTest.wantGroups) {
+				t.Errorf("got groups %v, want %v", groups, eachTest.wantGroups)
+			}
+		})
+	}
+}
+
+func TestCertificateSPIFFE(t *testing.T) {
+	t.Parallel()
+
+	uri := func(value string) *url.URL {
+		u, err := url.Parse(value)
+		if err != nil {
+			t.Fatalf("cannot parse URI: %v", err)
+		}
+
+		return u
+	}
+
+	tests := []struct {
+		name         string
+		mapping      CertificateMapping
+		uris         []*url.URL
+		wantUsername string
+		wantGroups   []string
+		err          bool
+	}{
+		{
+			"service account",
+			CertificateMapping{UsernameSource: "uri", GroupsSources: []string{"o"}},
+			[]*url.URL{uri("spiffe://cluster.local/ns/oil-production/sa/robot")},
+			"system:serviceaccount:oil-production:robot",
+			[]string{"system:serviceaccounts", "system:serviceaccounts:oil-production"},
+			false,
+		},
+		{
+			"first matching URI",
+			CertificateMapping{UsernameSource: "uri", GroupsSources: []string{"o"}},
+			[]*url.URL{uri("https://example.com/robot"), uri("spiffe://cluster.local/ns/gas-production/sa/robot")},
+			"system:serviceaccount:gas-production:robot",
+			[]string{"system:serviceaccounts", "system:serviceaccounts:gas-production"},
+			false,
+		},
+		{
+			"custom template",
+			CertificateMapping{UsernameSource: "uri", GroupsSources: []string{"o"}, URIPattern: `^spiffe://example\.org/workload/(?P<workload>[a-z-]+)$`, URITemplate: "spiffe:${workload}"},
+			[]*url.URL{uri("spiffe://example.org/workload/billing")},
+			"spiffe:billing",
+			[]string{},
+			false,
+		},
+		{
+			"not matching trust domain",
+			CertificateMapping{UsernameSource: "uri", GroupsSources: []string{"o"}, URIPattern: `^spiffe://example\.org/ns/(?P<namespace>[^/]+)/sa/(?P<name>[^/]+)$`},
+			[]*url.URL{uri("spiffe://evil.org/ns/oil-production/sa/robot")},
+			"",
+			nil,
+			true,
+		},
+		{
+			"missing URI SAN",
+			CertificateMapping{UsernameSource: "uri", GroupsSources: []string{"o"}},
+			nil,
+			"",
+			nil,
+			true,
+		},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			if err := eachTest.mapping.Validate(); err != nil {
+				t.Fatalf("got validation error: %v", err)
+			}
+
+			r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{URIs: eachTest.uris}}}
+
+			username, groups, err := NewCertificateAuthenticator(eachTest.mapping, nil).Resolve(r)
+			if eachTest.err {
+				var unauthorized *ErrUnauthorized
+				if !errors.As(err, &unauthorized) {
+					t.Errorf("expected unauthorized error, got %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if username != eachTest.wantUsername {
+				t.Errorf("got username %s, want %s", username, eachTest.wantUsername)
+			}
+
+			if !reflect.DeepEqual(groups, eachTest.wantGroups) {
+				t.Errorf("got groups %v, want %v", groups, eachTest.wantGroups)
+			}
+		})
+	}
+}
+
+func TestCertificateMappingValidate(t *testing.T) {
+	t.Parallel()
+
+	for _, mapping := range []CertificateMapping{
+		{UsernameSource: "san", GroupsSources: []string{"o"}},
+		{UsernameSource: "2.5.x", GroupsSources: []string{"o"}},
+		{UsernameSource: "cn", GroupsSources: []string{"c"}},
+		{UsernameSource: "cn"},
+		{UsernameSource: "uri", GroupsSources: []string{"o"}, URIPattern: "spiffe://(unclosed"},
+	} {
+		if err := mapping.Validate(); err == nil {
+			t.Errorf("expected validation error for %+v", mapping)
+		}
+	}
+}
+
+func newTestCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "capsule-proxy-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cannot create CA certificate: %v", err)
+	}
+
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("cannot parse CA certificate: %v", err)
+	}
+
+	return ca, key
+}
+
+func newTestClientCertificate(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, notAfter time.Time) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "alice", Organization: []string{"capsule.clastix.io"}},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("cannot create client certificate: %v", err)
+	}
+
+	pc, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("cannot parse client certificate: %v", err)
+	}
+
+	return pc
+}
+
+func TestCertificateClientCA(t *testing.T) {
+	t.Parallel()
+
+	trusted, trustedKey := newTestCA(t)
+	untrusted, untrustedKey := newTestCA(t)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(trusted)
+
+	tests := []struct {
+		name string
+		pc   *x509.Certificate
+		err  bool
+	}{
+		{"issued by the client CA", newTestClientCertificate(t, trusted, trustedKey, time.Now().Add(time.Hour)), false},
+		{"issued by another CA", newTestClientCertificate(t, untrusted, untrustedKey, time.Now().Add(time.Hour)), true},
+		{"expired", newTestClientCertificate(t, trusted, trustedKey, time.Now().Add(-time.Hour)), true},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{eachTest.pc}}
+
+			username, _, err := NewCertificateAuthenticator(CertificateMapping{UsernameSource: "cn", GroupsSources: []string{"o"}}, clientCAs).Resolve(r)
+			if eachTest.err {
+				var unauthorized *ErrUnauthorized
+				if !errors.As(err, &unauthorized) {
+					t.Errorf("expected unauthorized error, got %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if username != "alice" {
+				t.Errorf("got username %s, want alice", username)
+			}
+		})
+	}
+}
+
+func TestCertificateTrustedProxy(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "ingress-nginx"}}}}
+	r.Header.Set("X-Api-Key", "secret")
+
+	authenticators := []Authenticator{
+		NewCertificateAuthenticator(CertificateMapping{UsernameSource: "cn", GroupsSources: []string{"o"}, TrustedProxies: []string{"ingress-nginx"}}, nil),
+		fakeAuthenticator{header: "X-Api-Key", username: "alice"},
+	}
+
+	username, _, err := NewHTTPWithOptions(r, Options{Authenticators: authenticators}).GetUserAndGroups()
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+
+	if username != "alice" {
+		t.Errorf("got username %s, want alice", username)
+	}
+
+	if _, _, err = authenticators[0].Resolve(r); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("expected no credentials error for the trusted proxy, got %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request
+
+import (
+	"sync"
+	"time"
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// CircuitBreaker stops the calls to the API server after the given number of consecutive failures within the window,
+// fast-failing them for the cooldown rather than adding pressure to an overloaded API server: once the cooldown
+// elapsed, a single trial call is let through, closing the circuit when it succeeds.
+type CircuitBreaker struct {
+	mu           sync.Mutex
+	threshold    int
+	window       time.Duration
+	cooldown     time.Duration
+	state        circuitState
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	now          func() time.Time
+}
+
+func NewCircuitBreaker(threshold int, window, cooldown time.Duration) *CircuitBreaker {
+	circuitBreakerState.Set(float64(circuitClosed))
+
+	return &CircuitBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// Allow reports whether the call can be performed, the outcome of the allowed ones must be reported
+// with Success, Failure, or Cancel.
+func (c *CircuitBreaker) Allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case circuitClosed:
+		return true
+	case circuitHalfOpen:
+		// The trial call is still in progress
+		return false
+	case circuitOpen:
+	}
+
+	if c.now().Sub(c.openedAt) < c.cooldown {
+		return false
+	}
+
+	c.setState(circuitHalfOpen)
+
+	return true
+}
+
+func (c *CircuitBreaker) Success() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.failures = 0
+	c.setState(circuitClosed)
+}
+
+func (c *CircuitBreaker) Failure() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+
+	if c.state == circuitHalfOpen {
+		c.open(now)
+
+		return
+	}
+	// The failures older than the window are not counted, starting a new streak
+	if c.failures == 0 || now.Sub(c.firstFailure) > c.window {
+		c.failures = 0
+		c.firstFailure = now
+	}
+
+	if c.failures++; c.failures >= c.threshold {
+		c.open(now)
+	}
+}
+
+// Cancel reports the allowed call ended with no outcome, such as by the client going away: when it was the trial
+// one, the next call is let through as the trial.
+func (c *CircuitBreaker) Cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == circuitHalfOpen {
+		c.setState(circuitOpen)
+	}
+}
+
+func (c *CircuitBreaker) open(now time.Time) {
+	c.failures = 0
+	c.openedAt = now
+	c.setState(circuitOpen)
+}
+
+func (c *CircuitBreaker) setState(state circuitState) {
+	c.state = state
+	circuitBreakerState.Set(float64(state))
+}
@@ -0,0 +1,233 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// ClaimMapping defines how the user identity is extracted from the OIDC JWT claims:
+// prefixes are applied as the API server does with --oidc-username-prefix and --oidc-groups-prefix.
+// The groups of all the GroupsFields are merged, while GroupsSeparator splits the groups claim emitted as a single
+// string, such as "dev ops": any whitespace when blank, no splitting when empty. FallbackToSub resolves the username
+// from the sub claim when none of the UsernameFields is present, while LowercaseEmail lowercases the email-shaped
+// usernames, such as User@Example.com, since IdPs could vary their case.
+type ClaimMapping struct {
+	UsernameFields  []string `json:"usernameClaims,omitempty"`
+	GroupsFields    []string `json:"groupsClaims,omitempty"`
+	GroupsSeparator string   `json:"groupsSeparator,omitempty"`
+	UsernamePrefix  string   `json:"usernamePrefix,omitempty"`
+	GroupsPrefix    string   `json:"groupsPrefix,omitempty"`
+	RequireGroups   bool     `json:"requireGroupsClaim,omitempty"`
+	FallbackToSub   bool     `json:"usernameClaimFallbackSub,omitempty"`
+	LowercaseEmail  bool     `json:"usernameLowercaseEmail,omitempty"`
+}
+
+// MatchedClaims returns the claim fields of the given JWT the username and the groups are resolved from, empty when
+// missing: the token is parsed without verifying it, thus it must be authenticated in advance.
+func (c ClaimMapping) MatchedClaims(token string) (usernameField string, groupsFields []string) {
+	claims := jwt.MapClaims{}
+
+	parser := jwt.Parser{
+		SkipClaimsValidation: true,
+	}
+
+	if _, _, err := parser.ParseUnverified(token, claims); err != nil {
+		return "", nil
+	}
+
+	usernameField, _, _ = c.usernameClaim(claims)
+
+	for _, field := range c.GroupsFields {
+		if _, ok := lookupClaim(claims, field); ok {
+			groupsFields = append(groupsFields, field)
+		}
+	}
+
+	return usernameField, groupsFields
+}
+
+// identity returns the prefixed username and groups of the given claims, retrieved from the source, such as UserInfo.
+func (c ClaimMapping) identity(claims map[string]interface{}, source string) (username string, groups []string, err error) {
+	field, name, err := c.usernameClaim(claims)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(field) == 0 {
+		tried := c.UsernameFields
+		if c.FallbackToSub {
+			tried = append(append([]string{}, tried...), "sub")
+		}
+
+		return "", nil, newErrMissingUsernameClaim(source, tried)
+	}
+
+	groups, ok, err := c.groupsClaims(claims)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if !ok && c.RequireGroups {
+		return "", nil, newErrMissingGroupsClaim(source, c.GroupsFields)
+	}
+
+	if c.LowercaseEmail && isEmail(name) {
+		name = strings.ToLower(name)
+	}
+
+	return c.UsernamePrefix + name, groups, nil
+}
+
+// isEmail reports whether the username is a bare email address, such as user@example.com.
+func isEmail(username string) bool {
+	address, err := mail.ParseAddress(username)
+
+	return err == nil && address.Address == username
+}
+
+// groupsClaims returns the prefixed groups of all the configured groups claims, without duplicates and in order of
+// first appearance: ok is false when none of the claims is present, as providers usually omit it for the users
+// without any group membership.
+func (c ClaimMapping) groupsClaims(claims map[string]interface{}) (groups []string, ok bool, err error) {
+	groups = []string{}
+	seen := sets.NewString()
+
+	add := func(group string) {
+		if group = c.GroupsPrefix + group; !seen.Has(group) {
+			seen.Insert(group)
+			groups = append(groups, group)
+		}
+	}
+
+	for _, field := range c.GroupsFields {
+		g, found := lookupClaim(claims, field)
+		if !found {
+			continue
+		}
+
+		ok = true
+
+		switch v := g.(type) {
+		case string:
+			// Some providers, such as Keycloak, emit the groups as a single delimited string rather than an array
+			for _, group := range c.splitGroups(v) {
+				add(group)
+			}
+		case []interface{}:
+			for _, group := range v {
+				name, isString := group.(string)
+				if !isString {
+					return nil, false, newErrInvalidClaim(field, fmt.Sprintf("unexpected type %T for an entry of the %s claim in JWT", group, field))
+				}
+
+				add(name)
+			}
+		default:
+			return nil, false, newErrInvalidClaim(field, fmt.Sprintf("unexpected type %T for the %s claim in JWT", g, field))
+		}
+	}
+
+	return groups, ok, nil
+}
+
+// splitGroups returns the groups of the claim emitted as a single string, skipping the empty ones.
+func (c ClaimMapping) splitGroups(claim string) []string {
+	if len(c.GroupsSeparator) == 0 {
+		return []string{claim}
+	}
+
+	if len(strings.TrimSpace(c.GroupsSeparator)) == 0 {
+		return strings.Fields(claim)
+	}
+
+	var groups []string
+
+	for _, group := range strings.Split(claim, c.GroupsSeparator) {
+		if group = strings.TrimSpace(group); len(group) > 0 {
+			groups = append(groups, group)
+		}
+	}
+
+	return groups
+}
+
+// usernameClaim returns the first of the configured username fields holding a non-empty username, in order,
+// an empty field when none is present: a claim of a type other than string is an error.
+func (c ClaimMapping) usernameClaim(claims map[string]interface{}) (field, username string, err error) {
+	for _, field := range c.UsernameFields {
+		v, ok := lookupClaim(claims, field)
+		if !ok {
+			continue
+		}
+
+		username, ok := v.(string)
+		if !ok {
+			return "", "", newErrInvalidClaim(field, fmt.Sprintf("username claim %s is not a string", field))
+		}
+
+		if len(username) > 0 {
+			return field, username, nil
+		}
+	}
+
+	if sub, ok := claims["sub"].(string); c.FallbackToSub && ok && len(sub) > 0 {
+		return "sub", sub, nil
+	}
+
+	return "", "", nil
+}
+
+// projectedServiceAccount returns the namespace and name of the service account for bound
+// (projected) service account tokens, that store the identity under the kubernetes.io claim: only the tokens of the
+// given issuers, configured on the API server with --service-account-issuer, or of the legacy one are considered,
+// since any OIDC provider could carry such a claim.
+func projectedServiceAccount(claims map[string]interface{}, issuers sets.String) (namespace, name string, ok bool) {
+	if issuer, _ := claims["iss"].(string); issuer != legacyServiceAccountIssuer && !issuers.Has(issuer) {
+		return "", "", false
+	}
+
+	private, ok := claims["kubernetes.io"].(map[string]interface{})
+	if !ok {
+		return "", "", false
+	}
+
+	namespace, _ = private["namespace"].(string)
+
+	sa, _ := private["serviceaccount"].(map[string]interface{})
+	name, _ = sa["name"].(string)
+
+	return namespace, name, len(namespace) > 0 && len(name) > 0
+}
+
+// lookupClaim returns the value of the claim for the given field, supporting dotted paths
+// (e.g. resource_access.k8s.roles) walking the nested objects: the literal key always takes
+// precedence, since claim names can contain dots too (e.g. https://example.com/claims/email).
+func lookupClaim(claims map[string]interface{}, field string) (interface{}, bool) {
+	if v, ok := claims[field]; ok {
+		return v, true
+	}
+
+	for i := 0; i < len(field); i++ {
+		if field[i] != '.' {
+			continue
+		}
+
+		nested, ok := claims[field[:i]].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if v, ok := lookupClaim(nested, field[i+1:]); ok {
+			return v, true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,127 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	h "net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const discoveryPath = "/.well-known/openid-configuration"
+
+type providerMetadata struct {
+	Issuer           string `json:"issuer"`
+	JWKSURI          string `json:"jwks_uri"`
+	UserInfoEndpoint string `json:"userinfo_endpoint"`
+}
+
+// Discovery retrieves the OpenID Provider metadata from the issuer discovery document, refreshed periodically:
+// the JWKS URL, the issuer, and the UserInfo endpoint are derived from it.
+type Discovery struct {
+	issuerURL       string
+	refreshInterval time.Duration
+	client          *h.Client
+	log             logr.Logger
+
+	mu       sync.RWMutex
+	metadata providerMetadata
+}
+
+func NewDiscovery(issuerURL string, refreshInterval time.Duration) *Discovery {
+	return &Discovery{
+		issuerURL:       issuerURL,
+		refreshInterval: refreshInterval,
+		client:          &h.Client{Timeout: 10 * time.Second},
+		log:             ctrl.Log.WithName("oidc-discovery"),
+	}
+}
+
+// Start refreshes the discovery document until the context is done, keeping the last retrieved one on failure.
+func (d *Discovery) Start(ctx context.Context) error {
+	ticker := time.NewTicker(d.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		if err := d.Refresh(ctx); err != nil {
+			d.log.Error(err, "cannot refresh the OIDC discovery document", "issuer", d.issuerURL)
+		}
+	}
+}
+
+// Refresh retrieves the discovery document, rejecting the one issued for another issuer as mandated by OIDC Discovery.
+func (d *Discovery) Refresh(ctx context.Context) error {
+	r, err := h.NewRequestWithContext(ctx, h.MethodGet, strings.TrimSuffix(d.issuerURL, "/")+discoveryPath, nil)
+	if err != nil {
+		return fmt.Errorf("cannot create OIDC discovery request: %w", err)
+	}
+
+	resp, err := d.client.Do(r)
+	if err != nil {
+		return fmt.Errorf("cannot fetch OIDC discovery document: %w", err)
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != h.StatusOK {
+		return fmt.Errorf("returned status code from OIDC discovery is %d, expected 200", resp.StatusCode)
+	}
+
+	metadata := providerMetadata{}
+	if err = json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return fmt.Errorf("cannot decode OIDC discovery document: %w", err)
+	}
+
+	if metadata.Issuer != d.issuerURL {
+		return fmt.Errorf("OIDC discovery issuer %q does not match the issuer URL %q", metadata.Issuer, d.issuerURL)
+	}
+
+	if len(metadata.JWKSURI) == 0 {
+		return fmt.Errorf("OIDC discovery document is missing the jwks_uri")
+	}
+
+	d.mu.Lock()
+	d.metadata = metadata
+	d.mu.Unlock()
+
+	d.log.V(4).Info("OIDC discovery document refreshed", "jwks_uri", metadata.JWKSURI, "userinfo_endpoint", metadata.UserInfoEndpoint)
+
+	return nil
+}
+
+func (d *Discovery) Issuer() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.metadata.Issuer
+}
+
+func (d *Discovery) JWKSURL() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.metadata.JWKSURI
+}
+
+func (d *Discovery) UserInfoURL() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.metadata.UserInfoEndpoint
+}
@@ -0,0 +1,99 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	"github.com/clastix/capsule-proxy/internal/request"
+)
+
+func newDiscoveryServer(t *testing.T, jwksURL string, issuer func(srv *httptest.Server) string) *httptest.Server {
+	t.Helper()
+
+	var srv *httptest.Server
+
+	srv = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/openid-configuration" {
+			writer.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(map[string]string{
+			"issuer":            issuer(srv),
+			"jwks_uri":          jwksURL,
+			"userinfo_endpoint": srv.URL + "/userinfo",
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestDiscovery(t *testing.T) {
+	t.Parallel()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	jwks := newJWKSServer(t, "trusted", &key.PublicKey)
+
+	srv := newDiscoveryServer(t, jwks.URL, func(srv *httptest.Server) string {
+		return srv.URL
+	})
+
+	discovery := request.NewDiscovery(srv.URL, time.Hour)
+	if err = discovery.Refresh(context.Background()); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+
+	if discovery.Issuer() != srv.URL || discovery.JWKSURL() != jwks.URL || discovery.UserInfoURL() != srv.URL+"/userinfo" {
+		t.Errorf("got issuer %s, JWKS %s, and UserInfo %s", discovery.Issuer(), discovery.JWKSURL(), discovery.UserInfoURL())
+	}
+
+	claimMappings := request.ClaimMappings{Default: request.ClaimMapping{UsernameFields: []string{"preferred_username"}}}
+	authenticator := request.NewJWTAuthenticator(request.JWTOptions{ClaimMappings: claimMappings, KeySet: request.NewDiscoveryKeySet(discovery, time.Hour)})
+
+	resolve := func(issuer string) (string, error) {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+		r.Header.Set("Authorization", "Bearer "+signToken(t, "trusted", key, jwt.MapClaims{"iss": issuer, "preferred_username": "alice"}))
+
+		username, _, err := authenticator.Resolve(r)
+
+		return username, err
+	}
+
+	if username, err := resolve(srv.URL); err != nil || username != "alice" {
+		t.Errorf("got username %s and error %v, want alice", username, err)
+	}
+
+	if _, err = resolve("https://untrusted.example.com"); err == nil {
+		t.Error("expected the JWT issued by another issuer to be rejected")
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	t.Parallel()
+
+	srv := newDiscoveryServer(t, "https://idp.example.com/keys", func(*httptest.Server) string {
+		return "https://idp.example.com"
+	})
+
+	err := request.NewDiscovery(srv.URL, time.Hour).Refresh(context.Background())
+	if err == nil {
+		t.Fatal("expected the discovery document of another issuer to be rejected")
+	}
+}
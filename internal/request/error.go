@@ -3,8 +3,22 @@
 
 package request
 
+import (
+	"fmt"
+	h "net/http"
+	"strings"
+)
+
+// StatusError is implemented by the errors of the request package, carrying the HTTP status code of the response
+// the handlers reply with.
+type StatusError interface {
+	error
+	StatusCode() int
+}
+
 type ErrUnauthorized struct {
 	message string
+	details string
 }
 
 func NewErrUnauthorized(message string) *ErrUnauthorized {
@@ -13,6 +27,163 @@ func NewErrUnauthorized(message string) *ErrUnauthorized {
 	}
 }
 
+// NewErrUnauthorizedWithDetails returns an ErrUnauthorized carrying details, such as the authenticator
+// failure reason, that are not part of the error message to avoid leaking them to the clients.
+func NewErrUnauthorizedWithDetails(message, details string) *ErrUnauthorized {
+	return &ErrUnauthorized{
+		message: message,
+		details: details,
+	}
+}
+
 func (e *ErrUnauthorized) Error() string {
 	return e.message
 }
+
+func (e *ErrUnauthorized) StatusCode() int {
+	return h.StatusUnauthorized
+}
+
+func (e *ErrUnauthorized) Details() string {
+	return e.details
+}
+
+// ErrForbidden is returned when the identity has been resolved, but it's not allowed to perform the request,
+// such as the denied impersonation.
+type ErrForbidden struct {
+	message string
+}
+
+func NewErrForbidden(message string) *ErrForbidden {
+	return &ErrForbidden{
+		message: message,
+	}
+}
+
+func (e *ErrForbidden) Error() string {
+	return e.message
+}
+
+func (e *ErrForbidden) StatusCode() int {
+	return h.StatusForbidden
+}
+
+// ErrTimeout is returned when the API server didn't reply in time to the requests performed for the authentication,
+// such as the TokenReview and the SubjectAccessReview.
+type ErrTimeout struct {
+	message string
+}
+
+func NewErrTimeout(message string) *ErrTimeout {
+	return &ErrTimeout{
+		message: message,
+	}
+}
+
+func (e *ErrTimeout) Error() string {
+	return e.message
+}
+
+func (e *ErrTimeout) StatusCode() int {
+	return h.StatusGatewayTimeout
+}
+
+// ErrUnavailable is returned when the authentication requests are not sent to the API server,
+// such as when the circuit breaker is open.
+type ErrUnavailable struct {
+	message string
+}
+
+func NewErrUnavailable(message string) *ErrUnavailable {
+	return &ErrUnavailable{
+		message: message,
+	}
+}
+
+func (e *ErrUnavailable) Error() string {
+	return e.message
+}
+
+func (e *ErrUnavailable) StatusCode() int {
+	return h.StatusServiceUnavailable
+}
+
+// jwtError is the base of the JWT failure modes: these wrap an ErrUnauthorized, since the credentials are invalid.
+type jwtError struct {
+	unauthorized *ErrUnauthorized
+}
+
+func (e jwtError) Error() string {
+	return e.unauthorized.Error()
+}
+
+func (e jwtError) Unwrap() error {
+	return e.unauthorized
+}
+
+func (e jwtError) StatusCode() int {
+	return e.unauthorized.StatusCode()
+}
+
+// ErrMalformedToken is returned when the JWT cannot be parsed, or its signature cannot be verified.
+type ErrMalformedToken struct {
+	jwtError
+}
+
+func newErrMalformedToken(err error) *ErrMalformedToken {
+	return &ErrMalformedToken{jwtError{NewErrUnauthorized(err.Error())}}
+}
+
+// ErrMissingUsernameClaim is returned when none of the username claims is present, such as in the JWT or the UserInfo.
+type ErrMissingUsernameClaim struct {
+	jwtError
+	claims []string
+}
+
+func newErrMissingUsernameClaim(source string, claims []string) *ErrMissingUsernameClaim {
+	return &ErrMissingUsernameClaim{
+		jwtError: jwtError{NewErrUnauthorized(fmt.Sprintf("missing users claim in %s, tried %s", source, strings.Join(claims, ", ")))},
+		claims:   claims,
+	}
+}
+
+// Claims returns the username claims that have been tried.
+func (e *ErrMissingUsernameClaim) Claims() []string {
+	return e.claims
+}
+
+// ErrMissingGroupsClaim is returned when none of the groups claims is present, while required.
+type ErrMissingGroupsClaim struct {
+	jwtError
+	claims []string
+}
+
+func newErrMissingGroupsClaim(source string, claims []string) *ErrMissingGroupsClaim {
+	return &ErrMissingGroupsClaim{
+		jwtError: jwtError{NewErrUnauthorized(fmt.Sprintf("missing groups claim in %s, tried %s", source, strings.Join(claims, ", ")))},
+		claims:   claims,
+	}
+}
+
+// Claims returns the groups claims that have been tried.
+func (e *ErrMissingGroupsClaim) Claims() []string {
+	return e.claims
+}
+
+// ErrInvalidClaim is returned when a claim has an unexpected type or value, such as an expired exp or an untrusted iss.
+type ErrInvalidClaim struct {
+	jwtError
+	claim string
+}
+
+func newErrInvalidClaim(claim, message string) *ErrInvalidClaim {
+	return &ErrInvalidClaim{
+		jwtError: jwtError{NewErrUnauthorized(message)},
+		claim:    claim,
+	}
+}
+
+// Claim returns the name of the invalid claim.
+func (e *ErrInvalidClaim) Claim() string {
+	return e.claim
+}
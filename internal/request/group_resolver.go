@@ -0,0 +1,125 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	h "net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-logr/logr"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// GroupResolver resolves the groups of the authenticated users whose credentials carry none, such as the IdP tokens
+// without the groups claim, when the memberships are stored by an external service.
+type GroupResolver interface {
+	Groups(ctx context.Context, username string) ([]string, error)
+}
+
+type httpGroupResolver struct {
+	log     logr.Logger
+	url     string
+	cache   *TTLCache
+	timeout time.Duration
+	client  *h.Client
+}
+
+// groupsResponse is the body returned by the group-membership service.
+type groupsResponse struct {
+	Groups []string `json:"groups"`
+}
+
+// NewHTTPGroupResolver returns the GroupResolver querying the given URL with the user query parameter, such as
+// GET https://groups.example.com/memberships?user=alice, expecting a JSON object with the groups array: the unknown
+// users, replied with 404, have no groups. The resolved groups are cached by the username, if a cache is provided.
+func NewHTTPGroupResolver(url string, cache *TTLCache, timeout time.Duration) GroupResolver {
+	return &httpGroupResolver{
+		log:     ctrl.Log.WithName("group-resolver"),
+		url:     url,
+		cache:   cache,
+		timeout: timeout,
+		client:  &h.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (g httpGroupResolver) Groups(ctx context.Context, username string) ([]string, error) {
+	if g.cache != nil {
+		if cached, ok := g.cache.Get(username); ok {
+			if groups, ok := cached.([]string); ok {
+				return groups, nil
+			}
+		}
+	}
+
+	groups, err := g.query(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if g.cache != nil {
+		g.cache.Add(username, groups)
+	}
+
+	return groups, nil
+}
+
+func (g httpGroupResolver) query(ctx context.Context, username string) ([]string, error) {
+	ctx, cancel := withTimeout(ctx, g.timeout)
+	defer cancel()
+
+	u, err := url.Parse(g.url)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the group-membership service URL: %w", err)
+	}
+
+	query := u.Query()
+	query.Set("user", username)
+	u.RawQuery = query.Encode()
+
+	r, err := h.NewRequestWithContext(ctx, h.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create the group-membership request: %w", err)
+	}
+
+	r.Header.Set("Accept", "application/json")
+
+	resp, err := g.client.Do(r)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, NewErrTimeout("the group-membership request timed out")
+		}
+
+		return nil, fmt.Errorf("cannot query the group-membership service: %w", err)
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	switch resp.StatusCode {
+	case h.StatusOK:
+	case h.StatusNotFound:
+		RequestLogger(ctx, g.log).V(4).Info("the user is unknown to the group-membership service", "username", username)
+
+		return []string{}, nil
+	default:
+		return nil, fmt.Errorf("returned status code from the group-membership service is %d, expected 200", resp.StatusCode)
+	}
+
+	var body groupsResponse
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("cannot decode the group-membership response: %w", err)
+	}
+
+	if body.Groups == nil {
+		body.Groups = []string{}
+	}
+
+	return body.Groups, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/clastix/capsule-proxy/internal/request"
+)
+
+func TestHTTPGroupResolver(t *testing.T) {
+	t.Parallel()
+
+	var calls int64
+
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+
+		switch r.URL.Query().Get("user") {
+		case "alice":
+			_ = json.NewEncoder(writer).Encode(map[string]interface{}{"groups": []string{"developers", "tenant-oil"}})
+		case "bob":
+			writer.WriteHeader(http.StatusNotFound)
+		default:
+			writer.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	resolver := request.NewHTTPGroupResolver(srv.URL+"/memberships", request.NewTTLCache(time.Minute), 0)
+
+	for i := 0; i < 2; i++ {
+		groups, err := resolver.Groups(context.Background(), "alice")
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+
+		if !reflect.DeepEqual(groups, []string{"developers", "tenant-oil"}) {
+			t.Errorf("got groups %v, want [developers tenant-oil]", groups)
+		}
+	}
+
+	if got := atomic.LoadInt64(&calls); got != 1 {
+		t.Errorf("got %d group-membership requests, want 1 with the cached groups", got)
+	}
+
+	if groups, err := resolver.Groups(context.Background(), "bob"); err != nil || len(groups) != 0 {
+		t.Errorf("got groups %v and error %v, want no groups for the unknown user", groups, err)
+	}
+
+	if _, err := resolver.Groups(context.Background(), "mallory"); err == nil {
+		t.Error("expected the group-membership service failure to be returned")
+	}
+}
@@ -5,204 +5,481 @@ package request
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	h "net/http"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 
-	"github.com/golang-jwt/jwt"
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/attribute"
 	authenticationv1 "k8s.io/api/authentication/v1"
 	authorizationv1 "k8s.io/api/authorization/v1"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/serviceaccount"
+	apirequest "k8s.io/apiserver/pkg/endpoints/request"
+	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-)
-
-type authType int
 
-const (
-	bearerBased authType = iota
-	certificateBased
-	anonymousBased
+	"github.com/clastix/capsule-proxy/internal/tracing"
 )
 
 type http struct {
 	*h.Request
-	usernameClaimField string
-	client             client.Client
+	log                     logr.Logger
+	authenticators          []Authenticator
+	transformers            Transformers
+	groupResolver           GroupResolver
+	bypassUsers             sets.String
+	deniedUsers             sets.String
+	deniedGroups            sets.String
+	impersonationDisabled   bool
+	namespacedImpersonation bool
+	groupsSeparator         string
+	timeout                 time.Duration
+	unauthenticatedMessage  string
+	client                  client.Client
+}
+
+// DefaultUnauthenticatedMessage is the reason of the requests rejected for the missing credentials, when none is given.
+const DefaultUnauthenticatedMessage = "authentication required"
+
+// Options is the authentication configuration of the Request: the identity is resolved with the Authenticators chain,
+// such as the one returned by DefaultAuthenticators, and rewritten with the Transformers. The GroupResolver, if any,
+// resolves the groups of the authenticated users with none, before the impersonation. The impersonation
+// SubjectAccessReviews are bounded by the Timeout, if not zero, and skipped for the BypassUsers, while any
+// impersonation is rejected when ImpersonationDisabled, as well as the one of the DeniedUsers and DeniedGroups,
+// such as system:masters, regardless of the RBAC policy. With NamespacedImpersonation, the impersonation of the
+// namespaced requests is checked in their Namespace, letting the RoleBindings grant the impersonation per Namespace.
+// The Impersonate-Group values are split by the ImpersonateGroupsSeparator, if not empty, for the clients joining
+// the groups in a single header, each one checked on its own.
+// The requests with no credentials are rejected with the UnauthenticatedMessage, DefaultUnauthenticatedMessage if empty.
+type Options struct {
+	Authenticators             []Authenticator
+	Transformers               Transformers
+	GroupResolver              GroupResolver
+	BypassUsers                sets.String
+	DeniedUsers                sets.String
+	DeniedGroups               sets.String
+	ImpersonationDisabled      bool
+	NamespacedImpersonation    bool
+	ImpersonateGroupsSeparator string
+	Timeout                    time.Duration
+	UnauthenticatedMessage     string
+	Client                     client.Client
 }
 
-func NewHTTP(request *h.Request, usernameClaimField string, client client.Client) Request {
-	return &http{Request: request, usernameClaimField: usernameClaimField, client: client}
+// NewHTTPWithOptions returns the Request for the given HTTP one, authenticated according to the Options.
+func NewHTTPWithOptions(request *h.Request, opts Options) Request {
+	if len(opts.UnauthenticatedMessage) == 0 {
+		opts.UnauthenticatedMessage = DefaultUnauthenticatedMessage
+	}
+
+	return &http{
+		Request:                 request,
+		log:                     RequestLogger(request.Context(), ctrl.Log.WithName("request")),
+		authenticators:          opts.Authenticators,
+		transformers:            opts.Transformers,
+		groupResolver:           opts.GroupResolver,
+		bypassUsers:             opts.BypassUsers,
+		deniedUsers:             opts.DeniedUsers,
+		deniedGroups:            opts.DeniedGroups,
+		impersonationDisabled:   opts.ImpersonationDisabled,
+		namespacedImpersonation: opts.NamespacedImpersonation,
+		groupsSeparator:         opts.ImpersonateGroupsSeparator,
+		timeout:                 opts.Timeout,
+		unauthenticatedMessage:  opts.UnauthenticatedMessage,
+		client:                  opts.Client,
+	}
 }
 
 func (h http) GetHTTPRequest() *h.Request {
 	return h.Request
 }
 
-//nolint:funlen
 func (h http) GetUserAndGroups() (username string, groups []string, err error) {
-	switch h.getAuthType() {
-	case certificateBased:
-		pc := h.TLS.PeerCertificates
-		if len(pc) == 0 {
-			return "", nil, fmt.Errorf("no provided peer certificates")
-		}
+	identity, err := h.GetIdentity()
+	if err != nil {
+		return "", nil, err
+	}
 
-		username, groups = pc[0].Subject.CommonName, pc[0].Subject.Organization
-	case bearerBased:
-		if h.isJwtToken() {
-			username, groups, err = h.processJwtClaims()
+	return identity.Username, identity.Groups, nil
+}
 
-			break
-		}
+// GetIdentity returns the identity of the requester, resolved once per request when the context is the one returned
+// by WithIdentityCache.
+func (h http) GetIdentity() (Identity, error) {
+	return resolveOnce(h.Request.Context(), h.resolveIdentity)
+}
 
-		username, groups, err = h.processBearerToken()
-	case anonymousBased:
-		return "", nil, fmt.Errorf("capsule does not support unauthenticated users")
+func (h http) resolveIdentity() (identity Identity, err error) {
+	start := time.Now()
+	// The span is the parent of the authentication and authorization ones, such as the TokenReview
+	ctx, span := tracing.Start(h.Request.Context(), "GetIdentity")
+	defer func() { tracing.End(span, err) }()
+
+	h.Request = h.Request.WithContext(ctx)
+
+	user, authType, err := h.authenticate()
+	username, groups := user.Username, user.Groups
+
+	if err == nil && len(groups) == 0 && h.groupResolver != nil && authType != AuthTypeAnonymous && len(username) > 0 {
+		groups, err = h.groupResolver.Groups(h.Request.Context(), username)
+	}
+	// The groups filtered out are not honored by the impersonation SubjectAccessReviews either
+	if err == nil {
+		groups = h.transformers.groups(groups)
 	}
 	// In case of error, we're blocking the request flow here
+	if err == nil {
+		username, groups, err = h.impersonate(username, groups)
+	}
+
+	observeAuthentication(authType, err, time.Since(start))
+
 	if err != nil {
-		return "", nil, err
+		return Identity{}, err
+	}
+
+	username, groups = h.transformers.apply(username, groups)
+
+	uid, extra := ImpersonatedExtra(h.Request.Header)
+	impersonated := len(h.Request.Header.Get(authenticationv1.ImpersonateUserHeader)) > 0 || len(h.Request.Header.Values(authenticationv1.ImpersonateGroupHeader)) > 0 || len(uid) > 0 || len(extra) > 0
+	// Groups are personal data as well, listing them only at the highest verbosity
+	h.log.V(4).Info("resolved identity", "authType", authType, "username", username, "groupsCount", len(groups), "impersonated", impersonated)
+	h.log.V(8).Info("resolved identity groups", "username", username, "groups", groups)
+
+	identity = Identity{Username: username, Groups: groups, AuthType: authType, Impersonated: impersonated}
+	// The UID and the extras of the authenticated user are replaced by the impersonated ones, already verified
+	if !impersonated {
+		identity.UID, identity.Extra = user.UID, user.Extra
+
+		return identity, nil
 	}
+
+	identity.UID = uid
+
+	for key, values := range extra {
+		if identity.Extra == nil {
+			identity.Extra = make(map[string]authenticationv1.ExtraValue, len(extra))
+		}
+
+		identity.Extra[key] = values
+	}
+
+	return identity, nil
+}
+
+// impersonationConcurrency bounds the SubjectAccessReviews created in parallel for a single request.
+const impersonationConcurrency = 4
+
+// nolint:gochecknoglobals
+var requestInfoFactory = &apirequest.RequestInfoFactory{
+	APIPrefixes:          sets.NewString("api", "apis"),
+	GrouplessAPIPrefixes: sets.NewString("api"),
+}
+
+type impersonationCheck struct {
+	attributes *authorizationv1.ResourceAttributes
+	subject    string
+}
+
+func (h http) impersonate(username string, groups []string) (string, []string, error) {
 	// In case the requester is asking for impersonation, we have to be sure that's allowed by creating a
 	// SubjectAccessReview with the requested data, before proceeding.
-	if impersonateUser := h.Request.Header.Get("Impersonate-User"); len(impersonateUser) > 0 {
-		ac := &authorizationv1.SubjectAccessReview{
-			Spec: authorizationv1.SubjectAccessReviewSpec{
-				ResourceAttributes: &authorizationv1.ResourceAttributes{
-					Verb:     "impersonate",
-					Resource: "users",
-					Name:     impersonateUser,
-				},
-				User:   username,
-				Groups: groups,
-			},
-		}
-		if err = h.client.Create(h.Request.Context(), ac); err != nil {
-			return "", nil, err
+	var checks []impersonationCheck
+
+	impersonateUser := h.Request.Header.Get(authenticationv1.ImpersonateUserHeader)
+	if len(impersonateUser) > 0 {
+		checks = append(checks, userImpersonationCheck(impersonateUser))
+	}
+
+	impersonateGroups := uniqueGroups(h.transformers.groups(h.impersonateGroups()))
+	for _, impersonateGroup := range impersonateGroups {
+		checks = append(checks, impersonationCheck{
+			attributes: &authorizationv1.ResourceAttributes{Verb: "impersonate", Resource: "groups", Name: impersonateGroup},
+			subject:    fmt.Sprintf("the group %s", impersonateGroup),
+		})
+	}
+
+	uid, extra := ImpersonatedExtra(h.Request.Header)
+	if len(uid) > 0 {
+		checks = append(checks, impersonationCheck{
+			attributes: &authorizationv1.ResourceAttributes{Group: authenticationv1.SchemeGroupVersion.Group, Verb: "impersonate", Resource: "uids", Name: uid},
+			subject:    fmt.Sprintf("the uid %s", uid),
+		})
+	}
+
+	for key, values := range extra {
+		for _, value := range values {
+			checks = append(checks, impersonationCheck{
+				attributes: &authorizationv1.ResourceAttributes{Group: authenticationv1.SchemeGroupVersion.Group, Verb: "impersonate", Resource: "userextras", Subresource: key, Name: value},
+				subject:    fmt.Sprintf("the extra %s=%s", key, value),
+			})
 		}
+	}
+
+	if len(checks) == 0 {
+		return username, groups, nil
+	}
+
+	if h.namespacedImpersonation {
+		h.scopeImpersonation(checks)
+	}
+	// Regardless of the RBAC policy, thus with no SubjectAccessReview
+	if h.impersonationDisabled {
+		return "", nil, NewErrForbidden("impersonation is disabled")
+	}
 
-		if !ac.Status.Allowed {
-			return "", nil, NewErrUnauthorized(fmt.Sprintf("the current user %s cannot impersonate the user %s", username, impersonateUser))
+	if h.deniedUsers.Has(impersonateUser) {
+		return "", nil, NewErrForbidden(fmt.Sprintf("the impersonation of the user %s is denied by the proxy", impersonateUser))
+	}
+
+	for _, impersonateGroup := range impersonateGroups {
+		if h.deniedGroups.Has(impersonateGroup) {
+			return "", nil, NewErrForbidden(fmt.Sprintf("the impersonation of the group %s is denied by the proxy", impersonateGroup))
 		}
-		// The current user is allowed to perform authentication, allowing the override
-		username = impersonateUser
+	}
+	// An authenticator resolving an empty username leaves the request effectively unauthenticated
+	if len(username) == 0 {
+		return "", nil, NewErrUnauthorized("impersonation is not allowed for unauthenticated users")
 	}
 
-	if impersonateGroups := h.Request.Header.Values("Impersonate-Group"); len(impersonateGroups) > 0 {
-		for _, impersonateGroup := range impersonateGroups {
-			ac := &authorizationv1.SubjectAccessReview{
-				Spec: authorizationv1.SubjectAccessReviewSpec{
-					ResourceAttributes: &authorizationv1.ResourceAttributes{
-						Verb:     "impersonate",
-						Resource: "groups",
-						Name:     impersonateGroup,
-					},
-					User:   username,
-					Groups: groups,
-				},
-			}
-			if err = h.client.Create(h.Request.Context(), ac); err != nil {
-				return "", nil, err
-			}
+	// The bypass users are trusted to impersonate by policy, saving the SubjectAccessReview round-trips
+	if h.bypassUsers.Has(username) {
+		h.log.V(4).Info("skipping the impersonation checks for the bypass user", "username", username)
+	} else if err := h.checkImpersonation(username, groups, checks); err != nil {
+		return "", nil, err
+	}
+	impersonator := username
+	// The current user is allowed to perform authentication, allowing the override
+	if len(impersonateUser) > 0 {
+		username = impersonateUser
+	}
 
-			if !ac.Status.Allowed {
-				return "", nil, NewErrUnauthorized(fmt.Sprintf("the current user %s cannot impersonate the group %s", username, impersonateGroup))
-			}
+	current := sets.NewString(groups...)
+	impersonated := copyGroups(groups, len(impersonateGroups))
 
-			if !sets.NewString(groups...).Has(impersonateGroup) {
-				// The current user is allowed to perform authentication, allowing the override
-				groups = append(groups, impersonateGroup)
-			}
+	for _, impersonateGroup := range impersonateGroups {
+		if !current.Has(impersonateGroup) {
+			current.Insert(impersonateGroup)
+			impersonated = append(impersonated, impersonateGroup)
 		}
 	}
 
-	return username, groups, nil
+	extraKeys := make([]string, 0, len(extra))
+	for key := range extra {
+		extraKeys = append(extraKeys, key)
+	}
+	// Impersonation is sensitive, thus always logged: the impersonated identity is kept out of the metric labels
+	h.log.Info("impersonation applied", "impersonator", impersonator, "user", impersonateUser, "groups", impersonateGroups, "uid", uid, "extraKeys", extraKeys)
+	observeImpersonation(impersonator, len(impersonateUser) > 0, len(impersonateGroups) > 0, len(uid) > 0, len(extra) > 0)
+
+	return username, impersonated, nil
 }
 
-func (h http) processJwtClaims() (username string, groups []string, err error) {
-	claims := h.getJwtClaims()
+// userImpersonationCheck returns the check of the impersonated user: the service accounts are checked against the
+// serviceaccounts resource of their Namespace rather than the users one, as the API server does.
+func userImpersonationCheck(username string) impersonationCheck {
+	if namespace, name, err := serviceaccount.SplitUsername(username); err == nil {
+		return impersonationCheck{
+			attributes: &authorizationv1.ResourceAttributes{Verb: "impersonate", Resource: "serviceaccounts", Namespace: namespace, Name: name},
+			subject:    fmt.Sprintf("the service account %s/%s", namespace, name),
+		}
+	}
 
-	if claims["iss"] == "kubernetes/serviceaccount" {
-		username = claims["sub"].(string)
-		groups = append(groups, "system:serviceaccounts", fmt.Sprintf("system:serviceaccounts:%s", claims["kubernetes.io/serviceaccount/namespace"]))
+	return impersonationCheck{
+		attributes: &authorizationv1.ResourceAttributes{Verb: "impersonate", Resource: "users", Name: username},
+		subject:    fmt.Sprintf("the user %s", username),
+	}
+}
 
+// scopeImpersonation sets the Namespace of the target resource to the impersonation checks of the namespaced
+// requests, except for the service accounts one, already checked in their own Namespace.
+func (h http) scopeImpersonation(checks []impersonationCheck) {
+	info, err := requestInfoFactory.NewRequestInfo(h.Request)
+	if err != nil || len(info.Namespace) == 0 {
 		return
 	}
 
-	u, ok := claims[h.usernameClaimField]
-	if !ok {
-		return "", nil, fmt.Errorf("missing users claim in JWT")
+	for _, check := range checks {
+		if len(check.attributes.Namespace) == 0 {
+			check.attributes.Namespace = info.Namespace
+		}
 	}
+}
 
-	username = u.(string)
+// impersonateGroups returns the values of the Impersonate-Group headers, each one split by the groups separator
+// when configured, dropping the blank groups: with no separator, each header is a single group, as for the API server.
+func (h http) impersonateGroups() []string {
+	values := h.Request.Header.Values(authenticationv1.ImpersonateGroupHeader)
+	if len(h.groupsSeparator) == 0 {
+		return values
+	}
 
-	g, ok := claims["groups"]
-	if !ok {
-		return "", nil, fmt.Errorf("missing groups claim in JWT")
+	groups := make([]string, 0, len(values))
+
+	for _, value := range values {
+		for _, group := range strings.Split(value, h.groupsSeparator) {
+			if group = strings.TrimSpace(group); len(group) > 0 {
+				groups = append(groups, group)
+			}
+		}
 	}
 
-	for _, v := range g.([]interface{}) {
-		groups = append(groups, v.(string))
+	return groups
+}
+
+// uniqueGroups drops the duplicated groups, such as the repeated Impersonate-Group headers, keeping their order.
+func uniqueGroups(groups []string) []string {
+	seen := sets.NewString()
+	unique := make([]string, 0, len(groups))
+
+	for _, group := range groups {
+		if !seen.Has(group) {
+			seen.Insert(group)
+			unique = append(unique, group)
+		}
 	}
 
-	return username, groups, nil
+	return unique
 }
 
-func (h http) processBearerToken() (username string, groups []string, err error) {
-	token := h.bearerToken()
-	tr := &authenticationv1.TokenReview{
-		Spec: authenticationv1.TokenReviewSpec{
-			Token: token,
-		},
+// checkImpersonation creates the SubjectAccessReviews for the requested impersonation concurrently, on behalf of
+// the authenticated user as the API server does: the first denial or failure cancels the pending ones.
+func (h http) checkImpersonation(username string, groups []string, checks []impersonationCheck) error {
+	ctx, cancel := withTimeout(h.Request.Context(), h.timeout)
+	defer cancel()
+
+	errs := make(chan error, len(checks))
+	semaphore := make(chan struct{}, impersonationConcurrency)
+
+	var wg sync.WaitGroup
+
+	for _, check := range checks {
+		check := check
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-ctx.Done():
+				return
+			}
+
+			allowed, err := h.canImpersonate(ctx, username, groups, check.attributes)
+
+			switch {
+			case ctx.Err() != nil:
+				return
+			case err != nil:
+				errs <- err
+			case !allowed:
+				errs <- NewErrForbidden(fmt.Sprintf("the current user %s cannot impersonate %s", username, check.subject))
+			default:
+				return
+			}
+
+			cancel()
+		}()
 	}
 
-	if err = h.client.Create(context.Background(), tr); err != nil {
-		return "", nil, fmt.Errorf("cannot create TokenReview")
+	wg.Wait()
+	close(errs)
+
+	if err, ok := <-errs; ok {
+		return err
+	}
+	// The request could have been cancelled, or timed out, leaving some of the checks not performed
+	if err := h.Request.Context().Err(); err != nil {
+		return err
 	}
 
-	if statusErr := tr.Status.Error; len(statusErr) > 0 {
-		return "", nil, fmt.Errorf("cannot verify the token due to error")
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return NewErrTimeout("the impersonation SubjectAccessReview timed out")
 	}
 
-	return tr.Status.User.Username, tr.Status.User.Groups, nil
+	return nil
 }
 
-func (h http) bearerToken() string {
-	return strings.ReplaceAll(h.Header.Get("Authorization"), "Bearer ", "")
+// canImpersonate creates the SubjectAccessReview checking if the given user can perform the impersonation
+// described by the resource attributes.
+func (h http) canImpersonate(ctx context.Context, username string, groups []string, attributes *authorizationv1.ResourceAttributes) (bool, error) {
+	ac := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: attributes,
+			User:               username,
+			Groups:             groups,
+		},
+	}
+	ctx, span := tracing.Start(ctx, "SubjectAccessReview", attribute.String("verb", attributes.Verb), attribute.String("resource", attributes.Resource))
+	defer span.End()
+
+	if err := h.client.Create(ctx, ac); err != nil {
+		tracing.End(span, err)
+
+		return false, err
+	}
+
+	span.SetAttributes(attribute.Bool("allowed", ac.Status.Allowed))
+
+	return ac.Status.Allowed, nil
 }
 
-func (h http) getAuthType() authType {
-	switch {
-	case (h.TLS != nil) && len(h.TLS.PeerCertificates) > 0:
-		return certificateBased
-	case len(h.bearerToken()) > 0:
-		return bearerBased
-	default:
-		return anonymousBased
+// authenticate resolves the identity with the first Authenticator of the chain handling the request credentials,
+// returning its auth type, or AuthTypeAnonymous when none of them did.
+func (h http) authenticate() (user authenticationv1.UserInfo, authType string, err error) {
+	for _, authenticator := range h.authenticators {
+		if extraAuthenticator, ok := authenticator.(UserExtraAuthenticator); ok {
+			user, err = extraAuthenticator.ResolveUser(h.Request)
+		} else {
+			user.Username, user.Groups, err = authenticator.Resolve(h.Request)
+		}
+
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+
+		return user, authenticator.AuthType(), err
 	}
+
+	return authenticationv1.UserInfo{}, AuthTypeAnonymous, NewErrUnauthorized(h.unauthenticatedMessage)
 }
 
-func (h http) getJwtClaims() jwt.MapClaims {
-	parser := jwt.Parser{
-		SkipClaimsValidation: true,
+// RequestBearerToken returns the bearer token of the Authorization header or, when missing, the one carried by the
+// given query parameter, as done by the WebSocket clients that cannot set custom headers.
+func RequestBearerToken(request *h.Request, queryParameter string) string {
+	if authorization := request.Header.Get("Authorization"); len(authorization) > 0 || len(queryParameter) == 0 {
+		return BearerToken(authorization)
 	}
 
-	var token *jwt.Token
+	return request.URL.Query().Get(queryParameter)
+}
 
-	var err error
+// BearerToken extracts the token from the Authorization header value: the scheme is matched case-insensitively
+// and separated by any whitespace run, while headers with a scheme other than Bearer are considered without token.
+func BearerToken(authorization string) string {
+	authorization = strings.TrimSpace(authorization)
 
-	if token, _, err = parser.ParseUnverified(h.bearerToken(), jwt.MapClaims{}); err != nil {
-		panic(err)
+	i := strings.IndexFunc(authorization, unicode.IsSpace)
+	if i < 0 || !strings.EqualFold(authorization[:i], "bearer") {
+		return ""
 	}
 
-	return token.Claims.(jwt.MapClaims)
+	return strings.TrimSpace(authorization[i:])
 }
 
-func (h http) isJwtToken() bool {
-	parser := jwt.Parser{
-		SkipClaimsValidation: true,
+// withTimeout returns the context bounding the API server requests to the given timeout, not bounded when zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(ctx)
 	}
-	_, _, err := parser.ParseUnverified(h.bearerToken(), jwt.MapClaims{})
 
-	return err == nil
+	return context.WithTimeout(ctx, timeout)
 }
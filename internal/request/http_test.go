@@ -0,0 +1,1232 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+// nolint:testpackage
+package request
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	h "net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// fakeClient allows faking the API server responses for the created objects, such as TokenReview and SubjectAccessReview.
+type fakeClient struct {
+	client.Client
+	create func(ctx context.Context, obj client.Object) error
+}
+
+func (f fakeClient) Create(ctx context.Context, obj client.Object, _ ...client.CreateOption) error {
+	return f.create(ctx, obj)
+}
+
+// fakeAuthenticator resolves the configured identity when the request carries the given header.
+type fakeAuthenticator struct {
+	header   string
+	username string
+	// groups overrides the default capsule.clastix.io one when not nil
+	groups []string
+	err    error
+}
+
+func (f fakeAuthenticator) AuthType() string {
+	return "fake"
+}
+
+func (f fakeAuthenticator) Resolve(request *h.Request) (username string, groups []string, err error) {
+	if len(request.Header.Get(f.header)) == 0 {
+		return "", nil, ErrNoCredentials
+	}
+
+	if f.groups != nil {
+		return f.username, f.groups, f.err
+	}
+
+	return f.username, []string{"capsule.clastix.io"}, f.err
+}
+
+// fakeGroupResolver returns the groups of the users, counting the resolutions.
+type fakeGroupResolver struct {
+	groups map[string][]string
+	err    error
+	calls  *int64
+}
+
+func (f fakeGroupResolver) Groups(_ context.Context, username string) ([]string, error) {
+	atomic.AddInt64(f.calls, 1)
+
+	return f.groups[username], f.err
+}
+
+func newTestToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("cannot sign token: %v", err)
+	}
+
+	return token
+}
+
+func TestBearerToken(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		authorization string
+		want          string
+	}{
+		{"canonical", "Bearer abc.def.ghi", "abc.def.ghi"},
+		{"lowercase scheme", "bearer abc.def.ghi", "abc.def.ghi"},
+		{"uppercase scheme", "BEARER abc.def.ghi", "abc.def.ghi"},
+		{"tab separator", "Bearer\tabc.def.ghi", "abc.def.ghi"},
+		{"multiple spaces", "Bearer    abc.def.ghi", "abc.def.ghi"},
+		{"surrounding whitespace", "  Bearer abc.def.ghi  ", "abc.def.ghi"},
+		{"scheme only", "Bearer", ""},
+		{"scheme with trailing space", "Bearer   ", ""},
+		{"no scheme", "abc.def.ghi", ""},
+		{"basic scheme", "Basic YWxpY2U6c2VjcmV0", ""},
+		{"scheme prefix", "Bearerabc.def.ghi", ""},
+		{"embedded scheme", "Bearer opaque-Bearer token", "opaque-Bearer token"},
+		{"repeated scheme", "Bearer Bearer abc", "Bearer abc"},
+		{"empty", "", ""},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := BearerToken(eachTest.authorization); got != eachTest.want {
+				t.Errorf("got %q, want %q", got, eachTest.want)
+			}
+		})
+	}
+}
+
+func TestRequestBearerToken(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name           string
+		target         string
+		authorization  string
+		queryParameter string
+		want           string
+	}{
+		{"header", "/api/v1/namespaces", "Bearer abc.def.ghi", "access_token", "abc.def.ghi"},
+		{"query parameter", "/api/v1/namespaces?watch=true&access_token=abc.def.ghi", "", "access_token", "abc.def.ghi"},
+		{"header takes precedence", "/api/v1/namespaces?access_token=abc.def.ghi", "Bearer jkl.mno.pqr", "access_token", "jkl.mno.pqr"},
+		{"query parameter disabled", "/api/v1/namespaces?access_token=abc.def.ghi", "", "", ""},
+		{"custom query parameter", "/api/v1/namespaces?token=abc.def.ghi", "", "token", "abc.def.ghi"},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(h.MethodGet, eachTest.target, nil)
+			if len(eachTest.authorization) > 0 {
+				r.Header.Set("Authorization", eachTest.authorization)
+			}
+
+			if got := RequestBearerToken(r, eachTest.queryParameter); got != eachTest.want {
+				t.Errorf("got %q, want %q", got, eachTest.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	t.Parallel()
+
+	failure := fmt.Errorf("cannot verify the credentials")
+
+	tests := []struct {
+		name           string
+		authenticators []Authenticator
+		wantUsername   string
+		wantErr        error
+	}{
+		{
+			"first handling authenticator wins",
+			[]Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}, fakeAuthenticator{header: "X-Api-Key", username: "bob"}},
+			"alice",
+			nil,
+		},
+		{
+			"authenticators without credentials are skipped",
+			[]Authenticator{fakeAuthenticator{header: "X-Missing", username: "alice"}, fakeAuthenticator{header: "X-Api-Key", username: "bob"}},
+			"bob",
+			nil,
+		},
+		{
+			"error stops the chain",
+			[]Authenticator{fakeAuthenticator{header: "X-Api-Key", err: failure}, fakeAuthenticator{header: "X-Api-Key", username: "bob"}},
+			"",
+			failure,
+		},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+			r.Header.Set("X-Api-Key", "secret")
+
+			username, _, err := NewHTTPWithOptions(r, Options{Authenticators: eachTest.authenticators}).GetUserAndGroups()
+			if !errors.Is(err, eachTest.wantErr) {
+				t.Fatalf("got error %v, want %v", err, eachTest.wantErr)
+			}
+
+			if username != eachTest.wantUsername {
+				t.Errorf("got username %s, want %s", username, eachTest.wantUsername)
+			}
+		})
+	}
+}
+
+func TestAuthenticateUnauthenticated(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+
+	if _, _, err := NewHTTPWithOptions(r, Options{Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key"}}}).GetUserAndGroups(); err == nil || err.Error() != DefaultUnauthenticatedMessage {
+		t.Errorf("got error %v, want the default unauthenticated message", err)
+	}
+
+	_, _, err := NewHTTPWithOptions(r, Options{Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key"}}, UnauthenticatedMessage: "please log in with the company SSO"}).GetUserAndGroups()
+
+	var unauthorized *ErrUnauthorized
+	if !errors.As(err, &unauthorized) || err.Error() != "please log in with the company SSO" {
+		t.Errorf("got error %v, want the configured unauthenticated message", err)
+	}
+}
+
+func TestGroupResolver(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		groups     []string
+		resolveErr error
+		want       []string
+		wantCalls  int64
+		wantErr    bool
+	}{
+		{"token without groups", []string{}, nil, []string{"developers", "tenant-oil"}, 1, false},
+		{"token with groups", []string{"admins"}, nil, []string{"admins"}, 0, false},
+		{"resolver failure", []string{}, errors.New("unavailable"), nil, 1, true},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			var calls int64
+
+			resolver := fakeGroupResolver{
+				groups: map[string][]string{"alice": {"developers", "tenant-oil"}},
+				err:    eachTest.resolveErr,
+				calls:  &calls,
+			}
+
+			r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+			r.Header.Set("X-Api-Key", "secret")
+
+			_, groups, err := NewHTTPWithOptions(r, Options{
+				Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice", groups: eachTest.groups}},
+				GroupResolver:  resolver,
+			}).GetUserAndGroups()
+
+			if (err != nil) != eachTest.wantErr {
+				t.Fatalf("got error %v, want error %t", err, eachTest.wantErr)
+			}
+
+			if !eachTest.wantErr && !reflect.DeepEqual(groups, eachTest.want) {
+				t.Errorf("got groups %v, want %v", groups, eachTest.want)
+			}
+
+			if got := atomic.LoadInt64(&calls); got != eachTest.wantCalls {
+				t.Errorf("got %d resolutions, want %d", got, eachTest.wantCalls)
+			}
+		})
+	}
+}
+
+func TestNewHTTPWithOptions(t *testing.T) {
+	t.Parallel()
+
+	allowAll := fakeClient{create: func(_ context.Context, obj client.Object) error {
+		obj.(*authorizationv1.SubjectAccessReview).Status.Allowed = true
+
+		return nil
+	}}
+
+	tests := []struct {
+		name         string
+		opts         Options
+		apiKey       string
+		wantUsername string
+		wantGroups   []string
+		wantErr      string
+	}{
+		{
+			"default unauthenticated message",
+			Options{Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key"}}},
+			"",
+			"",
+			nil,
+			DefaultUnauthenticatedMessage,
+		},
+		{
+			"custom unauthenticated message",
+			Options{Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key"}}, UnauthenticatedMessage: "please log in"},
+			"",
+			"",
+			nil,
+			"please log in",
+		},
+		{
+			"impersonation",
+			Options{Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}}, Client: allowAll},
+			"secret",
+			"bob",
+			[]string{"capsule.clastix.io", "developers"},
+			"",
+		},
+		{
+			"impersonation disabled",
+			Options{Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}}, ImpersonationDisabled: true, Client: allowAll},
+			"secret",
+			"",
+			nil,
+			"impersonation is disabled",
+		},
+		{
+			"bypass user",
+			Options{Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}}, BypassUsers: sets.NewString("alice"), Client: fakeClient{}},
+			"secret",
+			"bob",
+			[]string{"capsule.clastix.io", "developers"},
+			"",
+		},
+		{
+			"transformers",
+			Options{
+				Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}},
+				Transformers:   Transformers{Groups: RegexGroupsTransformer(nil, regexp.MustCompile("^developers$"))},
+				Client:         allowAll,
+			},
+			"secret",
+			"bob",
+			[]string{"capsule.clastix.io"},
+			"",
+		},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+			if len(eachTest.apiKey) > 0 {
+				r.Header.Set("X-Api-Key", eachTest.apiKey)
+			}
+
+			r.Header.Set("Impersonate-User", "bob")
+			r.Header.Set("Impersonate-Group", "developers")
+
+			username, groups, err := NewHTTPWithOptions(r, eachTest.opts).GetUserAndGroups()
+			if len(eachTest.wantErr) > 0 {
+				if err == nil || err.Error() != eachTest.wantErr {
+					t.Errorf("got error %v, want %s", err, eachTest.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if username != eachTest.wantUsername || !reflect.DeepEqual(groups, eachTest.wantGroups) {
+				t.Errorf("got %s and %v, want %s and %v", username, groups, eachTest.wantUsername, eachTest.wantGroups)
+			}
+		})
+	}
+}
+
+func TestImpersonateExtra(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		denied  string
+		wantSAR []string
+		err     bool
+	}{
+		{
+			"uid allowed",
+			map[string]string{"Impersonate-Uid": "1234"},
+			"",
+			[]string{"uids//1234"},
+			false,
+		},
+		{
+			"extra allowed",
+			map[string]string{"Impersonate-Extra-Scopes": "view"},
+			"",
+			[]string{"userextras/scopes/view"},
+			false,
+		},
+		{
+			"escaped extra key",
+			map[string]string{"Impersonate-Extra-Example.com%2fteam": "platform"},
+			"",
+			[]string{"userextras/example.com/team/platform"},
+			false,
+		},
+		{
+			"extra denied",
+			map[string]string{"Impersonate-Extra-Scopes": "admin"},
+			"admin",
+			[]string{"userextras/scopes/admin"},
+			true,
+		},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			var reviewed []string
+
+			r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+			r.Header.Set("X-Api-Key", "secret")
+
+			for k, v := range eachTest.headers {
+				r.Header.Set(k, v)
+			}
+
+			c := fakeClient{create: func(_ context.Context, obj client.Object) error {
+				attributes := obj.(*authorizationv1.SubjectAccessReview).Spec.ResourceAttributes
+				if attributes.Group != "authentication.k8s.io" {
+					t.Errorf("got group %q, want authentication.k8s.io", attributes.Group)
+				}
+
+				reviewed = append(reviewed, strings.Join([]string{attributes.Resource, attributes.Subresource, attributes.Name}, "/"))
+				obj.(*authorizationv1.SubjectAccessReview).Status.Allowed = attributes.Name != eachTest.denied
+
+				return nil
+			}}
+
+			_, _, err := NewHTTPWithOptions(r, Options{Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}}, Client: c}).GetUserAndGroups()
+			if eachTest.err {
+				var forbidden *ErrForbidden
+				if !errors.As(err, &forbidden) {
+					t.Errorf("expected forbidden error, got %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("got error: %v", err)
+			}
+
+			if !reflect.DeepEqual(reviewed, eachTest.wantSAR) {
+				t.Errorf("got reviews %v, want %v", reviewed, eachTest.wantSAR)
+			}
+		})
+	}
+}
+
+func TestImpersonateDenied(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("X-Api-Key", "secret")
+	r.Header.Set("Impersonate-User", "bob")
+	r.Header.Add("Impersonate-Group", "developers")
+	r.Header.Add("Impersonate-Group", "system:masters")
+
+	c := fakeClient{create: func(_ context.Context, obj client.Object) error {
+		sar := obj.(*authorizationv1.SubjectAccessReview)
+		if sar.Spec.User != "alice" {
+			t.Errorf("got SubjectAccessReview for %s, want alice", sar.Spec.User)
+		}
+
+		sar.Status.Allowed = sar.Spec.ResourceAttributes.Name != "system:masters"
+
+		return nil
+	}}
+
+	_, _, err := NewHTTPWithOptions(r, Options{Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}}, Client: c}).GetUserAndGroups()
+
+	var forbidden *ErrForbidden
+	if !errors.As(err, &forbidden) {
+		t.Fatalf("expected forbidden error, got %v", err)
+	}
+
+	if want := "the current user alice cannot impersonate the group system:masters"; forbidden.Error() != want {
+		t.Errorf("got error %q, want %q", forbidden.Error(), want)
+	}
+}
+
+func TestImpersonateFilteredGroups(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("X-Api-Key", "secret")
+	r.Header.Set("Impersonate-User", "bob")
+
+	c := fakeClient{create: func(_ context.Context, obj client.Object) error {
+		sar := obj.(*authorizationv1.SubjectAccessReview)
+		// The privileged group would allow any impersonation
+		sar.Status.Allowed = sets.NewString(sar.Spec.Groups...).Has("system:masters")
+
+		return nil
+	}}
+
+	transformers := Transformers{Groups: RegexGroupsTransformer(nil, regexp.MustCompile("^system:masters$"))}
+	authenticators := []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice", groups: []string{"developers", "system:masters"}}}
+
+	_, _, err := NewHTTPWithOptions(r, Options{Authenticators: authenticators, Transformers: transformers, Client: c}).GetUserAndGroups()
+
+	var forbidden *ErrForbidden
+	if !errors.As(err, &forbidden) {
+		t.Errorf("got error %v, want the impersonation forbidden for the denied group", err)
+	}
+}
+
+func TestGroupsTransformedOnce(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("X-Api-Key", "secret")
+	r.Header.Set("Impersonate-Group", "ops")
+	// Prefixing is not idempotent, the groups must be transformed once
+	prefix := func(groups []string) []string {
+		prefixed := make([]string, 0, len(groups))
+		for _, group := range groups {
+			prefixed = append(prefixed, "oidc:"+group)
+		}
+
+		return prefixed
+	}
+
+	var reviewed []string
+
+	c := fakeClient{create: func(_ context.Context, obj client.Object) error {
+		sar := obj.(*authorizationv1.SubjectAccessReview)
+		reviewed = append(reviewed, sar.Spec.ResourceAttributes.Name)
+		reviewed = append(reviewed, sar.Spec.Groups...)
+		sar.Status.Allowed = true
+
+		return nil
+	}}
+
+	authenticators := []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice", groups: []string{"developers"}}}
+
+	_, groups, err := NewHTTPWithOptions(r, Options{Authenticators: authenticators, Transformers: Transformers{Groups: prefix}, Client: c}).GetUserAndGroups()
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+
+	if want := []string{"oidc:developers", "oidc:ops"}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("got groups %v, want %v", groups, want)
+	}
+
+	if want := []string{"oidc:ops", "oidc:developers"}; !reflect.DeepEqual(reviewed, want) {
+		t.Errorf("got the SubjectAccessReview of %v, want %v", reviewed, want)
+	}
+}
+
+func TestImpersonateDeniedTargets(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		deniedUsers  sets.String
+		deniedGroups sets.String
+		header       h.Header
+		wantErr      string
+	}{
+		{
+			"default denied group",
+			nil,
+			sets.NewString("system:masters"),
+			h.Header{"Impersonate-User": []string{"bob"}, "Impersonate-Group": []string{"developers", "system:masters"}},
+			"the impersonation of the group system:masters is denied by the proxy",
+		},
+		{
+			"custom denied user",
+			sets.NewString("kubernetes-admin"),
+			sets.NewString("system:masters"),
+			h.Header{"Impersonate-User": []string{"kubernetes-admin"}},
+			"the impersonation of the user kubernetes-admin is denied by the proxy",
+		},
+		{
+			"custom denied group",
+			nil,
+			sets.NewString("cluster-admins"),
+			h.Header{"Impersonate-Group": []string{"cluster-admins"}},
+			"the impersonation of the group cluster-admins is denied by the proxy",
+		},
+		{
+			"allowed targets",
+			sets.NewString("kubernetes-admin"),
+			sets.NewString("system:masters"),
+			h.Header{"Impersonate-User": []string{"bob"}, "Impersonate-Group": []string{"developers"}},
+			"",
+		},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+			r.Header.Set("X-Api-Key", "secret")
+
+			for key, values := range eachTest.header {
+				r.Header[key] = values
+			}
+			// The denied targets are rejected before any SubjectAccessReview, even for the bypass users
+			username, _, err := NewHTTPWithOptions(r, Options{
+				Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}},
+				BypassUsers:    sets.NewString("alice"),
+				DeniedUsers:    eachTest.deniedUsers,
+				DeniedGroups:   eachTest.deniedGroups,
+				Client: fakeClient{create: func(context.Context, client.Object) error {
+					t.Error("unexpected SubjectAccessReview for the bypass user")
+
+					return nil
+				}},
+			}).GetUserAndGroups()
+
+			if len(eachTest.wantErr) == 0 {
+				if err != nil || username != "bob" {
+					t.Errorf("got %s and error %v, want bob", username, err)
+				}
+
+				return
+			}
+
+			var forbidden *ErrForbidden
+			if !errors.As(err, &forbidden) || err.Error() != eachTest.wantErr {
+				t.Errorf("got error %v, want forbidden %s", err, eachTest.wantErr)
+			}
+		})
+	}
+}
+
+func TestImpersonateServiceAccount(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("X-Api-Key", "secret")
+	r.Header.Set("Impersonate-User", "system:serviceaccount:oil-production:robot")
+
+	var reviewed *authorizationv1.ResourceAttributes
+
+	c := fakeClient{create: func(_ context.Context, obj client.Object) error {
+		sar := obj.(*authorizationv1.SubjectAccessReview)
+		reviewed = sar.Spec.ResourceAttributes
+		sar.Status.Allowed = true
+
+		return nil
+	}}
+
+	username, _, err := NewHTTPWithOptions(r, Options{Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}}, Client: c}).GetUserAndGroups()
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+
+	if username != "system:serviceaccount:oil-production:robot" {
+		t.Errorf("got username %s, want system:serviceaccount:oil-production:robot", username)
+	}
+
+	want := &authorizationv1.ResourceAttributes{Verb: "impersonate", Resource: "serviceaccounts", Namespace: "oil-production", Name: "robot"}
+	if !reflect.DeepEqual(reviewed, want) {
+		t.Errorf("got SubjectAccessReview attributes %+v, want %+v", reviewed, want)
+	}
+}
+
+func TestImpersonateNamespaced(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		path       string
+		namespaced bool
+		want       map[string]string
+	}{
+		{"namespaced request", "/api/v1/namespaces/oil-production/pods/nginx/exec", true, map[string]string{"bob": "oil-production", "developers": "oil-production", "robot": "gas-production"}},
+		{"cluster-scoped request", "/api/v1/nodes", true, map[string]string{"bob": "", "developers": "", "robot": "gas-production"}},
+		{"disabled", "/api/v1/namespaces/oil-production/pods", false, map[string]string{"bob": "", "developers": "", "robot": "gas-production"}},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			impersonate := func(user string) map[string]string {
+				r := httptest.NewRequest(h.MethodGet, eachTest.path, nil)
+				r.Header.Set("X-Api-Key", "secret")
+				r.Header.Set("Impersonate-User", user)
+				r.Header.Set("Impersonate-Group", "developers")
+
+				var mu sync.Mutex
+
+				reviewed := map[string]string{}
+
+				c := fakeClient{create: func(_ context.Context, obj client.Object) error {
+					sar := obj.(*authorizationv1.SubjectAccessReview)
+					sar.Status.Allowed = true
+
+					mu.Lock()
+					defer mu.Unlock()
+
+					reviewed[sar.Spec.ResourceAttributes.Name] = sar.Spec.ResourceAttributes.Namespace
+
+					return nil
+				}}
+
+				if _, _, err := NewHTTPWithOptions(r, Options{Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}}, NamespacedImpersonation: eachTest.namespaced, Client: c}).GetUserAndGroups(); err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+
+				return reviewed
+			}
+
+			got := impersonate("bob")
+			for name, namespace := range impersonate("system:serviceaccount:gas-production:robot") {
+				got[name] = namespace
+			}
+
+			if !reflect.DeepEqual(got, eachTest.want) {
+				t.Errorf("got checked Namespaces %v, want %v", got, eachTest.want)
+			}
+		})
+	}
+}
+
+func BenchmarkImpersonateGroups(b *testing.B) {
+	r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("X-Api-Key", "secret")
+	r.Header.Set("Impersonate-User", "bob")
+
+	for i := 0; i < 10; i++ {
+		r.Header.Add("Impersonate-Group", fmt.Sprintf("group-%d", i))
+	}
+	// Simulating the API server round-trip
+	c := fakeClient{create: func(_ context.Context, obj client.Object) error {
+		time.Sleep(time.Millisecond)
+
+		obj.(*authorizationv1.SubjectAccessReview).Status.Allowed = true
+
+		return nil
+	}}
+
+	hr := NewHTTPWithOptions(r, Options{Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}}, Client: c})
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, _, err := hr.GetUserAndGroups(); err != nil {
+			b.Fatalf("got error: %v", err)
+		}
+	}
+}
+
+func TestImpersonateDuplicatedGroups(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("X-Api-Key", "secret")
+
+	for _, group := range []string{"developers", "capsule.clastix.io", "developers", "ops", "ops"} {
+		r.Header.Add("Impersonate-Group", group)
+	}
+
+	var reviewed []string
+
+	var mu sync.Mutex
+
+	c := fakeClient{create: func(_ context.Context, obj client.Object) error {
+		sar := obj.(*authorizationv1.SubjectAccessReview)
+
+		mu.Lock()
+		reviewed = append(reviewed, sar.Spec.ResourceAttributes.Name)
+		mu.Unlock()
+
+		sar.Status.Allowed = true
+
+		return nil
+	}}
+
+	_, groups, err := NewHTTPWithOptions(r, Options{Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}}, Client: c}).GetUserAndGroups()
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+
+	if want := []string{"capsule.clastix.io", "developers", "ops"}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("got groups %v, want %v", groups, want)
+	}
+
+	sort.Strings(reviewed)
+
+	if want := []string{"capsule.clastix.io", "developers", "ops"}; !reflect.DeepEqual(reviewed, want) {
+		t.Errorf("got reviews %v, want %v", reviewed, want)
+	}
+}
+
+func TestImpersonateGroupsSeparator(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		separator string
+		headers   []string
+		want      []string
+	}{
+		{"joined", ",", []string{"developers, ops,,capsule.clastix.io"}, []string{"capsule.clastix.io", "developers", "ops"}},
+		{"multiple headers", ",", []string{"developers", "ops,capsule.clastix.io", "ops"}, []string{"capsule.clastix.io", "developers", "ops"}},
+		{"no separator", "", []string{"developers,ops", "capsule.clastix.io"}, []string{"capsule.clastix.io", "developers,ops"}},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+			r.Header.Set("X-Api-Key", "secret")
+
+			for _, header := range eachTest.headers {
+				r.Header.Add("Impersonate-Group", header)
+			}
+
+			var reviewed []string
+
+			var mu sync.Mutex
+
+			c := fakeClient{create: func(_ context.Context, obj client.Object) error {
+				sar := obj.(*authorizationv1.SubjectAccessReview)
+
+				mu.Lock()
+				reviewed = append(reviewed, sar.Spec.ResourceAttributes.Name)
+				mu.Unlock()
+
+				sar.Status.Allowed = true
+
+				return nil
+			}}
+
+			_, groups, err := NewHTTPWithOptions(r, Options{
+				Authenticators:             []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}},
+				ImpersonateGroupsSeparator: eachTest.separator,
+				Client:                     c,
+			}).GetUserAndGroups()
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			sort.Strings(groups)
+			sort.Strings(reviewed)
+
+			if !reflect.DeepEqual(groups, eachTest.want) {
+				t.Errorf("got groups %v, want %v", groups, eachTest.want)
+			}
+
+			if !reflect.DeepEqual(reviewed, eachTest.want) {
+				t.Errorf("got reviews %v, want %v", reviewed, eachTest.want)
+			}
+		})
+	}
+}
+
+func TestImpersonateGroupsSeparatorDenied(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("X-Api-Key", "secret")
+	r.Header.Set("Impersonate-Group", "developers,system:masters")
+
+	_, _, err := NewHTTPWithOptions(r, Options{
+		Authenticators:             []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}},
+		BypassUsers:                sets.NewString("alice"),
+		DeniedGroups:               sets.NewString("system:masters"),
+		ImpersonateGroupsSeparator: ",",
+		Client:                     fakeClient{},
+	}).GetUserAndGroups()
+
+	var forbidden *ErrForbidden
+	if !errors.As(err, &forbidden) {
+		t.Errorf("got error %v, want the joined denied group to be forbidden", err)
+	}
+}
+
+func TestGetUserAndGroupsAdditionalGroups(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("X-Api-Key", "secret")
+	r.Header.Set("Impersonate-User", "bob")
+	r.Header.Add("Impersonate-Group", "shared-readers")
+	r.Header.Add("Impersonate-Group", "ops")
+
+	username, groups, err := NewHTTPWithOptions(r, Options{
+		Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}},
+		Transformers:   Transformers{AdditionalGroups: []string{"shared-readers", "baseline"}},
+		BypassUsers:    sets.NewString("alice"),
+		Client:         fakeClient{},
+	}).GetUserAndGroups()
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	// Applied to the impersonated identity, with no duplicate of the impersonated groups
+	if want := []string{"capsule.clastix.io", "shared-readers", "ops", "baseline"}; username != "bob" || !reflect.DeepEqual(groups, want) {
+		t.Errorf("got %s with groups %v, want bob with %v", username, groups, want)
+	}
+}
+
+func BenchmarkImpersonateManyGroups(b *testing.B) {
+	r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("X-Api-Key", "secret")
+
+	for i := 0; i < 50; i++ {
+		r.Header.Add("Impersonate-Group", fmt.Sprintf("group-%d", i))
+	}
+	// Skipping the SubjectAccessReviews to measure the groups handling only
+	hr := NewHTTPWithOptions(r, Options{Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}}, BypassUsers: sets.NewString("alice"), Client: fakeClient{}})
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, _, err := hr.GetUserAndGroups(); err != nil {
+			b.Fatalf("got error: %v", err)
+		}
+	}
+}
+
+func TestImpersonateEmptyUsername(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("X-Api-Key", "secret")
+	r.Header.Set("Impersonate-User", "bob")
+
+	c := fakeClient{create: func(_ context.Context, obj client.Object) error {
+		t.Error("unexpected SubjectAccessReview for an empty username")
+
+		obj.(*authorizationv1.SubjectAccessReview).Status.Allowed = true
+
+		return nil
+	}}
+
+	_, _, err := NewHTTPWithOptions(r, Options{Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key"}}, Client: c}).GetUserAndGroups()
+
+	var unauthorized *ErrUnauthorized
+	if !errors.As(err, &unauthorized) {
+		t.Errorf("expected unauthorized error, got %v", err)
+	}
+}
+
+func TestTransformers(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("X-Api-Key", "secret")
+	r.Header.Set("Impersonate-User", "Bob@EXAMPLE.COM")
+
+	c := fakeClient{create: func(_ context.Context, obj client.Object) error {
+		obj.(*authorizationv1.SubjectAccessReview).Status.Allowed = true
+
+		return nil
+	}}
+
+	transformers := Transformers{
+		Username: func(username string) string {
+			return strings.ToLower(strings.TrimSuffix(username, "@EXAMPLE.COM"))
+		},
+		Groups: func(groups []string) []string {
+			transformed := make([]string, 0, len(groups))
+			for _, group := range groups {
+				transformed = append(transformed, strings.TrimPrefix(group, "capsule."))
+			}
+
+			return transformed
+		},
+	}
+
+	username, groups, err := NewHTTPWithOptions(r, Options{Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}}, Transformers: transformers, Client: c}).GetUserAndGroups()
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	// Transformers are applied to the impersonated identity
+	if username != "bob" {
+		t.Errorf("got username %s, want bob", username)
+	}
+
+	if want := []string{"clastix.io"}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("got groups %v, want %v", groups, want)
+	}
+}
+
+func TestImpersonateTimeout(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("X-Api-Key", "secret")
+	r.Header.Set("Impersonate-User", "bob")
+
+	c := fakeClient{create: func(ctx context.Context, _ client.Object) error {
+		<-ctx.Done()
+
+		return ctx.Err()
+	}}
+
+	_, _, err := NewHTTPWithOptions(r, Options{Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}}, Timeout: 10 * time.Millisecond, Client: c}).GetUserAndGroups()
+
+	var timeout *ErrTimeout
+	if !errors.As(err, &timeout) {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+}
+
+func TestImpersonateBypassUsers(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		username string
+		reviews  int
+	}{
+		{"bypass user", "system:serviceaccount:capsule-system:controller", 0},
+		{"other user", "alice", 2},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+			r.Header.Set("X-Api-Key", "secret")
+			r.Header.Set("Impersonate-User", "bob")
+			r.Header.Add("Impersonate-Group", "developers")
+
+			var reviews int32
+
+			c := fakeClient{create: func(_ context.Context, obj client.Object) error {
+				atomic.AddInt32(&reviews, 1)
+
+				obj.(*authorizationv1.SubjectAccessReview).Status.Allowed = true
+
+				return nil
+			}}
+
+			bypass := sets.NewString("system:serviceaccount:capsule-system:controller")
+
+			username, _, err := NewHTTPWithOptions(r, Options{Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: eachTest.username}}, BypassUsers: bypass, Client: c}).GetUserAndGroups()
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if username != "bob" {
+				t.Errorf("got username %s, want bob", username)
+			}
+
+			if got := int(atomic.LoadInt32(&reviews)); got != eachTest.reviews {
+				t.Errorf("got %d SubjectAccessReviews, want %d", got, eachTest.reviews)
+			}
+		})
+	}
+}
+
+func TestImpersonationDisabled(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]h.Header{
+		"user":  {"Impersonate-User": []string{"bob"}},
+		"group": {"Impersonate-Group": []string{"system:masters"}},
+		"uid":   {"Impersonate-Uid": []string{"1234"}},
+		"extra": {"Impersonate-Extra-Scopes": []string{"view"}},
+	}
+
+	for name, header := range tests {
+		header := header
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+			r.Header.Set("X-Api-Key", "secret")
+
+			for key, values := range header {
+				r.Header[key] = values
+			}
+
+			c := fakeClient{create: func(context.Context, client.Object) error {
+				t.Error("unexpected SubjectAccessReview with impersonation disabled")
+
+				return nil
+			}}
+			// Even the bypass users are rejected
+			_, _, err := NewHTTPWithOptions(r, Options{Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}}, BypassUsers: sets.NewString("alice"), ImpersonationDisabled: true, Client: c}).GetUserAndGroups()
+
+			var forbidden *ErrForbidden
+			if !errors.As(err, &forbidden) || err.Error() != "impersonation is disabled" {
+				t.Errorf("got error %v, want impersonation is disabled", err)
+			}
+		})
+	}
+
+	r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("X-Api-Key", "secret")
+
+	if _, _, err := NewHTTPWithOptions(r, Options{Authenticators: []Authenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}}, ImpersonationDisabled: true}).GetUserAndGroups(); err != nil {
+		t.Errorf("got error %v for the request without impersonation", err)
+	}
+}
+
+// nolint:paralleltest
+func TestGetIdentitySpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+	})
+
+	c := fakeClient{create: func(ctx context.Context, obj client.Object) error {
+		if !trace.SpanContextFromContext(ctx).IsValid() {
+			t.Errorf("the %T is created without the span context", obj)
+		}
+
+		switch o := obj.(type) {
+		case *authenticationv1.TokenReview:
+			o.Status.Authenticated, o.Status.User.Username = true, "alice"
+		case *authorizationv1.SubjectAccessReview:
+			o.Status.Allowed = true
+		}
+
+		return nil
+	}}
+
+	r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("Authorization", "Bearer opaque-token")
+	r.Header.Set("Impersonate-User", "bob")
+
+	authenticators := []Authenticator{NewTokenReviewAuthenticator(nil, nil, wait.Backoff{}, nil, "", 0, c)}
+
+	if _, err := NewHTTPWithOptions(r, Options{Authenticators: authenticators, Client: c}).GetIdentity(); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+
+	identity, ok := spans["GetIdentity"]
+	if !ok {
+		t.Fatalf("missing the GetIdentity span, got %v", spans)
+	}
+
+	for _, name := range []string{"TokenReview", "SubjectAccessReview"} {
+		span, ok := spans[name]
+
+		switch {
+		case !ok:
+			t.Errorf("missing the %s span", name)
+		case span.Parent().SpanID() != identity.SpanContext().SpanID():
+			t.Errorf("the %s span is not a child of the GetIdentity one", name)
+		}
+	}
+}
+
+func TestGetIdentityUserExtra(t *testing.T) {
+	t.Parallel()
+
+	extra := map[string]authenticationv1.ExtraValue{"scopes.example.com": {"read"}}
+
+	c := fakeClient{create: func(_ context.Context, obj client.Object) error {
+		switch o := obj.(type) {
+		case *authenticationv1.TokenReview:
+			o.Status.Authenticated, o.Status.User = true, authenticationv1.UserInfo{Username: "alice", UID: "42", Groups: []string{"capsule.clastix.io"}, Extra: extra}
+		case *authorizationv1.SubjectAccessReview:
+			o.Status.Allowed = true
+		}
+
+		return nil
+	}}
+
+	tests := []struct {
+		name        string
+		impersonate h.Header
+		uid         string
+		extra       map[string]authenticationv1.ExtraValue
+	}{
+		{"authenticated user", h.Header{}, "42", extra},
+		{"impersonated user", h.Header{"Impersonate-User": {"bob"}}, "", nil},
+		{"impersonated user extras", h.Header{"Impersonate-User": {"bob"}, "Impersonate-Uid": {"7"}, "Impersonate-Extra-Scopes": {"write"}}, "7", map[string]authenticationv1.ExtraValue{"scopes": {"write"}}},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+			r.Header = eachTest.impersonate.Clone()
+			r.Header.Set("Authorization", "Bearer opaque-token")
+
+			authenticators := []Authenticator{NewTokenReviewAuthenticator(nil, nil, wait.Backoff{}, nil, "", 0, c)}
+
+			identity, err := NewHTTPWithOptions(r, Options{Authenticators: authenticators, Client: c}).GetIdentity()
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if identity.UID != eachTest.uid || !reflect.DeepEqual(identity.Extra, eachTest.extra) {
+				t.Errorf("got UID %q and extras %v, want %q and %v", identity.UID, identity.Extra, eachTest.uid, eachTest.extra)
+			}
+
+			if identity.Impersonated != (len(eachTest.impersonate) > 0) {
+				t.Errorf("got impersonated %t, want %t", identity.Impersonated, len(eachTest.impersonate) > 0)
+			}
+		})
+	}
+}
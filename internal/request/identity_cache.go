@@ -0,0 +1,58 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request
+
+import (
+	"context"
+	"sync"
+)
+
+type identityCacheKey struct{}
+
+// identityCache holds the outcome of the identity resolution of a single request, shared by the middlewares and the
+// handlers retrieving it.
+type identityCache struct {
+	mu       sync.Mutex
+	resolved bool
+	identity Identity
+	err      error
+}
+
+// WithIdentityCache returns the context caching the Identity of the request: it is resolved once, by the first
+// GetIdentity call, sparing the further authentications, SubjectAccessReviews, and metrics of the same request.
+func WithIdentityCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, identityCacheKey{}, &identityCache{})
+}
+
+// IdentityFrom returns the Identity resolved for the request context, if any, and if its resolution succeeded.
+func IdentityFrom(ctx context.Context) (Identity, bool) {
+	cache, ok := ctx.Value(identityCacheKey{}).(*identityCache)
+	if !ok {
+		return Identity{}, false
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	return cache.identity, cache.resolved && cache.err == nil
+}
+
+// resolveOnce returns the cached outcome of resolve, calling it only if not resolved yet: without a cache in the
+// context, it is called each time.
+func resolveOnce(ctx context.Context, resolve func() (Identity, error)) (Identity, error) {
+	cache, ok := ctx.Value(identityCacheKey{}).(*identityCache)
+	if !ok {
+		return resolve()
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if !cache.resolved {
+		cache.identity, cache.err = resolve()
+		cache.resolved = true
+	}
+
+	return cache.identity, cache.err
+}
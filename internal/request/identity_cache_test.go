@@ -0,0 +1,72 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+// nolint:testpackage
+package request
+
+import (
+	"context"
+	h "net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// resolvingAuthenticator counts the resolutions of the wrapped authenticator.
+type resolvingAuthenticator struct {
+	fakeAuthenticator
+	resolved *int64
+}
+
+func (r resolvingAuthenticator) Resolve(request *h.Request) (string, []string, error) {
+	atomic.AddInt64(r.resolved, 1)
+
+	return r.fakeAuthenticator.Resolve(request)
+}
+
+func TestGetIdentityCached(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		ctx          context.Context
+		wantResolved int64
+	}{
+		{"resolving once with the cache", WithIdentityCache(context.Background()), 1},
+		{"resolving each time without the cache", context.Background(), 2},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			var resolved int64
+
+			r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil).WithContext(eachTest.ctx)
+			r.Header.Set("X-Api-Key", "secret")
+
+			authenticators := []Authenticator{resolvingAuthenticator{fakeAuthenticator{header: "X-Api-Key", username: "alice"}, &resolved}}
+
+			for i := 0; i < 2; i++ {
+				// Each middleware and module builds its own request
+				identity, err := NewHTTPWithOptions(r, Options{Authenticators: authenticators}).GetIdentity()
+				if err != nil {
+					t.Fatalf("cannot get the identity: %v", err)
+				}
+
+				if identity.Username != "alice" {
+					t.Errorf("got username %s, want alice", identity.Username)
+				}
+			}
+
+			if resolved != eachTest.wantResolved {
+				t.Errorf("got %d resolutions, want %d", resolved, eachTest.wantResolved)
+			}
+
+			if identity, ok := IdentityFrom(r.Context()); ok != (eachTest.wantResolved == 1) || (ok && identity.Username != "alice") {
+				t.Errorf("got cached identity %v (%t)", identity, ok)
+			}
+		})
+	}
+}
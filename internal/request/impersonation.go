@@ -0,0 +1,37 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request
+
+import (
+	h "net/http"
+	"net/url"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+// ImpersonatedExtra returns the UID and the user extras requested with the Impersonate-Uid and Impersonate-Extra-*
+// headers: the extra keys are lowercased and percent-decoded, as the API server does.
+func ImpersonatedExtra(header h.Header) (uid string, extra map[string][]string) {
+	uid = header.Get(authenticationv1.ImpersonateUIDHeader)
+
+	for name, values := range header {
+		if !strings.HasPrefix(name, authenticationv1.ImpersonateUserExtraHeaderPrefix) || len(name) == len(authenticationv1.ImpersonateUserExtraHeaderPrefix) {
+			continue
+		}
+
+		key := strings.ToLower(name[len(authenticationv1.ImpersonateUserExtraHeaderPrefix):])
+		if unescaped, err := url.PathUnescape(key); err == nil {
+			key = unescaped
+		}
+
+		if extra == nil {
+			extra = map[string][]string{}
+		}
+
+		extra[key] = append(extra[key], values...)
+	}
+
+	return uid, extra
+}
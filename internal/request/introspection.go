@@ -0,0 +1,138 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	h "net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+type introspection struct {
+	log                 logr.Logger
+	url                 string
+	clientID            string
+	clientSecret        string
+	claimMapping        ClaimMapping
+	cache               *TTLCache
+	tokenQueryParameter string
+	timeout             time.Duration
+	client              *h.Client
+}
+
+// NewIntrospectionAuthenticator returns the Authenticator resolving the identity of the opaque access tokens with the
+// OAuth2 token introspection endpoint (RFC 7662), authenticated with the client credentials if a client ID is given:
+// the fields of the active tokens are mapped as the JWT claims, such as username and scope. The inactive tokens are
+// left to the next Authenticator, while the resolved identities are cached by the token hash up to the token exp,
+// if a cache is provided.
+func NewIntrospectionAuthenticator(url, clientID, clientSecret string, claimMapping ClaimMapping, cache *TTLCache, tokenQueryParameter string, timeout time.Duration) Authenticator {
+	return &introspection{
+		log:                 ctrl.Log.WithName("introspection"),
+		url:                 url,
+		clientID:            clientID,
+		clientSecret:        clientSecret,
+		claimMapping:        claimMapping,
+		cache:               cache,
+		tokenQueryParameter: tokenQueryParameter,
+		timeout:             timeout,
+		client:              &h.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (i introspection) AuthType() string {
+	return AuthTypeIntrospection
+}
+
+func (i introspection) Resolve(request *h.Request) (username string, groups []string, err error) {
+	token := RequestBearerToken(request, i.tokenQueryParameter)
+	if len(token) == 0 || IsJwtToken(token) {
+		return "", nil, ErrNoCredentials
+	}
+
+	if i.cache != nil {
+		if cached, ok := i.cache.Get(tokenHash(token)); ok {
+			if identity, ok := cached.(resolvedIdentity); ok {
+				return identity.username, identity.groups, nil
+			}
+		}
+	}
+
+	claims, err := i.introspect(request.Context(), token)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if username, groups, err = i.claimMapping.identity(claims, "introspection"); err != nil {
+		return "", nil, err
+	}
+
+	if i.cache != nil {
+		identity := resolvedIdentity{username: username, groups: groups}
+
+		if exp, ok := claims["exp"].(float64); ok {
+			i.cache.AddUntil(tokenHash(token), identity, time.Unix(int64(exp), 0))
+		} else {
+			i.cache.Add(tokenHash(token), identity)
+		}
+	}
+
+	return username, groups, nil
+}
+
+func (i introspection) introspect(ctx context.Context, token string) (map[string]interface{}, error) {
+	ctx, cancel := withTimeout(ctx, i.timeout)
+	defer cancel()
+
+	form := url.Values{"token": []string{token}, "token_type_hint": []string{"access_token"}}
+
+	r, err := h.NewRequestWithContext(ctx, h.MethodPost, i.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create introspection request: %w", err)
+	}
+
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Accept", "application/json")
+
+	if len(i.clientID) > 0 {
+		r.SetBasicAuth(url.QueryEscape(i.clientID), url.QueryEscape(i.clientSecret))
+	}
+
+	resp, err := i.client.Do(r)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, NewErrTimeout("the introspection request timed out")
+		}
+
+		return nil, fmt.Errorf("cannot query introspection: %w", err)
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != h.StatusOK {
+		return nil, fmt.Errorf("returned status code from introspection is %d, expected 200", resp.StatusCode)
+	}
+
+	claims := map[string]interface{}{}
+	if err = json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("cannot decode introspection: %w", err)
+	}
+
+	if active, _ := claims["active"].(bool); !active {
+		RequestLogger(ctx, i.log).V(4).Info("introspection reported the token as inactive")
+
+		return nil, ErrNoCredentials
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/clastix/capsule-proxy/internal/request"
+)
+
+func TestIntrospection(t *testing.T) {
+	t.Parallel()
+
+	var calls int64
+
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+
+		if id, secret, ok := r.BasicAuth(); !ok || id != "capsule-proxy" || secret != "s3cr3t" {
+			writer.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		if r.Method != http.MethodPost || r.PostFormValue("token") != "opaque-token" {
+			_ = json.NewEncoder(writer).Encode(map[string]interface{}{"active": false})
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(map[string]interface{}{
+			"active":   true,
+			"username": "alice",
+			"scope":    "openid capsule.clastix.io",
+			"exp":      time.Now().Add(time.Hour).Unix(),
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	mapping := request.ClaimMapping{UsernameFields: []string{"username"}, GroupsFields: []string{"scope"}, GroupsSeparator: " "}
+	authenticator := request.NewIntrospectionAuthenticator(srv.URL, "capsule-proxy", "s3cr3t", mapping, request.NewTTLCache(time.Minute), "", 0)
+
+	resolve := func(token string) (string, []string, error) {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+
+		return authenticator.Resolve(r)
+	}
+
+	for i := 0; i < 2; i++ {
+		username, groups, err := resolve("opaque-token")
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+
+		if username != "alice" || !reflect.DeepEqual(groups, []string{"openid", "capsule.clastix.io"}) {
+			t.Errorf("got %s and %v, want alice and [openid capsule.clastix.io]", username, groups)
+		}
+	}
+
+	if got := atomic.LoadInt64(&calls); got != 1 {
+		t.Errorf("got %d introspection requests, want 1 with the cached identity", got)
+	}
+
+	if _, _, err := resolve("revoked-token"); !errors.Is(err, request.ErrNoCredentials) {
+		t.Errorf("expected the inactive token to be left to the next authenticator, got %v", err)
+	}
+}
+
+func TestIntrospectionCacheExpiration(t *testing.T) {
+	t.Parallel()
+
+	var calls int64
+
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt64(&calls, 1)
+
+		_ = json.NewEncoder(writer).Encode(map[string]interface{}{
+			"active":   true,
+			"username": "alice",
+			// The token is expiring, thus not worth caching
+			"exp": time.Now().Unix(),
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	mapping := request.ClaimMapping{UsernameFields: []string{"username"}}
+	authenticator := request.NewIntrospectionAuthenticator(srv.URL, "", "", mapping, request.NewTTLCache(time.Hour), "", 0)
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+		r.Header.Set("Authorization", "Bearer opaque-token")
+
+		if _, _, err := authenticator.Resolve(r); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+	}
+
+	if got := atomic.LoadInt64(&calls); got != 2 {
+		t.Errorf("got %d introspection requests, want 2 since the identity expires with the token", got)
+	}
+}
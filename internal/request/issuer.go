@@ -0,0 +1,98 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/golang-jwt/jwt"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/yaml"
+)
+
+// IssuerClaimMapping is the ClaimMapping of the JWT issued by the given issuer, matched with the iss claim.
+type IssuerClaimMapping struct {
+	Issuer       string `json:"issuer"`
+	ClaimMapping `json:",inline"`
+}
+
+// ClaimMappings selects the ClaimMapping of the JWT according to its issuer, when federating more than one IdP:
+// the unlisted issuers are using the default ClaimMapping, unless StrictIssuers is set. When not empty, the
+// TrustedIssuers are the only ones accepted along with the listed ones, regardless of StrictIssuers.
+type ClaimMappings struct {
+	Default        ClaimMapping
+	Issuers        map[string]ClaimMapping
+	StrictIssuers  bool
+	TrustedIssuers sets.String
+}
+
+// LoadIssuerClaimMappings reads the YAML, or JSON, list of IssuerClaimMapping from the given file:
+// the username and groups claims are inherited from the default ClaimMapping when omitted.
+func LoadIssuerClaimMappings(path string, defaultMapping ClaimMapping) (map[string]ClaimMapping, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the issuers configuration: %w", err)
+	}
+
+	var list []IssuerClaimMapping
+
+	if err = yaml.UnmarshalStrict(b, &list); err != nil {
+		return nil, fmt.Errorf("cannot parse the issuers configuration: %w", err)
+	}
+
+	issuers := make(map[string]ClaimMapping, len(list))
+
+	for _, i := range list {
+		if len(i.Issuer) == 0 {
+			return nil, fmt.Errorf("missing issuer in the issuers configuration")
+		}
+
+		if _, ok := issuers[i.Issuer]; ok {
+			return nil, fmt.Errorf("duplicated issuer %s in the issuers configuration", i.Issuer)
+		}
+
+		if len(i.UsernameFields) == 0 {
+			i.UsernameFields = defaultMapping.UsernameFields
+		}
+
+		if len(i.GroupsFields) == 0 {
+			i.GroupsFields = defaultMapping.GroupsFields
+		}
+
+		issuers[i.Issuer] = i.ClaimMapping
+	}
+
+	return issuers, nil
+}
+
+func (c ClaimMappings) lookup(issuer string) (ClaimMapping, error) {
+	if mapping, ok := c.Issuers[issuer]; ok {
+		return mapping, nil
+	}
+
+	if c.StrictIssuers || (c.TrustedIssuers.Len() > 0 && !c.TrustedIssuers.Has(issuer)) {
+		return ClaimMapping{}, newErrInvalidClaim("iss", fmt.Sprintf("untrusted issuer %s", issuer))
+	}
+
+	return c.Default, nil
+}
+
+// ForToken returns the ClaimMapping of the given JWT: the token is parsed without verifying it, thus it must be
+// authenticated in advance.
+func (c ClaimMappings) ForToken(token string) (ClaimMapping, error) {
+	claims := jwt.MapClaims{}
+
+	parser := jwt.Parser{
+		SkipClaimsValidation: true,
+	}
+
+	if _, _, err := parser.ParseUnverified(token, claims); err != nil {
+		return ClaimMapping{}, fmt.Errorf("cannot parse the JWT: %w", err)
+	}
+
+	issuer, _ := claims["iss"].(string)
+
+	return c.lookup(issuer)
+}
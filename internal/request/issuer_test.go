@@ -0,0 +1,178 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+// nolint:testpackage
+package request
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestLoadIssuerClaimMappings(t *testing.T) {
+	t.Parallel()
+
+	defaultMapping := ClaimMapping{UsernameFields: []string{"preferred_username"}, GroupsFields: []string{"groups"}}
+
+	tests := []struct {
+		name   string
+		config string
+		want   map[string]ClaimMapping
+		err    bool
+	}{
+		{
+			"inherited claims",
+			"- issuer: https://keycloak.example.com\n  groupsPrefix: \"keycloak:\"\n- issuer: https://dex.example.com\n  usernameClaims: [email]\n  groupsClaims: [roles]\n",
+			map[string]ClaimMapping{
+				"https://keycloak.example.com": {UsernameFields: []string{"preferred_username"}, GroupsFields: []string{"groups"}, GroupsPrefix: "keycloak:"},
+				"https://dex.example.com":      {UsernameFields: []string{"email"}, GroupsFields: []string{"roles"}},
+			},
+			false,
+		},
+		{"missing issuer", "- usernameClaims: [email]\n", nil, true},
+		{"duplicated issuer", "- issuer: https://dex.example.com\n- issuer: https://dex.example.com\n", nil, true},
+		{"unknown field", "- issuer: https://dex.example.com\n  usernameClaim: email\n", nil, true},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "issuers.yaml")
+			if err := os.WriteFile(path, []byte(eachTest.config), 0o600); err != nil {
+				t.Fatalf("cannot write the configuration: %v", err)
+			}
+
+			issuers, err := LoadIssuerClaimMappings(path, defaultMapping)
+			if eachTest.err {
+				if err == nil {
+					t.Errorf("expected error, got %v", issuers)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if !reflect.DeepEqual(issuers, eachTest.want) {
+				t.Errorf("got issuers %v, want %v", issuers, eachTest.want)
+			}
+		})
+	}
+}
+
+func TestProcessJwtClaimsIssuers(t *testing.T) {
+	t.Parallel()
+
+	issuers := map[string]ClaimMapping{
+		"https://dex.example.com": {UsernameFields: []string{"email"}, GroupsFields: []string{"roles"}, UsernamePrefix: "dex:"},
+	}
+
+	tests := []struct {
+		name     string
+		strict   bool
+		claims   jwt.MapClaims
+		username string
+		groups   []string
+		err      bool
+	}{
+		{"listed issuer", false, jwt.MapClaims{"iss": "https://dex.example.com", "email": "alice@example.com", "roles": []string{"dev"}}, "dex:alice@example.com", []string{"dev"}, false},
+		{"unlisted issuer", false, jwt.MapClaims{"iss": "https://other.example.com", "preferred_username": "alice", "groups": []string{"ops"}}, "alice", []string{"ops"}, false},
+		{"strict unlisted issuer", true, jwt.MapClaims{"iss": "https://other.example.com", "preferred_username": "alice"}, "", nil, true},
+		{"strict listed issuer", true, jwt.MapClaims{"iss": "https://dex.example.com", "email": "alice@example.com"}, "dex:alice@example.com", []string{}, false},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			j := newTestJWT()
+			j.claimMappings.Issuers = issuers
+			j.claimMappings.StrictIssuers = eachTest.strict
+
+			username, groups, err := j.processJwtClaims(context.Background(), newTestToken(t, eachTest.claims))
+			if eachTest.err {
+				var unauthorized *ErrUnauthorized
+				if !errors.As(err, &unauthorized) {
+					t.Errorf("expected unauthorized error, got %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if username != eachTest.username || !reflect.DeepEqual(groups, eachTest.groups) {
+				t.Errorf("got %s and %v, want %s and %v", username, groups, eachTest.username, eachTest.groups)
+			}
+		})
+	}
+}
+
+func TestProcessJwtClaimsTrustedIssuers(t *testing.T) {
+	t.Parallel()
+
+	issuers := map[string]ClaimMapping{
+		"https://dex.example.com": {UsernameFields: []string{"email"}, GroupsFields: []string{"roles"}, UsernamePrefix: "dex:"},
+	}
+
+	tests := []struct {
+		name     string
+		claims   jwt.MapClaims
+		username string
+		err      bool
+	}{
+		{"trusted issuer", jwt.MapClaims{"iss": "https://keycloak.example.com", "preferred_username": "alice", "groups": []string{"ops"}}, "alice", false},
+		{"configured issuer", jwt.MapClaims{"iss": "https://dex.example.com", "email": "alice@example.com", "roles": []string{"dev"}}, "dex:alice@example.com", false},
+		{"untrusted issuer", jwt.MapClaims{"iss": "https://evil.example.com", "preferred_username": "alice", "groups": []string{"ops"}}, "", true},
+		{"missing issuer", jwt.MapClaims{"preferred_username": "alice", "groups": []string{"ops"}}, "", true},
+		{"service account", jwt.MapClaims{"iss": "kubernetes/serviceaccount", "kubernetes.io/serviceaccount/namespace": "default", "kubernetes.io/serviceaccount/service-account.name": "builder"}, "system:serviceaccount:default:builder", false},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			j := newTestJWT()
+			j.claimMappings.Issuers = issuers
+			j.claimMappings.TrustedIssuers = sets.NewString("https://keycloak.example.com")
+
+			username, _, err := j.processJwtClaims(context.Background(), newTestToken(t, eachTest.claims))
+			if eachTest.err {
+				var invalid *ErrInvalidClaim
+				if !errors.As(err, &invalid) || invalid.Claim() != "iss" {
+					t.Fatalf("got error %v, want the iss claim to be invalid", err)
+				}
+
+				var unauthorized *ErrUnauthorized
+				if !errors.As(err, &unauthorized) {
+					t.Errorf("expected unauthorized error, got %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if username != eachTest.username {
+				t.Errorf("got %s, want %s", username, eachTest.username)
+			}
+		})
+	}
+}
@@ -0,0 +1,366 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	h "net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/golang-jwt/jwt"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// jwksMinRefreshInterval rate limits the refreshes, such as the on-demand ones triggered by the unknown key IDs.
+const jwksMinRefreshInterval = 10 * time.Second
+
+// KeySet retrieves and caches the JSON Web Key Set used to verify the JWT signatures: keys are refreshed
+// periodically, honoring the Cache-Control max-age and the ETag of the provider, and on demand when a token refers
+// to an unknown key ID.
+type KeySet struct {
+	url             func() string
+	issuer          func() string
+	refreshInterval time.Duration
+	client          *h.Client
+	log             logr.Logger
+
+	mu   sync.RWMutex
+	keys map[string]interface{}
+
+	refreshMu   sync.Mutex
+	inflight    *jwksRefresh
+	lastRefresh time.Time
+	etag        string
+	maxAge      time.Duration
+}
+
+// jwksRefresh is the JWKS refresh in progress, the concurrent ones waiting for it to be done.
+type jwksRefresh struct {
+	done chan struct{}
+	err  error
+}
+
+// jwksResponse is the retrieved JWKS, the keys being nil when not modified since the last retrieval.
+type jwksResponse struct {
+	keys   map[string]interface{}
+	etag   string
+	maxAge time.Duration
+}
+
+func NewKeySet(url string, refreshInterval time.Duration) *KeySet {
+	return &KeySet{
+		url: func() string {
+			return url
+		},
+		issuer: func() string {
+			return ""
+		},
+		refreshInterval: refreshInterval,
+		client:          &h.Client{Timeout: 10 * time.Second},
+		log:             ctrl.Log.WithName("jwks"),
+		keys:            map[string]interface{}{},
+	}
+}
+
+// NewDiscoveryKeySet returns the KeySet retrieved from the JWKS URL of the OIDC discovery document:
+// the verified tokens must be issued by the discovered issuer.
+func NewDiscoveryKeySet(discovery *Discovery, refreshInterval time.Duration) *KeySet {
+	keySet := NewKeySet("", refreshInterval)
+	keySet.url = discovery.JWKSURL
+	keySet.issuer = discovery.Issuer
+
+	return keySet
+}
+
+// Issuer returns the issuer the verified tokens must be issued by, empty when any is accepted.
+func (k *KeySet) Issuer() string {
+	return k.issuer()
+}
+
+func (k *KeySet) Start(ctx context.Context) error {
+	for {
+		if err := k.refresh(ctx, false); err != nil {
+			k.log.Error(err, "cannot refresh JWKS", "url", k.url())
+		}
+
+		timer := time.NewTimer(k.nextRefresh())
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// nextRefresh returns the time until the next periodic refresh: the max-age of the JWKS response, when provided,
+// or the configured refresh interval.
+func (k *KeySet) nextRefresh() time.Duration {
+	k.refreshMu.Lock()
+	defer k.refreshMu.Unlock()
+
+	interval := k.refreshInterval
+	if k.maxAge > 0 {
+		interval = k.maxAge
+	}
+
+	if interval < jwksMinRefreshInterval {
+		interval = jwksMinRefreshInterval
+	}
+
+	return interval
+}
+
+// Keyfunc returns the jwt.Keyfunc looking up the public key matching the token key ID, refreshing the JWKS with the
+// given request context when the key ID is not known yet.
+func (k *KeySet) Keyfunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method %s", token.Header["alg"])
+		}
+
+		kid, _ := token.Header["kid"].(string)
+
+		if key, ok := k.lookup(kid); ok {
+			return key, nil
+		}
+		// The key ID is not known yet: the provider could have rotated its keys
+		if err := k.refresh(ctx, true); err != nil {
+			return nil, fmt.Errorf("cannot refresh JWKS: %w", err)
+		}
+
+		if key, ok := k.lookup(kid); ok {
+			return key, nil
+		}
+
+		return nil, fmt.Errorf("no JWKS key found for kid %q", kid)
+	}
+}
+
+func (k *KeySet) lookup(kid string) (interface{}, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	// Tokens without a key ID can be verified only when the set is made of a single key
+	if len(kid) == 0 && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+
+	key, ok := k.keys[kid]
+
+	return key, ok
+}
+
+// refresh retrieves the JWKS, unless unchanged since the last retrieval: the on-demand refreshes are skipped when
+// the last one happened less than jwksMinRefreshInterval ago. The JWKS is fetched without holding refreshMu, the
+// concurrent refreshes waiting for the one in progress, bound to their own context, and the new keys being published
+// only once retrieved.
+func (k *KeySet) refresh(ctx context.Context, onDemand bool) error {
+	k.refreshMu.Lock()
+
+	if inflight := k.inflight; inflight != nil {
+		k.refreshMu.Unlock()
+
+		select {
+		case <-inflight.done:
+			return inflight.err
+		case <-ctx.Done():
+			return fmt.Errorf("cannot wait for the JWKS refresh: %w", ctx.Err())
+		}
+	}
+
+	if onDemand && !k.lastRefresh.IsZero() && time.Since(k.lastRefresh) < jwksMinRefreshInterval {
+		k.refreshMu.Unlock()
+
+		k.log.V(4).Info("skipping the on-demand JWKS refresh, rate limited")
+
+		return nil
+	}
+
+	inflight := &jwksRefresh{done: make(chan struct{})}
+	k.inflight, k.lastRefresh = inflight, time.Now()
+	etag := k.etag
+
+	k.refreshMu.Unlock()
+
+	resp, err := k.fetch(ctx, etag)
+
+	k.refreshMu.Lock()
+
+	if err == nil {
+		k.maxAge = resp.maxAge
+
+		if resp.keys != nil {
+			k.mu.Lock()
+			k.keys = resp.keys
+			k.mu.Unlock()
+
+			k.etag = resp.etag
+		}
+	}
+
+	inflight.err, k.inflight = err, nil
+	close(inflight.done)
+
+	k.refreshMu.Unlock()
+
+	return err
+}
+
+// fetch retrieves the JWKS, conditionally to the given ETag when provided.
+func (k *KeySet) fetch(ctx context.Context, etag string) (*jwksResponse, error) {
+	r, err := h.NewRequestWithContext(ctx, h.MethodGet, k.url(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create JWKS request: %w", err)
+	}
+
+	if len(etag) > 0 {
+		r.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := k.client.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch JWKS: %w", err)
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	switch resp.StatusCode {
+	case h.StatusOK:
+	case h.StatusNotModified:
+		k.log.V(4).Info("JWKS not modified")
+
+		return &jwksResponse{maxAge: cacheMaxAge(resp.Header)}, nil
+	default:
+		return nil, fmt.Errorf("returned status code from JWKS is %d, expected 200", resp.StatusCode)
+	}
+
+	set := jsonWebKeySet{}
+	if err = json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("cannot decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+
+	for _, jwk := range set.Keys {
+		if len(jwk.Use) > 0 && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			k.log.V(4).Info("skipping JWKS key", "kid", jwk.Kid, "error", err.Error())
+
+			continue
+		}
+
+		keys[jwk.Kid] = key
+	}
+
+	k.log.V(4).Info("JWKS refreshed", "keys", len(keys))
+
+	return &jwksResponse{keys: keys, etag: resp.Header.Get("ETag"), maxAge: cacheMaxAge(resp.Header)}, nil
+}
+
+// cacheMaxAge returns the max-age directive of the Cache-Control header, zero when missing.
+func cacheMaxAge(header h.Header) time.Duration {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		value := strings.TrimPrefix(strings.TrimSpace(directive), "max-age=")
+		if value == strings.TrimSpace(directive) {
+			continue
+		}
+
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	return 0
+}
+
+func (j jsonWebKey) publicKey() (interface{}, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeBigInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", j.Crv)
+		}
+
+		x, err := decodeBigInt(j.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeBigInt(j.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", j.Kty)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode key component: %w", err)
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
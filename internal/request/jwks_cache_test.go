@@ -0,0 +1,206 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+// nolint:testpackage
+package request
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	h "net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// newCachingJWKSServer returns the JWKS server replying with 304 when the If-None-Match header matches its ETag,
+// counting the full and the not modified responses.
+func newCachingJWKSServer(t *testing.T, full, notModified *int64) *httptest.Server {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	srv := httptest.NewServer(h.HandlerFunc(func(writer h.ResponseWriter, r *h.Request) {
+		writer.Header().Set("Cache-Control", "public, max-age=600")
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt64(notModified, 1)
+			writer.WriteHeader(h.StatusNotModified)
+
+			return
+		}
+
+		atomic.AddInt64(full, 1)
+		writer.Header().Set("ETag", `"v1"`)
+
+		_ = json.NewEncoder(writer).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": "trusted",
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+			}},
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestKeySetNotModified(t *testing.T) {
+	t.Parallel()
+
+	var full, notModified int64
+
+	keySet := NewKeySet(newCachingJWKSServer(t, &full, &notModified).URL, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if err := keySet.refresh(context.Background(), false); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+	}
+
+	if full != 1 || notModified != 2 {
+		t.Errorf("got %d full and %d not modified responses, want 1 and 2", full, notModified)
+	}
+
+	if _, ok := keySet.lookup("trusted"); !ok {
+		t.Error("expected the keys to be kept when not modified")
+	}
+
+	if got := keySet.nextRefresh(); got != 10*time.Minute {
+		t.Errorf("got next refresh in %s, want the 10m max-age", got)
+	}
+}
+
+func TestKeySetOnDemandRefreshRateLimited(t *testing.T) {
+	t.Parallel()
+
+	var full, notModified int64
+
+	keySet := NewKeySet(newCachingJWKSServer(t, &full, &notModified).URL, time.Hour)
+
+	token := jwt.New(jwt.SigningMethodRS256)
+	token.Header["kid"] = "rotated"
+
+	for i := 0; i < 5; i++ {
+		if _, err := keySet.Keyfunc(context.Background())(token); err == nil {
+			t.Fatal("expected the unknown kid to be rejected")
+		}
+	}
+
+	if requests := full + notModified; requests != 1 {
+		t.Errorf("got %d JWKS requests, want 1 with the on-demand refreshes rate limited", requests)
+	}
+}
+
+func TestKeySetOnDemandRefreshContext(t *testing.T) {
+	t.Parallel()
+
+	var full, notModified int64
+
+	keySet := NewKeySet(newCachingJWKSServer(t, &full, &notModified).URL, time.Hour)
+
+	token := jwt.New(jwt.SigningMethodRS256)
+	token.Header["kid"] = "trusted"
+	// The refresh is bound to the request context, ended by the client going away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := keySet.Keyfunc(ctx)(token); err == nil {
+		t.Fatal("expected the refresh to fail with the canceled context")
+	}
+
+	if requests := full + notModified; requests != 0 {
+		t.Errorf("got %d JWKS requests, want none with the canceled context", requests)
+	}
+}
+
+func TestKeySetOnDemandRefreshConcurrent(t *testing.T) {
+	t.Parallel()
+
+	var full, notModified int64
+
+	srv := newCachingJWKSServer(t, &full, &notModified)
+	// The identity provider replies only once released, the first refresh being in progress meanwhile
+	release, fetching := make(chan struct{}), make(chan struct{})
+	next := srv.Config.Handler
+
+	srv.Config.Handler = h.HandlerFunc(func(writer h.ResponseWriter, r *h.Request) {
+		close(fetching)
+		<-release
+		next.ServeHTTP(writer, r)
+	})
+
+	keySet := NewKeySet(srv.URL, time.Hour)
+
+	token := jwt.New(jwt.SigningMethodRS256)
+	token.Header["kid"] = "trusted"
+
+	verified := make(chan error, 1)
+
+	go func() {
+		_, err := keySet.Keyfunc(context.Background())(token)
+		verified <- err
+	}()
+
+	<-fetching
+	// The refresh lock is not held during the fetch
+	if got := keySet.nextRefresh(); got != time.Hour {
+		t.Errorf("got next refresh in %s, want the 1h refresh interval", got)
+	}
+	// The concurrent refreshes wait for the one in progress, bound to their own context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := keySet.Keyfunc(ctx)(token); err == nil {
+		t.Error("expected the concurrent refresh to fail with the expired context")
+	}
+
+	waiting := make(chan error, 1)
+
+	go func() {
+		_, err := keySet.Keyfunc(context.Background())(token)
+		waiting <- err
+	}()
+
+	close(release)
+
+	for _, ch := range []chan error{verified, waiting} {
+		if err := <-ch; err != nil {
+			t.Errorf("cannot verify token: %v", err)
+		}
+	}
+
+	if requests := full + notModified; requests != 1 {
+		t.Errorf("got %d JWKS requests, want 1 shared by the concurrent refreshes", requests)
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]time.Duration{
+		"max-age=300":                         5 * time.Minute,
+		"public, max-age=60, must-revalidate": time.Minute,
+		"no-cache":                            0,
+		"max-age=invalid":                     0,
+		"":                                    0,
+	}
+
+	for cacheControl, want := range tests {
+		if got := cacheMaxAge(h.Header{"Cache-Control": []string{cacheControl}}); got != want {
+			t.Errorf("got %s for %q, want %s", got, cacheControl, want)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	"github.com/clastix/capsule-proxy/internal/request"
+)
+
+func newJWKSServer(t *testing.T, kid string, key *rsa.PublicKey) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(writer).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": kid,
+				"kty": "RSA",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func signToken(t *testing.T, kid string, key *rsa.PrivateKey, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("cannot sign token: %v", err)
+	}
+
+	return signed
+}
+
+func TestKeySet(t *testing.T) {
+	t.Parallel()
+
+	trusted, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	untrusted, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	srv := newJWKSServer(t, "trusted", &trusted.PublicKey)
+
+	keySet := request.NewKeySet(srv.URL, time.Hour)
+
+	claimMappings := request.ClaimMappings{Default: request.ClaimMapping{UsernameFields: []string{"preferred_username"}, GroupsFields: []string{"groups"}}}
+
+	claims := func(exp time.Duration) jwt.MapClaims {
+		return jwt.MapClaims{
+			"preferred_username": "alice",
+			"groups":             []string{"capsule.clastix.io"},
+			"exp":                time.Now().Add(exp).Unix(),
+		}
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   bool
+	}{
+		{"pass signed by trusted key", signToken(t, "trusted", trusted, claims(time.Hour)), false},
+		{"fail signed by untrusted key", signToken(t, "trusted", untrusted, claims(time.Hour)), true},
+		{"fail unknown kid", signToken(t, "rotated", untrusted, claims(time.Hour)), true},
+		{"fail expired", signToken(t, "trusted", trusted, claims(-time.Hour)), true},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+			r.Header.Set("Authorization", "Bearer "+eachTest.token)
+
+			username, _, err := request.NewHTTPWithOptions(r, request.Options{Authenticators: []request.Authenticator{request.NewJWTAuthenticator(request.JWTOptions{ClaimMappings: claimMappings, KeySet: keySet})}}).GetUserAndGroups()
+			if eachTest.err {
+				var unauthorized *request.ErrUnauthorized
+				if !errors.As(err, &unauthorized) {
+					t.Errorf("expected unauthorized error, got %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Errorf("got error: %v", err)
+			}
+
+			if username != "alice" {
+				t.Errorf("got username %s, want alice", username)
+			}
+		})
+	}
+}
+
+func TestKeySetClockSkew(t *testing.T) {
+	t.Parallel()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	srv := newJWKSServer(t, "trusted", &key.PublicKey)
+
+	keySet := request.NewKeySet(srv.URL, time.Hour)
+
+	claimMappings := request.ClaimMappings{Default: request.ClaimMapping{UsernameFields: []string{"preferred_username"}, GroupsFields: []string{"groups"}}}
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		err    bool
+	}{
+		{"pass expired within skew", jwt.MapClaims{"preferred_username": "alice", "exp": time.Now().Add(-30 * time.Second).Unix()}, false},
+		{"fail expired beyond skew", jwt.MapClaims{"preferred_username": "alice", "exp": time.Now().Add(-2 * time.Minute).Unix()}, true},
+		{"pass not valid yet within skew", jwt.MapClaims{"preferred_username": "alice", "nbf": time.Now().Add(30 * time.Second).Unix()}, false},
+		{"fail not valid yet beyond skew", jwt.MapClaims{"preferred_username": "alice", "nbf": time.Now().Add(2 * time.Minute).Unix()}, true},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+			r.Header.Set("Authorization", "Bearer "+signToken(t, "trusted", key, eachTest.claims))
+
+			_, _, err := request.NewHTTPWithOptions(r, request.Options{Authenticators: []request.Authenticator{request.NewJWTAuthenticator(request.JWTOptions{ClaimMappings: claimMappings, KeySet: keySet, ClockSkew: time.Minute})}}).GetUserAndGroups()
+			if eachTest.err {
+				var unauthorized *request.ErrUnauthorized
+				if !errors.As(err, &unauthorized) {
+					t.Errorf("expected unauthorized error, got %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Errorf("got error: %v", err)
+			}
+		})
+	}
+}
+
+func TestKeySetServiceAccountLeeway(t *testing.T) {
+	t.Parallel()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	srv := newJWKSServer(t, "trusted", &key.PublicKey)
+
+	keySet := request.NewKeySet(srv.URL, time.Hour)
+
+	claimMappings := request.ClaimMappings{Default: request.ClaimMapping{UsernameFields: []string{"preferred_username"}}}
+	// The proxy clock lagging a few seconds behind the API server one, that just minted the token
+	issuedAhead := time.Now().Add(3 * time.Second).Unix()
+
+	serviceAccount := jwt.MapClaims{
+		"iss": "https://kubernetes.default.svc.cluster.local",
+		"sub": "system:serviceaccount:oil-production:robot",
+		"iat": issuedAhead,
+		"nbf": issuedAhead,
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"kubernetes.io": map[string]interface{}{
+			"namespace":      "oil-production",
+			"serviceaccount": map[string]interface{}{"name": "robot"},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		claims   jwt.MapClaims
+		saLeeway time.Duration
+		err      bool
+	}{
+		{"pass service account issued ahead within leeway", serviceAccount, 5 * time.Second, false},
+		{"fail service account issued ahead without leeway", serviceAccount, 0, true},
+		{"fail service account issued ahead beyond leeway", serviceAccount, time.Second, true},
+		{"fail user not valid yet despite leeway", jwt.MapClaims{"preferred_username": "alice", "nbf": issuedAhead}, 5 * time.Second, true},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+			r.Header.Set("Authorization", "Bearer "+signToken(t, "trusted", key, eachTest.claims))
+
+			_, _, err := request.NewHTTPWithOptions(r, request.Options{Authenticators: []request.Authenticator{request.NewJWTAuthenticator(request.JWTOptions{ClaimMappings: claimMappings, KeySet: keySet, ServiceAccountLeeway: eachTest.saLeeway, ServiceAccountIssuers: []string{request.DefaultServiceAccountIssuer}})}}).GetUserAndGroups()
+			if eachTest.err {
+				var unauthorized *request.ErrUnauthorized
+				if !errors.As(err, &unauthorized) {
+					t.Errorf("expected unauthorized error, got %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Errorf("got error: %v", err)
+			}
+		})
+	}
+}
+
+// countingAuthenticator counts the requests it resolves, failing them when err is set.
+type countingAuthenticator struct {
+	resolved *int64
+	err      error
+}
+
+func (c countingAuthenticator) AuthType() string {
+	return request.AuthTypeBearer
+}
+
+func (c countingAuthenticator) Resolve(*http.Request) (string, []string, error) {
+	atomic.AddInt64(c.resolved, 1)
+
+	return "", nil, c.err
+}
+
+func TestKeySetServiceAccountTokens(t *testing.T) {
+	t.Parallel()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	keySet := request.NewKeySet(newJWKSServer(t, "trusted", &key.PublicKey).URL, time.Hour)
+
+	claimMappings := request.ClaimMappings{Default: request.ClaimMapping{UsernameFields: []string{"preferred_username"}}}
+	// The service account tokens are signed by the API server, with a key out of the OIDC provider JWKS
+	apiServerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		token     string
+		reviewErr error
+		want      string
+		reviews   int64
+	}{
+		{
+			"OIDC verified with the JWKS",
+			signToken(t, "trusted", key, jwt.MapClaims{"preferred_username": "alice"}),
+			nil, "alice", 0,
+		},
+		{
+			"legacy service account verified with the TokenReview",
+			signToken(t, "api-server", apiServerKey, jwt.MapClaims{
+				"iss":                                    "kubernetes/serviceaccount",
+				"kubernetes.io/serviceaccount/namespace": "default",
+				"kubernetes.io/serviceaccount/service-account.name": "builder",
+			}),
+			nil, "system:serviceaccount:default:builder", 1,
+		},
+		{
+			"projected service account verified with the TokenReview",
+			signToken(t, "api-server", apiServerKey, jwt.MapClaims{
+				"iss":           "https://kubernetes.default.svc.cluster.local",
+				"kubernetes.io": map[string]interface{}{"namespace": "default", "serviceaccount": map[string]interface{}{"name": "builder"}},
+			}),
+			nil, "system:serviceaccount:default:builder", 1,
+		},
+		{
+			"projected service account rejected by the TokenReview",
+			signToken(t, "api-server", apiServerKey, jwt.MapClaims{
+				"iss":           "https://kubernetes.default.svc.cluster.local",
+				"kubernetes.io": map[string]interface{}{"namespace": "default", "serviceaccount": map[string]interface{}{"name": "builder"}},
+			}),
+			request.NewErrUnauthorized("the token is not authenticated"), "", 1,
+		},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			var reviews int64
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+			r.Header.Set("Authorization", "Bearer "+eachTest.token)
+
+			authenticator := request.NewJWTAuthenticator(request.JWTOptions{
+				ClaimMappings:         claimMappings,
+				KeySet:                keySet,
+				ServiceAccountIssuers: []string{request.DefaultServiceAccountIssuer},
+				TokenReview:           countingAuthenticator{resolved: &reviews, err: eachTest.reviewErr},
+			})
+
+			username, _, err := authenticator.Resolve(r)
+			if eachTest.reviewErr != nil {
+				if !errors.Is(err, eachTest.reviewErr) {
+					t.Errorf("got error %v, want the TokenReview one", err)
+				}
+			} else if err != nil || username != eachTest.want {
+				t.Errorf("got username %q with error %v, want %s", username, err, eachTest.want)
+			}
+
+			if reviews != eachTest.reviews {
+				t.Errorf("got %d TokenReview requests, want %d", reviews, eachTest.reviews)
+			}
+		})
+	}
+}
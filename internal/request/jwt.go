@@ -0,0 +1,404 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	h "net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	corev1 "k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/serviceaccount"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/clastix/capsule-proxy/internal/tracing"
+)
+
+const (
+	// DefaultServiceAccountIssuer is the issuer of the projected service account tokens of the kubeadm clusters.
+	DefaultServiceAccountIssuer = "https://kubernetes.default.svc.cluster.local"
+	// legacyServiceAccountIssuer is the issuer of the service account tokens stored in the Secrets.
+	legacyServiceAccountIssuer = "kubernetes/serviceaccount"
+)
+
+type jwtAuthenticator struct {
+	claimMappings       ClaimMappings
+	keySet              *KeySet
+	requiredAudiences   []string
+	clockSkew           time.Duration
+	saLeeway            time.Duration
+	tokenQueryParameter string
+	namespaceLabels     []string
+	saIssuers           sets.String
+	tokenReview         Authenticator
+	client              client.Client
+}
+
+// JWTOptions configures the JWT Authenticator: when a KeySet is provided, the JWT signature is verified before
+// trusting its claims, otherwise the token is verified by the TokenReview Authenticator, if any.
+type JWTOptions struct {
+	ClaimMappings ClaimMappings
+	KeySet        *KeySet
+	// RequiredAudiences are the audiences the aud claim must contain one of, not checked when empty.
+	RequiredAudiences []string
+	// ClockSkew is tolerated validating the exp and nbf claims of the verified tokens.
+	ClockSkew time.Duration
+	// ServiceAccountLeeway further tolerates the service account tokens to be issued in the future, as the freshly
+	// minted ones could be.
+	ServiceAccountLeeway time.Duration
+	TokenQueryParameter  string
+	// NamespaceLabels are the labels of the service accounts Namespace added as <label>:<value> groups, retrieved
+	// with the Client.
+	NamespaceLabels []string
+	// ServiceAccountIssuers are the issuers of the projected service account tokens, as the API server
+	// --service-account-issuer: the JWT of the other issuers are never mapped to a service account.
+	ServiceAccountIssuers []string
+	// TokenReview verifies the tokens not verified with the KeySet, sharing the cache and the circuit breaker of the
+	// TokenReview Authenticator: when nil, the claims are trusted unverified.
+	TokenReview Authenticator
+	Client      client.Client
+}
+
+// NewJWTAuthenticator returns the Authenticator resolving the identity from the JWT bearer tokens claims, see
+// JWTOptions for the meaning of the options.
+func NewJWTAuthenticator(opts JWTOptions) Authenticator {
+	return &jwtAuthenticator{
+		claimMappings:       opts.ClaimMappings,
+		keySet:              opts.KeySet,
+		requiredAudiences:   opts.RequiredAudiences,
+		clockSkew:           opts.ClockSkew,
+		saLeeway:            opts.ServiceAccountLeeway,
+		tokenQueryParameter: opts.TokenQueryParameter,
+		namespaceLabels:     opts.NamespaceLabels,
+		saIssuers:           sets.NewString(opts.ServiceAccountIssuers...),
+		tokenReview:         opts.TokenReview,
+		client:              opts.Client,
+	}
+}
+
+func (j jwtAuthenticator) AuthType() string {
+	return AuthTypeJWT
+}
+
+func (j jwtAuthenticator) Resolve(request *h.Request) (username string, groups []string, err error) {
+	token := RequestBearerToken(request, j.tokenQueryParameter)
+	if len(token) == 0 || !IsJwtToken(token) {
+		return "", nil, ErrNoCredentials
+	}
+
+	ctx, span := tracing.Start(request.Context(), "JWT")
+	username, groups, err = j.processJwtClaims(ctx, token)
+	tracing.End(span, err)
+
+	if err != nil {
+		return "", nil, err
+	}
+	// The claims are parsed first, sparing the API server the malformed tokens
+	if !j.verifiedLocally(token) && j.tokenReview != nil {
+		if _, _, err = j.tokenReview.Resolve(request); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if namespace, _, saErr := serviceaccount.SplitUsername(username); saErr == nil && len(j.namespaceLabels) > 0 {
+		var labelGroups []string
+
+		if labelGroups, err = j.namespaceLabelGroups(request.Context(), namespace); err != nil {
+			return "", nil, err
+		}
+
+		groups = append(groups, labelGroups...)
+	}
+
+	return username, groups, nil
+}
+
+// namespaceLabelGroups returns the groups of the configured labels of the service account Namespace: the client
+// is expected to read from the manager cache, sparing an API server request for each one.
+func (j jwtAuthenticator) namespaceLabelGroups(ctx context.Context, name string) ([]string, error) {
+	ns := &corev1.Namespace{}
+
+	if err := j.client.Get(ctx, types.NamespacedName{Name: name}, ns); err != nil {
+		if apierr.IsNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("cannot retrieve the service account Namespace: %w", err)
+	}
+
+	var groups []string
+
+	for _, label := range j.namespaceLabels {
+		if value, ok := ns.GetLabels()[label]; ok {
+			groups = append(groups, fmt.Sprintf("%s:%s", label, value))
+		}
+	}
+
+	return groups, nil
+}
+
+func (j jwtAuthenticator) processJwtClaims(ctx context.Context, token string) (username string, groups []string, err error) {
+	claims, err := j.getJwtClaims(ctx, token)
+	if err != nil {
+		return "", nil, err
+	}
+
+	projectedNamespace, projectedName, projected := projectedServiceAccount(claims, j.saIssuers)
+	serviceAccount := projected || claims["iss"] == legacyServiceAccountIssuer
+	// Without local verification the API server is in charge of rejecting the expired tokens
+	if j.keySet != nil {
+		if err = j.validateTimes(claims, serviceAccount); err != nil {
+			return "", nil, err
+		}
+	}
+
+	// The legacy service account tokens carry no audience, being accepted by the API server regardless
+	if claims["iss"] != legacyServiceAccountIssuer {
+		if err = j.validateAudience(claims); err != nil {
+			return "", nil, err
+		}
+	}
+
+	// The nested kubernetes.io claims take precedence over the legacy flat ones
+	if projected {
+		if username, err = serviceAccountUsername(projectedNamespace, projectedName); err != nil {
+			return "", nil, err
+		}
+
+		return username, serviceaccount.MakeGroupNames(projectedNamespace), nil
+	}
+
+	if claims["iss"] == legacyServiceAccountIssuer {
+		namespace, ok := claims["kubernetes.io/serviceaccount/namespace"].(string)
+		if !ok {
+			return "", nil, newErrInvalidClaim("kubernetes.io/serviceaccount/namespace", "service account namespace claim is not a string")
+		}
+
+		username, err = legacyServiceAccountUsername(claims, namespace)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return username, serviceaccount.MakeGroupNames(namespace), nil
+	}
+
+	issuer, _ := claims["iss"].(string)
+
+	mapping, err := j.claimMappings.lookup(issuer)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return mapping.identity(claims, "JWT")
+}
+
+// getJwtClaims returns the JWT claims: when a KeySet is configured the token signature is verified
+// against the JWKS, while the exp and nbf claims are validated by validateTimes.
+// The unsigned tokens, declaring the none alg, are always rejected, regardless of the verification.
+func (j jwtAuthenticator) getJwtClaims(ctx context.Context, token string) (jwt.MapClaims, error) {
+	if isUnsignedToken(token) {
+		return nil, NewErrUnauthorized("the unsigned JWT with the none alg is not accepted")
+	}
+
+	claims := jwt.MapClaims{}
+
+	if j.verifiedLocally(token) {
+		parser := jwt.Parser{
+			SkipClaimsValidation: true,
+		}
+
+		if _, err := parser.ParseWithClaims(token, claims, j.keySet.Keyfunc(ctx)); err != nil {
+			return nil, newErrMalformedToken(fmt.Errorf("cannot verify the JWT: %w", err))
+		}
+
+		if issuer := j.keySet.Issuer(); len(issuer) > 0 && claims["iss"] != issuer {
+			return nil, newErrInvalidClaim("iss", fmt.Sprintf("the JWT is not issued by %s", issuer))
+		}
+
+		return claims, nil
+	}
+
+	parser := jwt.Parser{
+		SkipClaimsValidation: true,
+	}
+
+	if _, _, err := parser.ParseUnverified(token, claims); err != nil {
+		return nil, newErrMalformedToken(fmt.Errorf("cannot parse the JWT: %w", err))
+	}
+
+	return claims, nil
+}
+
+// verifiedLocally reports whether the JWT signature is verified with the KeySet: the service account tokens are
+// signed by the API server rather than by the OIDC provider, thus verified by the TokenReview API instead.
+func (j jwtAuthenticator) verifiedLocally(token string) bool {
+	return j.keySet != nil && !IsServiceAccountToken(token, j.saIssuers)
+}
+
+// legacyServiceAccountUsername returns the canonical system:serviceaccount:<namespace>:<name> username, derived from
+// the dedicated service account claims rather than trusting sub verbatim, since some tokens carry a UID in it:
+// sub is used only when the name claim is missing, and must be the canonical username of the Namespace.
+func legacyServiceAccountUsername(claims jwt.MapClaims, namespace string) (string, error) {
+	if name, ok := claims["kubernetes.io/serviceaccount/service-account.name"].(string); ok && len(name) > 0 {
+		return serviceAccountUsername(namespace, name)
+	}
+
+	sub, ok := claims["sub"].(string)
+	if !ok {
+		return "", newErrInvalidClaim("sub", "sub claim is not a string")
+	}
+
+	if subNamespace, _, err := serviceaccount.SplitUsername(sub); err != nil || subNamespace != namespace {
+		return "", newErrInvalidClaim("sub", fmt.Sprintf("the sub claim %s is not a service account of the %s Namespace", sub, namespace))
+	}
+
+	return sub, nil
+}
+
+// serviceAccountUsername returns the system:serviceaccount:<namespace>:<name> username, rejecting the invalid
+// Namespace and service account names, such as the empty ones.
+func serviceAccountUsername(namespace, name string) (string, error) {
+	username := serviceaccount.MakeUsername(namespace, name)
+	if _, _, err := serviceaccount.SplitUsername(username); err != nil {
+		return "", newErrInvalidClaim("kubernetes.io", fmt.Sprintf("invalid service account %s/%s in JWT", namespace, name))
+	}
+
+	return username, nil
+}
+
+// validateAudience checks the aud claim, either a string or an array, contains one of the required audiences, if any.
+func (j jwtAuthenticator) validateAudience(claims jwt.MapClaims) error {
+	if len(j.requiredAudiences) == 0 {
+		return nil
+	}
+
+	var audiences []string
+
+	switch aud := claims["aud"].(type) {
+	case nil:
+		return newErrInvalidClaim("aud", "missing aud claim in JWT")
+	case string:
+		audiences = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			if value, ok := a.(string); ok {
+				audiences = append(audiences, value)
+			}
+		}
+	default:
+		return newErrInvalidClaim("aud", fmt.Sprintf("unexpected type %T for the aud claim in JWT", aud))
+	}
+
+	for _, audience := range audiences {
+		for _, required := range j.requiredAudiences {
+			if audience == required {
+				return nil
+			}
+		}
+	}
+
+	return newErrInvalidClaim("aud", "the JWT is not issued for any of the required audiences")
+}
+
+// validateTimes checks the exp and nbf claims, when present, tolerating the configured clock skew: the service account
+// tokens iat and nbf claims are further tolerated up to the service account leeway in the future.
+func (j jwtAuthenticator) validateTimes(claims jwt.MapClaims, serviceAccount bool) error {
+	now := time.Now()
+
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(j.clockSkew)) {
+		return newErrInvalidClaim("exp", "token expired")
+	}
+
+	notBeforeSkew := j.clockSkew
+	if serviceAccount {
+		notBeforeSkew += j.saLeeway
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0).Add(-notBeforeSkew)) {
+		return newErrInvalidClaim("nbf", "token not valid yet")
+	}
+
+	if iat, ok := claims["iat"].(float64); ok && serviceAccount && now.Before(time.Unix(int64(iat), 0).Add(-notBeforeSkew)) {
+		return newErrInvalidClaim("iat", "token used before issued")
+	}
+
+	return nil
+}
+
+// IsJwtToken reports whether the token is a JWT, requiring a JSON header declaring the alg and a JSON payload:
+// any other token, even when made of three dot-separated segments, is an opaque one.
+func IsJwtToken(token string) bool {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return false
+	}
+
+	header, ok := decodeSegment(segments[0])
+	if !ok {
+		return false
+	}
+
+	if alg, ok := header["alg"].(string); !ok || len(alg) == 0 {
+		return false
+	}
+
+	_, ok = decodeSegment(segments[1])
+
+	return ok
+}
+
+// isUnsignedToken reports whether the JWT header declares the none alg, in any case.
+func isUnsignedToken(token string) bool {
+	header, ok := decodeSegment(strings.Split(token, ".")[0])
+	if !ok {
+		return false
+	}
+
+	alg, _ := header["alg"].(string)
+
+	return strings.EqualFold(strings.TrimSpace(alg), jwt.SigningMethodNone.Alg())
+}
+
+// IsServiceAccountToken reports whether the token is a Kubernetes service account JWT, either a legacy or a bound one
+// of the given issuers: the signature is not verified, thus the token must not be trusted for this.
+func IsServiceAccountToken(token string, issuers sets.String) bool {
+	if !IsJwtToken(token) {
+		return false
+	}
+
+	claims, ok := decodeSegment(strings.Split(token, ".")[1])
+	if !ok {
+		return false
+	}
+
+	if claims["iss"] == legacyServiceAccountIssuer {
+		return true
+	}
+
+	_, _, ok = projectedServiceAccount(claims, issuers)
+
+	return ok
+}
+
+// decodeSegment decodes a base64url JWT segment holding a JSON object.
+func decodeSegment(segment string) (map[string]interface{}, bool) {
+	decoded, err := jwt.DecodeSegment(segment)
+	if err != nil {
+		return nil, false
+	}
+
+	var object map[string]interface{}
+	if err = json.Unmarshal(decoded, &object); err != nil || object == nil {
+		return nil, false
+	}
+
+	return object, true
+}
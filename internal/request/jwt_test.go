@@ -0,0 +1,1132 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+// nolint:testpackage
+package request
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	h "net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/serviceaccount"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestJWT() jwtAuthenticator {
+	return jwtAuthenticator{
+		claimMappings: ClaimMappings{Default: ClaimMapping{UsernameFields: []string{"preferred_username"}, GroupsFields: []string{"groups"}}},
+		saIssuers:     sets.NewString(DefaultServiceAccountIssuer),
+	}
+}
+
+func TestProcessJwtClaimsGroupsClaimField(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name             string
+		groupsClaimField string
+		claims           jwt.MapClaims
+		want             []string
+	}{
+		{"default groups claim", "groups", jwt.MapClaims{"preferred_username": "alice", "groups": []string{"foo", "bar"}}, []string{"foo", "bar"}},
+		{"custom groups claim", "roles", jwt.MapClaims{"preferred_username": "alice", "roles": []string{"foo", "bar"}}, []string{"foo", "bar"}},
+		{"single string claim", "roles", jwt.MapClaims{"preferred_username": "alice", "roles": "foo"}, []string{"foo"}},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			j := newTestJWT()
+			j.claimMappings.Default.GroupsFields = []string{eachTest.groupsClaimField}
+
+			_, groups, err := j.processJwtClaims(context.Background(), newTestToken(t, eachTest.claims))
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if !reflect.DeepEqual(groups, eachTest.want) {
+				t.Errorf("got groups %v, want %v", groups, eachTest.want)
+			}
+		})
+	}
+}
+
+func TestProcessJwtClaimsGroupsString(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		separator string
+		groups    interface{}
+		want      []string
+		err       bool
+	}{
+		{"array", " ", []string{"dev", "ops"}, []string{"dev", "ops"}, false},
+		{"space delimited", " ", "dev  ops\tqa", []string{"dev", "ops", "qa"}, false},
+		{"comma delimited", ",", "dev, ops,,qa", []string{"dev", "ops", "qa"}, false},
+		{"not split", "", "dev ops", []string{"dev ops"}, false},
+		{"non string entry", " ", []interface{}{"dev", 42}, nil, true},
+		{"unexpected type", " ", 42, nil, true},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("unexpected panic: %v", r)
+				}
+			}()
+
+			j := newTestJWT()
+			j.claimMappings.Default.GroupsSeparator = eachTest.separator
+
+			_, groups, err := j.processJwtClaims(context.Background(), newTestToken(t, jwt.MapClaims{"preferred_username": "alice", "groups": eachTest.groups}))
+			if eachTest.err {
+				if err == nil {
+					t.Errorf("expected error, got groups %v", groups)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if !reflect.DeepEqual(groups, eachTest.want) {
+				t.Errorf("got groups %v, want %v", groups, eachTest.want)
+			}
+		})
+	}
+}
+
+func TestValidateTimes(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		err    bool
+	}{
+		{"pass before the skew after exp", jwt.MapClaims{"exp": float64(now.Add(-28 * time.Second).Unix())}, false},
+		{"fail after the skew after exp", jwt.MapClaims{"exp": float64(now.Add(-32 * time.Second).Unix())}, true},
+		{"pass within the skew before nbf", jwt.MapClaims{"nbf": float64(now.Add(28 * time.Second).Unix())}, false},
+		{"fail beyond the skew before nbf", jwt.MapClaims{"nbf": float64(now.Add(32 * time.Second).Unix())}, true},
+		{"pass without times", jwt.MapClaims{}, false},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			j := newTestJWT()
+			j.clockSkew = 30 * time.Second
+
+			err := j.validateTimes(eachTest.claims, false)
+			if eachTest.err {
+				var unauthorized *ErrUnauthorized
+				if !errors.As(err, &unauthorized) {
+					t.Errorf("expected unauthorized error, got %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Errorf("got error: %v", err)
+			}
+		})
+	}
+}
+
+func TestProcessJwtClaimsMultipleGroupsClaims(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   []string
+	}{
+		{"array and string", jwt.MapClaims{"preferred_username": "alice", "groups": []string{"dev", "ops"}, "roles": "admin ops viewer"}, []string{"dev", "ops", "admin", "viewer"}},
+		{"string and array", jwt.MapClaims{"preferred_username": "alice", "groups": "ops", "roles": []string{"viewer", "ops"}}, []string{"ops", "viewer"}},
+		{"only the second", jwt.MapClaims{"preferred_username": "alice", "roles": []string{"viewer"}}, []string{"viewer"}},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			j := newTestJWT()
+			j.claimMappings.Default.GroupsFields = []string{"groups", "roles"}
+			j.claimMappings.Default.GroupsSeparator = " "
+
+			_, groups, err := j.processJwtClaims(context.Background(), newTestToken(t, eachTest.claims))
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if !reflect.DeepEqual(groups, eachTest.want) {
+				t.Errorf("got groups %v, want %v", groups, eachTest.want)
+			}
+		})
+	}
+}
+
+func TestProcessJwtClaimsMissingGroups(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		requireGroups bool
+		claims        jwt.MapClaims
+		want          []string
+		err           bool
+	}{
+		{"groups claim present", false, jwt.MapClaims{"preferred_username": "alice", "groups": []string{"foo"}}, []string{"foo"}, false},
+		{"groups claim missing", false, jwt.MapClaims{"preferred_username": "alice"}, []string{}, false},
+		{"groups claim present in strict mode", true, jwt.MapClaims{"preferred_username": "alice", "groups": []string{"foo"}}, []string{"foo"}, false},
+		{"groups claim missing in strict mode", true, jwt.MapClaims{"preferred_username": "alice"}, nil, true},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			j := newTestJWT()
+			j.claimMappings.Default.RequireGroups = eachTest.requireGroups
+
+			username, groups, err := j.processJwtClaims(context.Background(), newTestToken(t, eachTest.claims))
+			if eachTest.err {
+				if err == nil {
+					t.Errorf("expected error, got groups %v", groups)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if username != "alice" {
+				t.Errorf("got username %s, want alice", username)
+			}
+
+			if !reflect.DeepEqual(groups, eachTest.want) {
+				t.Errorf("got groups %v, want %v", groups, eachTest.want)
+			}
+		})
+	}
+}
+
+func TestProcessJwtClaimsNestedFields(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name               string
+		usernameClaimField string
+		groupsClaimField   string
+		claims             jwt.MapClaims
+		wantUsername       string
+		wantGroups         []string
+	}{
+		{
+			"literal dotted claims",
+			"https://example.com/claims/email",
+			"groups",
+			jwt.MapClaims{"https://example.com/claims/email": "alice@example.com", "groups": []string{"foo"}},
+			"alice@example.com",
+			[]string{"foo"},
+		},
+		{
+			"two-level nested username",
+			"identity.username",
+			"groups",
+			jwt.MapClaims{"identity": map[string]interface{}{"username": "alice"}, "groups": []string{"foo"}},
+			"alice",
+			[]string{"foo"},
+		},
+		{
+			"nested groups array",
+			"preferred_username",
+			"resource_access.k8s.roles",
+			jwt.MapClaims{"preferred_username": "alice", "resource_access": map[string]interface{}{"k8s": map[string]interface{}{"roles": []string{"foo", "bar"}}}},
+			"alice",
+			[]string{"foo", "bar"},
+		},
+		{
+			"nested key containing dots",
+			"preferred_username",
+			"kubernetes.io.groups",
+			jwt.MapClaims{"preferred_username": "alice", "kubernetes.io": map[string]interface{}{"groups": []string{"foo"}}},
+			"alice",
+			[]string{"foo"},
+		},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			j := newTestJWT()
+			j.claimMappings.Default.UsernameFields = []string{eachTest.usernameClaimField}
+			j.claimMappings.Default.GroupsFields = []string{eachTest.groupsClaimField}
+
+			username, groups, err := j.processJwtClaims(context.Background(), newTestToken(t, eachTest.claims))
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if username != eachTest.wantUsername {
+				t.Errorf("got username %s, want %s", username, eachTest.wantUsername)
+			}
+
+			if !reflect.DeepEqual(groups, eachTest.wantGroups) {
+				t.Errorf("got groups %v, want %v", groups, eachTest.wantGroups)
+			}
+		})
+	}
+}
+
+func TestProcessJwtClaimsUsernameFallback(t *testing.T) {
+	t.Parallel()
+
+	fields := []string{"email", "preferred_username"}
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   string
+		err    bool
+	}{
+		{"first match", jwt.MapClaims{"email": "alice@example.com", "preferred_username": "alice", "groups": []string{}}, "alice@example.com", false},
+		{"second match", jwt.MapClaims{"preferred_username": "alice", "groups": []string{}}, "alice", false},
+		{"empty first skipped", jwt.MapClaims{"email": "", "preferred_username": "alice", "groups": []string{}}, "alice", false},
+		{"none match", jwt.MapClaims{"sub": "alice", "groups": []string{}}, "", true},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			j := newTestJWT()
+			j.claimMappings.Default.UsernameFields = fields
+
+			username, _, err := j.processJwtClaims(context.Background(), newTestToken(t, eachTest.claims))
+			if eachTest.err {
+				if err == nil || !strings.Contains(err.Error(), "email, preferred_username") {
+					t.Errorf("expected error naming the attempted claims, got %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if username != eachTest.want {
+				t.Errorf("got username %s, want %s", username, eachTest.want)
+			}
+		})
+	}
+}
+
+func TestProcessJwtClaimsFallbackToSub(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		fallback bool
+		claims   jwt.MapClaims
+		want     string
+		err      bool
+	}{
+		{"present claim", true, jwt.MapClaims{"preferred_username": "alice", "sub": "8f2b1c4e"}, "alice", false},
+		{"fallback to sub", true, jwt.MapClaims{"sub": "8f2b1c4e"}, "8f2b1c4e", false},
+		{"fallback disabled", false, jwt.MapClaims{"sub": "8f2b1c4e"}, "", true},
+		{"missing sub", true, jwt.MapClaims{"email": "alice@example.com"}, "", true},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			j := newTestJWT()
+			j.claimMappings.Default.FallbackToSub = eachTest.fallback
+
+			username, _, err := j.processJwtClaims(context.Background(), newTestToken(t, eachTest.claims))
+			if eachTest.err {
+				if err == nil {
+					t.Errorf("expected error, got username %s", username)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if username != eachTest.want {
+				t.Errorf("got username %s, want %s", username, eachTest.want)
+			}
+		})
+	}
+}
+
+func TestProcessJwtClaimsLowercaseEmail(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		lowercase bool
+		username  string
+		want      string
+	}{
+		{"mixed-case email", true, "Alice.Smith@Example.COM", "oidc:alice.smith@example.com"},
+		{"lowercase email", true, "alice@example.com", "oidc:alice@example.com"},
+		{"not an email", true, "Alice", "oidc:Alice"},
+		{"display name with email", true, "Alice <Alice@Example.com>", "oidc:Alice <Alice@Example.com>"},
+		{"disabled", false, "Alice@Example.com", "oidc:Alice@Example.com"},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			j := newTestJWT()
+			j.claimMappings.Default.UsernamePrefix = "oidc:"
+			j.claimMappings.Default.LowercaseEmail = eachTest.lowercase
+
+			username, _, err := j.processJwtClaims(context.Background(), newTestToken(t, jwt.MapClaims{"preferred_username": eachTest.username, "groups": "foo"}))
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if username != eachTest.want {
+				t.Errorf("got username %s, want %s", username, eachTest.want)
+			}
+		})
+	}
+}
+
+func TestProcessJwtClaimsPrefixes(t *testing.T) {
+	t.Parallel()
+
+	claims := jwt.MapClaims{"preferred_username": "alice", "groups": []string{"foo", "bar"}}
+
+	j := newTestJWT()
+	j.claimMappings.Default.UsernamePrefix = "oidc:"
+	j.claimMappings.Default.GroupsPrefix = "oidc:"
+
+	username, groups, err := j.processJwtClaims(context.Background(), newTestToken(t, claims))
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+
+	if username != "oidc:alice" {
+		t.Errorf("got username %s, want oidc:alice", username)
+	}
+
+	if want := []string{"oidc:foo", "oidc:bar"}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("got groups %v, want %v", groups, want)
+	}
+}
+
+func TestProcessJwtClaimsServiceAccount(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+	}{
+		{
+			"legacy token",
+			jwt.MapClaims{
+				"iss":                                    "kubernetes/serviceaccount",
+				"sub":                                    "system:serviceaccount:oil-production:robot",
+				"kubernetes.io/serviceaccount/namespace": "oil-production",
+			},
+		},
+		{
+			"projected token",
+			jwt.MapClaims{
+				"iss": "https://kubernetes.default.svc.cluster.local",
+				"sub": "system:serviceaccount:oil-production:robot",
+				"kubernetes.io": map[string]interface{}{
+					"namespace":      "oil-production",
+					"serviceaccount": map[string]interface{}{"name": "robot", "uid": "2f1e9a3c-8f0e-4a4b-9c1d-5b2e7c3d4a5f"},
+				},
+			},
+		},
+		{
+			"legacy issuer with nested claims",
+			jwt.MapClaims{
+				"iss": "kubernetes/serviceaccount",
+				"sub": "2f1e9a3c-8f0e-4a4b-9c1d-5b2e7c3d4a5f",
+				"kubernetes.io": map[string]interface{}{
+					"namespace":      "oil-production",
+					"serviceaccount": map[string]interface{}{"name": "robot"},
+				},
+			},
+		},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			username, groups, err := newTestJWT().processJwtClaims(context.Background(), newTestToken(t, eachTest.claims))
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if username != "system:serviceaccount:oil-production:robot" {
+				t.Errorf("got username %s, want system:serviceaccount:oil-production:robot", username)
+			}
+
+			if want := []string{"system:serviceaccounts", "system:serviceaccounts:oil-production"}; !reflect.DeepEqual(groups, want) {
+				t.Errorf("got groups %v, want %v", groups, want)
+			}
+		})
+	}
+}
+
+func TestProcessJwtClaimsServiceAccountIssuers(t *testing.T) {
+	t.Parallel()
+
+	projected := map[string]interface{}{
+		"namespace":      "oil-production",
+		"serviceaccount": map[string]interface{}{"name": "robot"},
+	}
+
+	tests := []struct {
+		name     string
+		issuers  []string
+		claims   jwt.MapClaims
+		username string
+	}{
+		{
+			"OIDC issuer carrying the kubernetes.io claim",
+			[]string{DefaultServiceAccountIssuer},
+			jwt.MapClaims{"iss": "https://idp.example.com", "preferred_username": "alice", "kubernetes.io": projected},
+			"alice",
+		},
+		{
+			"missing issuer carrying the kubernetes.io claim",
+			[]string{DefaultServiceAccountIssuer},
+			jwt.MapClaims{"preferred_username": "alice", "kubernetes.io": projected},
+			"alice",
+		},
+		{
+			"configured service account issuer",
+			[]string{"https://oidc.eks.eu-west-1.amazonaws.com/id/EXAMPLE"},
+			jwt.MapClaims{"iss": "https://oidc.eks.eu-west-1.amazonaws.com/id/EXAMPLE", "preferred_username": "alice", "kubernetes.io": projected},
+			"system:serviceaccount:oil-production:robot",
+		},
+		{
+			"default issuer out of the configured ones",
+			[]string{"https://oidc.eks.eu-west-1.amazonaws.com/id/EXAMPLE"},
+			jwt.MapClaims{"iss": DefaultServiceAccountIssuer, "preferred_username": "alice", "kubernetes.io": projected},
+			"alice",
+		},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			j := newTestJWT()
+			j.saIssuers = sets.NewString(eachTest.issuers...)
+
+			token := newTestToken(t, eachTest.claims)
+
+			username, _, err := j.processJwtClaims(context.Background(), token)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if username != eachTest.username {
+				t.Errorf("got username %s, want %s", username, eachTest.username)
+			}
+
+			if serviceAccount := strings.HasPrefix(eachTest.username, serviceaccount.ServiceAccountUsernamePrefix); IsServiceAccountToken(token, j.saIssuers) != serviceAccount {
+				t.Errorf("got the token detected as a service account one %t, want %t", !serviceAccount, serviceAccount)
+			}
+		})
+	}
+}
+
+func TestProcessJwtClaimsServiceAccountUsername(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		err    bool
+	}{
+		{
+			"legacy token with UID sub",
+			jwt.MapClaims{
+				"iss":                                    "kubernetes/serviceaccount",
+				"sub":                                    "2f1e9a3c-8f0e-4a4b-9c1d-5b2e7c3d4a5f",
+				"kubernetes.io/serviceaccount/namespace": "oil-production",
+				"kubernetes.io/serviceaccount/service-account.name": "robot",
+			},
+			false,
+		},
+		{
+			"legacy token with canonical sub",
+			jwt.MapClaims{
+				"iss":                                    "kubernetes/serviceaccount",
+				"sub":                                    "system:serviceaccount:oil-production:robot",
+				"kubernetes.io/serviceaccount/namespace": "oil-production",
+				"kubernetes.io/serviceaccount/service-account.name": "robot",
+			},
+			false,
+		},
+		{
+			"legacy token with UID sub and no name",
+			jwt.MapClaims{
+				"iss":                                    "kubernetes/serviceaccount",
+				"sub":                                    "2f1e9a3c-8f0e-4a4b-9c1d-5b2e7c3d4a5f",
+				"kubernetes.io/serviceaccount/namespace": "oil-production",
+			},
+			true,
+		},
+		{
+			"legacy token with sub of another Namespace",
+			jwt.MapClaims{
+				"iss":                                    "kubernetes/serviceaccount",
+				"sub":                                    "system:serviceaccount:gas-production:robot",
+				"kubernetes.io/serviceaccount/namespace": "oil-production",
+			},
+			true,
+		},
+		{
+			"projected token with UID sub",
+			jwt.MapClaims{
+				"iss": "https://kubernetes.default.svc.cluster.local",
+				"sub": "2f1e9a3c-8f0e-4a4b-9c1d-5b2e7c3d4a5f",
+				"kubernetes.io": map[string]interface{}{
+					"namespace":      "oil-production",
+					"serviceaccount": map[string]interface{}{"name": "robot", "uid": "2f1e9a3c-8f0e-4a4b-9c1d-5b2e7c3d4a5f"},
+				},
+			},
+			false,
+		},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			username, groups, err := newTestJWT().processJwtClaims(context.Background(), newTestToken(t, eachTest.claims))
+			if eachTest.err {
+				var unauthorized *ErrUnauthorized
+				if !errors.As(err, &unauthorized) {
+					t.Errorf("expected unauthorized error, got %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if username != "system:serviceaccount:oil-production:robot" {
+				t.Errorf("got username %s, want system:serviceaccount:oil-production:robot", username)
+			}
+
+			if want := []string{"system:serviceaccounts", "system:serviceaccounts:oil-production"}; !reflect.DeepEqual(groups, want) {
+				t.Errorf("got groups %v, want %v", groups, want)
+			}
+		})
+	}
+}
+
+func TestProcessJwtClaimsRequiredAudiences(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		err    bool
+	}{
+		{"single string", jwt.MapClaims{"preferred_username": "alice", "aud": "capsule-proxy"}, false},
+		{"array", jwt.MapClaims{"preferred_username": "alice", "aud": []string{"grafana", "https://kubernetes.default.svc"}}, false},
+		{"not required string", jwt.MapClaims{"preferred_username": "alice", "aud": "grafana"}, true},
+		{"not required array", jwt.MapClaims{"preferred_username": "alice", "aud": []string{"grafana", "argocd"}}, true},
+		{"missing audience", jwt.MapClaims{"preferred_username": "alice"}, true},
+		{"unexpected type", jwt.MapClaims{"preferred_username": "alice", "aud": 42}, true},
+		{
+			"legacy service account token",
+			jwt.MapClaims{
+				"iss":                                    "kubernetes/serviceaccount",
+				"sub":                                    "system:serviceaccount:oil-production:robot",
+				"kubernetes.io/serviceaccount/namespace": "oil-production",
+			},
+			false,
+		},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			j := newTestJWT()
+			j.requiredAudiences = []string{"capsule-proxy", "https://kubernetes.default.svc"}
+
+			_, _, err := j.processJwtClaims(context.Background(), newTestToken(t, eachTest.claims))
+			if eachTest.err {
+				var unauthorized *ErrUnauthorized
+				if !errors.As(err, &unauthorized) {
+					t.Errorf("expected unauthorized error, got %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Errorf("got error: %v", err)
+			}
+		})
+	}
+}
+
+func TestProcessJwtClaimsMalformed(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"not a jwt", "not.a.jwt"},
+		{"two segments", "eyJhbGciOiJIUzI1NiJ9.e30"},
+		{"invalid payload", "eyJhbGciOiJIUzI1NiJ9.bm90LWpzb24.c2ln"},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("unexpected panic: %v", r)
+				}
+			}()
+
+			_, _, err := newTestJWT().processJwtClaims(context.Background(), eachTest.token)
+
+			var unauthorized *ErrUnauthorized
+			if !errors.As(err, &unauthorized) {
+				t.Errorf("expected unauthorized error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMatchedClaims(t *testing.T) {
+	t.Parallel()
+
+	mapping := ClaimMapping{UsernameFields: []string{"email", "preferred_username"}, GroupsFields: []string{"realm_access.roles"}}
+
+	tests := []struct {
+		name     string
+		claims   jwt.MapClaims
+		username string
+		groups   []string
+	}{
+		{"fallback username", jwt.MapClaims{"preferred_username": "alice", "realm_access": map[string]interface{}{"roles": []string{"dev"}}}, "preferred_username", []string{"realm_access.roles"}},
+		{"missing groups", jwt.MapClaims{"email": "alice@example.com"}, "email", nil},
+		{"no match", jwt.MapClaims{"sub": "alice"}, "", nil},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			username, groups := mapping.MatchedClaims(newTestToken(t, eachTest.claims))
+			if username != eachTest.username || !reflect.DeepEqual(groups, eachTest.groups) {
+				t.Errorf("got claims %q and %q, want %q and %q", username, groups, eachTest.username, eachTest.groups)
+			}
+		})
+	}
+}
+
+func TestProcessJwtClaimsUnexpectedTypes(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   string
+	}{
+		{"numeric sub", jwt.MapClaims{"iss": "kubernetes/serviceaccount", "sub": 1234, "kubernetes.io/serviceaccount/namespace": "oil-production"}, "sub claim is not a string"},
+		{"numeric namespace", jwt.MapClaims{"iss": "kubernetes/serviceaccount", "sub": "system:serviceaccount:oil-production:robot", "kubernetes.io/serviceaccount/namespace": 1234}, "namespace claim is not a string"},
+		{"numeric username", jwt.MapClaims{"preferred_username": 1234, "groups": []string{}}, "username claim preferred_username is not a string"},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("unexpected panic: %v", r)
+				}
+			}()
+
+			_, _, err := newTestJWT().processJwtClaims(context.Background(), newTestToken(t, eachTest.claims))
+			if err == nil || !strings.Contains(err.Error(), eachTest.want) {
+				t.Errorf("expected error %q, got %v", eachTest.want, err)
+			}
+		})
+	}
+}
+
+func TestResolveNamespaceLabelGroups(t *testing.T) {
+	t.Parallel()
+
+	c := fake.NewClientBuilder().WithObjects(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "oil-production", Labels: map[string]string{"team": "payments", "env": "prod"}},
+	}).Build()
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   []string
+	}{
+		{
+			"labelled namespace",
+			jwt.MapClaims{"iss": "kubernetes/serviceaccount", "sub": "system:serviceaccount:oil-production:robot", "kubernetes.io/serviceaccount/namespace": "oil-production"},
+			[]string{"system:serviceaccounts", "system:serviceaccounts:oil-production", "team:payments"},
+		},
+		{
+			"missing namespace",
+			jwt.MapClaims{"iss": "kubernetes/serviceaccount", "sub": "system:serviceaccount:gas-production:robot", "kubernetes.io/serviceaccount/namespace": "gas-production"},
+			[]string{"system:serviceaccounts", "system:serviceaccounts:gas-production"},
+		},
+		{
+			"not a service account",
+			jwt.MapClaims{"preferred_username": "alice", "groups": []string{"dev"}},
+			[]string{"dev"},
+		},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			j := newTestJWT()
+			j.namespaceLabels = []string{"team", "cost-center"}
+			j.client = c
+
+			r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+			r.Header.Set("Authorization", "Bearer "+newTestToken(t, eachTest.claims))
+
+			_, groups, err := j.Resolve(r)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+
+			if !reflect.DeepEqual(groups, eachTest.want) {
+				t.Errorf("got groups %v, want %v", groups, eachTest.want)
+			}
+		})
+	}
+}
+
+func TestIsJwtToken(t *testing.T) {
+	t.Parallel()
+
+	segment := func(s string) string {
+		return jwt.EncodeSegment([]byte(s))
+	}
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "alice"}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("cannot sign token: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		jwt   bool
+	}{
+		{"genuine jwt", signed, true},
+		{"unsigned jwt", segment(`{"alg":"none"}`) + "." + segment(`{"sub":"alice"}`) + ".", true},
+		{"opaque dotted token", "abc.def.ghi", false},
+		{"bootstrap token", "abcdef.0123456789abcdef", false},
+		{"opaque token", "sha256~2M1Ql4m7ohJkDxm", false},
+		{"header without alg", segment(`{"typ":"JWT"}`) + "." + segment(`{"sub":"alice"}`) + ".c2ln", false},
+		{"empty alg", segment(`{"alg":""}`) + "." + segment(`{"sub":"alice"}`) + ".c2ln", false},
+		{"payload not json", segment(`{"alg":"HS256"}`) + "." + segment("not-json") + ".c2ln", false},
+		{"payload not an object", segment(`{"alg":"HS256"}`) + "." + segment("null") + ".c2ln", false},
+		{"four segments", signed + ".c2ln", false},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := IsJwtToken(eachTest.token); got != eachTest.jwt {
+				t.Errorf("got %t, want %t", got, eachTest.jwt)
+			}
+		})
+	}
+}
+
+func TestProcessJwtClaimsErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		token  string
+		target interface{}
+		claim  string
+	}{
+		{"malformed token", "not.a.jwt", new(*ErrMalformedToken), ""},
+		{"missing username claim", newTestToken(t, jwt.MapClaims{"sub": "alice"}), new(*ErrMissingUsernameClaim), ""},
+		{"missing groups claim", newTestToken(t, jwt.MapClaims{"preferred_username": "alice"}), new(*ErrMissingGroupsClaim), ""},
+		{"username claim not a string", newTestToken(t, jwt.MapClaims{"preferred_username": 42}), new(*ErrInvalidClaim), "preferred_username"},
+		{"groups claim not a list", newTestToken(t, jwt.MapClaims{"preferred_username": "alice", "groups": 42}), new(*ErrInvalidClaim), "groups"},
+		{"sub not a service account", newTestToken(t, jwt.MapClaims{"iss": "kubernetes/serviceaccount", "kubernetes.io/serviceaccount/namespace": "default", "sub": "alice"}), new(*ErrInvalidClaim), "sub"},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			j := newTestJWT()
+			j.claimMappings.Default.RequireGroups = true
+
+			_, _, err := j.processJwtClaims(context.Background(), eachTest.token)
+			if !errors.As(err, eachTest.target) {
+				t.Fatalf("got error %T: %v, want %T", err, err, eachTest.target)
+			}
+			// The failure modes are unauthorized, as the other invalid credentials
+			var statusErr StatusError
+			if !errors.As(err, &statusErr) || statusErr.StatusCode() != h.StatusUnauthorized {
+				t.Errorf("got error %v, want status code 401", err)
+			}
+
+			var unauthorized *ErrUnauthorized
+			if !errors.As(err, &unauthorized) {
+				t.Errorf("expected unauthorized error, got %v", err)
+			}
+
+			if invalid, ok := eachTest.target.(**ErrInvalidClaim); ok && (*invalid).Claim() != eachTest.claim {
+				t.Errorf("got invalid claim %s, want %s", (*invalid).Claim(), eachTest.claim)
+			}
+		})
+	}
+}
+
+// FuzzProcessJwtClaims feeds arbitrary JSON claims through the claims extraction, that must never panic and either
+// resolve a valid identity or fail: the OIDC usernames are prefixed, thus never overlapping the service account ones.
+func FuzzProcessJwtClaims(f *testing.F) {
+	for _, seed := range []string{
+		`{"preferred_username":"alice","groups":["foo","bar"]}`,
+		`{"preferred_username":"alice","groups":"foo, bar"}`,
+		`{"preferred_username":"alice","groups":[1,{"a":null}]}`,
+		`{"preferred_username":42,"groups":"foo"}`,
+		`{"sub":"alice","resource_access":{"k8s":{"roles":["admin"]}}}`,
+		`{"resource_access":{"k8s":"roles"},"resource_access.k8s":{"roles":null}}`,
+		`{"iss":"kubernetes/serviceaccount","kubernetes.io/serviceaccount/namespace":"default","kubernetes.io/serviceaccount/service-account.name":"builder"}`,
+		`{"iss":"kubernetes/serviceaccount","kubernetes.io/serviceaccount/namespace":"default","sub":"system:serviceaccount:default:builder"}`,
+		`{"iss":"kubernetes/serviceaccount","kubernetes.io/serviceaccount/namespace":"","sub":"system:serviceaccount::builder"}`,
+		`{"iss":"kubernetes/serviceaccount","kubernetes.io/serviceaccount/namespace":"","kubernetes.io/serviceaccount/service-account.name":"builder"}`,
+		`{"iss":"https://kubernetes.default.svc","kubernetes.io":{"namespace":"default","serviceaccount":{"name":"builder"}}}`,
+		`{"kubernetes.io":{"namespace":"default","serviceaccount":{"name":"Builder"}}}`,
+		`{"kubernetes.io":{"namespace":["default"],"serviceaccount":"builder"}}`,
+		`{"preferred_username":"alice","aud":[null,"kubernetes"]}`,
+		`[]`,
+		`null`,
+	} {
+		f.Add([]byte(seed))
+	}
+
+	header := jwt.EncodeSegment([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		token := header + "." + jwt.EncodeSegment(payload) + ".c2ln"
+
+		j := jwtAuthenticator{claimMappings: ClaimMappings{Default: ClaimMapping{
+			UsernameFields:  []string{"preferred_username", "resource_access.k8s.username"},
+			GroupsFields:    []string{"groups", "resource_access.k8s.roles"},
+			GroupsSeparator: ",",
+			UsernamePrefix:  "oidc:",
+			GroupsPrefix:    "oidc:",
+			FallbackToSub:   true,
+		}}, saIssuers: sets.NewString(DefaultServiceAccountIssuer)}
+
+		for _, audiences := range [][]string{nil, {"kubernetes"}} {
+			j.requiredAudiences = audiences
+
+			username, groups, err := j.processJwtClaims(context.Background(), token)
+			if err != nil {
+				continue
+			}
+
+			if strings.HasPrefix(username, "oidc:") {
+				if len(username) == len("oidc:") {
+					t.Errorf("got the empty username with groups %v", groups)
+				}
+
+				continue
+			}
+
+			if namespace, name, err := serviceaccount.SplitUsername(username); err != nil || len(namespace) == 0 || len(name) == 0 {
+				t.Errorf("got the invalid service account username %q", username)
+			}
+		}
+
+		_ = IsServiceAccountToken(token, j.saIssuers)
+	})
+}
+
+func TestProcessJwtClaimsNoneAlg(t *testing.T) {
+	t.Parallel()
+
+	payload := `{"preferred_username":"alice","groups":["foo"]}`
+
+	tests := []struct {
+		name   string
+		token  string
+		keySet *KeySet
+	}{
+		{"unverified", newTestUnsignedToken("none", payload), nil},
+		{"unverified uppercase", newTestUnsignedToken("NONE", payload), nil},
+		{"verified", newTestUnsignedToken("none", payload), NewKeySet("http://127.0.0.1:0/jwks", time.Hour)},
+		{"verified with signature", newTestUnsignedToken("none", payload) + "c2ln", NewKeySet("http://127.0.0.1:0/jwks", time.Hour)},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			j := newTestJWT()
+			j.keySet = eachTest.keySet
+
+			username, _, err := j.processJwtClaims(context.Background(), eachTest.token)
+
+			var unauthorized *ErrUnauthorized
+			if !errors.As(err, &unauthorized) {
+				t.Fatalf("got username %q with error %v, want unauthorized error", username, err)
+			}
+
+			if !strings.Contains(err.Error(), "none alg") {
+				t.Errorf("got error %v, want the none alg to be reported", err)
+			}
+		})
+	}
+}
+
+func newTestUnsignedToken(alg, payload string) string {
+	encode := base64.RawURLEncoding.EncodeToString
+
+	return encode([]byte(`{"alg":"`+alg+`","typ":"JWT"}`)) + "." + encode([]byte(payload)) + "."
+}
+
+func TestResolveTokenReview(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		authenticated bool
+		wantErr       bool
+	}{
+		{"authenticated", true, false},
+		{"not authenticated", false, true},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			var reviews int
+
+			tr := newTestTokenReview()
+			tr.tokenReviewCache = NewTokenReviewCache(time.Minute)
+			tr.client = fakeClient{create: func(_ context.Context, obj client.Object) error {
+				reviews++
+
+				review := obj.(*authenticationv1.TokenReview)
+				review.Status.Authenticated = eachTest.authenticated
+				review.Status.User.Username = "alice"
+
+				return nil
+			}}
+
+			j := newTestJWT()
+			j.tokenReview = tr
+
+			token := newTestToken(t, jwt.MapClaims{"preferred_username": "alice", "groups": []string{"foo"}})
+
+			for i := 0; i < 2; i++ {
+				r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+				r.Header.Set("Authorization", "Bearer "+token)
+
+				username, groups, err := j.Resolve(r)
+				if eachTest.wantErr {
+					var unauthorized *ErrUnauthorized
+					if !errors.As(err, &unauthorized) {
+						t.Fatalf("got username %q with error %v, want unauthorized error", username, err)
+					}
+
+					return
+				}
+
+				if err != nil || username != "alice" || !reflect.DeepEqual(groups, []string{"foo"}) {
+					t.Fatalf("got username %q, groups %v, error %v", username, groups, err)
+				}
+			}
+			// The second request is verified by the TokenReview cache
+			if reviews != 1 {
+				t.Errorf("got %d TokenReview requests, want 1", reviews)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	impersonationTargetUser  = "user"
+	impersonationTargetGroup = "group"
+	impersonationTargetUID   = "uid"
+	impersonationTargetExtra = "extra"
+)
+
+const (
+	authOutcomeSuccess      = "success"
+	authOutcomeUnauthorized = "unauthorized"
+	authOutcomeForbidden    = "forbidden"
+	authOutcomeTimeout      = "timeout"
+	authOutcomeUnavailable  = "unavailable"
+	authOutcomeError        = "error"
+)
+
+// nolint:gochecknoinits
+func init() {
+	metrics.Registry.MustRegister(authenticationsTotal, authenticationDuration, tokenReviewCacheHitsTotal, tokenReviewCacheMissesTotal, tokenReviewCacheEntries, circuitBreakerState, impersonationsTotal)
+}
+
+// nolint:gochecknoglobals
+var authenticationsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "capsule_proxy_authentications_total",
+		Help: "Number of authentications by auth type and outcome",
+	},
+	[]string{"auth_type", "outcome"},
+)
+
+// nolint:gochecknoglobals
+var authenticationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "capsule_proxy_authentication_duration_seconds",
+	Help: "Duration of the user and groups resolution, including the impersonation checks.",
+}, []string{"auth_type"})
+
+// nolint:gochecknoglobals
+var tokenReviewCacheHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "capsule_proxy_token_review_cache_hits_total",
+	Help: "Number of the TokenReview results served by the cache",
+})
+
+// nolint:gochecknoglobals
+var tokenReviewCacheMissesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "capsule_proxy_token_review_cache_misses_total",
+	Help: "Number of the TokenReview cache misses by reason, not_present or expired",
+}, []string{"reason"})
+
+// nolint:gochecknoglobals
+var tokenReviewCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "capsule_proxy_token_review_cache_size",
+	Help: "Number of the entries held by the TokenReview cache",
+})
+
+// nolint:gochecknoglobals
+var circuitBreakerState = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "capsule_proxy_token_review_circuit_breaker_state",
+	Help: "State of the TokenReview circuit breaker, 0 when closed, 1 when open, and 2 when half-open",
+})
+
+// nolint:gochecknoglobals
+var impersonationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "capsule_proxy_impersonations_total",
+	Help: "Number of the impersonations applied by impersonator and target kind, user, group, uid, or extra",
+}, []string{"impersonator", "target_kind"})
+
+func observeImpersonation(impersonator string, user, groups, uid, extra bool) {
+	for kind, impersonated := range map[string]bool{
+		impersonationTargetUser:  user,
+		impersonationTargetGroup: groups,
+		impersonationTargetUID:   uid,
+		impersonationTargetExtra: extra,
+	} {
+		if impersonated {
+			impersonationsTotal.WithLabelValues(impersonator, kind).Inc()
+		}
+	}
+}
+
+func observeTokenReviewCache(missReason string) {
+	if len(missReason) == 0 {
+		tokenReviewCacheHitsTotal.Inc()
+
+		return
+	}
+
+	tokenReviewCacheMissesTotal.WithLabelValues(missReason).Inc()
+}
+
+func observeAuthentication(authType string, err error, duration time.Duration) {
+	outcome := authOutcomeSuccess
+
+	var unauthorized *ErrUnauthorized
+
+	var forbidden *ErrForbidden
+
+	var timeout *ErrTimeout
+
+	var unavailable *ErrUnavailable
+
+	switch {
+	case err == nil:
+	case errors.As(err, &unauthorized):
+		outcome = authOutcomeUnauthorized
+	case errors.As(err, &forbidden):
+		outcome = authOutcomeForbidden
+	case errors.As(err, &timeout):
+		outcome = authOutcomeTimeout
+	case errors.As(err, &unavailable):
+		outcome = authOutcomeUnavailable
+	default:
+		outcome = authOutcomeError
+	}
+
+	authenticationsTotal.WithLabelValues(authType, outcome).Inc()
+	authenticationDuration.WithLabelValues(authType).Observe(duration.Seconds())
+}
@@ -0,0 +1,90 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+// nolint:testpackage
+package request
+
+import (
+	"fmt"
+	h "net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// nolint:paralleltest
+func TestObserveAuthentication(t *testing.T) {
+	testCases := []struct {
+		name     string
+		authType string
+		err      error
+		outcome  string
+	}{
+		{"success", AuthTypeJWT, nil, authOutcomeSuccess},
+		{"unauthorized", AuthTypeBearer, NewErrUnauthorized("token has expired"), authOutcomeUnauthorized},
+		{"forbidden", AuthTypeJWT, NewErrForbidden("the current user alice cannot impersonate the user bob"), authOutcomeForbidden},
+		{"timeout", AuthTypeBearer, NewErrTimeout("the TokenReview timed out"), authOutcomeTimeout},
+		{"anonymous", AuthTypeAnonymous, NewErrUnauthorized("authentication required"), authOutcomeUnauthorized},
+		{"error", AuthTypeBearer, fmt.Errorf("cannot create TokenReview"), authOutcomeError},
+	}
+
+	for _, test := range testCases {
+		counter := authenticationsTotal.WithLabelValues(test.authType, test.outcome)
+		before := testutil.ToFloat64(counter)
+
+		observeAuthentication(test.authType, test.err, time.Millisecond)
+
+		if got := testutil.ToFloat64(counter) - before; got != 1 {
+			t.Errorf("%s: got %v increments for outcome %s, want 1", test.name, got, test.outcome)
+		}
+	}
+}
+
+func TestImpersonationMetric(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("X-Api-Key", "secret")
+	r.Header.Set("Impersonate-User", "bob")
+	r.Header.Add("Impersonate-Group", "developers")
+	r.Header.Add("Impersonate-Group", "ops")
+
+	user := impersonationsTotal.WithLabelValues("impersonating-controller", impersonationTargetUser)
+	group := impersonationsTotal.WithLabelValues("impersonating-controller", impersonationTargetGroup)
+	userBefore, groupBefore := testutil.ToFloat64(user), testutil.ToFloat64(group)
+
+	authenticator := fakeAuthenticator{header: "X-Api-Key", username: "impersonating-controller"}
+	if _, _, err := NewHTTPWithOptions(r, Options{Authenticators: []Authenticator{authenticator}, BypassUsers: sets.NewString("impersonating-controller"), Client: fakeClient{}}).GetUserAndGroups(); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+
+	if got := testutil.ToFloat64(user) - userBefore; got != 1 {
+		t.Errorf("got %v user impersonations, want 1", got)
+	}
+
+	if got := testutil.ToFloat64(group) - groupBefore; got != 1 {
+		t.Errorf("got %v group impersonations, want 1 for all the impersonated groups", got)
+	}
+	// The impersonated identity must never be a label value
+	ch := make(chan prometheus.Metric, 64)
+	go func() {
+		impersonationsTotal.Collect(ch)
+		close(ch)
+	}()
+
+	for metric := range ch {
+		m := &dto.Metric{}
+		_ = metric.Write(m)
+
+		for _, label := range m.GetLabel() {
+			if value := label.GetValue(); value == "bob" || value == "developers" || value == "ops" {
+				t.Errorf("got the impersonated %s as the %s label", value, label.GetName())
+			}
+		}
+	}
+}
@@ -5,9 +5,23 @@ package request
 
 import (
 	h "net/http"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
 )
 
+// Identity is the resolved requester identity, along with the method used to authenticate it: the UID and the
+// extras are returned by the UserExtraAuthenticator only, or requested along with the impersonation, if Impersonated.
+type Identity struct {
+	Username     string
+	Groups       []string
+	UID          string
+	Extra        map[string]authenticationv1.ExtraValue
+	AuthType     string
+	Impersonated bool
+}
+
 type Request interface {
 	GetUserAndGroups() (string, []string, error)
+	GetIdentity() (Identity, error)
 	GetHTTPRequest() *h.Request
 }
@@ -0,0 +1,36 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+)
+
+// RequestIDHeader carries the correlation ID of the request, forwarded to the API server.
+const RequestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// WithRequestID returns the context carrying the request correlation ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFrom returns the correlation ID of the request context, empty if missing.
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+
+	return id
+}
+
+// RequestLogger returns the logger adding the correlation ID of the request context, if any, to the log lines.
+func RequestLogger(ctx context.Context, log logr.Logger) logr.Logger {
+	if id := RequestIDFrom(ctx); len(id) > 0 {
+		return log.WithValues("requestID", id)
+	}
+
+	return log
+}
@@ -0,0 +1,191 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	h "net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/clastix/capsule-proxy/internal/tracing"
+)
+
+type tokenReview struct {
+	log                 logr.Logger
+	tokenReviewCache    *TokenReviewCache
+	circuitBreaker      *CircuitBreaker
+	retry               wait.Backoff
+	audiences           []string
+	tokenQueryParameter string
+	timeout             time.Duration
+	client              client.Client
+}
+
+// NewTokenReviewAuthenticator returns the Authenticator resolving the identity of the bearer tokens
+// using the Kubernetes TokenReview API, waiting for the API server reply up to the given timeout, if not zero:
+// the TokenReview requests are fast-failed while the circuit breaker, if any, is open, and retried with the backoff
+// steps for the transient errors only.
+func NewTokenReviewAuthenticator(tokenReviewCache *TokenReviewCache, circuitBreaker *CircuitBreaker, retry wait.Backoff, audiences []string, tokenQueryParameter string, timeout time.Duration, client client.Client) Authenticator {
+	return &tokenReview{
+		log:                 ctrl.Log.WithName("token_review"),
+		tokenReviewCache:    tokenReviewCache,
+		circuitBreaker:      circuitBreaker,
+		retry:               retry,
+		audiences:           audiences,
+		tokenQueryParameter: tokenQueryParameter,
+		timeout:             timeout,
+		client:              client,
+	}
+}
+
+func (t tokenReview) AuthType() string {
+	return AuthTypeBearer
+}
+
+func (t tokenReview) Resolve(request *h.Request) (username string, groups []string, err error) {
+	user, err := t.ResolveUser(request)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return user.Username, user.Groups, nil
+}
+
+// ResolveUser returns the user info of the TokenReview, along with the UID and the extras, such as the scopes.
+func (t tokenReview) ResolveUser(request *h.Request) (authenticationv1.UserInfo, error) {
+	token := RequestBearerToken(request, t.tokenQueryParameter)
+	if len(token) == 0 {
+		return authenticationv1.UserInfo{}, ErrNoCredentials
+	}
+
+	return t.processBearerToken(request.Context(), token)
+}
+
+func (t tokenReview) processBearerToken(ctx context.Context, token string) (user authenticationv1.UserInfo, err error) {
+	if t.tokenReviewCache != nil {
+		result, missReason := t.tokenReviewCache.lookup(token)
+		observeTokenReviewCache(missReason)
+
+		if len(missReason) == 0 {
+			return result.userInfo(), nil
+		}
+	}
+
+	if t.circuitBreaker != nil && !t.circuitBreaker.Allow() {
+		return authenticationv1.UserInfo{}, NewErrUnavailable("the TokenReview is not performed since the API server is failing")
+	}
+
+	tr := &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token:     token,
+			Audiences: t.audiences,
+		},
+	}
+
+	reviewCtx, cancel := withTimeout(ctx, t.timeout)
+	defer cancel()
+
+	if err = t.create(reviewCtx, tr); err != nil {
+		t.reportFailure(ctx, err)
+
+		if errors.Is(reviewCtx.Err(), context.DeadlineExceeded) {
+			return authenticationv1.UserInfo{}, NewErrTimeout("the TokenReview timed out")
+		}
+
+		return authenticationv1.UserInfo{}, fmt.Errorf("cannot create TokenReview")
+	}
+
+	if t.circuitBreaker != nil {
+		t.circuitBreaker.Success()
+	}
+
+	if statusErr := tr.Status.Error; len(statusErr) > 0 {
+		RequestLogger(ctx, t.log).V(4).Info("TokenReview failed", "error", statusErr)
+
+		return authenticationv1.UserInfo{}, NewErrUnauthorizedWithDetails("cannot verify the token due to error", statusErr)
+	}
+	// An authenticated review with an empty username would be handled as the anonymous user
+	if !tr.Status.Authenticated || len(tr.Status.User.Username) == 0 {
+		return authenticationv1.UserInfo{}, NewErrUnauthorized("the token is not authenticated")
+	}
+	// The API server returns the intersection of the requested audiences with the token ones
+	if len(t.audiences) > 0 && !sets.NewString(tr.Status.Audiences...).HasAny(t.audiences...) {
+		return authenticationv1.UserInfo{}, NewErrUnauthorized("the token is not issued for the expected audiences")
+	}
+
+	if t.tokenReviewCache != nil {
+		t.tokenReviewCache.addUser(token, tr.Status.User)
+		tokenReviewCacheEntries.Set(float64(t.tokenReviewCache.Len()))
+	}
+
+	return tr.Status.User, nil
+}
+
+// reportFailure reports the failed TokenReview to the circuit breaker, if any: the reviews rejected by the API server,
+// such as with 400 or 403, are answered, while the ones ended by the request context, such as by the client going away
+// or by its timeoutSeconds, have no outcome.
+func (t tokenReview) reportFailure(ctx context.Context, err error) {
+	switch {
+	case t.circuitBreaker == nil:
+	case ctx.Err() != nil:
+		t.circuitBreaker.Cancel()
+	case isServerFailure(err):
+		t.circuitBreaker.Failure()
+	default:
+		t.circuitBreaker.Success()
+	}
+}
+
+// create performs the TokenReview, retrying the transient failures up to the backoff steps while the context allows.
+func (t tokenReview) create(ctx context.Context, tr *authenticationv1.TokenReview) (err error) {
+	ctx, span := tracing.Start(ctx, "TokenReview")
+	defer func() { tracing.End(span, err) }()
+
+	backoff := t.retry
+
+	for {
+		if err = t.client.Create(ctx, tr); err == nil || backoff.Steps < 1 || !isTransient(err) {
+			return err
+		}
+
+		delay := backoff.Step()
+
+		RequestLogger(ctx, t.log).V(4).Info("retrying the TokenReview", "error", err.Error(), "delay", delay.String())
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isTransient reports whether the API server request failed for a temporary condition, worth retrying,
+// rather than for a permanent one.
+func isTransient(err error) bool {
+	return apierr.IsServiceUnavailable(err) || apierr.IsTooManyRequests(err) || apierr.IsServerTimeout(err) || apierr.IsTimeout(err) ||
+		utilnet.IsConnectionReset(err) || utilnet.IsConnectionRefused(err) || utilnet.IsProbableEOF(err)
+}
+
+// isServerFailure reports whether the API server request failed for the API server itself, such as a transient
+// error, a 5xx status, or no response at all, rather than for the request being rejected.
+func isServerFailure(err error) bool {
+	var status apierr.APIStatus
+	if errors.As(err, &status) {
+		return isTransient(err) || status.Status().Code >= h.StatusInternalServerError
+	}
+
+	return !errors.Is(err, context.Canceled)
+}
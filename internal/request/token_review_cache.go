@@ -0,0 +1,139 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/util/cache"
+)
+
+const (
+	tokenReviewCacheSize = 4096
+	// The expired entries are retained for a while, telling apart the expired misses from the not present ones
+	expiredEntryRetention = time.Minute
+)
+
+const (
+	cacheMissNotPresent = "not_present"
+	cacheMissExpired    = "expired"
+)
+
+type tokenReviewResult struct {
+	username  string
+	groups    []string
+	uid       string
+	extra     map[string]authenticationv1.ExtraValue
+	expiresAt time.Time
+}
+
+func (t tokenReviewResult) userInfo() authenticationv1.UserInfo {
+	return authenticationv1.UserInfo{Username: t.username, UID: t.uid, Groups: t.groups, Extra: t.extra}
+}
+
+// TokenReviewCache stores the identities resolved by the TokenReview API, keyed by the token hash
+// to avoid keeping raw tokens in memory: entries expire after the configured TTL, or earlier
+// when the token carries an exp claim.
+type TokenReviewCache struct {
+	ttl   time.Duration
+	cache *cache.LRUExpireCache
+	now   func() time.Time
+}
+
+func NewTokenReviewCache(ttl time.Duration) *TokenReviewCache {
+	return &TokenReviewCache{
+		ttl:   ttl,
+		cache: cache.NewLRUExpireCache(tokenReviewCacheSize),
+		now:   time.Now,
+	}
+}
+
+func (t *TokenReviewCache) Get(token string) (username string, groups []string, ok bool) {
+	result, missReason := t.lookup(token)
+	if len(missReason) > 0 {
+		return "", nil, false
+	}
+
+	return result.username, result.groups, true
+}
+
+// lookup returns the cached result of the token, or the reason of the miss.
+func (t *TokenReviewCache) lookup(token string) (result tokenReviewResult, missReason string) {
+	key := tokenHash(token)
+
+	v, ok := t.cache.Get(key)
+	if !ok {
+		return tokenReviewResult{}, cacheMissNotPresent
+	}
+
+	if result = v.(tokenReviewResult); t.now().After(result.expiresAt) {
+		t.cache.Remove(key)
+
+		return tokenReviewResult{}, cacheMissExpired
+	}
+
+	return result, ""
+}
+
+func (t *TokenReviewCache) Add(token, username string, groups []string) {
+	exp, ok := tokenExpiration(token)
+
+	t.add(token, tokenReviewResult{username: username, groups: groups}, exp, ok)
+}
+
+// addUser caches the full user info of the TokenReview, along with the UID and the extras.
+func (t *TokenReviewCache) addUser(token string, user authenticationv1.UserInfo) {
+	exp, ok := tokenExpiration(token)
+
+	t.add(token, tokenReviewResult{username: user.Username, groups: user.Groups, uid: user.UID, extra: user.Extra}, exp, ok)
+}
+
+func (t *TokenReviewCache) add(token string, result tokenReviewResult, exp time.Time, expires bool) {
+	ttl := t.ttl
+
+	if expires {
+		if untilExp := exp.Sub(t.now()); untilExp < ttl {
+			ttl = untilExp
+		}
+	}
+
+	if ttl <= 0 {
+		return
+	}
+
+	result.expiresAt = t.now().Add(ttl)
+
+	t.cache.Add(tokenHash(token), result, ttl+expiredEntryRetention)
+}
+
+// Len returns the number of the entries held by the cache, including the expired ones still retained.
+func (t *TokenReviewCache) Len() int {
+	return len(t.cache.Keys())
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenExpiration returns the exp claim of the token, when it's a JWT carrying it.
+func tokenExpiration(token string) (time.Time, bool) {
+	claims := jwt.MapClaims{}
+
+	if _, _, err := (&jwt.Parser{}).ParseUnverified(token, claims); err != nil {
+		return time.Time{}, false
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(exp), 0), true
+}
@@ -0,0 +1,129 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+// nolint:testpackage
+package request
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestTokenReviewCache(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		token     string
+		wantCalls int32
+	}{
+		{"opaque token is cached", "opaque-token", 1},
+		{"valid jwt is cached", newTestToken(t, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}), 1},
+		{"expired jwt is not cached", newTestToken(t, jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}), 3},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			var calls int32
+
+			tr := newTestTokenReview()
+			tr.tokenReviewCache = NewTokenReviewCache(time.Minute)
+			tr.client = fakeClient{create: func(_ context.Context, obj client.Object) error {
+				atomic.AddInt32(&calls, 1)
+
+				review := obj.(*authenticationv1.TokenReview)
+				review.Status.Authenticated = true
+				review.Status.User.Username = "alice"
+				review.Status.User.Groups = []string{"capsule.clastix.io"}
+
+				return nil
+			}}
+
+			for i := 0; i < 3; i++ {
+				user, err := tr.processBearerToken(context.Background(), eachTest.token)
+				if err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+
+				if user.Username != "alice" {
+					t.Errorf("got username %s, want alice", user.Username)
+				}
+			}
+
+			if calls != eachTest.wantCalls {
+				t.Errorf("got %d TokenReview calls, want %d", calls, eachTest.wantCalls)
+			}
+		})
+	}
+}
+
+// nolint:paralleltest
+func TestTokenReviewCacheMetrics(t *testing.T) {
+	now := time.Now()
+
+	tr := newTestTokenReview()
+	tr.tokenReviewCache = NewTokenReviewCache(time.Minute)
+	tr.tokenReviewCache.now = func() time.Time {
+		return now
+	}
+	tr.client = fakeClient{create: func(_ context.Context, obj client.Object) error {
+		review := obj.(*authenticationv1.TokenReview)
+		review.Status.Authenticated = true
+		review.Status.User.Username = "alice"
+
+		return nil
+	}}
+
+	hits := testutil.ToFloat64(tokenReviewCacheHitsTotal)
+	notPresent := testutil.ToFloat64(tokenReviewCacheMissesTotal.WithLabelValues(cacheMissNotPresent))
+	expired := testutil.ToFloat64(tokenReviewCacheMissesTotal.WithLabelValues(cacheMissExpired))
+
+	steps := []struct {
+		elapsed        time.Duration
+		hits           float64
+		notPresent     float64
+		expired        float64
+		wantCacheEntry int
+	}{
+		{0, 0, 1, 0, 1},
+		{30 * time.Second, 1, 1, 0, 1},
+		{2 * time.Minute, 1, 1, 1, 1},
+		{2 * time.Minute, 2, 1, 1, 1},
+	}
+
+	start := now
+
+	for i, step := range steps {
+		now = start.Add(step.elapsed)
+
+		if _, err := tr.processBearerToken(context.Background(), "opaque-token"); err != nil {
+			t.Fatalf("step %d: got error: %v", i, err)
+		}
+
+		if got := testutil.ToFloat64(tokenReviewCacheHitsTotal) - hits; got != step.hits {
+			t.Errorf("step %d: got %v hits, want %v", i, got, step.hits)
+		}
+
+		if got := testutil.ToFloat64(tokenReviewCacheMissesTotal.WithLabelValues(cacheMissNotPresent)) - notPresent; got != step.notPresent {
+			t.Errorf("step %d: got %v not present misses, want %v", i, got, step.notPresent)
+		}
+
+		if got := testutil.ToFloat64(tokenReviewCacheMissesTotal.WithLabelValues(cacheMissExpired)) - expired; got != step.expired {
+			t.Errorf("step %d: got %v expired misses, want %v", i, got, step.expired)
+		}
+
+		if got := tr.tokenReviewCache.Len(); got != step.wantCacheEntry {
+			t.Errorf("step %d: got %d cache entries, want %d", i, got, step.wantCacheEntry)
+		}
+	}
+}
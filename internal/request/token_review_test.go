@@ -0,0 +1,507 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+// nolint:testpackage
+package request
+
+import (
+	"context"
+	"errors"
+	h "net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func newTestTokenReview() tokenReview {
+	return tokenReview{log: logr.Discard()}
+}
+
+func TestProcessBearerTokenStatusError(t *testing.T) {
+	t.Parallel()
+
+	tr := newTestTokenReview()
+	tr.client = fakeClient{create: func(_ context.Context, obj client.Object) error {
+		obj.(*authenticationv1.TokenReview).Status.Error = "token has expired"
+
+		return nil
+	}}
+
+	_, err := tr.processBearerToken(context.Background(), "opaque-token")
+
+	var unauthorized *ErrUnauthorized
+	if !errors.As(err, &unauthorized) {
+		t.Fatalf("expected unauthorized error, got %v", err)
+	}
+
+	if strings.Contains(unauthorized.Error(), "token has expired") {
+		t.Errorf("error message %q is leaking the TokenReview error", unauthorized.Error())
+	}
+
+	if unauthorized.Details() != "token has expired" {
+		t.Errorf("got details %q, want %q", unauthorized.Details(), "token has expired")
+	}
+}
+
+func TestProcessBearerTokenAudiences(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		audiences []string
+		reviewed  []string
+		err       bool
+	}{
+		{"no expected audiences", nil, []string{"https://kubernetes.default.svc"}, false},
+		{"matching audience", []string{"capsule-proxy"}, []string{"capsule-proxy"}, false},
+		{"not matching audience", []string{"capsule-proxy"}, []string{}, true},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			tr := newTestTokenReview()
+			tr.audiences = eachTest.audiences
+			tr.client = fakeClient{create: func(_ context.Context, obj client.Object) error {
+				review := obj.(*authenticationv1.TokenReview)
+				if !reflect.DeepEqual(review.Spec.Audiences, eachTest.audiences) {
+					t.Errorf("got requested audiences %v, want %v", review.Spec.Audiences, eachTest.audiences)
+				}
+
+				review.Status.Authenticated = true
+				review.Status.User.Username = "alice"
+				review.Status.Audiences = eachTest.reviewed
+
+				return nil
+			}}
+
+			_, err := tr.processBearerToken(context.Background(), "opaque-token")
+			if eachTest.err {
+				var unauthorized *ErrUnauthorized
+				if !errors.As(err, &unauthorized) {
+					t.Errorf("expected unauthorized error, got %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Errorf("got error: %v", err)
+			}
+		})
+	}
+}
+
+func TestProcessBearerTokenTimeout(t *testing.T) {
+	t.Parallel()
+
+	tr := newTestTokenReview()
+	tr.timeout = 10 * time.Millisecond
+	// Blocking until the deadline, as a hung API server would do
+	tr.client = fakeClient{create: func(ctx context.Context, _ client.Object) error {
+		<-ctx.Done()
+
+		return ctx.Err()
+	}}
+
+	_, err := tr.processBearerToken(context.Background(), "opaque-token")
+
+	var timeout *ErrTimeout
+	if !errors.As(err, &timeout) {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+}
+
+func TestResolveOpaqueTokenContainingScheme(t *testing.T) {
+	t.Parallel()
+
+	const token = "opaque Bearer token"
+
+	tr := newTestTokenReview()
+	tr.client = fakeClient{create: func(_ context.Context, obj client.Object) error {
+		review := obj.(*authenticationv1.TokenReview)
+		if review.Spec.Token != token {
+			t.Errorf("got token %q, want %q", review.Spec.Token, token)
+		}
+
+		review.Status.Authenticated = true
+		review.Status.User.Username = "alice"
+
+		return nil
+	}}
+
+	r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	if _, _, err := tr.Resolve(r); err != nil {
+		t.Errorf("got error: %v", err)
+	}
+}
+
+func TestProcessBearerTokenEmptyUsername(t *testing.T) {
+	t.Parallel()
+
+	tr := newTestTokenReview()
+	tr.tokenReviewCache = NewTokenReviewCache(time.Minute)
+	tr.client = fakeClient{create: func(_ context.Context, obj client.Object) error {
+		review := obj.(*authenticationv1.TokenReview)
+		review.Status.Authenticated = true
+		review.Status.User.Groups = []string{"system:authenticated"}
+
+		return nil
+	}}
+
+	_, err := tr.processBearerToken(context.Background(), "opaque-token")
+
+	var unauthorized *ErrUnauthorized
+	if !errors.As(err, &unauthorized) {
+		t.Fatalf("expected unauthorized error, got %v", err)
+	}
+
+	if _, _, ok := tr.tokenReviewCache.Get("opaque-token"); ok {
+		t.Error("expected the rejected review not to be cached")
+	}
+}
+
+func TestProcessBearerTokenNotAuthenticated(t *testing.T) {
+	t.Parallel()
+
+	tr := newTestTokenReview()
+	// No error is reported for an unrecognized, yet syntactically valid, token
+	tr.client = fakeClient{create: func(_ context.Context, obj client.Object) error {
+		review := obj.(*authenticationv1.TokenReview)
+		review.Status.Authenticated = false
+		review.Status.User.Username = "alice"
+
+		return nil
+	}}
+
+	_, err := tr.processBearerToken(context.Background(), "opaque-token")
+
+	var unauthorized *ErrUnauthorized
+	if !errors.As(err, &unauthorized) {
+		t.Errorf("expected unauthorized error, got %v", err)
+	}
+}
+
+func TestProcessBearerTokenCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+
+	var calls int
+
+	var failing bool
+
+	tr := newTestTokenReview()
+	tr.circuitBreaker = NewCircuitBreaker(2, time.Minute, 30*time.Second)
+	tr.circuitBreaker.now = func() time.Time { return now }
+	tr.client = fakeClient{create: func(_ context.Context, obj client.Object) error {
+		calls++
+
+		if failing {
+			return errors.New("the server is currently unable to handle the request")
+		}
+
+		review := obj.(*authenticationv1.TokenReview)
+		review.Status.Authenticated = true
+		review.Status.User.Username = "alice"
+
+		return nil
+	}}
+
+	process := func() error {
+		_, err := tr.processBearerToken(context.Background(), "opaque-token")
+
+		return err
+	}
+
+	failing = true
+
+	for i := 0; i < 2; i++ {
+		if err := process(); err == nil {
+			t.Fatal("expected the failing TokenReview to return an error")
+		}
+	}
+
+	var unavailable *ErrUnavailable
+	if err := process(); !errors.As(err, &unavailable) {
+		t.Fatalf("expected unavailable error with the open circuit, got %v", err)
+	}
+
+	if calls != 2 {
+		t.Errorf("got %d TokenReview requests, want 2 since the open circuit is fast-failing", calls)
+	}
+	// The trial request failing opens the circuit again
+	now = now.Add(30 * time.Second)
+
+	if err := process(); err == nil || errors.As(err, &unavailable) {
+		t.Fatalf("expected the trial TokenReview to be performed, got %v", err)
+	}
+
+	if err := process(); !errors.As(err, &unavailable) {
+		t.Fatalf("expected unavailable error with the reopened circuit, got %v", err)
+	}
+	// The trial request succeeding closes the circuit
+	now = now.Add(30 * time.Second)
+	failing = false
+
+	for i := 0; i < 2; i++ {
+		if err := process(); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+	}
+
+	if calls != 5 {
+		t.Errorf("got %d TokenReview requests, want 5", calls)
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+
+	cb := NewCircuitBreaker(2, time.Minute, time.Minute)
+	cb.now = func() time.Time { return now }
+
+	cb.Failure()
+	// The first failure is out of the window, thus not consecutive within it
+	now = now.Add(2 * time.Minute)
+	cb.Failure()
+
+	if !cb.Allow() {
+		t.Fatal("expected the circuit to be closed")
+	}
+
+	cb.Failure()
+
+	if cb.Allow() {
+		t.Error("expected the circuit to be open")
+	}
+}
+
+func TestProcessBearerTokenCircuitBreakerFailures(t *testing.T) {
+	t.Parallel()
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		open bool
+	}{
+		{"unavailable", context.Background(), apierr.NewServiceUnavailable("the server is currently unable to handle the request"), true},
+		{"internal error", context.Background(), apierr.NewInternalError(errors.New("etcd is down")), true},
+		{"too many requests", context.Background(), apierr.NewTooManyRequests("the server is throttling", 1), true},
+		{"connection refused", context.Background(), syscall.ECONNREFUSED, true},
+		{"bad request", context.Background(), apierr.NewBadRequest("the TokenReview is not valid"), false},
+		{"forbidden", context.Background(), apierr.NewForbidden(schema.GroupResource{Group: "authentication.k8s.io", Resource: "tokenreviews"}, "", errors.New("not allowed")), false},
+		{"canceled by the client", canceled, context.Canceled, false},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			tr := newTestTokenReview()
+			tr.circuitBreaker = NewCircuitBreaker(1, time.Minute, time.Minute)
+			tr.client = fakeClient{create: func(context.Context, client.Object) error {
+				return eachTest.err
+			}}
+
+			if _, err := tr.processBearerToken(eachTest.ctx, "opaque-token"); err == nil {
+				t.Fatal("expected the failing TokenReview to return an error")
+			}
+
+			if open := !tr.circuitBreaker.Allow(); open != eachTest.open {
+				t.Errorf("got the circuit open %t, want %t", open, eachTest.open)
+			}
+		})
+	}
+}
+
+func TestProcessBearerTokenTimeoutCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		ctx     func() (context.Context, context.CancelFunc)
+		open    bool
+	}{
+		{"upstream timeout", 10 * time.Millisecond, func() (context.Context, context.CancelFunc) {
+			return context.WithCancel(context.Background())
+		}, true},
+		{"request deadline", time.Minute, func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 10*time.Millisecond)
+		}, false},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			tr := newTestTokenReview()
+			tr.timeout = eachTest.timeout
+			tr.circuitBreaker = NewCircuitBreaker(1, time.Minute, time.Minute)
+			tr.client = fakeClient{create: func(ctx context.Context, _ client.Object) error {
+				<-ctx.Done()
+
+				return ctx.Err()
+			}}
+
+			ctx, cancel := eachTest.ctx()
+			defer cancel()
+
+			if _, err := tr.processBearerToken(ctx, "opaque-token"); err == nil {
+				t.Fatal("expected the hung TokenReview to return an error")
+			}
+			// The timeoutSeconds of the request is not the API server failing
+			if open := !tr.circuitBreaker.Allow(); open != eachTest.open {
+				t.Errorf("got the circuit open %t, want %t", open, eachTest.open)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerCancel(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+
+	cb := NewCircuitBreaker(1, time.Minute, time.Minute)
+	cb.now = func() time.Time { return now }
+
+	cb.Failure()
+
+	now = now.Add(time.Minute)
+
+	if !cb.Allow() {
+		t.Fatal("expected the trial call to be allowed")
+	}
+	// The canceled trial call lets the next one through
+	cb.Cancel()
+
+	if !cb.Allow() {
+		t.Error("expected the next trial call to be allowed")
+	}
+}
+
+func TestProcessBearerTokenRetry(t *testing.T) {
+	t.Parallel()
+
+	unavailable := apierr.NewServiceUnavailable("the server is currently unable to handle the request")
+
+	tests := []struct {
+		name      string
+		failures  []error
+		retries   int
+		wantCalls int
+		err       bool
+	}{
+		{"transient failures", []error{unavailable, syscall.ECONNRESET}, 2, 3, false},
+		{"retries exhausted", []error{unavailable, unavailable, unavailable}, 2, 3, true},
+		{"permanent failure", []error{apierr.NewForbidden(schema.GroupResource{Group: "authentication.k8s.io", Resource: "tokenreviews"}, "", errors.New("denied"))}, 2, 1, true},
+		{"no retries", []error{unavailable}, 0, 1, true},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			var calls int
+
+			tr := newTestTokenReview()
+			tr.retry = wait.Backoff{Duration: time.Millisecond, Factor: 2, Steps: eachTest.retries}
+			tr.client = fakeClient{create: func(_ context.Context, obj client.Object) error {
+				calls++
+
+				if calls <= len(eachTest.failures) {
+					return eachTest.failures[calls-1]
+				}
+
+				review := obj.(*authenticationv1.TokenReview)
+				review.Status.Authenticated = true
+				review.Status.User.Username = "alice"
+
+				return nil
+			}}
+
+			user, err := tr.processBearerToken(context.Background(), "opaque-token")
+			if (err != nil) != eachTest.err {
+				t.Fatalf("got error %v, want error %t", err, eachTest.err)
+			}
+
+			if !eachTest.err && user.Username != "alice" {
+				t.Errorf("got username %s, want alice", user.Username)
+			}
+
+			if calls != eachTest.wantCalls {
+				t.Errorf("got %d TokenReview requests, want %d", calls, eachTest.wantCalls)
+			}
+		})
+	}
+}
+
+func TestProcessBearerTokenUserExtra(t *testing.T) {
+	t.Parallel()
+
+	user := authenticationv1.UserInfo{
+		Username: "system:serviceaccount:default:builder",
+		UID:      "0c9c7e8a-0a4f-4a1e-9f1e-7d3c0b6f1a2b",
+		Groups:   []string{"system:serviceaccounts"},
+		Extra: map[string]authenticationv1.ExtraValue{
+			"authentication.kubernetes.io/pod-name": {"builder-7d9f"},
+			"scopes.example.com":                    {"read", "write"},
+		},
+	}
+
+	var reviews int
+
+	tr := newTestTokenReview()
+	tr.tokenReviewCache = NewTokenReviewCache(time.Minute)
+	tr.client = fakeClient{create: func(_ context.Context, obj client.Object) error {
+		reviews++
+
+		review := obj.(*authenticationv1.TokenReview)
+		review.Status.Authenticated, review.Status.User = true, user
+
+		return nil
+	}}
+
+	r := httptest.NewRequest(h.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("Authorization", "Bearer opaque-token")
+	// The cached user info carries the UID and the extras as well
+	for i := 0; i < 2; i++ {
+		got, err := tr.ResolveUser(r)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+
+		if !reflect.DeepEqual(got, user) {
+			t.Errorf("got user %+v, want %+v", got, user)
+		}
+	}
+
+	if reviews != 1 {
+		t.Errorf("got %d TokenReviews, want the second one served by the cache", reviews)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request
+
+import (
+	"regexp"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+// UsernameTransformer rewrites the resolved username, such as stripping a realm suffix.
+type UsernameTransformer func(username string) string
+
+// GroupsTransformer rewrites the resolved groups, such as mapping LDAP DNs to short names.
+type GroupsTransformer func(groups []string) []string
+
+// The Groups transformer is applied once to the authenticated groups, and to the impersonated ones, before the
+// impersonation checks: the groups filtered out are not honored by the SubjectAccessReviews either. The other
+// transformers are applied to the identity right before GetUserAndGroups returns, thus after the impersonation: the
+// effective identity is transformed consistently, regardless it has been impersonated or not. AdditionalGroups are added to the groups of any user but the anonymous one, after the Groups transformer, thus
+// regardless of the identity provider. AuthenticatedGroup adds the system:authenticated group, or
+// system:unauthenticated for the anonymous user, as the API server does.
+type Transformers struct {
+	Username           UsernameTransformer
+	Groups             GroupsTransformer
+	AdditionalGroups   []string
+	AuthenticatedGroup bool
+}
+
+func NoopUsernameTransformer(username string) string {
+	return username
+}
+
+func NoopGroupsTransformer(groups []string) []string {
+	return groups
+}
+
+// RegexGroupsTransformer returns the GroupsTransformer keeping the groups matching the allow regex, if any,
+// and dropping the ones matching the deny regex, if any: the deny one takes precedence.
+func RegexGroupsTransformer(allow, deny *regexp.Regexp) GroupsTransformer {
+	return func(groups []string) []string {
+		if allow == nil && deny == nil {
+			return groups
+		}
+		// Filtering in place the copy
+		filtered := copyGroups(groups, 0)[:0]
+
+		for _, group := range groups {
+			if allow != nil && !allow.MatchString(group) {
+				continue
+			}
+
+			if deny != nil && deny.MatchString(group) {
+				continue
+			}
+
+			filtered = append(filtered, group)
+		}
+
+		return filtered
+	}
+}
+
+// DefaultTransformers returns the Transformers leaving the identity untouched.
+func DefaultTransformers() Transformers {
+	return Transformers{
+		Username: NoopUsernameTransformer,
+		Groups:   NoopGroupsTransformer,
+	}
+}
+
+func (t Transformers) groups(groups []string) []string {
+	if t.Groups == nil {
+		return groups
+	}
+
+	return t.Groups(groups)
+}
+
+func (t Transformers) apply(username string, groups []string) (string, []string) {
+	if t.Username != nil {
+		username = t.Username(username)
+	}
+
+	if len(t.AdditionalGroups) > 0 && len(username) > 0 && username != user.Anonymous {
+		groups = withAdditionalGroups(groups, t.AdditionalGroups)
+	}
+
+	if t.AuthenticatedGroup {
+		groups = withAuthenticatedGroup(username, groups)
+	}
+
+	return username, groups
+}
+
+func withAdditionalGroups(groups, additional []string) []string {
+	current := sets.NewString(groups...)
+	merged := copyGroups(groups, len(additional))
+
+	for _, group := range additional {
+		if !current.Has(group) {
+			current.Insert(group)
+			merged = append(merged, group)
+		}
+	}
+
+	return merged
+}
+
+func withAuthenticatedGroup(username string, groups []string) []string {
+	group := user.AllAuthenticated
+	if username == user.Anonymous {
+		group = user.AllUnauthenticated
+	}
+
+	for _, g := range groups {
+		if g == group {
+			return groups
+		}
+	}
+	return append(copyGroups(groups, 1), group)
+}
+
+// copyGroups returns a copy of the groups, with room for the given number of additional ones: the resolved groups
+// must not be modified in place, since these could be shared with the caches, such as the TokenReview one.
+func copyGroups(groups []string, additional int) []string {
+	return append(make([]string, 0, len(groups)+additional), groups...)
+}
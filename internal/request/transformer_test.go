@@ -0,0 +1,131 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+// nolint:testpackage
+package request
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestAuthenticatedGroup(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		username string
+		groups   []string
+		want     []string
+	}{
+		{"authenticated", "alice", []string{"capsule.clastix.io"}, []string{"capsule.clastix.io", "system:authenticated"}},
+		{"already present", "alice", []string{"system:authenticated", "capsule.clastix.io"}, []string{"system:authenticated", "capsule.clastix.io"}},
+		{"without groups", "alice", nil, []string{"system:authenticated"}},
+		{"anonymous", "system:anonymous", nil, []string{"system:unauthenticated"}},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			groups := make([]string, len(eachTest.groups), len(eachTest.groups)+1)
+			copy(groups, eachTest.groups)
+
+			_, got := Transformers{AuthenticatedGroup: true}.apply(eachTest.username, groups)
+			if !reflect.DeepEqual(got, eachTest.want) {
+				t.Errorf("got groups %v, want %v", got, eachTest.want)
+			}
+			// The resolved groups must not be modified in place
+			if len(groups) > 0 && !reflect.DeepEqual(groups, eachTest.groups) {
+				t.Errorf("resolved groups modified to %v", groups)
+			}
+		})
+	}
+}
+
+func TestAdditionalGroups(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		username string
+		groups   []string
+		want     []string
+	}{
+		{"authenticated", "alice", []string{"capsule.clastix.io"}, []string{"capsule.clastix.io", "shared-readers", "system:authenticated"}},
+		{"already present", "alice", []string{"shared-readers", "capsule.clastix.io"}, []string{"shared-readers", "capsule.clastix.io", "system:authenticated"}},
+		{"filtered groups", "alice", []string{"ldap:admins"}, []string{"shared-readers", "system:authenticated"}},
+		{"anonymous", "system:anonymous", nil, []string{"system:unauthenticated"}},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			groups := make([]string, len(eachTest.groups), len(eachTest.groups)+2)
+			copy(groups, eachTest.groups)
+
+			transformers := Transformers{
+				Groups:             RegexGroupsTransformer(nil, regexp.MustCompile("^ldap:")),
+				AdditionalGroups:   []string{"shared-readers"},
+				AuthenticatedGroup: true,
+			}
+
+			_, got := transformers.apply(eachTest.username, transformers.groups(groups))
+			if !reflect.DeepEqual(got, eachTest.want) {
+				t.Errorf("got groups %v, want %v", got, eachTest.want)
+			}
+			// The resolved groups must not be modified in place
+			if len(groups) > 0 && !reflect.DeepEqual(groups, eachTest.groups) {
+				t.Errorf("resolved groups modified to %v", groups)
+			}
+		})
+	}
+}
+
+func TestRegexGroupsTransformer(t *testing.T) {
+	t.Parallel()
+	// The noisy IdP groups along with a few Capsule ones
+	groups := make([]string, 0, 1003)
+	for i := 0; i < 1000; i++ {
+		groups = append(groups, fmt.Sprintf("idp-distribution-list-%d", i))
+	}
+
+	groups = append(groups, "capsule-oil", "capsule-gas", "capsule-admins")
+
+	tests := []struct {
+		name  string
+		allow *regexp.Regexp
+		deny  *regexp.Regexp
+		want  []string
+	}{
+		{"allow", regexp.MustCompile("^capsule-"), nil, []string{"capsule-oil", "capsule-gas", "capsule-admins"}},
+		{"deny takes precedence", regexp.MustCompile("^capsule-"), regexp.MustCompile("^capsule-admins$"), []string{"capsule-oil", "capsule-gas"}},
+		{"deny only", nil, regexp.MustCompile("^idp-"), []string{"capsule-oil", "capsule-gas", "capsule-admins"}},
+		{"disabled", nil, nil, groups},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			transformers := Transformers{Groups: RegexGroupsTransformer(eachTest.allow, eachTest.deny), AuthenticatedGroup: true}
+
+			_, got := transformers.apply("alice", transformers.groups(groups))
+
+			want := append(append([]string{}, eachTest.want...), "system:authenticated")
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %d groups, want %v", len(got), want)
+			}
+		})
+	}
+
+	if len(groups) != 1003 || groups[0] != "idp-distribution-list-0" {
+		t.Error("resolved groups modified in place")
+	}
+}
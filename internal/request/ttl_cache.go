@@ -0,0 +1,47 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request
+
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/cache"
+)
+
+const ttlCacheSize = 4096
+
+// TTLCache stores the values by key up to the configured TTL, such as the groups resolved by the username.
+type TTLCache struct {
+	ttl   time.Duration
+	cache *cache.LRUExpireCache
+}
+
+func NewTTLCache(ttl time.Duration) *TTLCache {
+	return &TTLCache{
+		ttl:   ttl,
+		cache: cache.NewLRUExpireCache(ttlCacheSize),
+	}
+}
+
+func (t *TTLCache) Get(key string) (interface{}, bool) {
+	return t.cache.Get(key)
+}
+
+func (t *TTLCache) Add(key string, value interface{}) {
+	t.cache.Add(key, value, t.ttl)
+}
+
+// AddUntil stores the value up to the given expiration, bounded by the TTL: the already expired values are not stored.
+func (t *TTLCache) AddUntil(key string, value interface{}, exp time.Time) {
+	ttl := t.ttl
+	if untilExp := time.Until(exp); untilExp < ttl {
+		ttl = untilExp
+	}
+
+	if ttl <= 0 {
+		return
+	}
+
+	t.cache.Add(key, value, ttl)
+}
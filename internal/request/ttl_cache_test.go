@@ -0,0 +1,39 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/clastix/capsule-proxy/internal/request"
+)
+
+func TestTTLCache(t *testing.T) {
+	t.Parallel()
+
+	c := request.NewTTLCache(time.Hour)
+
+	c.Add("alice", []string{"capsule.clastix.io"})
+	c.AddUntil("bob", []string{"ops"}, time.Now().Add(-time.Second))
+	c.AddUntil("carol", []string{"dev"}, time.Now().Add(20*time.Millisecond))
+
+	if v, ok := c.Get("alice"); !ok || v.([]string)[0] != "capsule.clastix.io" {
+		t.Errorf("got %v (%t), want the cached groups", v, ok)
+	}
+
+	if _, ok := c.Get("bob"); ok {
+		t.Error("got the already expired value cached")
+	}
+
+	if _, ok := c.Get("carol"); !ok {
+		t.Error("got the value expired before its expiration")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if _, ok := c.Get("carol"); ok {
+		t.Error("got the value cached after its expiration")
+	}
+}
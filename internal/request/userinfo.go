@@ -0,0 +1,135 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	h "net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// resolvedIdentity is the identity resolved by the identity provider, cached by the token hash.
+type resolvedIdentity struct {
+	username string
+	groups   []string
+}
+
+type userInfo struct {
+	log                 logr.Logger
+	url                 func() string
+	claimMapping        ClaimMapping
+	cache               *TTLCache
+	tokenQueryParameter string
+	timeout             time.Duration
+	client              *h.Client
+}
+
+// NewUserInfoAuthenticator returns the Authenticator resolving the identity of the opaque access tokens, the ones
+// that are not a JWT, querying the OIDC UserInfo endpoint: the returned claims are mapped as the JWT ones.
+// The tokens rejected by the endpoint are left to the next Authenticator, such as the TokenReview one,
+// while the resolved identities are cached by the token hash, if a cache is provided.
+func NewUserInfoAuthenticator(url string, claimMapping ClaimMapping, cache *TTLCache, tokenQueryParameter string, timeout time.Duration) Authenticator {
+	return &userInfo{
+		log: ctrl.Log.WithName("userinfo"),
+		url: func() string {
+			return url
+		},
+		claimMapping:        claimMapping,
+		cache:               cache,
+		tokenQueryParameter: tokenQueryParameter,
+		timeout:             timeout,
+		client:              &h.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// NewDiscoveryUserInfoAuthenticator returns the UserInfo Authenticator querying the endpoint of the OIDC discovery document.
+func NewDiscoveryUserInfoAuthenticator(discovery *Discovery, claimMapping ClaimMapping, cache *TTLCache, tokenQueryParameter string, timeout time.Duration) Authenticator {
+	authenticator := NewUserInfoAuthenticator("", claimMapping, cache, tokenQueryParameter, timeout).(*userInfo) // nolint:forcetypeassert
+	authenticator.url = discovery.UserInfoURL
+
+	return authenticator
+}
+
+func (u userInfo) AuthType() string {
+	return AuthTypeUserInfo
+}
+
+func (u userInfo) Resolve(request *h.Request) (username string, groups []string, err error) {
+	token := RequestBearerToken(request, u.tokenQueryParameter)
+	if len(token) == 0 || IsJwtToken(token) {
+		return "", nil, ErrNoCredentials
+	}
+
+	if u.cache != nil {
+		if cached, ok := u.cache.Get(tokenHash(token)); ok {
+			if identity, ok := cached.(resolvedIdentity); ok {
+				return identity.username, identity.groups, nil
+			}
+		}
+	}
+
+	claims, err := u.claims(request.Context(), token)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if username, groups, err = u.claimMapping.identity(claims, "UserInfo"); err != nil {
+		return "", nil, err
+	}
+
+	if u.cache != nil {
+		u.cache.Add(tokenHash(token), resolvedIdentity{username: username, groups: groups})
+	}
+
+	return username, groups, nil
+}
+
+func (u userInfo) claims(ctx context.Context, token string) (map[string]interface{}, error) {
+	ctx, cancel := withTimeout(ctx, u.timeout)
+	defer cancel()
+
+	r, err := h.NewRequestWithContext(ctx, h.MethodGet, u.url(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create UserInfo request: %w", err)
+	}
+
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("Accept", "application/json")
+
+	resp, err := u.client.Do(r)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, NewErrTimeout("the UserInfo request timed out")
+		}
+
+		return nil, fmt.Errorf("cannot query UserInfo: %w", err)
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	switch resp.StatusCode {
+	case h.StatusOK:
+	case h.StatusUnauthorized, h.StatusForbidden:
+		RequestLogger(ctx, u.log).V(4).Info("UserInfo rejected the token", "status", resp.StatusCode)
+
+		return nil, ErrNoCredentials
+	default:
+		return nil, fmt.Errorf("returned status code from UserInfo is %d, expected 200", resp.StatusCode)
+	}
+
+	claims := map[string]interface{}{}
+	if err = json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("cannot decode UserInfo: %w", err)
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package request_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	"github.com/clastix/capsule-proxy/internal/request"
+)
+
+func TestUserInfo(t *testing.T) {
+	t.Parallel()
+
+	var calls int64
+
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+
+		if r.Header.Get("Authorization") != "Bearer opaque-token" {
+			writer.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		_ = json.NewEncoder(writer).Encode(map[string]interface{}{
+			"sub":                "1234",
+			"preferred_username": "alice",
+			"groups":             []string{"capsule.clastix.io"},
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	mapping := request.ClaimMapping{UsernameFields: []string{"preferred_username"}, GroupsFields: []string{"groups"}, UsernamePrefix: "oidc:"}
+	authenticator := request.NewUserInfoAuthenticator(srv.URL, mapping, request.NewTTLCache(time.Minute), "", 0)
+
+	resolve := func(token string) (string, []string, error) {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+
+		return authenticator.Resolve(r)
+	}
+
+	for i := 0; i < 2; i++ {
+		username, groups, err := resolve("opaque-token")
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+
+		if username != "oidc:alice" || !reflect.DeepEqual(groups, []string{"capsule.clastix.io"}) {
+			t.Errorf("got %s and %v, want oidc:alice and [capsule.clastix.io]", username, groups)
+		}
+	}
+
+	if got := atomic.LoadInt64(&calls); got != 1 {
+		t.Errorf("got %d UserInfo requests, want 1 with the cached identity", got)
+	}
+
+	if _, _, err := resolve("revoked-token"); !errors.Is(err, request.ErrNoCredentials) {
+		t.Errorf("expected the rejected token to be left to the next authenticator, got %v", err)
+	}
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "alice"}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("cannot sign token: %v", err)
+	}
+
+	if _, _, err = resolve(signed); !errors.Is(err, request.ErrNoCredentials) {
+		t.Errorf("expected the JWT to be left to the JWT authenticator, got %v", err)
+	}
+
+	if got := atomic.LoadInt64(&calls); got != 2 {
+		t.Errorf("got %d UserInfo requests, want 2", got)
+	}
+}
+
+func TestUserInfoMissingUsername(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(writer).Encode(map[string]interface{}{"sub": "1234"})
+	}))
+	t.Cleanup(srv.Close)
+
+	mapping := request.ClaimMapping{UsernameFields: []string{"preferred_username"}}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("Authorization", "Bearer opaque-token")
+
+	_, _, err := request.NewUserInfoAuthenticator(srv.URL, mapping, nil, "", 0).Resolve(r)
+	if err == nil || err.Error() != "missing users claim in UserInfo, tried preferred_username" {
+		t.Errorf("got error %v, want the missing users claim", err)
+	}
+}
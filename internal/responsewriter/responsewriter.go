@@ -0,0 +1,47 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package responsewriter
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Wrapper forwards the Flush and Hijack calls to the wrapped writer, required by the streamed responses, such as
+// the watches, and by the upgraded connections: the wrapping writers embed it, overriding WriteHeader.
+type Wrapper struct {
+	http.ResponseWriter
+}
+
+func (w Wrapper) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w Wrapper) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("writer is not http.Hijacker")
+	}
+
+	return hijacker.Hijack()
+}
+
+// StatusRecorder records the status code of the response, 200 unless written otherwise.
+type StatusRecorder struct {
+	Wrapper
+	StatusCode int
+}
+
+func NewStatusRecorder(writer http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{Wrapper: Wrapper{ResponseWriter: writer}, StatusCode: http.StatusOK}
+}
+
+func (s *StatusRecorder) WriteHeader(statusCode int) {
+	s.StatusCode = statusCode
+	s.ResponseWriter.WriteHeader(statusCode)
+}
@@ -0,0 +1,39 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package responsewriter_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/clastix/capsule-proxy/internal/responsewriter"
+)
+
+func TestStatusRecorder(t *testing.T) {
+	t.Parallel()
+
+	rw := httptest.NewRecorder()
+	recorder := responsewriter.NewStatusRecorder(rw)
+
+	if recorder.StatusCode != http.StatusOK {
+		t.Errorf("got default status code %d, want 200", recorder.StatusCode)
+	}
+
+	recorder.WriteHeader(http.StatusNotFound)
+	_, _ = recorder.Write([]byte("not found"))
+	recorder.Flush()
+
+	if recorder.StatusCode != http.StatusNotFound || rw.Code != http.StatusNotFound {
+		t.Errorf("got recorded status code %d and written %d, want 404", recorder.StatusCode, rw.Code)
+	}
+
+	if !rw.Flushed {
+		t.Error("got the response not flushed, want Flush forwarded to the wrapped writer")
+	}
+	// The recorder is not a Hijacker
+	if _, _, err := recorder.Hijack(); err == nil {
+		t.Error("got no error hijacking a writer not supporting it")
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/clastix/capsule-proxy/internal/responsewriter"
+)
+
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+
+	instrumentationName = "github.com/clastix/capsule-proxy"
+)
+
+// Setup registers the global TracerProvider exporting the spans with the given exporter, sampling the new traces
+// with the given ratio while honouring the sampling decision of the incoming ones: the W3C Trace Context is both
+// extracted from the requests and injected in the outgoing ones. The returned function flushes the pending spans.
+func Setup(ctx context.Context, exporter, otlpEndpoint string, samplingRatio float64) (shutdown func(context.Context) error, err error) {
+	if samplingRatio < 0 || samplingRatio > 1 {
+		return nil, fmt.Errorf("the tracing sampling ratio %v must be between 0 and 1", samplingRatio)
+	}
+
+	var spanExporter sdktrace.SpanExporter
+
+	switch exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		var opts []otlptracehttp.Option
+		if len(otlpEndpoint) > 0 {
+			opts = append(opts, otlptracehttp.WithEndpoint(otlpEndpoint))
+		}
+
+		spanExporter, err = otlptracehttp.New(ctx, opts...)
+	case ExporterStdout:
+		spanExporter, err = stdouttrace.New()
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %s, use %s, %s, or %s", exporter, ExporterNone, ExporterOTLP, ExporterStdout)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot create the %s tracing exporter: %w", exporter, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(samplingRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceNameKey.String("capsule-proxy"))),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the Tracer of the proxy from the global TracerProvider, a no-op one unless Setup registered it.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Start starts the span as a child of the one in the context, returning the context carrying the new span.
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// End records the error, if any, on the span before ending it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// Inject propagates the span of the context to the outgoing request headers, such as traceparent.
+func Inject(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// Middleware starts the server span of each request, as a child of the one propagated by the client with the
+// traceparent header, if any: the handlers retrieve it from the request context to start their own spans.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+
+		ctx, span := Tracer().Start(ctx, "HTTP "+request.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			semconv.HTTPMethodKey.String(request.Method),
+			semconv.HTTPTargetKey.String(request.URL.Path),
+		))
+		defer span.End()
+
+		rw := responsewriter.NewStatusRecorder(writer)
+		next.ServeHTTP(rw, request.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(rw.StatusCode))
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(rw.StatusCode, trace.SpanKindServer))
+	})
+}
+
+type transport struct {
+	next http.RoundTripper
+}
+
+func (t transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	ctx, span := Tracer().Start(request.Context(), "HTTP "+request.Method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.HTTPMethodKey.String(request.Method),
+		semconv.HTTPTargetKey.String(request.URL.Path),
+	))
+	defer span.End()
+
+	request = request.Clone(ctx)
+	Inject(ctx, request.Header)
+
+	response, err := t.next.RoundTrip(request)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		return nil, err
+	}
+
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(response.StatusCode))
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(response.StatusCode))
+
+	return response, nil
+}
+
+// WrapTransport traces the API server requests of the Kubernetes clients, such as the TokenReview and the
+// SubjectAccessReview ones, propagating the span of the request context: it's meant for rest.Config.Wrap.
+func WrapTransport(next http.RoundTripper) http.RoundTripper {
+	return transport{next: next}
+}
@@ -0,0 +1,145 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package tracing_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/clastix/capsule-proxy/internal/tracing"
+)
+
+const (
+	traceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	traceparent = "00-" + traceID + "-00f067aa0ba902b7-01"
+)
+
+func newRecorder(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+
+	return recorder
+}
+
+// nolint:paralleltest
+func TestMiddleware(t *testing.T) {
+	recorder := newRecorder(t)
+
+	var child trace.SpanContext
+
+	handler := tracing.Middleware(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, span := tracing.Start(request.Context(), "GetIdentity")
+		child = span.SpanContext()
+		span.End()
+
+		writer.WriteHeader(http.StatusForbidden)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("traceparent", traceparent)
+
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+
+	server := spans[1]
+
+	if server.SpanKind() != trace.SpanKindServer || server.Name() != "HTTP GET" {
+		t.Errorf("got the %s span %s, want the server one", server.SpanKind(), server.Name())
+	}
+
+	if got := server.SpanContext().TraceID().String(); got != traceID {
+		t.Errorf("got trace ID %s, want the incoming %s", got, traceID)
+	}
+
+	if child.TraceID() != server.SpanContext().TraceID() || spans[0].Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Error("the handler span is not a child of the server one")
+	}
+}
+
+// nolint:paralleltest
+func TestWrapTransport(t *testing.T) {
+	recorder := newRecorder(t)
+
+	var propagated string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		propagated = request.Header.Get("traceparent")
+	}))
+	t.Cleanup(upstream.Close)
+
+	ctx, parent := tracing.Start(context.Background(), "TokenReview")
+
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPost, upstream.URL+"/apis/authentication.k8s.io/v1/tokenreviews", nil)
+
+	resp, err := (&http.Client{Transport: tracing.WrapTransport(http.DefaultTransport)}).Do(r)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 || spans[0].SpanKind() != trace.SpanKindClient {
+		t.Fatalf("got spans %v, want the client and the parent ones", spans)
+	}
+
+	if want := "00-" + parent.SpanContext().TraceID().String() + "-" + spans[0].SpanContext().SpanID().String() + "-01"; propagated != want {
+		t.Errorf("got traceparent %q, want %q", propagated, want)
+	}
+}
+
+func TestSetup(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		exporter string
+		ratio    float64
+		err      bool
+	}{
+		{"disabled", tracing.ExporterNone, 1, false},
+		{"unknown exporter", "jaeger", 1, true},
+		{"invalid ratio", tracing.ExporterStdout, 2, true},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			shutdown, err := tracing.Setup(context.Background(), eachTest.exporter, "", eachTest.ratio)
+			if (err != nil) != eachTest.err {
+				t.Fatalf("got error %v, want error %t", err, eachTest.err)
+			}
+
+			if err == nil {
+				_ = shutdown(context.Background())
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+
+	capsulev1beta1 "github.com/clastix/capsule/api/v1beta1"
+)
+
+// The build information, set at link time, such as:
+// -ldflags "-X github.com/clastix/capsule-proxy/internal/version.GitTag=v0.2.0".
+// nolint:gochecknoglobals
+var (
+	GitTag    = "dev"
+	GitCommit string
+	GitDirty  string
+	GitRepo   string
+	BuildTime string
+)
+
+// capsuleModule is the Go module providing the Capsule API types.
+const capsuleModule = "github.com/clastix/capsule"
+
+// Capsule is the Capsule API the proxy reads the Tenants from.
+type Capsule struct {
+	Group    string   `json:"group"`
+	Versions []string `json:"versions"`
+	Module   string   `json:"module,omitempty"`
+}
+
+type Info struct {
+	Version   string  `json:"version"`
+	GitCommit string  `json:"gitCommit,omitempty"`
+	GitDirty  string  `json:"gitDirty,omitempty"`
+	GitRepo   string  `json:"gitRepo,omitempty"`
+	BuildTime string  `json:"buildTime,omitempty"`
+	GoVersion string  `json:"goVersion"`
+	Platform  string  `json:"platform"`
+	Capsule   Capsule `json:"capsule"`
+}
+
+// Get returns the build information: the commit falls back to the VCS revision stamped by the Go toolchain, when
+// not set at link time, and the Capsule module version is the one of the build dependencies.
+func Get() Info {
+	info := Info{
+		Version:   GitTag,
+		GitCommit: GitCommit,
+		GitDirty:  GitDirty,
+		GitRepo:   GitRepo,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Capsule: Capsule{
+			Group:    capsulev1beta1.GroupVersion.Group,
+			Versions: []string{capsulev1beta1.GroupVersion.Version},
+		},
+	}
+
+	// An empty tag is given by the builds out of the tagged releases
+	if len(info.Version) == 0 {
+		info.Version = "dev"
+	}
+
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+
+	for _, setting := range build.Settings {
+		if setting.Key == "vcs.revision" && len(info.GitCommit) == 0 {
+			info.GitCommit = setting.Value
+		}
+	}
+
+	for _, dep := range build.Deps {
+		if dep.Path != capsuleModule {
+			continue
+		}
+
+		info.Capsule.Module = dep.Version
+		if dep.Replace != nil {
+			info.Capsule.Module = dep.Replace.Version
+		}
+	}
+
+	return info
+}
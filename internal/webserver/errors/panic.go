@@ -5,48 +5,109 @@ package errors
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	req "github.com/clastix/capsule-proxy/internal/request"
 )
 
-func HandleUnauthorized(w http.ResponseWriter, err error, message string) {
-	message = fmt.Sprintf("%s: %s", message, err.Error())
-	status := &metav1.Status{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "Status",
-			APIVersion: "v1",
-		},
-		Status:  metav1.StatusFailure,
-		Message: message,
-		Reason:  metav1.StatusReasonForbidden,
-		Code:    http.StatusForbidden,
+// HandleRequestError replies with the status code of the errors returned by the request package, such as 401 for
+// ErrUnauthorized and the JWT failure modes, 403 for ErrForbidden, 504 for ErrTimeout, and 503 for ErrUnavailable:
+// any other error is replied with 500.
+func HandleRequestError(w http.ResponseWriter, err error, message string) {
+	var statusErr req.StatusError
+	if !errors.As(err, &statusErr) {
+		HandleError(w, err, message)
 	}
 
-	w.Header().Set("content-type", "application/json")
+	code := statusErr.StatusCode()
 
-	b, _ := json.Marshal(status)
-	_, _ = w.Write(b)
+	handle(w, err, message, reasonForStatusCode(code), int32(code))
+}
+
+// reasonForStatusCode returns the Status reason of the given status code, as the API server does.
+func reasonForStatusCode(code int) metav1.StatusReason {
+	switch code {
+	case http.StatusUnauthorized:
+		return metav1.StatusReasonUnauthorized
+	case http.StatusForbidden:
+		return metav1.StatusReasonForbidden
+	case http.StatusGatewayTimeout:
+		return metav1.StatusReasonTimeout
+	case http.StatusServiceUnavailable:
+		return metav1.StatusReasonServiceUnavailable
+	case http.StatusRequestEntityTooLarge:
+		return metav1.StatusReasonRequestEntityTooLarge
+	default:
+		return metav1.StatusReasonInternalError
+	}
+}
 
-	panic(message)
+// HandleUnauthorized replies with 401 for the missing or invalid credentials.
+func HandleUnauthorized(w http.ResponseWriter, err error, message string) {
+	handle(w, err, message, metav1.StatusReasonUnauthorized, http.StatusUnauthorized)
+}
+
+// HandleForbidden replies with 403 when the identity is valid, but not allowed to perform the request.
+func HandleForbidden(w http.ResponseWriter, err error, message string) {
+	handle(w, err, message, metav1.StatusReasonForbidden, http.StatusForbidden)
+}
+
+// HandleTimeout replies with 504 when the API server didn't reply in time.
+func HandleTimeout(w http.ResponseWriter, err error, message string) {
+	handle(w, err, message, metav1.StatusReasonTimeout, http.StatusGatewayTimeout)
+}
+
+// HandleServiceUnavailable replies with 503 when the API server is not queried, since failing.
+func HandleServiceUnavailable(w http.ResponseWriter, err error, message string) {
+	handle(w, err, message, metav1.StatusReasonServiceUnavailable, http.StatusServiceUnavailable)
+}
+
+// HandleRequestEntityTooLarge replies with 413 when the request body exceeds the allowed size.
+func HandleRequestEntityTooLarge(w http.ResponseWriter, err error, message string) {
+	handle(w, err, message, metav1.StatusReasonRequestEntityTooLarge, http.StatusRequestEntityTooLarge)
+}
+
+// HandleTooManyRequests replies with 429 when the rate limit is exceeded, along with the Retry-After header honoured
+// by the Kubernetes clients.
+func HandleTooManyRequests(w http.ResponseWriter, err error, message string, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
+	handle(w, err, message, metav1.StatusReasonTooManyRequests, http.StatusTooManyRequests)
 }
 
 func HandleError(w http.ResponseWriter, err error, message string) {
-	message = fmt.Sprintf("%s: %s", message, err.Error())
-	status := &metav1.Status{
+	handle(w, err, message, metav1.StatusReasonInternalError, http.StatusInternalServerError)
+}
+
+// NewStatus returns the failure Status for the given error, in the format expected by the Kubernetes clients.
+func NewStatus(err error, message string, reason metav1.StatusReason, code int32) *metav1.Status {
+	return &metav1.Status{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Status",
 			APIVersion: "v1",
 		},
-		Message: message,
-		Reason:  metav1.StatusReasonInternalError,
+		Status:  metav1.StatusFailure,
+		Message: fmt.Sprintf("%s: %s", message, err.Error()),
+		Reason:  reason,
+		Code:    code,
 	}
+}
+
+func handle(w http.ResponseWriter, err error, message string, reason metav1.StatusReason, code int32) {
+	status := NewStatus(err, message, reason, code)
 
 	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(int(code))
 
 	b, _ := json.Marshal(status)
 	_, _ = w.Write(b)
 
-	panic(message)
+	panic(status.Message)
 }
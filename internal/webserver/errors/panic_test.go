@@ -0,0 +1,96 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package errors_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	req "github.com/clastix/capsule-proxy/internal/request"
+	"github.com/clastix/capsule-proxy/internal/webserver/errors"
+)
+
+// jwtError returns the error of the JWT with the given claims, authenticated with the preferred_username claim.
+func jwtError(t *testing.T, claims jwt.MapClaims) error {
+	t.Helper()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("cannot sign token: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	claimMappings := req.ClaimMappings{Default: req.ClaimMapping{UsernameFields: []string{"preferred_username"}}}
+	_, _, err = req.NewJWTAuthenticator(req.JWTOptions{ClaimMappings: claimMappings}).Resolve(r)
+
+	return err
+}
+
+func TestHandleRequestError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		err    error
+		reason metav1.StatusReason
+		code   int32
+	}{
+		{"unauthorized", req.NewErrUnauthorized("authentication required"), metav1.StatusReasonUnauthorized, http.StatusUnauthorized},
+		{"forbidden", req.NewErrForbidden("the current user alice cannot impersonate the user bob"), metav1.StatusReasonForbidden, http.StatusForbidden},
+		{"wrapped forbidden", fmt.Errorf("wrapped: %w", req.NewErrForbidden("denied")), metav1.StatusReasonForbidden, http.StatusForbidden},
+		{"timeout", req.NewErrTimeout("the TokenReview timed out"), metav1.StatusReasonTimeout, http.StatusGatewayTimeout},
+		{"unavailable", req.NewErrUnavailable("the TokenReview is not performed since the API server is failing"), metav1.StatusReasonServiceUnavailable, http.StatusServiceUnavailable},
+		{"missing username claim", jwtError(t, jwt.MapClaims{"sub": "alice"}), metav1.StatusReasonUnauthorized, http.StatusUnauthorized},
+		{"invalid claim", jwtError(t, jwt.MapClaims{"preferred_username": 42}), metav1.StatusReasonUnauthorized, http.StatusUnauthorized},
+		{"internal error", fmt.Errorf("cannot create TokenReview"), metav1.StatusReasonInternalError, http.StatusInternalServerError},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			rw := httptest.NewRecorder()
+
+			func() {
+				defer func() {
+					if r := recover(); r == nil {
+						t.Error("expected the handler to panic")
+					}
+				}()
+
+				errors.HandleRequestError(rw, eachTest.err, "cannot retrieve user and group")
+			}()
+
+			if ct := rw.Header().Get("content-type"); ct != "application/json" {
+				t.Errorf("got content type %s, want application/json", ct)
+			}
+
+			if rw.Code != int(eachTest.code) {
+				t.Errorf("got status code %d, want %d", rw.Code, eachTest.code)
+			}
+
+			status := metav1.Status{}
+			if err := json.Unmarshal(rw.Body.Bytes(), &status); err != nil {
+				t.Fatalf("cannot parse the Status: %v", err)
+			}
+
+			if status.Kind != "Status" || status.Status != metav1.StatusFailure {
+				t.Errorf("got kind %s and status %s, want a failure Status", status.Kind, status.Status)
+			}
+
+			if status.Reason != eachTest.reason || status.Code != eachTest.code {
+				t.Errorf("got reason %s and code %d, want %s and %d", status.Reason, status.Code, eachTest.reason, eachTest.code)
+			}
+		})
+	}
+}
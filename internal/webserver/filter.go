@@ -12,5 +12,6 @@ import (
 type Filter interface {
 	manager.Runnable
 	ReadinessProbe(req *http.Request) error
+	APIServerProbe(req *http.Request) error
 	LivenessProbe(req *http.Request) error
 }
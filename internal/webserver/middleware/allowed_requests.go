@@ -10,13 +10,15 @@ import (
 	"github.com/gorilla/mux"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	req "github.com/clastix/capsule-proxy/internal/request"
 )
 
 func CheckPaths(client client.Client, log logr.Logger, allowedPaths sets.String, skipTo func(writer http.ResponseWriter, request *http.Request)) mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 			if allowedPaths.Has(request.URL.Path) {
-				log.V(4).Info("allowed url path.", "url path", request.URL.Path)
+				req.RequestLogger(request.Context(), log).V(4).Info("allowed url path.", "url path", request.URL.Path)
 				skipTo(writer, request)
 
 				return
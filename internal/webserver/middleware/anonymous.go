@@ -0,0 +1,63 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package middleware
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/gorilla/mux"
+
+	req "github.com/clastix/capsule-proxy/internal/request"
+)
+
+// CheckAnonymousPaths skips to the given handler the requests without any credential targeting the allowed path
+// prefixes, letting them bypass the user and groups resolution: the client certificates are credentials only when
+// these authenticate the requests.
+func CheckAnonymousPaths(log logr.Logger, allowedPrefixes []string, tokenQueryParameter string, certificates bool, skipTo func(writer http.ResponseWriter, request *http.Request)) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if !hasCredentials(request, tokenQueryParameter, certificates) && IsAnonymousPathAllowed(allowedPrefixes, request.URL.Path) {
+				req.RequestLogger(request.Context(), log).V(4).Info("allowed anonymous url path.", "url path", request.URL.Path)
+				skipTo(writer, request)
+
+				return
+			}
+
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+// IsAnonymousPathAllowed matches the path against the prefixes on segment boundaries: paths that are not
+// in their canonical form, such as containing dot segments or double slashes, never match.
+func IsAnonymousPathAllowed(allowedPrefixes []string, urlPath string) bool {
+	if len(urlPath) == 0 || path.Clean(urlPath) != urlPath {
+		return false
+	}
+
+	for _, prefix := range allowedPrefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+
+		if urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasCredentials(request *http.Request, tokenQueryParameter string, certificates bool) bool {
+	if len(request.Header.Get("Authorization")) > 0 {
+		return true
+	}
+
+	if certificates && request.TLS != nil && len(request.TLS.PeerCertificates) > 0 {
+		return true
+	}
+
+	return len(tokenQueryParameter) > 0 && len(request.URL.Query().Get(tokenQueryParameter)) > 0
+}
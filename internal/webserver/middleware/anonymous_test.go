@@ -0,0 +1,86 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package middleware_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-logr/logr"
+
+	"github.com/clastix/capsule-proxy/internal/webserver/middleware"
+)
+
+func TestIsAnonymousPathAllowed(t *testing.T) {
+	t.Parallel()
+
+	allowed := []string{"/healthz", "/version", "/openapi/"}
+
+	tests := []struct {
+		name string
+		path string
+		want bool
+	}{
+		{"pass exact path", "/version", true},
+		{"pass nested path", "/openapi/v2", true},
+		{"pass prefix with trailing slash", "/openapi", true},
+		{"fail sibling path", "/versions", false},
+		{"fail other path", "/api/v1/secrets", false},
+		{"fail dot segments", "/version/../api/v1/secrets", false},
+		{"fail double slashes", "/healthz//../api", false},
+		{"fail trailing slash", "/version/", false},
+		{"fail relative path", "version", false},
+		{"fail empty path", "", false},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := middleware.IsAnonymousPathAllowed(allowed, eachTest.path); got != eachTest.want {
+				t.Errorf("got %v, want %v", got, eachTest.want)
+			}
+		})
+	}
+}
+
+func TestCheckAnonymousPathsCertificates(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		certificates bool
+		anonymous    bool
+	}{
+		{"certificate", true, false},
+		{"certificate auth disabled", false, true},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			var anonymous bool
+
+			handler := middleware.CheckAnonymousPaths(logr.Discard(), []string{"/version"}, "", eachTest.certificates, func(http.ResponseWriter, *http.Request) {
+				anonymous = true
+			})(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+			r := httptest.NewRequest(http.MethodGet, "/version", nil)
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "alice"}}}}
+
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			if anonymous != eachTest.anonymous {
+				t.Errorf("got anonymous %t, want %t", anonymous, eachTest.anonymous)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/clastix/capsule-proxy/internal/responsewriter"
+)
+
+const wwwAuthenticateHeader = "WWW-Authenticate"
+
+type challengeResponseWriter struct {
+	responsewriter.Wrapper
+	challenge string
+}
+
+func (c *challengeResponseWriter) WriteHeader(statusCode int) {
+	if statusCode == http.StatusUnauthorized && len(c.Header().Get(wwwAuthenticateHeader)) == 0 {
+		c.Header().Set(wwwAuthenticateHeader, c.challenge)
+	}
+
+	c.ResponseWriter.WriteHeader(statusCode)
+}
+
+// WWWAuthenticate adds the Bearer challenge to the 401 responses, as for RFC 6750: the invalid_token error is
+// reported only when the request carries a bearer token, and the realm only if not empty.
+func WWWAuthenticate(realm, tokenQueryParameter string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			var params []string
+
+			if len(realm) > 0 {
+				params = append(params, fmt.Sprintf("realm=%q", realm))
+			}
+
+			if hasBearerToken(request, tokenQueryParameter) {
+				params = append(params, `error="invalid_token"`)
+			}
+
+			challenge := "Bearer"
+			if len(params) > 0 {
+				challenge += " " + strings.Join(params, ", ")
+			}
+
+			next.ServeHTTP(&challengeResponseWriter{Wrapper: responsewriter.Wrapper{ResponseWriter: writer}, challenge: challenge}, request)
+		})
+	}
+}
+
+func hasBearerToken(request *http.Request, tokenQueryParameter string) bool {
+	if authorization := request.Header.Get("Authorization"); len(authorization) > 0 {
+		return true
+	}
+
+	return len(tokenQueryParameter) > 0 && len(request.URL.Query().Get(tokenQueryParameter)) > 0
+}
@@ -0,0 +1,54 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/clastix/capsule-proxy/internal/webserver/middleware"
+)
+
+func TestWWWAuthenticate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		realm         string
+		authorization string
+		target        string
+		code          int
+		want          string
+	}{
+		{"missing credentials", "", "", "/api/v1/pods", http.StatusUnauthorized, "Bearer"},
+		{"invalid token", "", "Bearer abc.def.ghi", "/api/v1/pods", http.StatusUnauthorized, `Bearer error="invalid_token"`},
+		{"invalid query token", "kubernetes", "", "/api/v1/pods?access_token=abc", http.StatusUnauthorized, `Bearer realm="kubernetes", error="invalid_token"`},
+		{"realm", "kubernetes", "", "/api/v1/pods", http.StatusUnauthorized, `Bearer realm="kubernetes"`},
+		{"forbidden", "kubernetes", "Bearer abc.def.ghi", "/api/v1/pods", http.StatusForbidden, ""},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			handler := middleware.WWWAuthenticate(eachTest.realm, "access_token")(http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+				writer.WriteHeader(eachTest.code)
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, eachTest.target, nil)
+			if len(eachTest.authorization) > 0 {
+				r.Header.Set("Authorization", eachTest.authorization)
+			}
+
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, r)
+
+			if got := rw.Header().Get("WWW-Authenticate"); got != eachTest.want {
+				t.Errorf("got challenge %q, want %q", got, eachTest.want)
+			}
+		})
+	}
+}
@@ -15,20 +15,28 @@ import (
 	"github.com/clastix/capsule-proxy/internal/webserver/errors"
 )
 
-const (
-	regexPatternForAuthHeader = "^(Bearer ([\\w-]*\\.[\\w-]*\\.[\\w-]*|[\\w-]*))$"
-)
+// regexPatternForAuthHeader matches the bearer tokens made of the b64token characters of RFC 6750, such as the JWTs
+// and the opaque tokens of the identity providers.
+const regexPatternForAuthHeader = "^\\s*(?i:bearer)\\s+([A-Za-z0-9\\-._~+/]+=*)\\s*$"
 
-func CheckAuthorization(client client.Client, log logr.Logger, tls bool) mux.MiddlewareFunc {
+// CheckAuthorization rejects with 401 the requests without a bearer token, or a client certificate when these
+// authenticate the requests, such as on the TLS listener.
+func CheckAuthorization(client client.Client, log logr.Logger, certificates bool, tokenQueryParameter string) mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 			err := fmt.Errorf("forbidden access")
 
-			isCertificates := request.TLS != nil && len(request.TLS.PeerCertificates) > 0
+			isCertificates := certificates && request.TLS != nil && len(request.TLS.PeerCertificates) > 0
+
+			authorization := request.Header.Get("Authorization")
+			// WebSocket clients cannot set custom headers, sending the token as query parameter
+			if token := request.URL.Query().Get(tokenQueryParameter); len(authorization) == 0 && len(tokenQueryParameter) > 0 && len(token) > 0 {
+				authorization = "Bearer " + token
+			}
 
-			isBearerToken, errBT := CheckBearerToken(request.Header.Get("Authorization"))
+			isBearerToken, errBT := CheckBearerToken(authorization)
 
-			unauthorized := errBT != nil || (tls && (!isCertificates && !isBearerToken)) || (!tls && !isBearerToken)
+			unauthorized := errBT != nil || (!isCertificates && !isBearerToken)
 
 			if unauthorized {
 				errors.HandleUnauthorized(writer, err, "unauthorized")
@@ -0,0 +1,58 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/http/httpguts"
+
+	"github.com/clastix/capsule-proxy/internal/webserver/errors"
+)
+
+// LimitRequestBody rejects with 413 the write requests with a body larger than the given bytes, if not zero:
+// the declared Content-Length is checked upfront, while the streamed bodies fail as soon as the limit is exceeded.
+// The upgraded connections, such as exec, attach and port-forward, are not limited.
+func LimitRequestBody(maxBytes int64) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if maxBytes <= 0 || !hasLimitedBody(request) {
+				next.ServeHTTP(writer, request)
+
+				return
+			}
+
+			if request.ContentLength > maxBytes {
+				errors.HandleRequestEntityTooLarge(writer, fmt.Errorf("the request body exceeds %d bytes", maxBytes), "cannot proxy the request")
+			}
+
+			request.Body = http.MaxBytesReader(writer, request.Body, maxBytes)
+
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+func hasLimitedBody(request *http.Request) bool {
+	switch request.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		return false
+	}
+
+	if httpguts.HeaderValuesContainsToken(request.Header.Values("Connection"), "upgrade") {
+		return false
+	}
+
+	for _, subresource := range []string{"/exec", "/attach", "/portforward"} {
+		if strings.HasSuffix(request.URL.Path, subresource) {
+			return false
+		}
+	}
+
+	return true
+}
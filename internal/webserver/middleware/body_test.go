@@ -0,0 +1,72 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package middleware_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/clastix/capsule-proxy/internal/webserver/middleware"
+)
+
+func TestLimitRequestBody(t *testing.T) {
+	t.Parallel()
+
+	oversized := strings.Repeat("a", 2048)
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		chunked bool
+		code    int
+		readErr bool
+	}{
+		{"oversized put", http.MethodPut, "/api/v1/namespaces/oil/configmaps/big", false, http.StatusRequestEntityTooLarge, false},
+		{"oversized chunked post", http.MethodPost, "/api/v1/namespaces/oil/configmaps", true, http.StatusOK, true},
+		{"exec is exempt", http.MethodPost, "/api/v1/namespaces/oil/pods/nginx/exec", false, http.StatusOK, false},
+		{"get is not limited", http.MethodGet, "/api/v1/namespaces/oil/configmaps", false, http.StatusOK, false},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			var readErr error
+
+			handler := middleware.LimitRequestBody(1024)(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				_, readErr = io.ReadAll(request.Body)
+			}))
+
+			r := httptest.NewRequest(eachTest.method, eachTest.target, strings.NewReader(oversized))
+			if eachTest.chunked {
+				r.ContentLength = -1
+			}
+
+			rw := httptest.NewRecorder()
+
+			func() {
+				defer func() {
+					_ = recover()
+				}()
+
+				handler.ServeHTTP(rw, r)
+			}()
+
+			if rw.Code != eachTest.code {
+				t.Errorf("got status code %d, want %d", rw.Code, eachTest.code)
+			}
+
+			var maxBytesErr *http.MaxBytesError
+			if got := errors.As(readErr, &maxBytesErr); got != eachTest.readErr {
+				t.Errorf("got read error %v, want the body limit exceeded %v", readErr, eachTest.readErr)
+			}
+		})
+	}
+}
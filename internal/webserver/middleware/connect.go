@@ -0,0 +1,40 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/clastix/capsule-proxy/internal/webserver/errors"
+)
+
+// allowedMethods are the methods of the Kubernetes API, returned with the Allow header of the rejected requests.
+// nolint:gochecknoglobals
+var allowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions}
+
+// RejectConnect replies with 405 to the CONNECT requests, sent by the clients misconfigured to use the proxy as a
+// forward one, before any authentication: it must wrap the router, since these carry no path, thus redirected by it.
+// The Status is written with no panic, being out of the router recovery.
+func RejectConnect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodConnect {
+			next.ServeHTTP(writer, request)
+
+			return
+		}
+
+		status := errors.NewStatus(fmt.Errorf("the CONNECT method is not supported, capsule-proxy is not a forward proxy"), "cannot tunnel the connection", metav1.StatusReasonMethodNotAllowed, http.StatusMethodNotAllowed)
+
+		writer.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+		writer.Header().Set("content-type", "application/json")
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+
+		_ = json.NewEncoder(writer).Encode(status)
+	})
+}
@@ -0,0 +1,93 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package middleware_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/clastix/capsule-proxy/internal/webserver/middleware"
+)
+
+func TestRejectConnect(t *testing.T) {
+	t.Parallel()
+
+	var authenticated bool
+
+	r := mux.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			authenticated = true
+
+			next.ServeHTTP(writer, request)
+		})
+	})
+	r.PathPrefix("/").HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+	})
+
+	srv := httptest.NewServer(middleware.RejectConnect(r))
+	t.Cleanup(srv.Close)
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("cannot dial the proxy: %v", err)
+	}
+
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	_, _ = io.WriteString(conn, "CONNECT kubernetes.default.svc:443 HTTP/1.1\r\nHost: kubernetes.default.svc:443\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("cannot read the response: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMethodNotAllowed || len(resp.Header.Get("Allow")) == 0 {
+		t.Fatalf("got status code %d with Allow %q, want 405 with the allowed methods", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+
+	status := &metav1.Status{}
+	if err = json.NewDecoder(resp.Body).Decode(status); err != nil {
+		t.Fatalf("cannot decode the Status: %v", err)
+	}
+
+	if status.Reason != metav1.StatusReasonMethodNotAllowed || status.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got reason %s and code %d, want MethodNotAllowed", status.Reason, status.Code)
+	}
+
+	if authenticated {
+		t.Error("expected the CONNECT request to be rejected before the router middlewares")
+	}
+}
+
+func TestRejectConnectOtherMethods(t *testing.T) {
+	t.Parallel()
+
+	handler := middleware.RejectConnect(http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+	}))
+
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodOptions} {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(method, "/api/v1/namespaces", nil))
+
+		if rw.Code != http.StatusOK {
+			t.Errorf("got status code %d for %s, want 200", rw.Code, method)
+		}
+	}
+}
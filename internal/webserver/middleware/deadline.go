@@ -0,0 +1,35 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RequestDeadline bounds the request context to the timeoutSeconds query parameter sent by the clients, such as
+// kubectl for lists and watches, thus the upstream request and the authentication round-trips never outlive the client
+// intent: the grace period lets the API server end the request, such as closing the watch stream, before the proxy
+// cancels it. The requests with no, or an invalid, timeoutSeconds are not bounded.
+func RequestDeadline(grace time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			seconds, err := strconv.ParseInt(request.URL.Query().Get("timeoutSeconds"), 10, 64)
+			if err != nil || seconds <= 0 {
+				next.ServeHTTP(writer, request)
+
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(request.Context(), time.Duration(seconds)*time.Second+grace)
+			defer cancel()
+
+			next.ServeHTTP(writer, request.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/clastix/capsule-proxy/internal/webserver/middleware"
+)
+
+func TestRequestDeadline(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		url      string
+		deadline time.Duration
+	}{
+		{"list", "/api/v1/pods?timeoutSeconds=30", 35 * time.Second},
+		{"watch", "/api/v1/pods?watch=true&timeoutSeconds=300", 305 * time.Second},
+		{"without timeout", "/api/v1/pods", 0},
+		{"invalid timeout", "/api/v1/pods?timeoutSeconds=forever", 0},
+		{"negative timeout", "/api/v1/pods?timeoutSeconds=-1", 0},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			start := time.Now()
+
+			middleware.RequestDeadline(5*time.Second)(http.HandlerFunc(func(_ http.ResponseWriter, request *http.Request) {
+				deadline, ok := request.Context().Deadline()
+				if ok != (eachTest.deadline > 0) {
+					t.Fatalf("got deadline %t, want %t", ok, eachTest.deadline > 0)
+				}
+
+				if ok && (deadline.Before(start.Add(eachTest.deadline)) || deadline.After(time.Now().Add(eachTest.deadline))) {
+					t.Errorf("got deadline in %s, want %s", deadline.Sub(start), eachTest.deadline)
+				}
+			})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, eachTest.url, nil))
+		})
+	}
+}
+
+func TestRequestDeadlineEndsStream(t *testing.T) {
+	t.Parallel()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		// A negative grace period bounds the one second watch to a few milliseconds
+		middleware.RequestDeadline(-990*time.Millisecond)(http.HandlerFunc(func(_ http.ResponseWriter, request *http.Request) {
+			<-request.Context().Done()
+		})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/pods?watch=true&timeoutSeconds=1", nil))
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the watch has not been ended at the client timeout")
+	}
+}
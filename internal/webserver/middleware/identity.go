@@ -0,0 +1,23 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	req "github.com/clastix/capsule-proxy/internal/request"
+)
+
+// IdentityCache resolves the identity of the requester once per request, rather than by each middleware, module,
+// and handler retrieving it: the authentication, the impersonation SubjectAccessReviews, and the metrics are not
+// repeated.
+func IdentityCache() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			next.ServeHTTP(writer, request.WithContext(req.WithIdentityCache(request.Context())))
+		})
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	req "github.com/clastix/capsule-proxy/internal/request"
+	"github.com/clastix/capsule-proxy/internal/webserver/errors"
+)
+
+const impersonateHeaderPrefix = "Impersonate-"
+
+// RejectServiceAccountImpersonation rejects with 403 the requests authenticated with a service account token, either
+// a legacy or a bound one, carrying any Impersonate-* header, when enabled: the service accounts are not expected to
+// impersonate through the proxy, thus these are almost always a misconfiguration or an attack. The bound tokens are
+// the ones of the given service account issuers.
+func RejectServiceAccountImpersonation(enabled bool, tokenQueryParameter string, serviceAccountIssuers []string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if !enabled {
+			return next
+		}
+
+		issuers := sets.NewString(serviceAccountIssuers...)
+
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if impersonating(request.Header) && req.IsServiceAccountToken(req.RequestBearerToken(request, tokenQueryParameter), issuers) {
+				errors.HandleForbidden(writer, fmt.Errorf("the service accounts cannot impersonate"), "cannot impersonate")
+			}
+
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+func impersonating(header http.Header) bool {
+	for name := range header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), impersonateHeaderPrefix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,89 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+
+	"github.com/clastix/capsule-proxy/internal/webserver/middleware"
+)
+
+func TestRejectServiceAccountImpersonation(t *testing.T) {
+	t.Parallel()
+
+	sign := func(claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+		if err != nil {
+			t.Fatalf("cannot sign token: %v", err)
+		}
+
+		return token
+	}
+
+	legacy := sign(jwt.MapClaims{
+		"iss":                                    "kubernetes/serviceaccount",
+		"sub":                                    "system:serviceaccount:oil-production:robot",
+		"kubernetes.io/serviceaccount/namespace": "oil-production",
+	})
+	bound := sign(jwt.MapClaims{
+		"iss": "https://kubernetes.default.svc.cluster.local",
+		"sub": "system:serviceaccount:oil-production:robot",
+		"kubernetes.io": map[string]interface{}{
+			"namespace":      "oil-production",
+			"serviceaccount": map[string]interface{}{"name": "robot"},
+		},
+	})
+	oidc := sign(jwt.MapClaims{"iss": "https://idp.example.com", "sub": "alice"})
+
+	tests := []struct {
+		name    string
+		enabled bool
+		token   string
+		header  string
+		code    int
+	}{
+		{"service account impersonating a user", true, legacy, "Impersonate-User", http.StatusForbidden},
+		{"service account impersonating a group", true, legacy, "Impersonate-Group", http.StatusForbidden},
+		{"bound service account impersonating a user", true, bound, "Impersonate-User", http.StatusForbidden},
+		{"service account not impersonating", true, legacy, "", http.StatusOK},
+		{"user impersonating", true, oidc, "Impersonate-User", http.StatusOK},
+		{"opaque token impersonating", true, "opaque-token", "Impersonate-User", http.StatusOK},
+		{"disabled", false, legacy, "Impersonate-User", http.StatusOK},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+			r.Header.Set("Authorization", "Bearer "+eachTest.token)
+
+			if len(eachTest.header) > 0 {
+				r.Header.Set(eachTest.header, "bob")
+			}
+
+			rw := httptest.NewRecorder()
+
+			func() {
+				// The error handlers panic once the Status is written
+				defer func() {
+					_ = recover()
+				}()
+
+				middleware.RejectServiceAccountImpersonation(eachTest.enabled, "", []string{"https://kubernetes.default.svc.cluster.local"})(http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+					writer.WriteHeader(http.StatusOK)
+				})).ServeHTTP(rw, r)
+			}()
+
+			if rw.Code != eachTest.code {
+				t.Errorf("got status code %d, want %d", rw.Code, eachTest.code)
+			}
+		})
+	}
+}
@@ -4,9 +4,6 @@
 package middleware
 
 import (
-	"bufio"
-	"fmt"
-	"net"
 	"net/http"
 	"strconv"
 
@@ -14,6 +11,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/clastix/capsule-proxy/internal/responsewriter"
 )
 
 // nolint:gochecknoinits
@@ -21,32 +20,6 @@ func init() {
 	metrics.Registry.MustRegister(totalRequests, httpDuration)
 }
 
-type httpResponseWriter struct {
-	http.ResponseWriter
-	statusCode int
-}
-
-func (h *httpResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	hijacker, ok := h.ResponseWriter.(http.Hijacker)
-	if !ok {
-		return nil, nil, fmt.Errorf("writer is not http.Hijacker")
-	}
-
-	return hijacker.Hijack()
-}
-
-func newHTTPResponseWriter(w http.ResponseWriter) *httpResponseWriter {
-	return &httpResponseWriter{
-		w,
-		http.StatusOK,
-	}
-}
-
-func (h *httpResponseWriter) WriteHeader(statusCode int) {
-	h.statusCode = statusCode
-	h.ResponseWriter.WriteHeader(statusCode)
-}
-
 // nolint:gochecknoglobals
 var totalRequests = prometheus.NewCounterVec(
 	prometheus.CounterOpts{
@@ -69,10 +42,10 @@ func MetricsMiddleware(next http.Handler) http.Handler {
 
 		timer := prometheus.NewTimer(httpDuration.WithLabelValues(path))
 
-		rw := newHTTPResponseWriter(w)
+		rw := responsewriter.NewStatusRecorder(w)
 		next.ServeHTTP(rw, r)
 
-		statusCode := rw.statusCode
+		statusCode := rw.StatusCode
 
 		totalRequests.WithLabelValues(path, strconv.Itoa(statusCode)).Inc()
 
@@ -0,0 +1,50 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"k8s.io/apimachinery/pkg/util/uuid"
+
+	req "github.com/clastix/capsule-proxy/internal/request"
+)
+
+// maxRequestIDLength bounds the incoming correlation IDs, avoiding the clients to flood the logs.
+const maxRequestIDLength = 128
+
+// RequestID correlates the request across the proxy and the API server with the X-Request-Id header: the incoming
+// one is reused, when sane, otherwise a new one is generated. The ID is attached to the request context, added to
+// the log lines with request.RequestLogger, forwarded to the upstream, and returned to the client.
+func RequestID() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			id := request.Header.Get(req.RequestIDHeader)
+			if !validRequestID(id) {
+				id = string(uuid.NewUUID())
+			}
+
+			request.Header.Set(req.RequestIDHeader, id)
+			writer.Header().Set(req.RequestIDHeader, id)
+
+			next.ServeHTTP(writer, request.WithContext(req.WithRequestID(request.Context(), id)))
+		})
+	}
+}
+
+// validRequestID accepts the non-empty IDs made of printable ASCII characters, with no spaces.
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,58 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/clastix/capsule-proxy/internal/request"
+	"github.com/clastix/capsule-proxy/internal/webserver/middleware"
+)
+
+func TestRequestID(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		incoming string
+		reused   bool
+	}{
+		{"reusing the incoming ID", "3f6c1e2a-trace", true},
+		{"generating a missing ID", "", false},
+		{"generating for an ID with spaces", "forged id", false},
+		{"generating for a too long ID", strings.Repeat("a", 129), false},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+			if len(eachTest.incoming) > 0 {
+				r.Header.Set("X-Request-Id", eachTest.incoming)
+			}
+
+			var forwarded, fromContext string
+
+			rw := httptest.NewRecorder()
+
+			middleware.RequestID()(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				forwarded = r.Header.Get("X-Request-Id")
+				fromContext = request.RequestIDFrom(r.Context())
+			})).ServeHTTP(rw, r)
+
+			if len(forwarded) == 0 || forwarded != fromContext || forwarded != rw.Header().Get("X-Request-Id") {
+				t.Fatalf("got forwarded ID %q, context one %q, and response one %q", forwarded, fromContext, rw.Header().Get("X-Request-Id"))
+			}
+
+			if reused := forwarded == eachTest.incoming; reused != eachTest.reused {
+				t.Errorf("got ID %q reused %t, want %t", forwarded, reused, eachTest.reused)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const authorizationHeader = "Authorization"
+
+// TokenHeader reads the bearer token from the given header, as forwarded by the gateways stripping the Authorization
+// one, such as oauth2-proxy with X-Forwarded-Access-Token: the header carries the raw token, with no scheme, and takes
+// precedence over the Authorization one. The token is moved to the Authorization header, thus the authentication is
+// unaware of its source, and the custom header is never forwarded to the upstream.
+func TokenHeader(header string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if len(header) == 0 || http.CanonicalHeaderKey(header) == authorizationHeader {
+			return next
+		}
+
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if token := strings.TrimSpace(request.Header.Get(header)); len(token) > 0 {
+				request.Header.Set(authorizationHeader, "Bearer "+token)
+			}
+
+			request.Header.Del(header)
+
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
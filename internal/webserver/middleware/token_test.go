@@ -0,0 +1,62 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/clastix/capsule-proxy/internal/request"
+	"github.com/clastix/capsule-proxy/internal/webserver/middleware"
+)
+
+func TestTokenHeader(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		tokenHeader   string
+		header        http.Header
+		want          string
+		wantForwarded bool
+	}{
+		{"standard header", "Authorization", http.Header{"Authorization": []string{"Bearer abc.def.ghi"}}, "abc.def.ghi", false},
+		{"standard header by default", "", http.Header{"Authorization": []string{"Bearer abc.def.ghi"}}, "abc.def.ghi", false},
+		{"standard header ignores the custom one", "", http.Header{"X-Forwarded-Access-Token": []string{"abc.def.ghi"}}, "", true},
+		{"custom header", "X-Forwarded-Access-Token", http.Header{"X-Forwarded-Access-Token": []string{"abc.def.ghi"}}, "abc.def.ghi", false},
+		{"custom header is case insensitive", "x-forwarded-access-token", http.Header{"X-Forwarded-Access-Token": []string{"opaque-token"}}, "opaque-token", false},
+		{"custom header takes precedence", "X-Forwarded-Access-Token", http.Header{"X-Forwarded-Access-Token": []string{"abc.def.ghi"}, "Authorization": []string{"Bearer jkl.mno.pqr"}}, "abc.def.ghi", false},
+		{"custom header missing", "X-Forwarded-Access-Token", http.Header{"Authorization": []string{"Bearer jkl.mno.pqr"}}, "jkl.mno.pqr", false},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+			for name, values := range eachTest.header {
+				r.Header[name] = values
+			}
+
+			var token string
+
+			var forwarded bool
+
+			middleware.TokenHeader(eachTest.tokenHeader)(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				token = request.RequestBearerToken(r, "")
+				forwarded = len(r.Header.Get("X-Forwarded-Access-Token")) > 0
+			})).ServeHTTP(httptest.NewRecorder(), r)
+
+			if token != eachTest.want {
+				t.Errorf("got token %q, want %q", token, eachTest.want)
+			}
+
+			if forwarded != eachTest.wantForwarded {
+				t.Errorf("got the custom header forwarded %t, want %t", forwarded, eachTest.wantForwarded)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package webserver
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+const (
+	livenessPath  = "/healthz"
+	readinessPath = "/readyz"
+)
+
+// probeServer serves the probes of the Filter, in place of the Manager one replying with 500 to the failed checks.
+type probeServer struct {
+	server *http.Server
+}
+
+// NewProbeServer returns the Runnable serving on the given address the liveness probe, not depending on the API
+// server since restarting the proxy wouldn't help reaching it, and the readiness one, replying with 503 until the
+// proxy is listening and the API server is reachable.
+func NewProbeServer(addr string, filter Filter) manager.Runnable {
+	return &probeServer{server: &http.Server{Addr: addr, Handler: probesHandler(filter)}}
+}
+
+func (p *probeServer) Start(ctx context.Context) error {
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- p.server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return errors.Wrap(err, "cannot serve the probes")
+	case <-ctx.Done():
+		return p.server.Shutdown(context.Background())
+	}
+}
+
+func probesHandler(filter Filter) http.Handler {
+	mux := http.NewServeMux()
+
+	liveness := probeHandler(filter.LivenessProbe)
+	mux.Handle(livenessPath, liveness)
+	mux.Handle(livenessPath+"/", liveness)
+
+	readiness := probeHandler(filter.ReadinessProbe, filter.APIServerProbe)
+	mux.Handle(readinessPath, readiness)
+	mux.Handle(readinessPath+"/", readiness)
+
+	return mux
+}
+
+// probeHandler replies with 503 and the error of the first failing check, if any.
+func probeHandler(checks ...func(*http.Request) error) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		for _, check := range checks {
+			if err := check(request); err != nil {
+				http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+
+				return
+			}
+		}
+
+		_, _ = writer.Write([]byte("ok"))
+	})
+}
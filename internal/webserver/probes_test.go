@@ -0,0 +1,66 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+// nolint:testpackage
+package webserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fakeFilter struct {
+	readinessErr error
+	apiServerErr error
+}
+
+func (f fakeFilter) Start(context.Context) error {
+	return nil
+}
+
+func (f fakeFilter) ReadinessProbe(*http.Request) error {
+	return f.readinessErr
+}
+
+func (f fakeFilter) APIServerProbe(*http.Request) error {
+	return f.apiServerErr
+}
+
+func (f fakeFilter) LivenessProbe(*http.Request) error {
+	return nil
+}
+
+func TestProbesHandler(t *testing.T) {
+	t.Parallel()
+
+	unreachable := fmt.Errorf("cannot reach the API server")
+
+	tests := []struct {
+		name     string
+		filter   fakeFilter
+		path     string
+		wantCode int
+	}{
+		{"ready", fakeFilter{}, "/readyz/", http.StatusOK},
+		{"not listening", fakeFilter{readinessErr: fmt.Errorf("cannot make local _healthz request")}, "/readyz", http.StatusServiceUnavailable},
+		{"API server unreachable", fakeFilter{apiServerErr: unreachable}, "/readyz/", http.StatusServiceUnavailable},
+		{"alive with the API server unreachable", fakeFilter{apiServerErr: unreachable}, "/healthz/", http.StatusOK},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			rw := httptest.NewRecorder()
+			probesHandler(eachTest.filter).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, eachTest.path, nil))
+
+			if rw.Code != eachTest.wantCode {
+				t.Errorf("got status code %d, want %d", rw.Code, eachTest.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package webserver
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// rateLimiterSweepInterval is how often the idle buckets are dropped, bounding the memory to the active users.
+const rateLimiterSweepInterval = time.Minute
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter throttles the requests with a token bucket for each user and, when configured, one shared by all the
+// members of each of the given groups, such as a Tenant one: a request consumes a token from all of its buckets.
+type rateLimiter struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	groups    sets.String
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newRateLimiter(qps float64, burst int, groups []string) *rateLimiter {
+	return &rateLimiter{
+		limit:   rate.Limit(qps),
+		burst:   burst,
+		groups:  sets.NewString(groups...),
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+}
+
+// Allow reports whether the request of the given identity can be performed, otherwise the delay after which a token
+// is available again: the tokens of the denied requests are given back, thus the retries are not penalized.
+func (r *rateLimiter) Allow(username string, groups []string) (bool, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	r.sweep(now)
+
+	keys := []string{"user:" + username}
+
+	for _, group := range groups {
+		if r.groups.Has(group) {
+			keys = append(keys, "group:"+group)
+		}
+	}
+
+	reservations := make([]*rate.Reservation, 0, len(keys))
+
+	for _, key := range keys {
+		b, ok := r.buckets[key]
+		if !ok {
+			b = &bucket{limiter: rate.NewLimiter(r.limit, r.burst)}
+			r.buckets[key] = b
+		}
+
+		b.lastSeen = now
+
+		reservation := b.limiter.ReserveN(now, 1)
+		reservations = append(reservations, reservation)
+
+		if delay := reservation.DelayFrom(now); !reservation.OK() || delay > 0 {
+			for _, reserved := range reservations {
+				reserved.CancelAt(now)
+			}
+
+			return false, delay
+		}
+	}
+
+	return true, 0
+}
+
+// sweep drops the buckets idle for longer than the time to refill them, since equivalent to the new ones.
+func (r *rateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < rateLimiterSweepInterval {
+		return
+	}
+
+	r.lastSweep = now
+
+	refill := time.Duration(float64(r.burst) / float64(r.limit) * float64(time.Second))
+
+	for key, b := range r.buckets {
+		if now.Sub(b.lastSeen) > refill {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// isWatch reports whether the request is a watch one: these are long-running, thus not rate-limited, since a single
+// request streams the events for its whole duration.
+func isWatch(request *http.Request) bool {
+	if request.Method != http.MethodGet {
+		return false
+	}
+
+	if watch := request.URL.Query().Get("watch"); watch == "true" || watch == "1" {
+		return true
+	}
+	// The deprecated watch endpoints, such as /api/v1/watch/namespaces/default/pods
+	segments := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+
+	switch {
+	case len(segments) > 2 && segments[0] == "api":
+		return segments[2] == "watch"
+	case len(segments) > 3 && segments[0] == "apis":
+		return segments[3] == "watch"
+	default:
+		return false
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+// nolint:testpackage
+package webserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	req "github.com/clastix/capsule-proxy/internal/request"
+)
+
+func newTestRateLimiter(qps float64, burst int, groups []string) (*rateLimiter, *time.Time) {
+	now := time.Now()
+
+	limiter := newRateLimiter(qps, burst, groups)
+	limiter.now = func() time.Time {
+		return now
+	}
+
+	return limiter, &now
+}
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+
+	limiter, now := newTestRateLimiter(1, 2, nil)
+
+	for i := 0; i < 2; i++ {
+		if allowed, _ := limiter.Allow("alice", nil); !allowed {
+			t.Fatalf("expected the request %d within the burst to be allowed", i)
+		}
+	}
+
+	allowed, retryAfter := limiter.Allow("alice", nil)
+	if allowed || retryAfter != time.Second {
+		t.Fatalf("got allowed %t with retry after %s, want denied with retry after 1s", allowed, retryAfter)
+	}
+
+	if allowed, _ = limiter.Allow("bob", nil); !allowed {
+		t.Error("expected the requests of another user to be allowed")
+	}
+
+	*now = now.Add(time.Second)
+
+	if allowed, _ = limiter.Allow("alice", nil); !allowed {
+		t.Error("expected the request to be allowed once the token is refilled")
+	}
+}
+
+func TestRateLimiterGroups(t *testing.T) {
+	t.Parallel()
+
+	limiter, now := newTestRateLimiter(1, 2, []string{"tenant-oil"})
+
+	for _, username := range []string{"alice", "bob"} {
+		if allowed, _ := limiter.Allow(username, []string{"capsule.clastix.io", "tenant-oil"}); !allowed {
+			t.Fatalf("expected the request of %s to be allowed", username)
+		}
+	}
+
+	if allowed, _ := limiter.Allow("carol", []string{"capsule.clastix.io", "tenant-oil"}); allowed {
+		t.Fatal("expected the request exceeding the group rate limit to be denied")
+	}
+
+	if allowed, _ := limiter.Allow("dave", []string{"capsule.clastix.io", "tenant-gas"}); !allowed {
+		t.Error("expected the requests of the members of the other groups to be allowed")
+	}
+	// The denied request gave its token back, thus the burst of carol is still full
+	*now = now.Add(2 * time.Second)
+
+	for i := 0; i < 2; i++ {
+		if allowed, _ := limiter.Allow("carol", nil); !allowed {
+			t.Fatalf("expected the request %d of carol to be allowed", i)
+		}
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	t.Parallel()
+
+	limiter, now := newTestRateLimiter(1, 2, nil)
+
+	limiter.Allow("alice", nil)
+
+	*now = now.Add(rateLimiterSweepInterval)
+	limiter.Allow("bob", nil)
+
+	if _, ok := limiter.buckets["user:alice"]; ok || len(limiter.buckets) != 1 {
+		t.Errorf("got buckets %v, want the idle ones to be dropped", limiter.buckets)
+	}
+}
+
+func TestIsWatch(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		method string
+		target string
+		want   bool
+	}{
+		{http.MethodGet, "/api/v1/namespaces/default/pods?watch=true", true},
+		{http.MethodGet, "/api/v1/namespaces/default/pods?watch=1", true},
+		{http.MethodGet, "/api/v1/watch/namespaces/default/pods", true},
+		{http.MethodGet, "/apis/apps/v1/watch/namespaces/default/deployments", true},
+		{http.MethodGet, "/api/v1/namespaces/default/pods?watch=false", false},
+		{http.MethodGet, "/api/v1/namespaces/watch/pods", false},
+		{http.MethodPost, "/api/v1/namespaces/default/pods?watch=true", false},
+	}
+
+	for _, eachTest := range tests {
+		if got := isWatch(httptest.NewRequest(eachTest.method, eachTest.target, nil)); got != eachTest.want {
+			t.Errorf("got %t for %s %s, want %t", got, eachTest.method, eachTest.target, eachTest.want)
+		}
+	}
+}
+
+func TestImpersonateHandlerRateLimit(t *testing.T) {
+	t.Parallel()
+
+	limiter, _ := newTestRateLimiter(1, 1, nil)
+
+	n := kubeFilter{
+		log:            logr.Discard(),
+		authenticators: []req.Authenticator{headerAuthenticator{username: "alice"}},
+		serverOptions:  fakeServerOptions{},
+		rateLimiter:    limiter,
+	}
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("X-Api-Key", "secret")
+
+		rw := httptest.NewRecorder()
+
+		func() {
+			// The throttled requests panic, recovered by the router
+			defer func() { _ = recover() }()
+
+			n.impersonateHandler(rw, r)
+		}()
+
+		return rw
+	}
+
+	if rw := serve("/api/v1/namespaces/default/pods"); rw.Code != http.StatusOK {
+		t.Fatalf("got status code %d, want 200", rw.Code)
+	}
+
+	rw := serve("/api/v1/namespaces/default/pods")
+	if rw.Code != http.StatusTooManyRequests || rw.Header().Get("Retry-After") != "1" {
+		t.Errorf("got status code %d with Retry-After %q, want 429 with 1", rw.Code, rw.Header().Get("Retry-After"))
+	}
+
+	if rw = serve("/api/v1/namespaces/default/pods?watch=true"); rw.Code != http.StatusOK {
+		t.Errorf("got status code %d for the watch request, want 200", rw.Code)
+	}
+}
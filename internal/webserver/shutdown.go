@@ -0,0 +1,148 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package webserver
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http/httpguts"
+)
+
+// gracefulServer runs the HTTP server until the context is done, then stops accepting new connections and waits
+// up to the shutdown timeout for the in-flight requests to complete. The long-running requests, such as watches and
+// upgraded connections, are cancelled once the streams grace period elapsed, since these would never end otherwise.
+type gracefulServer struct {
+	server             *http.Server
+	shutdownTimeout    time.Duration
+	streamsGracePeriod time.Duration
+	log                logr.Logger
+
+	streams       context.Context
+	cancelStreams context.CancelFunc
+	// The upgraded connections are hijacked, thus not tracked by the server
+	activeStreams sync.WaitGroup
+}
+
+func newGracefulServer(server *http.Server, shutdownTimeout, streamsGracePeriod time.Duration, log logr.Logger) *gracefulServer {
+	streams, cancelStreams := context.WithCancel(context.Background())
+
+	return &gracefulServer{
+		server:             server,
+		shutdownTimeout:    shutdownTimeout,
+		streamsGracePeriod: streamsGracePeriod,
+		log:                log,
+		streams:            streams,
+		cancelStreams:      cancelStreams,
+	}
+}
+
+// Run serves the requests with the given function, such as ListenAndServe, until the context is done.
+func (g *gracefulServer) Run(ctx context.Context, serve func() error) error {
+	errCh := make(chan error, 1)
+
+	go func() {
+		if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- err
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		g.cancelStreams()
+
+		return errors.Wrap(err, "cannot serve the requests")
+	case <-ctx.Done():
+	}
+
+	g.log.Info("shutting down, draining the in-flight requests", "timeout", g.shutdownTimeout.String())
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), g.shutdownTimeout)
+	defer cancel()
+
+	timer := time.AfterFunc(g.streamsGracePeriod, g.cancelStreams)
+	defer timer.Stop()
+
+	if err := g.server.Shutdown(shutdownCtx); err != nil {
+		g.cancelStreams()
+		_ = g.server.Close()
+
+		return errors.Wrap(err, "cannot drain the in-flight requests")
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		g.activeStreams.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-shutdownCtx.Done():
+		g.cancelStreams()
+
+		return errors.Wrap(shutdownCtx.Err(), "cannot drain the upgraded connections")
+	}
+
+	return nil
+}
+
+// BoundStreams is the middleware binding the long-running requests to the streams grace period of the shutdown.
+func (g *gracefulServer) BoundStreams(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !isLongRunning(request) {
+			next.ServeHTTP(writer, request)
+
+			return
+		}
+
+		g.activeStreams.Add(1)
+		defer g.activeStreams.Done()
+
+		ctx, cancel := context.WithCancel(request.Context())
+		defer cancel()
+
+		go func() {
+			select {
+			case <-g.streams.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// isLongRunning reports whether the request is a watch, a followed log, or an upgraded connection,
+// such as exec, attach, and port-forward.
+func isLongRunning(request *http.Request) bool {
+	q := request.URL.Query()
+
+	if watch := q.Get("watch"); watch == "true" || watch == "1" {
+		return true
+	}
+
+	if q.Get("follow") == "true" {
+		return true
+	}
+
+	if httpguts.HeaderValuesContainsToken(request.Header.Values("Connection"), "upgrade") {
+		return true
+	}
+
+	for _, subresource := range []string{"/exec", "/attach", "/portforward"} {
+		if strings.HasSuffix(request.URL.Path, subresource) {
+			return true
+		}
+	}
+
+	return strings.Contains(request.URL.Path, "/watch/")
+}
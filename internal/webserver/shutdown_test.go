@@ -0,0 +1,202 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+// nolint:testpackage
+package webserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+type shutdownHarness struct {
+	url    string
+	cancel context.CancelFunc
+	done   chan error
+}
+
+// startGracefulServer serves the handler bound to the streams grace period, until the harness is cancelled.
+func startGracefulServer(t *testing.T, handler http.Handler, shutdownTimeout, streamsGracePeriod time.Duration) *shutdownHarness {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+
+	srv := &http.Server{ReadHeaderTimeout: time.Second}
+	graceful := newGracefulServer(srv, shutdownTimeout, streamsGracePeriod, logr.Discard())
+	srv.Handler = graceful.BoundStreams(handler)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- graceful.Run(ctx, func() error {
+			return srv.Serve(listener)
+		})
+	}()
+
+	return &shutdownHarness{url: "http://" + listener.Addr().String(), cancel: cancel, done: done}
+}
+
+// get performs the request in background, sending a nil response when it failed.
+func (s *shutdownHarness) get(path string) <-chan *http.Response {
+	responses := make(chan *http.Response, 1)
+
+	go func() {
+		// The response is nil on error
+		res, _ := http.Get(s.url + path) // nolint:noctx,bodyclose
+
+		responses <- res
+	}()
+
+	return responses
+}
+
+func TestGracefulShutdownDrainsInFlightRequests(t *testing.T) {
+	t.Parallel()
+
+	started, release := make(chan struct{}), make(chan struct{})
+
+	harness := startGracefulServer(t, http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+		close(started)
+		<-release
+		_, _ = writer.Write([]byte("ok"))
+	}), 5*time.Second, time.Second)
+
+	responses := harness.get("/api/v1/namespaces")
+
+	<-started
+	harness.cancel()
+
+	select {
+	case err := <-harness.done:
+		t.Fatalf("the server stopped with an in-flight request: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+
+	res := <-responses
+	if res == nil {
+		t.Fatal("the in-flight request failed")
+	}
+	defer res.Body.Close()
+
+	if body, _ := io.ReadAll(res.Body); res.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("got status code %d and body %q, want the in-flight request to complete", res.StatusCode, body)
+	}
+
+	if err := <-harness.done; err != nil {
+		t.Errorf("got error: %v", err)
+	}
+}
+
+func TestGracefulShutdownBoundsStreams(t *testing.T) {
+	t.Parallel()
+
+	started := make(chan struct{})
+
+	harness := startGracefulServer(t, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+		writer.(http.Flusher).Flush()
+		close(started)
+		// Streaming the watch events until the client or the proxy closes it
+		<-request.Context().Done()
+	}), 5*time.Second, 50*time.Millisecond)
+
+	responses := harness.get("/api/v1/pods?watch=true")
+
+	<-started
+
+	shutdownStarted := time.Now()
+
+	harness.cancel()
+
+	select {
+	case err := <-harness.done:
+		if err != nil {
+			t.Errorf("got error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the watch has not been closed after the streams grace period")
+	}
+
+	if elapsed := time.Since(shutdownStarted); elapsed < 50*time.Millisecond {
+		t.Errorf("the watch has been closed after %s, before the streams grace period", elapsed)
+	}
+
+	if res := <-responses; res != nil {
+		_ = res.Body.Close()
+	}
+}
+
+func TestGracefulShutdownTimeout(t *testing.T) {
+	t.Parallel()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+
+	harness := startGracefulServer(t, http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+		close(started)
+		<-release
+	}), 100*time.Millisecond, 50*time.Millisecond)
+
+	_ = harness.get("/api/v1/namespaces")
+
+	<-started
+	harness.cancel()
+
+	select {
+	case err := <-harness.done:
+		if err == nil {
+			t.Error("expected an error when the in-flight requests are not drained in time")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the server has not been stopped after the shutdown timeout")
+	}
+}
+
+func TestIsLongRunning(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		url         string
+		header      http.Header
+		longRunning bool
+	}{
+		{"list", "/api/v1/namespaces", nil, false},
+		{"watch", "/api/v1/pods?watch=true", nil, true},
+		{"legacy watch", "/api/v1/watch/pods", nil, true},
+		{"follow logs", "/api/v1/namespaces/default/pods/nginx/log?follow=true", nil, true},
+		{"exec", "/api/v1/namespaces/default/pods/nginx/exec", nil, true},
+		{"upgrade", "/api/v1/namespaces/default/pods/nginx/portforward", http.Header{"Connection": []string{"Upgrade"}}, true},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(http.MethodGet, eachTest.url, nil)
+			for name, values := range eachTest.header {
+				r.Header[name] = values
+			}
+
+			if got := isLongRunning(r); got != eachTest.longRunning {
+				t.Errorf("got %t, want %t", got, eachTest.longRunning)
+			}
+		})
+	}
+}
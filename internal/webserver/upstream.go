@@ -0,0 +1,127 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package webserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+
+	req "github.com/clastix/capsule-proxy/internal/request"
+)
+
+// UpstreamRoute forwards the requests of the users member of the group, or with the given username, to the API server
+// of the kubeconfig, such as a virtual cluster: its credentials must be allowed to impersonate the users.
+type UpstreamRoute struct {
+	Group      string `json:"group,omitempty"`
+	User       string `json:"user,omitempty"`
+	Kubeconfig string `json:"kubeconfig"`
+}
+
+type upstream struct {
+	UpstreamRoute
+	proxy *httputil.ReverseProxy
+}
+
+// upstreamRouter selects the upstream of the authenticated requests with the first matching route, defaulting to
+// the primary API server: the TokenReview and SubjectAccessReview requests are always sent to the primary one.
+type upstreamRouter struct {
+	primary   *httputil.ReverseProxy
+	upstreams []upstream
+}
+
+// loadUpstreamRoutes reads the YAML, or JSON, list of UpstreamRoute from the given file.
+func loadUpstreamRoutes(path string) ([]UpstreamRoute, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the upstreams configuration: %w", err)
+	}
+
+	var routes []UpstreamRoute
+
+	if err = yaml.UnmarshalStrict(b, &routes); err != nil {
+		return nil, fmt.Errorf("cannot parse the upstreams configuration: %w", err)
+	}
+
+	for _, route := range routes {
+		if (len(route.Group) == 0) == (len(route.User) == 0) {
+			return nil, fmt.Errorf("the upstream route to %s must match either a group or a user", route.Kubeconfig)
+		}
+
+		if len(route.Kubeconfig) == 0 {
+			return nil, fmt.Errorf("missing kubeconfig in the upstream route of %s%s", route.Group, route.User)
+		}
+	}
+
+	return routes, nil
+}
+
+// newUpstreamRouter returns the router of the given routes, proxying to the API server of their kubeconfig
+// with its credentials.
+func newUpstreamRouter(primary *httputil.ReverseProxy, routes []UpstreamRoute, errorHandler func(http.ResponseWriter, *http.Request, error)) (*upstreamRouter, error) {
+	router := &upstreamRouter{primary: primary}
+
+	for _, route := range routes {
+		config, err := clientcmd.BuildConfigFromFlags("", route.Kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load the upstream kubeconfig %s: %w", route.Kubeconfig, err)
+		}
+
+		u, err := url.Parse(config.Host)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse the upstream URL of %s: %w", route.Kubeconfig, err)
+		}
+
+		transport, err := rest.TransportFor(config)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create the upstream transport of %s: %w", route.Kubeconfig, err)
+		}
+
+		proxy := httputil.NewSingleHostReverseProxy(u)
+		proxy.FlushInterval = primary.FlushInterval
+		proxy.Transport = transport
+		proxy.ErrorHandler = errorHandler
+
+		router.upstreams = append(router.upstreams, upstream{UpstreamRoute: route, proxy: proxy})
+	}
+
+	return router, nil
+}
+
+// ServeHTTP proxies the request to the upstream of the identity resolved by the handlers, rather than of the
+// Impersonate-* headers, these are removed from the filtered requests: the unresolved ones, such as the anonymous,
+// are proxied to the primary API server.
+func (u *upstreamRouter) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	identity, _ := req.IdentityFrom(request.Context())
+
+	proxy, routed := u.route(identity.Username, identity.Groups)
+	if routed {
+		// The upstream is authenticated with the kubeconfig credentials rather than the primary API server ones
+		request.Header.Del("Authorization")
+	}
+
+	proxy.ServeHTTP(writer, request)
+}
+
+func (u *upstreamRouter) route(username string, groups []string) (proxy *httputil.ReverseProxy, routed bool) {
+	for _, upstream := range u.upstreams {
+		if len(upstream.User) > 0 && upstream.User == username {
+			return upstream.proxy, true
+		}
+
+		for _, group := range groups {
+			if len(upstream.Group) > 0 && upstream.Group == group {
+				return upstream.proxy, true
+			}
+		}
+	}
+
+	return u.primary, false
+}
@@ -0,0 +1,205 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+// nolint:testpackage
+package webserver
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/labels"
+
+	req "github.com/clastix/capsule-proxy/internal/request"
+)
+
+// newUpstream returns the API server replying with its name, and the kubeconfig authenticating to it with the token:
+// TLS is required, since the kubeconfig credentials are never sent over plain HTTP.
+func newUpstream(t *testing.T, name, token string) (*httptest.Server, string) {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(writer, "%s %s %s", name, r.Header.Get("Authorization"), r.Header.Get("Impersonate-User"))
+	}))
+	t.Cleanup(srv.Close)
+
+	kubeconfig := filepath.Join(t.TempDir(), name)
+	ca := base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+
+	if err := os.WriteFile(kubeconfig, []byte(fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: %[1]s
+  cluster:
+    server: %[2]s
+    certificate-authority-data: %[4]s
+users:
+- name: %[1]s
+  user:
+    token: %[3]s
+contexts:
+- name: %[1]s
+  context:
+    cluster: %[1]s
+    user: %[1]s
+current-context: %[1]s
+`, name, srv.URL, token, ca)), 0o600); err != nil {
+		t.Fatalf("cannot write kubeconfig: %v", err)
+	}
+
+	return srv, kubeconfig
+}
+
+// identityAuthenticator authenticates any request as the given user and groups.
+type identityAuthenticator struct {
+	username string
+	groups   []string
+}
+
+func (i identityAuthenticator) AuthType() string {
+	return "identity"
+}
+
+func (i identityAuthenticator) Resolve(*http.Request) (string, []string, error) {
+	return i.username, i.groups, nil
+}
+
+// resolvedRequest returns the request whose identity has been resolved, as by the handlers.
+func resolvedRequest(t *testing.T, method, target, username string, groups []string) *http.Request {
+	t.Helper()
+
+	r := httptest.NewRequest(method, target, nil)
+	r = r.WithContext(req.WithIdentityCache(r.Context()))
+
+	authenticators := []req.Authenticator{identityAuthenticator{username: username, groups: groups}}
+	if _, err := req.NewHTTPWithOptions(r, req.Options{Authenticators: authenticators}).GetIdentity(); err != nil {
+		t.Fatalf("cannot resolve the identity: %v", err)
+	}
+
+	return r
+}
+
+func TestUpstreamRouter(t *testing.T) {
+	t.Parallel()
+
+	primary, _ := newUpstream(t, "primary", "")
+	_, oilKubeconfig := newUpstream(t, "oil", "oil-token")
+	_, gasKubeconfig := newUpstream(t, "gas", "gas-token")
+
+	primaryURL, _ := url.Parse(primary.URL)
+
+	routes := []UpstreamRoute{
+		{Group: "tenant-oil", Kubeconfig: oilKubeconfig},
+		{User: "bob", Kubeconfig: gasKubeconfig},
+		{Group: "tenant-gas", Kubeconfig: gasKubeconfig},
+	}
+
+	primaryProxy := httputil.NewSingleHostReverseProxy(primaryURL)
+	primaryProxy.Transport = primary.Client().Transport
+
+	router, err := newUpstreamRouter(primaryProxy, routes, nil)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		groups   []string
+		want     string
+	}{
+		{"group", "alice", []string{"capsule.clastix.io", "tenant-oil"}, "oil Bearer oil-token alice"},
+		{"user", "bob", []string{"capsule.clastix.io"}, "gas Bearer gas-token bob"},
+		{"first matching route", "alice", []string{"tenant-gas", "tenant-oil"}, "oil Bearer oil-token alice"},
+		{"default to primary", "alice", []string{"capsule.clastix.io"}, "primary Bearer proxy-token alice"},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := resolvedRequest(t, http.MethodGet, "/api/v1/namespaces/default/pods", eachTest.username, eachTest.groups)
+			r.Header.Set("Authorization", "Bearer proxy-token")
+			r.Header.Set("Impersonate-User", eachTest.username)
+
+			rw := httptest.NewRecorder()
+			router.ServeHTTP(rw, r)
+
+			if body, _ := io.ReadAll(rw.Body); string(body) != eachTest.want {
+				t.Errorf("got %q, want %q", body, eachTest.want)
+			}
+		})
+	}
+}
+
+func TestLoadUpstreamRoutes(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		config string
+		err    bool
+	}{
+		{"valid", "- group: tenant-oil\n  kubeconfig: /etc/oil\n- user: bob\n  kubeconfig: /etc/gas\n", false},
+		{"both group and user", "- group: tenant-oil\n  user: bob\n  kubeconfig: /etc/oil\n", true},
+		{"neither group nor user", "- kubeconfig: /etc/oil\n", true},
+		{"missing kubeconfig", "- group: tenant-oil\n", true},
+		{"unknown field", "- group: tenant-oil\n  server: https://oil\n", true},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "upstreams.yaml")
+			if err := os.WriteFile(path, []byte(eachTest.config), 0o600); err != nil {
+				t.Fatalf("cannot write configuration: %v", err)
+			}
+
+			if _, err := loadUpstreamRoutes(path); (err != nil) != eachTest.err {
+				t.Errorf("got error %v, want error %t", err, eachTest.err)
+			}
+		})
+	}
+}
+
+func TestUpstreamRouterFilteredRequest(t *testing.T) {
+	t.Parallel()
+
+	primary, _ := newUpstream(t, "primary", "")
+	_, oilKubeconfig := newUpstream(t, "oil", "oil-token")
+
+	primaryURL, _ := url.Parse(primary.URL)
+
+	primaryProxy := httputil.NewSingleHostReverseProxy(primaryURL)
+	primaryProxy.Transport = primary.Client().Transport
+
+	router, err := newUpstreamRouter(primaryProxy, []UpstreamRoute{{Group: "tenant-oil", Kubeconfig: oilKubeconfig}}, nil)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+
+	r := resolvedRequest(t, http.MethodGet, "/api/v1/namespaces", "alice", []string{"capsule.clastix.io", "tenant-oil"})
+	r.Header.Set("Impersonate-Group", "tenant-oil")
+	// The filtered requests have no Impersonate-* headers, performed with the proxy credentials
+	(kubeFilter{log: logr.Discard(), bearerToken: "proxy-token"}).handleRequest(r, labels.Everything())
+
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, r)
+
+	if body, _ := io.ReadAll(rw.Body); string(body) != "oil Bearer oil-token " {
+		t.Errorf("got %q, want the filtered request routed to the tenant upstream", body)
+	}
+}
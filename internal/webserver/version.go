@@ -0,0 +1,21 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/clastix/capsule-proxy/internal/version"
+)
+
+// versionPath is not /version, the API server one, proxied for the clients discovery such as kubectl version.
+const versionPath = "/_version"
+
+// versionHandler replies with the proxy build and the supported Capsule API, with no authentication as /_healthz,
+// since these are not sensitive.
+func versionHandler(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(writer).Encode(version.Get())
+}
@@ -0,0 +1,38 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+// nolint:testpackage
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/clastix/capsule-proxy/internal/version"
+)
+
+func TestVersionHandler(t *testing.T) {
+	t.Parallel()
+
+	rw := httptest.NewRecorder()
+	versionHandler(rw, httptest.NewRequest(http.MethodGet, versionPath, nil))
+
+	if rw.Code != http.StatusOK || rw.Header().Get("content-type") != "application/json" {
+		t.Fatalf("got status code %d with content type %q, want 200 with JSON", rw.Code, rw.Header().Get("content-type"))
+	}
+
+	info := version.Info{}
+	if err := json.NewDecoder(rw.Body).Decode(&info); err != nil {
+		t.Fatalf("cannot decode the version: %v", err)
+	}
+
+	if len(info.Version) == 0 || len(info.GoVersion) == 0 {
+		t.Errorf("got version %q built with %q, want both to be set", info.Version, info.GoVersion)
+	}
+
+	if info.Capsule.Group != "capsule.clastix.io" || len(info.Capsule.Versions) == 0 {
+		t.Errorf("got Capsule API %s %v, want the capsule.clastix.io versions", info.Capsule.Group, info.Capsule.Versions)
+	}
+}
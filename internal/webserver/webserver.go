@@ -8,9 +8,11 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/textproto"
+	"net/url"
 	"strings"
 	"time"
 
@@ -20,13 +22,18 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"golang.org/x/net/http/httpguts"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apiserver/pkg/authentication/serviceaccount"
+	"k8s.io/apiserver/pkg/authentication/user"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/clastix/capsule-proxy/api/v1beta1"
+	"github.com/clastix/capsule-proxy/internal/audit"
 	"github.com/clastix/capsule-proxy/internal/controllers"
 	"github.com/clastix/capsule-proxy/internal/indexer"
 	"github.com/clastix/capsule-proxy/internal/modules"
@@ -42,11 +49,39 @@ import (
 	"github.com/clastix/capsule-proxy/internal/options"
 	req "github.com/clastix/capsule-proxy/internal/request"
 	"github.com/clastix/capsule-proxy/internal/tenant"
+	"github.com/clastix/capsule-proxy/internal/tracing"
 	server "github.com/clastix/capsule-proxy/internal/webserver/errors"
 	"github.com/clastix/capsule-proxy/internal/webserver/middleware"
 )
 
-func NewKubeFilter(opts options.ListenerOpts, srv options.ServerOptions, rbReflector *controllers.RoleBindingReflector) (Filter, error) {
+const (
+	forwardedForHeader   = "X-Forwarded-For"
+	realIPHeader         = "X-Real-Ip"
+	identityUserHeader   = "X-Capsule-Proxy-User"
+	identityGroupsHeader = "X-Capsule-Proxy-Groups"
+	warningHeader        = "Warning"
+	// The warn-code 299 is the one of the API server warnings, printed by kubectl
+	filteredListWarning = `299 - "the list has been filtered to the resources of your Tenants"`
+	// The API server ends the requests bounded by timeoutSeconds, the proxy cancels them past this grace period only
+	timeoutSecondsGrace = 5 * time.Second
+)
+
+// Options are the dependencies of the Filter: the KeySet, the Discovery, the TokenReviewCache, the CircuitBreaker,
+// and the audit Logger are optional, disabled when nil.
+type Options struct {
+	Listener             options.ListenerOpts
+	Server               options.ServerOptions
+	RoleBindingReflector *controllers.RoleBindingReflector
+	KeySet               *req.KeySet
+	Discovery            *req.Discovery
+	TokenReviewCache     *req.TokenReviewCache
+	CircuitBreaker       *req.CircuitBreaker
+	AuditLogger          *audit.Logger
+}
+
+func NewKubeFilter(config Options) (Filter, error) {
+	opts, srv, discovery := config.Listener, config.Server, config.Discovery
+
 	reverseProxy := httputil.NewSingleHostReverseProxy(opts.KubernetesControlPlaneURL())
 	reverseProxy.FlushInterval = time.Millisecond * 100
 
@@ -57,25 +92,191 @@ func NewKubeFilter(opts options.ListenerOpts, srv options.ServerOptions, rbRefle
 
 	reverseProxy.Transport = reverseProxyTransport
 
-	return &kubeFilter{
+	certificateMapping := req.CertificateMapping{
+		UsernameSource: opts.CertificateUsernameSource(),
+		GroupsSources:  opts.CertificateGroupsSources(),
+		TrustedProxies: opts.TrustedProxyCommonNames(),
+		URIPattern:     opts.CertificateURIPattern(),
+		URITemplate:    opts.CertificateURIUsernameTemplate(),
+	}
+
+	if err = certificateMapping.Validate(); err != nil {
+		return nil, errors.Wrap(err, "cannot use the client certificate mapping")
+	}
+
+	claimMappings := req.ClaimMappings{StrictIssuers: opts.StrictIssuers(), TrustedIssuers: sets.NewString(opts.TrustedIssuers()...)}
+
+	claimMappings.Default = req.ClaimMapping{
+		UsernameFields:  opts.PreferredUsernameClaims(),
+		GroupsFields:    opts.GroupsClaims(),
+		GroupsSeparator: opts.GroupsSeparator(),
+		UsernamePrefix:  opts.UsernamePrefix(),
+		GroupsPrefix:    opts.GroupsPrefix(),
+		RequireGroups:   opts.RequireGroupsClaim(),
+		FallbackToSub:   opts.UsernameClaimFallbackSub(),
+		LowercaseEmail:  opts.UsernameLowercaseEmail(),
+	}
+
+	if path := opts.IssuersConfigPath(); len(path) > 0 {
+		if claimMappings.Issuers, err = req.LoadIssuerClaimMappings(path, claimMappings.Default); err != nil {
+			return nil, errors.Wrap(err, "cannot use the OIDC issuers configuration")
+		}
+	}
+
+	var userInfo req.Authenticator
+
+	var userInfoCache *req.TTLCache
+
+	if ttl := opts.UserInfoCacheTTL(); ttl > 0 {
+		userInfoCache = req.NewTTLCache(ttl)
+	}
+	// The configured UserInfo endpoint takes precedence over the discovered one: the opaque tokens are sent to the
+	// discovered endpoint only if opted in, these could be the cluster ones, such as the bootstrap tokens
+	switch {
+	case len(opts.UserInfoURL()) > 0:
+		userInfo = req.NewUserInfoAuthenticator(opts.UserInfoURL(), claimMappings.Default, userInfoCache, opts.TokenQueryParameter(), opts.UpstreamTimeout())
+	case opts.DiscoverUserInfo() && discovery != nil && len(discovery.UserInfoURL()) > 0:
+		userInfo = req.NewDiscoveryUserInfoAuthenticator(discovery, claimMappings.Default, userInfoCache, opts.TokenQueryParameter(), opts.UpstreamTimeout())
+	}
+
+	var introspection req.Authenticator
+
+	if url := opts.IntrospectionURL(); len(url) > 0 {
+		var introspectionCache *req.TTLCache
+
+		if ttl := opts.IntrospectionCacheTTL(); ttl > 0 {
+			introspectionCache = req.NewTTLCache(ttl)
+		}
+
+		mapping := claimMappings.Default
+		mapping.UsernameFields = opts.IntrospectionUsernameClaims()
+		mapping.GroupsFields = opts.IntrospectionGroupsClaims()
+		// The scope field is a space-separated list
+		mapping.GroupsSeparator = " "
+
+		introspection = req.NewIntrospectionAuthenticator(url, opts.IntrospectionClientID(), opts.IntrospectionClientSecret(), mapping, introspectionCache, opts.TokenQueryParameter(), opts.UpstreamTimeout())
+	}
+
+	var groupResolver req.GroupResolver
+
+	if url := opts.GroupResolverURL(); len(url) > 0 {
+		var groupsCache *req.TTLCache
+
+		if ttl := opts.GroupResolverCacheTTL(); ttl > 0 {
+			groupsCache = req.NewTTLCache(ttl)
+		}
+
+		groupResolver = req.NewHTTPGroupResolver(url, groupsCache, opts.UpstreamTimeout())
+	}
+
+	transformers := req.DefaultTransformers()
+	transformers.AuthenticatedGroup = opts.AddAuthenticatedGroup()
+	transformers.AdditionalGroups = opts.AdditionalGroups()
+
+	if opts.GroupsAllowRegex() != nil || opts.GroupsDenyRegex() != nil {
+		transformers.Groups = req.RegexGroupsTransformer(opts.GroupsAllowRegex(), opts.GroupsDenyRegex())
+	}
+
+	var limiter *rateLimiter
+
+	if qps := srv.RateLimitQPS(); qps > 0 {
+		limiter = newRateLimiter(qps, srv.RateLimitBurst(), srv.RateLimitGroups())
+	}
+
+	filter := &kubeFilter{
 		allowedPaths:          sets.NewString("/api", "/apis", "/version"),
 		ignoredUserGroups:     sets.NewString(opts.IgnoredGroupNames()...),
 		reverseProxy:          reverseProxy,
 		bearerToken:           opts.BearerToken(),
-		usernameClaimField:    opts.PreferredUsernameClaim(),
+		certificateMapping:    certificateMapping,
+		certAuthDisabled:      opts.ClientCertificateAuthDisabled(),
+		claimMappings:         claimMappings,
+		keySet:                config.KeySet,
+		tokenReviewCache:      config.TokenReviewCache,
+		circuitBreaker:        config.CircuitBreaker,
+		userInfo:              userInfo,
+		introspection:         introspection,
+		groupResolver:         groupResolver,
+		audiences:             opts.Audiences(),
+		requiredAudiences:     opts.JWTRequiredAudiences(),
+		tokenQueryParameter:   opts.TokenQueryParameter(),
+		anonymousAllowedPaths: opts.AnonymousAllowedPaths(),
+		clockSkew:             opts.ClockSkew(),
+		saLeeway:              opts.ServiceAccountTokenLeeway(),
+		saIssuers:             opts.ServiceAccountIssuers(),
+		upstreamTimeout:       opts.UpstreamTimeout(),
+		tokenReviewRetry:      wait.Backoff{Duration: opts.TokenReviewRetryBackoff(), Factor: 2, Jitter: 0.1, Steps: opts.TokenReviewRetries()},
+		namespaceLabels:       opts.ServiceAccountNamespaceLabels(),
+		impersonationBypass:   sets.NewString(opts.ImpersonationBypassUsers()...),
+		deniedUsers:           sets.NewString(opts.ImpersonationDeniedUsers()...),
+		deniedGroups:          sets.NewString(opts.ImpersonationDeniedGroups()...),
+		rateLimiter:           limiter,
+		impersonationDisabled: opts.ImpersonationDisabled(),
+		saImpersonationDenied: opts.ServiceAccountImpersonationDisabled(),
+		nsImpersonation:       opts.NamespacedImpersonationChecks(),
+		groupsSeparator:       opts.ImpersonateGroupsSeparator(),
+		forwardUserExtra:      opts.ForwardUserExtra(),
+		transformers:          transformers,
+		auditLogger:           config.AuditLogger,
 		serverOptions:         srv,
 		log:                   ctrl.Log.WithName("proxy"),
-		roleBindingsReflector: rbReflector,
-	}, nil
+		roleBindingsReflector: config.RoleBindingReflector,
+	}
+	reverseProxy.ErrorHandler = filter.reverseProxyErrorHandler
+
+	var routes []UpstreamRoute
+
+	if path := opts.UpstreamsConfigPath(); len(path) > 0 {
+		if routes, err = loadUpstreamRoutes(path); err != nil {
+			return nil, errors.Wrap(err, "cannot use the upstreams configuration")
+		}
+	}
+
+	if filter.upstreams, err = newUpstreamRouter(reverseProxy, routes, filter.reverseProxyErrorHandler); err != nil {
+		return nil, errors.Wrap(err, "cannot create the upstreams router")
+	}
+
+	return filter, nil
 }
 
 type kubeFilter struct {
 	allowedPaths          sets.String
 	ignoredUserGroups     sets.String
 	reverseProxy          *httputil.ReverseProxy
+	upstreams             *upstreamRouter
 	client                client.Client
 	bearerToken           string
-	usernameClaimField    string
+	certificateMapping    req.CertificateMapping
+	certAuthDisabled      bool
+	claimMappings         req.ClaimMappings
+	keySet                *req.KeySet
+	tokenReviewCache      *req.TokenReviewCache
+	circuitBreaker        *req.CircuitBreaker
+	userInfo              req.Authenticator
+	introspection         req.Authenticator
+	groupResolver         req.GroupResolver
+	audiences             []string
+	requiredAudiences     []string
+	tokenQueryParameter   string
+	anonymousAllowedPaths []string
+	clockSkew             time.Duration
+	saLeeway              time.Duration
+	saIssuers             []string
+	upstreamTimeout       time.Duration
+	tokenReviewRetry      wait.Backoff
+	namespaceLabels       []string
+	impersonationBypass   sets.String
+	deniedUsers           sets.String
+	deniedGroups          sets.String
+	rateLimiter           *rateLimiter
+	impersonationDisabled bool
+	saImpersonationDenied bool
+	nsImpersonation       bool
+	forwardUserExtra      bool
+	groupsSeparator       string
+	transformers          req.Transformers
+	authenticators        []req.Authenticator
+	auditLogger           *audit.Logger
 	serverOptions         options.ServerOptions
 	log                   logr.Logger
 	roleBindingsReflector *controllers.RoleBindingReflector
@@ -126,69 +327,237 @@ func (n *kubeFilter) ReadinessProbe(req *http.Request) (err error) {
 	return nil
 }
 
+// APIServerProbe checks the API server is reachable through the same client used for the TokenReview and
+// SubjectAccessReview requests, creating a SelfSubjectAccessReview that's never cached.
+func (n *kubeFilter) APIServerProbe(req *http.Request) error {
+	if n.client == nil {
+		return fmt.Errorf("the Kubernetes client has not been injected yet")
+	}
+
+	ssar := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Group:    authenticationv1.SchemeGroupVersion.Group,
+				Resource: "tokenreviews",
+				Verb:     "create",
+			},
+		},
+	}
+
+	if err := n.client.Create(req.Context(), ssar); err != nil {
+		return errors.Wrap(err, "cannot reach the API server")
+	}
+
+	return nil
+}
+
 func (n *kubeFilter) InjectClient(client client.Client) error {
 	n.client = client
+	n.authenticators = req.DefaultAuthenticators(req.AuthenticatorOptions{
+		CertificateMapping:    n.certificateMapping,
+		ClientCAs:             n.serverOptions.GetClientCertificateAuthorityPool(),
+		ClaimMappings:         n.claimMappings,
+		KeySet:                n.keySet,
+		RequiredAudiences:     n.requiredAudiences,
+		ClockSkew:             n.clockSkew,
+		ServiceAccountLeeway:  n.saLeeway,
+		ServiceAccountIssuers: n.saIssuers,
+		TokenReviewCache:      n.tokenReviewCache,
+		CircuitBreaker:        n.circuitBreaker,
+		Retry:                 n.tokenReviewRetry,
+		Audiences:             n.audiences,
+		TokenQueryParameter:   n.tokenQueryParameter,
+		Timeout:               n.upstreamTimeout,
+		NamespaceLabels:       n.namespaceLabels,
+		Client:                client,
+	})
+
+	if n.certAuthDisabled {
+		n.authenticators = withoutAuthType(n.authenticators, req.AuthTypeCertificate)
+	}
+	// The opaque tokens are resolved by the UserInfo and the introspection endpoints before falling back to the TokenReview API
+	for _, authenticator := range []req.Authenticator{n.userInfo, n.introspection} {
+		if authenticator == nil {
+			continue
+		}
+
+		last := len(n.authenticators) - 1
+
+		authenticators := append([]req.Authenticator{}, n.authenticators[:last]...)
+		n.authenticators = append(authenticators, authenticator, n.authenticators[last])
+	}
 
 	return nil
 }
 
+// certificateAuthentication reports whether the client certificates authenticate the requests: these are presented
+// on the TLS listener only, and can be disabled in favour of the bearer tokens.
+func (n kubeFilter) certificateAuthentication() bool {
+	return n.serverOptions.IsListeningTLS() && !n.certAuthDisabled
+}
+
+func withoutAuthType(authenticators []req.Authenticator, authType string) []req.Authenticator {
+	filtered := make([]req.Authenticator, 0, len(authenticators))
+
+	for _, authenticator := range authenticators {
+		if authenticator.AuthType() != authType {
+			filtered = append(filtered, authenticator)
+		}
+	}
+
+	return filtered
+}
+
+// reverseProxyMiddleware proxies the request once the handlers resolved the identity: the upgraded connections, such
+// as exec, attach, and port-forward, keep their Connection and Upgrade headers, thus the reverse proxy hijacks them
+// piping the bytes as they are in both directions, with no body filtering. The upstream call is traced by its own
+// span, propagated to the API server with the traceparent header.
 func (n kubeFilter) reverseProxyMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		// The identity headers are set by the handlers only, once the user is authenticated
+		request.Header.Del(identityUserHeader)
+		request.Header.Del(identityGroupsHeader)
+
 		next.ServeHTTP(writer, request)
 
-		n.log.V(5).Info("debugging request", "uri", request.RequestURI, "method", request.Method)
-		n.reverseProxy.ServeHTTP(writer, request)
+		n.forwardingClientIP(request)
+
+		req.RequestLogger(request.Context(), n.log).V(5).Info("debugging request", "uri", request.RequestURI, "method", request.Method)
+
+		ctx, span := tracing.Start(request.Context(), "proxy")
+		defer span.End()
+
+		tracing.Inject(ctx, request.Header)
+		n.upstreams.ServeHTTP(writer, request.WithContext(ctx))
 	})
 }
 
+// reverseProxyErrorHandler replies with 413 when the streamed request body exceeded the limit while proxying it,
+// and with 502 for any other error, as the default reverse proxy handler does.
+func (n kubeFilter) reverseProxyErrorHandler(writer http.ResponseWriter, request *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		server.HandleRequestEntityTooLarge(writer, err, "cannot proxy the request")
+	}
+
+	req.RequestLogger(request.Context(), n.log).Error(err, "cannot proxy the request", "uri", request.RequestURI)
+	writer.WriteHeader(http.StatusBadGateway)
+}
+
+// handleRequest filters the request with the selector, letting the API server apply it: the response is never
+// rewritten, thus the content negotiation, such as the Table of kubectl get or protobuf, is preserved, as well as
+// the Content-Encoding negotiated by the client, streamed as it is.
 // nolint:interfacer
 func (n kubeFilter) handleRequest(request *http.Request, selector labels.Selector) {
-	// Sanitizing the impersonation
-	request.Header.Del("Impersonate-User")
-	request.Header.Del("Impersonate-Group")
+	// Sanitizing the impersonation, the filtered requests are performed with the proxy credentials
+	n.removingImpersonationHeaders(request)
+
+	log := req.RequestLogger(request.Context(), n.log)
 
 	q := request.URL.Query()
 	if e := q.Get("labelSelector"); len(e) > 0 {
-		n.log.V(4).Info("handling current labelSelector", "selector", e)
+		log.V(4).Info("handling current labelSelector", "selector", e)
 
 		v := strings.Join([]string{e, selector.String()}, ",")
 		q.Set("labelSelector", v)
-		n.log.V(4).Info("labelSelector updated", "selector", v)
+		log.V(4).Info("labelSelector updated", "selector", v)
 	} else {
 		q.Set("labelSelector", selector.String())
-		n.log.V(4).Info("labelSelector added", "selector", selector.String())
+		log.V(4).Info("labelSelector added", "selector", selector.String())
 	}
 
-	n.log.V(4).Info("updating RawQuery", "query", q.Encode())
+	log.V(4).Info("updating RawQuery", "query", q.Encode())
 	request.URL.RawQuery = q.Encode()
 
 	if len(n.bearerToken) > 0 {
-		n.log.V(4).Info("Updating the token", "token", n.bearerToken)
+		log.V(4).Info("Updating the token", "token", n.bearerToken)
 		request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", n.bearerToken))
 	}
 }
 
-func (n kubeFilter) impersonateHandler(writer http.ResponseWriter, request *http.Request) {
-	hr := req.NewHTTP(request, n.usernameClaimField, n.client)
+// warnFilteredList appends the Warning of the filtered list responses, when enabled: the reverse proxy adds the
+// API server ones, such as the deprecation notices, next to it.
+func (n kubeFilter) warnFilteredList(writer http.ResponseWriter, request *http.Request) {
+	if !n.serverOptions.FilteredListWarning() || len(mux.Vars(request)["name"]) > 0 {
+		return
+	}
 
-	var username string
+	writer.Header().Add(warningHeader, filteredListWarning)
+}
 
-	var groups []string
+// rejectWrites rejects with 403 the write requests in the read-only mode: it's meant to be called once the identity
+// is resolved, thus the unauthenticated requests are still replied with 401. The authentication and authorization
+// reviews, such as the SelfSubjectAccessReview of kubectl auth can-i, are not persisted, thus allowed.
+func (n kubeFilter) rejectWrites(writer http.ResponseWriter, request *http.Request) {
+	if !n.serverOptions.ReadOnly() || !isWrite(request) {
+		return
+	}
 
-	var err error
+	server.HandleForbidden(writer, fmt.Errorf("%s", n.serverOptions.ReadOnlyMessage()), "the proxy is read-only")
+}
 
-	if username, groups, err = hr.GetUserAndGroups(); err != nil {
+// throttle replies with 429 to the requests of the identity exceeding the rate limit, when enabled: the watch
+// requests are not limited, since long-running.
+func (n kubeFilter) throttle(writer http.ResponseWriter, request *http.Request, username string, groups []string) {
+	if n.rateLimiter == nil || isWatch(request) {
+		return
+	}
+
+	if allowed, retryAfter := n.rateLimiter.Allow(username, groups); !allowed {
+		server.HandleTooManyRequests(writer, fmt.Errorf("the rate limit of the user %s is exceeded", username), "too many requests", retryAfter)
+	}
+}
+
+func isWrite(request *http.Request) bool {
+	switch request.Method {
+	case http.MethodPost:
+		return !strings.HasPrefix(request.URL.Path, "/apis/"+authorizationv1.GroupName+"/") && !strings.HasPrefix(request.URL.Path, "/apis/"+authenticationv1.GroupName+"/")
+	case http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+func (n kubeFilter) newHTTP(request *http.Request) req.Request {
+	return req.NewHTTPWithOptions(request, req.Options{
+		Authenticators:             n.authenticators,
+		Transformers:               n.transformers,
+		GroupResolver:              n.groupResolver,
+		BypassUsers:                n.impersonationBypass,
+		DeniedUsers:                n.deniedUsers,
+		DeniedGroups:               n.deniedGroups,
+		ImpersonationDisabled:      n.impersonationDisabled,
+		NamespacedImpersonation:    n.nsImpersonation,
+		ImpersonateGroupsSeparator: n.groupsSeparator,
+		Timeout:                    n.upstreamTimeout,
+		UnauthenticatedMessage:     n.serverOptions.UnauthenticatedMessage(),
+		Client:                     n.client,
+	})
+}
+
+func (n kubeFilter) impersonateHandler(writer http.ResponseWriter, request *http.Request) {
+	hr := n.newHTTP(request)
+
+	identity, err := hr.GetIdentity()
+	if err != nil {
 		msg := "cannot retrieve user and group"
 
 		var t *req.ErrUnauthorized
-		if errors.As(err, &t) {
-			server.HandleUnauthorized(writer, err, msg)
-		} else {
-			server.HandleError(writer, err, msg)
+		if errors.As(err, &t) && n.serverOptions.VerboseAuthErrors() && len(t.Details()) > 0 {
+			err = fmt.Errorf("%w: %s", err, t.Details())
 		}
+
+		server.HandleRequestError(writer, err, msg)
 	}
 
-	n.log.V(4).Info("impersonating for the current request", "username", username, "groups", groups)
+	audit.EventFrom(request.Context()).SetIdentity(identity.Username, identity.Groups, identity.AuthType)
+	n.rejectWrites(writer, request)
+	n.throttle(writer, request, identity.Username, identity.Groups)
+
+	username, groups := identity.Username, identity.Groups
+
+	req.RequestLogger(request.Context(), n.log).V(4).Info("impersonating for the current request", "username", username, "groups", groups)
 
 	if len(n.bearerToken) > 0 {
 		request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", n.bearerToken))
@@ -196,12 +565,41 @@ func (n kubeFilter) impersonateHandler(writer http.ResponseWriter, request *http
 	// Dropping malicious header connection
 	// https://github.com/clastix/capsule-proxy/issues/188
 	n.removingHopByHopHeaders(request)
+	// The user token must not be forwarded to the upstream along with the proxy credentials
+	n.removingTokenQueryParameter(request)
+
+	// The client impersonation headers are replaced by the resolved identity ones, such as the transformed groups
+	n.removingImpersonationHeaders(request)
 
-	request.Header.Add("Impersonate-User", username)
+	request.Header.Set(authenticationv1.ImpersonateUserHeader, username)
 
 	for _, group := range groups {
-		request.Header.Add("Impersonate-Group", group)
+		request.Header.Add(authenticationv1.ImpersonateGroupHeader, group)
 	}
+
+	n.forwardingUserExtra(request, identity)
+
+	n.forwardingIdentity(request, username, groups)
+}
+
+// anonymousHandler forwards the unauthenticated requests as the anonymous user, letting the API server
+// authorize them: any impersonation requested by the client is dropped.
+func (n kubeFilter) anonymousHandler(writer http.ResponseWriter, request *http.Request) {
+	req.RequestLogger(request.Context(), n.log).V(4).Info("impersonating the anonymous user for the current request", "path", request.URL.Path)
+
+	n.rejectWrites(writer, request)
+
+	if len(n.bearerToken) > 0 {
+		request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", n.bearerToken))
+	}
+
+	n.removingHopByHopHeaders(request)
+	n.removingImpersonationHeaders(request)
+
+	request.Header.Set(authenticationv1.ImpersonateUserHeader, user.Anonymous)
+	request.Header.Set(authenticationv1.ImpersonateGroupHeader, user.AllUnauthenticated)
+
+	n.forwardingIdentity(request, user.Anonymous, []string{user.AllUnauthenticated})
 }
 
 func (n kubeFilter) registerModules(ctx context.Context, root *mux.Router) {
@@ -231,16 +629,19 @@ func (n kubeFilter) registerModules(ctx context.Context, root *mux.Router) {
 
 		sr := rp.Subrouter()
 		sr.Use(
+			middleware.CheckAnonymousPaths(n.log, n.anonymousAllowedPaths, n.tokenQueryParameter, n.certificateAuthentication(), n.anonymousHandler),
 			middleware.CheckPaths(n.client, n.log, n.allowedPaths, n.impersonateHandler),
-			middleware.CheckAuthorization(n.client, n.log, n.serverOptions.IsListeningTLS()),
-			middleware.CheckJWTMiddleware(n.client, n.log),
-			middleware.CheckUserInIgnoredGroupMiddleware(n.client, n.log, n.usernameClaimField, n.ignoredUserGroups, n.impersonateHandler),
-			middleware.CheckUserInCapsuleGroupMiddleware(n.client, n.log, n.usernameClaimField, n.impersonateHandler),
+			middleware.CheckAuthorization(n.client, n.log, n.certificateAuthentication(), n.tokenQueryParameter),
+			middleware.CheckUserInIgnoredGroupMiddleware(n.client, n.log, n.newHTTP, n.ignoredUserGroups, n.impersonateHandler),
+			middleware.CheckUserInCapsuleGroupMiddleware(n.client, n.log, n.newHTTP, n.impersonateHandler),
 		)
 		sr.HandleFunc("", func(writer http.ResponseWriter, request *http.Request) {
-			proxyRequest := req.NewHTTP(request, n.usernameClaimField, n.client)
-			username, groups, _ := proxyRequest.GetUserAndGroups()
-			proxyTenants, err := n.getTenantsForOwner(ctx, username, groups)
+			proxyRequest := n.newHTTP(request)
+			identity, _ := proxyRequest.GetIdentity()
+			audit.EventFrom(request.Context()).SetIdentity(identity.Username, identity.Groups, identity.AuthType)
+			n.rejectWrites(writer, request)
+
+			proxyTenants, err := n.getTenantsForOwner(ctx, identity.Username, identity.Groups)
 			if err != nil {
 				server.HandleError(writer, err, "cannot list Tenant resources")
 			}
@@ -261,7 +662,12 @@ func (n kubeFilter) registerModules(ctx context.Context, root *mux.Router) {
 				// if there's no selector, let it pass to the
 				n.impersonateHandler(writer, request)
 			default:
+				// The requests not filtered are throttled by the impersonateHandler
+				n.throttle(writer, request, identity.Username, identity.Groups)
+				audit.EventFrom(request.Context()).SetDecision(audit.DecisionFiltered)
+				n.warnFilteredList(writer, request)
 				n.handleRequest(request, selector)
+				n.forwardingIdentity(request, identity.Username, identity.Groups)
 			}
 		})
 	}
@@ -269,60 +675,76 @@ func (n kubeFilter) registerModules(ctx context.Context, root *mux.Router) {
 
 func (n kubeFilter) Start(ctx context.Context) error {
 	r := mux.NewRouter().StrictSlash(true)
-	r.Use(handlers.RecoveryHandler())
+	r.Use(
+		handlers.RecoveryHandler(),
+		middleware.RequestID(),
+		middleware.IdentityCache(),
+		tracing.Middleware,
+		middleware.RequestDeadline(timeoutSecondsGrace),
+		middleware.TokenHeader(n.serverOptions.TokenHeader()),
+		middleware.RejectServiceAccountImpersonation(n.saImpersonationDenied, n.tokenQueryParameter, n.saIssuers),
+		middleware.WWWAuthenticate(n.serverOptions.AuthenticateRealm(), n.tokenQueryParameter),
+		middleware.LimitRequestBody(n.serverOptions.MaxRequestBodyBytes()),
+	)
 
 	r.Path("/_healthz").Subrouter().HandleFunc("", func(writer http.ResponseWriter, request *http.Request) {
 		writer.WriteHeader(200)
 		_, _ = writer.Write([]byte("ok"))
 	})
 
+	r.Path(versionPath).Methods(http.MethodGet).Subrouter().HandleFunc("", versionHandler)
+
+	whoami := r.Path(whoamiPath).Methods(http.MethodGet, http.MethodPost).Subrouter()
+	if n.auditLogger != nil {
+		whoami.Use(n.auditLogger.Middleware(n.tokenQueryParameter))
+	}
+
+	whoami.Use(middleware.CheckAuthorization(n.client, n.log, n.certificateAuthentication(), n.tokenQueryParameter))
+	whoami.HandleFunc("", n.whoamiHandler)
+
 	root := r.PathPrefix("").Subrouter()
+	if n.auditLogger != nil {
+		root.Use(n.auditLogger.Middleware(n.tokenQueryParameter))
+	}
+
 	n.registerModules(ctx, root)
 	root.Use(
 		n.reverseProxyMiddleware,
+		middleware.CheckAnonymousPaths(n.log, n.anonymousAllowedPaths, n.tokenQueryParameter, n.certificateAuthentication(), n.anonymousHandler),
 		middleware.CheckPaths(n.client, n.log, n.allowedPaths, n.impersonateHandler),
-		middleware.CheckAuthorization(n.client, n.log, n.serverOptions.IsListeningTLS()),
-		middleware.CheckJWTMiddleware(n.client, n.log),
+		middleware.CheckAuthorization(n.client, n.log, n.certificateAuthentication(), n.tokenQueryParameter),
 	)
 	root.PathPrefix("/").HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		n.impersonateHandler(writer, request)
 	})
 
-	var srv *http.Server
-
-	go func() {
-		var err error
+	srv := &http.Server{
+		Handler: middleware.RejectConnect(r),
+		Addr:    fmt.Sprintf("0.0.0.0:%d", n.serverOptions.ListeningPort()),
+	}
 
-		addr := fmt.Sprintf("0.0.0.0:%d", n.serverOptions.ListeningPort())
+	graceful := newGracefulServer(srv, n.serverOptions.ShutdownTimeout(), n.serverOptions.StreamsGracePeriod(), n.log)
+	r.Use(graceful.BoundStreams)
 
-		if n.serverOptions.IsListeningTLS() {
-			tlsConfig := &tls.Config{
-				MinVersion: tls.VersionTLS12,
-				ClientCAs:  n.serverOptions.GetCertificateAuthorityPool(),
-				ClientAuth: tls.VerifyClientCertIfGiven,
-			}
-			srv = &http.Server{
-				Handler:   r,
-				Addr:      addr,
-				TLSConfig: tlsConfig,
-			}
-			err = srv.ListenAndServeTLS(n.serverOptions.TLSCertificatePath(), n.serverOptions.TLSCertificateKeyPath())
-		} else {
-			srv = &http.Server{
-				Handler: r,
-				Addr:    addr,
-			}
-			err = srv.ListenAndServe()
-		}
+	if !n.serverOptions.IsListeningTLS() {
+		return graceful.Run(ctx, srv.ListenAndServe)
+	}
 
-		if err != nil {
-			panic(err)
-		}
-	}()
+	clientCAs := n.serverOptions.GetCertificateAuthorityPool()
+	if pool := n.serverOptions.GetClientCertificateAuthorityPool(); pool != nil {
+		clientCAs = pool
+	}
 
-	<-ctx.Done()
+	srv.TLSConfig = &tls.Config{
+		MinVersion:   n.serverOptions.TLSMinVersion(),
+		CipherSuites: n.serverOptions.TLSCipherSuites(),
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
 
-	return srv.Shutdown(ctx)
+	return graceful.Run(ctx, func() error {
+		return srv.ListenAndServeTLS(n.serverOptions.TLSCertificatePath(), n.serverOptions.TLSCertificateKeyPath())
+	})
 }
 
 func (n *kubeFilter) getTenantsForOwner(ctx context.Context, username string, groups []string) (proxyTenants []*tenant.ProxyTenant, err error) {
@@ -396,6 +818,84 @@ func (n kubeFilter) getProxyTenantsForOwnerKind(ctx context.Context, ownerKind c
 	return proxyTenants, nil
 }
 
+func (n kubeFilter) removingTokenQueryParameter(request *http.Request) {
+	if len(n.tokenQueryParameter) == 0 {
+		return
+	}
+
+	if q := request.URL.Query(); q.Has(n.tokenQueryParameter) {
+		q.Del(n.tokenQueryParameter)
+		request.URL.RawQuery = q.Encode()
+	}
+}
+
+// forwardingClientIP sets the X-Real-IP header to the client IP, the first of the X-Forwarded-For chain when the
+// proxy is behind a load balancer, while the reverse proxy appends the request remote address to the chain.
+// When the client IP is not trusted, both headers are dropped, since these could be spoofed by the clients.
+func (n *kubeFilter) forwardingClientIP(request *http.Request) {
+	if !n.serverOptions.TrustClientIP() {
+		request.Header.Del(realIPHeader)
+		// A nil value prevents the reverse proxy from setting the header
+		request.Header[forwardedForHeader] = nil
+
+		return
+	}
+
+	if len(request.Header.Get(realIPHeader)) > 0 {
+		return
+	}
+
+	clientIP, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return
+	}
+
+	if chain := request.Header.Get(forwardedForHeader); len(chain) > 0 {
+		clientIP = strings.TrimSpace(strings.Split(chain, ",")[0])
+	}
+
+	request.Header.Set(realIPHeader, clientIP)
+}
+
+// forwardingUserExtra adds the UID and the extras of the identity: the impersonated ones, requested by the client, are
+// always forwarded, while the ones of the authenticated user only when enabled.
+func (n *kubeFilter) forwardingUserExtra(request *http.Request, identity req.Identity) {
+	if !n.forwardUserExtra && !identity.Impersonated {
+		return
+	}
+
+	if len(identity.UID) > 0 {
+		request.Header.Set(authenticationv1.ImpersonateUIDHeader, identity.UID)
+	}
+	// The keys are percent-encoded, such as authentication.kubernetes.io%2fpod-name, as expected by the API server
+	for key, values := range identity.Extra {
+		for _, value := range values {
+			request.Header.Add(authenticationv1.ImpersonateUserExtraHeaderPrefix+url.PathEscape(key), value)
+		}
+	}
+}
+
+// forwardingIdentity sets the identity headers read by the logging sidecars, when enabled:
+// being sensitive, these must be exposed on trusted internal networks only.
+func (n *kubeFilter) forwardingIdentity(request *http.Request, username string, groups []string) {
+	if !n.serverOptions.ForwardIdentityHeaders() {
+		return
+	}
+
+	request.Header.Set(identityUserHeader, username)
+	request.Header.Set(identityGroupsHeader, strings.Join(groups, ","))
+}
+
+// removingImpersonationHeaders drops any Impersonate-* header, such as the client ones, since these are not forwarded
+// as they are, but set according to the resolved identity.
+func (n *kubeFilter) removingImpersonationHeaders(request *http.Request) {
+	for name := range request.Header {
+		if strings.HasPrefix(name, "Impersonate-") {
+			request.Header.Del(name)
+		}
+	}
+}
+
 func (n *kubeFilter) removingHopByHopHeaders(request *http.Request) {
 	connectionHeaderName, upgradeHeaderName, requestUpgradeType := "connection", "upgrade", ""
 
@@ -0,0 +1,762 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+// nolint:testpackage
+package webserver
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/clastix/capsule-proxy/internal/options"
+	req "github.com/clastix/capsule-proxy/internal/request"
+	"github.com/clastix/capsule-proxy/internal/webserver/middleware"
+)
+
+const tableAccept = "application/json;as=Table;v=v1;g=meta.k8s.io,application/json;as=Table;v=v1beta1;g=meta.k8s.io,application/json"
+
+// newTableServer returns the API server replying to the Table requests with the rows of the Namespaces matching
+// the label selector, as the server-side printing does.
+func newTableServer(t *testing.T, namespaces ...string) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept"), "as=Table") {
+			writer.WriteHeader(http.StatusNotAcceptable)
+
+			return
+		}
+
+		selector, err := labels.Parse(r.URL.Query().Get("labelSelector"))
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		table := metav1.Table{
+			TypeMeta:          metav1.TypeMeta{Kind: "Table", APIVersion: "meta.k8s.io/v1"},
+			ColumnDefinitions: []metav1.TableColumnDefinition{{Name: "Name", Type: "string"}},
+		}
+
+		for _, namespace := range namespaces {
+			if selector.Matches(labels.Set{"name": namespace}) {
+				table.Rows = append(table.Rows, metav1.TableRow{Cells: []interface{}{namespace}, Object: runtime.RawExtension{Raw: []byte(`{"kind":"PartialObjectMetadata"}`)}})
+			}
+		}
+
+		writer.Header().Set("Content-Type", "application/json;as=Table;v=v1;g=meta.k8s.io")
+		_ = json.NewEncoder(writer).Encode(table)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestHandleRequestTable(t *testing.T) {
+	t.Parallel()
+
+	srv := newTableServer(t, "oil-production", "gas-production", "kube-system")
+	u, _ := url.Parse(srv.URL)
+
+	requirement, err := labels.NewRequirement("name", selection.In, []string{"oil-production", "gas-production"})
+	if err != nil {
+		t.Fatalf("cannot create requirement: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces?limit=500", nil)
+	r.Header.Set("Accept", tableAccept)
+
+	(kubeFilter{log: logr.Discard()}).handleRequest(r, labels.NewSelector().Add(*requirement))
+
+	rw := httptest.NewRecorder()
+	httputil.NewSingleHostReverseProxy(u).ServeHTTP(rw, r)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("got status code %d, want 200 with the Table content negotiation preserved", rw.Code)
+	}
+
+	var table metav1.Table
+	if err = json.NewDecoder(rw.Body).Decode(&table); err != nil {
+		t.Fatalf("cannot decode the Table: %v", err)
+	}
+
+	if table.Kind != "Table" || len(table.Rows) != 2 {
+		t.Fatalf("got %s with %d rows, want Table with 2 rows", table.Kind, len(table.Rows))
+	}
+
+	for _, row := range table.Rows {
+		if row.Cells[0] == "kube-system" {
+			t.Errorf("got the not owned Namespace %v in the Table rows", row.Cells[0])
+		}
+	}
+}
+
+func TestHandleRequestContentEncoding(t *testing.T) {
+	t.Parallel()
+
+	const body = `{"kind":"NamespaceList","apiVersion":"v1","items":[{"metadata":{"name":"oil-production"}}]}`
+
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("labelSelector") != "name in (oil-production)" {
+			writer.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			_, _ = io.WriteString(writer, body)
+
+			return
+		}
+
+		writer.Header().Set("Content-Encoding", "gzip")
+
+		gz := gzip.NewWriter(writer)
+		_, _ = io.WriteString(gz, body)
+		_ = gz.Close()
+	}))
+	t.Cleanup(srv.Close)
+
+	u, _ := url.Parse(srv.URL)
+
+	requirement, err := labels.NewRequirement("name", selection.In, []string{"oil-production"})
+	if err != nil {
+		t.Fatalf("cannot create requirement: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		wantEncoding   string
+	}{
+		{"gzip", "gzip", "gzip"},
+		{"identity", "identity", ""},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+			r.Header.Set("Accept-Encoding", eachTest.acceptEncoding)
+
+			(kubeFilter{log: logr.Discard()}).handleRequest(r, labels.NewSelector().Add(*requirement))
+
+			rw := httptest.NewRecorder()
+			httputil.NewSingleHostReverseProxy(u).ServeHTTP(rw, r)
+
+			if rw.Code != http.StatusOK {
+				t.Fatalf("got status code %d, want 200", rw.Code)
+			}
+			// The response is streamed as encoded by the API server, neither decoded nor encoded twice
+			if got := rw.Header().Get("Content-Encoding"); got != eachTest.wantEncoding {
+				t.Fatalf("got Content-Encoding %q, want %q", got, eachTest.wantEncoding)
+			}
+
+			var reader io.Reader = rw.Body
+
+			if eachTest.wantEncoding == "gzip" {
+				if reader, err = gzip.NewReader(rw.Body); err != nil {
+					t.Fatalf("cannot decode the gzip body: %v", err)
+				}
+			}
+
+			if got, _ := io.ReadAll(reader); string(got) != body {
+				t.Errorf("got body %q, want %q", got, body)
+			}
+		})
+	}
+}
+
+// headerAuthenticator authenticates the requests carrying the X-Api-Key header as the given user.
+type headerAuthenticator struct {
+	username string
+}
+
+func (h headerAuthenticator) AuthType() string {
+	return "header"
+}
+
+func (h headerAuthenticator) Resolve(request *http.Request) (string, []string, error) {
+	if len(request.Header.Get("X-Api-Key")) == 0 {
+		return "", nil, req.ErrNoCredentials
+	}
+
+	return h.username, []string{"capsule.clastix.io"}, nil
+}
+
+type fakeServerOptions struct {
+	options.ServerOptions
+	filteredListWarning bool
+	readOnly            bool
+}
+
+func (f fakeServerOptions) ReadOnly() bool {
+	return f.readOnly
+}
+
+func (fakeServerOptions) ReadOnlyMessage() string {
+	return "the cluster is under maintenance"
+}
+
+func (fakeServerOptions) GetClientCertificateAuthorityPool() *x509.CertPool {
+	return nil
+}
+
+func (f fakeServerOptions) FilteredListWarning() bool {
+	return f.filteredListWarning
+}
+
+func (fakeServerOptions) TrustClientIP() bool {
+	return false
+}
+
+func (fakeServerOptions) ForwardIdentityHeaders() bool {
+	return false
+}
+
+func (fakeServerOptions) VerboseAuthErrors() bool {
+	return false
+}
+
+func (fakeServerOptions) UnauthenticatedMessage() string {
+	return ""
+}
+
+// newEchoUpstream returns the API server accepting the SPDY upgrade of the impersonated user, echoing the bytes
+// sent over the hijacked connection as the exec streams do.
+func newEchoUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "SPDY/3.1" || r.Header.Get("Impersonate-User") != "alice" || r.Header.Get("Authorization") != "Bearer proxy-token" {
+			writer.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		conn, rw, err := writer.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		_, _ = fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: SPDY/3.1\r\nX-Stream-Protocol-Version: %s\r\n\r\n", r.Header.Get("X-Stream-Protocol-Version"))
+		_ = rw.Flush()
+
+		_, _ = io.Copy(conn, rw)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestImpersonateHandlerUpgrade(t *testing.T) {
+	t.Parallel()
+
+	upstream := newEchoUpstream(t)
+	u, _ := url.Parse(upstream.URL)
+
+	router, err := newUpstreamRouter(httputil.NewSingleHostReverseProxy(u), nil, nil)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+
+	n := kubeFilter{
+		log:            logr.Discard(),
+		bearerToken:    "proxy-token",
+		authenticators: []req.Authenticator{headerAuthenticator{username: "alice"}},
+		upstreams:      router,
+		serverOptions:  fakeServerOptions{},
+	}
+	// The chain the upgraded requests go through, with the middlewares wrapping the response writer
+	handler := middleware.RequestID()(middleware.LimitRequestBody(1024)(n.reverseProxyMiddleware(http.HandlerFunc(n.impersonateHandler))))
+
+	proxy := httptest.NewServer(handler)
+	t.Cleanup(proxy.Close)
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("cannot dial the proxy: %v", err)
+	}
+
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	_, _ = io.WriteString(conn, "POST /api/v1/namespaces/default/pods/nginx/exec?command=sh&stdin=true HTTP/1.1\r\n"+
+		"Host: capsule-proxy\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Upgrade: SPDY/3.1\r\n"+
+		"X-Stream-Protocol-Version: v4.channel.k8s.io\r\n"+
+		"X-Api-Key: secret\r\n"+
+		"Content-Length: 0\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("cannot read the upgrade response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "SPDY/3.1" || resp.Header.Get("X-Stream-Protocol-Version") != "v4.channel.k8s.io" {
+		t.Fatalf("got status code %d with Upgrade %q, want 101 with SPDY/3.1", resp.StatusCode, resp.Header.Get("Upgrade"))
+	}
+	// The bytes are piped as they are in both directions, the stream is never buffered until its end
+	for _, message := range []string{"stdin ping", "stdin pong"} {
+		if _, err = io.WriteString(conn, message); err != nil {
+			t.Fatalf("cannot write to the upgraded connection: %v", err)
+		}
+
+		b := make([]byte, len(message))
+		if _, err = io.ReadFull(br, b); err != nil {
+			t.Fatalf("cannot read from the upgraded connection: %v", err)
+		}
+
+		if string(b) != message {
+			t.Errorf("got %q, want %q", b, message)
+		}
+	}
+}
+
+func TestImpersonateHandlerReadOnly(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		readOnly bool
+		apiKey   bool
+		want     int
+	}{
+		{"get", http.MethodGet, "/api/v1/namespaces/default/pods/nginx", true, true, http.StatusOK},
+		{"list", http.MethodGet, "/api/v1/namespaces/default/pods", true, true, http.StatusOK},
+		{"watch", http.MethodGet, "/api/v1/namespaces/default/pods?watch=true", true, true, http.StatusOK},
+		{"create", http.MethodPost, "/api/v1/namespaces/default/pods", true, true, http.StatusForbidden},
+		{"update", http.MethodPut, "/api/v1/namespaces/default/pods/nginx", true, true, http.StatusForbidden},
+		{"patch", http.MethodPatch, "/api/v1/namespaces/default/pods/nginx", true, true, http.StatusForbidden},
+		{"delete", http.MethodDelete, "/api/v1/namespaces/default/pods/nginx", true, true, http.StatusForbidden},
+		{"deletecollection", http.MethodDelete, "/api/v1/namespaces/default/pods", true, true, http.StatusForbidden},
+		{"exec", http.MethodPost, "/api/v1/namespaces/default/pods/nginx/exec", true, true, http.StatusForbidden},
+		{"self subject access review", http.MethodPost, "/apis/authorization.k8s.io/v1/selfsubjectaccessreviews", true, true, http.StatusOK},
+		{"unauthenticated write", http.MethodPost, "/api/v1/namespaces/default/pods", true, false, http.StatusUnauthorized},
+		{"disabled", http.MethodDelete, "/api/v1/namespaces/default/pods/nginx", false, true, http.StatusOK},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			n := kubeFilter{
+				log:            logr.Discard(),
+				authenticators: []req.Authenticator{headerAuthenticator{username: "alice"}},
+				serverOptions:  fakeServerOptions{readOnly: eachTest.readOnly},
+			}
+
+			r := httptest.NewRequest(eachTest.method, eachTest.target, nil)
+			if eachTest.apiKey {
+				r.Header.Set("X-Api-Key", "secret")
+			}
+
+			rw := httptest.NewRecorder()
+
+			func() {
+				// The rejected requests panic, recovered by the router
+				defer func() { _ = recover() }()
+
+				n.impersonateHandler(rw, r)
+			}()
+
+			if rw.Code != eachTest.want {
+				t.Fatalf("got status code %d, want %d", rw.Code, eachTest.want)
+			}
+
+			if eachTest.want != http.StatusForbidden {
+				return
+			}
+
+			status := &metav1.Status{}
+			if err := json.Unmarshal(rw.Body.Bytes(), status); err != nil {
+				t.Fatalf("cannot decode the Status: %v", err)
+			}
+
+			if status.Reason != metav1.StatusReasonForbidden || !strings.Contains(status.Message, "the cluster is under maintenance") {
+				t.Errorf("got reason %s and message %q, want the read-only one", status.Reason, status.Message)
+			}
+		})
+	}
+}
+
+func TestWarnFilteredList(t *testing.T) {
+	t.Parallel()
+
+	const deprecation = `299 - "policy/v1beta1 PodSecurityPolicy is deprecated in v1.21+, unavailable in v1.25+"`
+
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		writer.Header().Add("Warning", deprecation)
+		writer.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(writer, `{"kind":"List","items":[]}`)
+	}))
+	t.Cleanup(srv.Close)
+
+	u, _ := url.Parse(srv.URL)
+
+	requirement, err := labels.NewRequirement("name", selection.In, []string{"oil-production"})
+	if err != nil {
+		t.Fatalf("cannot create requirement: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		enabled bool
+		vars    map[string]string
+		want    []string
+	}{
+		{"list", true, nil, []string{filteredListWarning, deprecation}},
+		{"disabled", false, nil, []string{deprecation}},
+		{"get", true, map[string]string{"name": "oil-production"}, []string{deprecation}},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			n := kubeFilter{log: logr.Discard(), serverOptions: fakeServerOptions{filteredListWarning: eachTest.enabled}}
+
+			r := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil), eachTest.vars)
+			rw := httptest.NewRecorder()
+
+			n.warnFilteredList(rw, r)
+			n.handleRequest(r, labels.NewSelector().Add(*requirement))
+			httputil.NewSingleHostReverseProxy(u).ServeHTTP(rw, r)
+
+			if got := rw.Header().Values("Warning"); !reflect.DeepEqual(got, eachTest.want) {
+				t.Errorf("got warnings %q, want %q", got, eachTest.want)
+			}
+		})
+	}
+}
+
+// tokenReviewClient authenticates any token with the TokenReview API, or blocks until the deadline as a hung API
+// server would do.
+type tokenReviewClient struct {
+	client.Client
+	hung bool
+}
+
+func (c tokenReviewClient) Create(ctx context.Context, obj client.Object, _ ...client.CreateOption) error {
+	if c.hung {
+		<-ctx.Done()
+
+		return ctx.Err()
+	}
+
+	if review, ok := obj.(*authenticationv1.TokenReview); ok {
+		review.Status.Authenticated = true
+		review.Status.User.Username = "bob"
+	}
+
+	return nil
+}
+
+func TestInjectClientCertificateAuthDisabled(t *testing.T) {
+	t.Parallel()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"preferred_username": "bob"}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("cannot sign token: %v", err)
+	}
+
+	n := &kubeFilter{
+		log:              logr.Discard(),
+		certAuthDisabled: true,
+		claimMappings:    req.ClaimMappings{Default: req.ClaimMapping{UsernameFields: []string{"preferred_username"}}},
+		serverOptions:    fakeServerOptions{},
+	}
+
+	if err = n.InjectClient(tokenReviewClient{}); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	// The peer certificate is ignored, even if presented, authenticating with the bearer token
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "alice"}}}}
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	identity, err := n.newHTTP(r).GetIdentity()
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+
+	if identity.Username != "bob" || identity.AuthType != req.AuthTypeJWT {
+		t.Errorf("got %s authenticated with %s, want bob authenticated with %s", identity.Username, identity.AuthType, req.AuthTypeJWT)
+	}
+}
+
+func TestImpersonateHandlerTokenReviewTimeout(t *testing.T) {
+	t.Parallel()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"preferred_username": "bob"}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("cannot sign token: %v", err)
+	}
+
+	n := &kubeFilter{
+		log:             logr.Discard(),
+		claimMappings:   req.ClaimMappings{Default: req.ClaimMapping{UsernameFields: []string{"preferred_username"}}},
+		upstreamTimeout: 10 * time.Millisecond,
+		serverOptions:   fakeServerOptions{},
+	}
+
+	if err = n.InjectClient(tokenReviewClient{hung: true}); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	rw := httptest.NewRecorder()
+
+	func() {
+		// The rejected requests panic, recovered by the router
+		defer func() { _ = recover() }()
+
+		n.impersonateHandler(rw, r)
+	}()
+	// The JWT review is bound by the upstream timeout as the opaque tokens one
+	if rw.Code != http.StatusGatewayTimeout {
+		t.Errorf("got status code %d, want %d", rw.Code, http.StatusGatewayTimeout)
+	}
+}
+
+func TestForwardingUserExtra(t *testing.T) {
+	t.Parallel()
+
+	identity := req.Identity{
+		Username: "system:serviceaccount:default:builder",
+		UID:      "42",
+		Extra: map[string]authenticationv1.ExtraValue{
+			"authentication.kubernetes.io/pod-name": {"builder-7d9f"},
+			"scopes":                                {"read", "write"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		enabled bool
+		want    http.Header
+	}{
+		{"enabled", true, http.Header{
+			"Impersonate-Uid": {"42"},
+			"Impersonate-Extra-Authentication.kubernetes.io%2fpod-Name": {"builder-7d9f"},
+			"Impersonate-Extra-Scopes":                                  {"read", "write"},
+		}},
+		{"disabled", false, http.Header{}},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			n := kubeFilter{forwardUserExtra: eachTest.enabled}
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+			n.forwardingUserExtra(r, identity)
+
+			if !reflect.DeepEqual(r.Header, eachTest.want) {
+				t.Errorf("got headers %v, want %v", r.Header, eachTest.want)
+			}
+		})
+	}
+}
+
+// impersonationHeaders returns the Impersonate-* headers of the request, the ones the upstream authorizes with.
+func impersonationHeaders(request *http.Request) http.Header {
+	header := http.Header{}
+
+	for name, values := range request.Header {
+		if strings.HasPrefix(name, "Impersonate-") {
+			header[name] = values
+		}
+	}
+
+	return header
+}
+
+func TestImpersonateHandlerHeaders(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		separator string
+		deny      string
+		header    http.Header
+		want      http.Header
+	}{
+		{"authenticated", "", "", http.Header{}, http.Header{
+			"Impersonate-User":  {"alice"},
+			"Impersonate-Group": {"capsule.clastix.io"},
+		}},
+		{"impersonated", "", "", http.Header{
+			"Impersonate-User":         {"bob"},
+			"Impersonate-Group":        {"ops", "capsule.clastix.io"},
+			"Impersonate-Uid":          {"7"},
+			"Impersonate-Extra-Scopes": {"read", "write"},
+		}, http.Header{
+			"Impersonate-User":         {"bob"},
+			"Impersonate-Group":        {"capsule.clastix.io", "ops"},
+			"Impersonate-Uid":          {"7"},
+			"Impersonate-Extra-Scopes": {"read", "write"},
+		}},
+		{"joined groups", ",", "", http.Header{
+			"Impersonate-Group": {"ops,developers"},
+		}, http.Header{
+			"Impersonate-User":  {"alice"},
+			"Impersonate-Group": {"capsule.clastix.io", "ops", "developers"},
+		}},
+		{"transformed groups", "", "^ops$", http.Header{
+			"Impersonate-Group": {"ops"},
+		}, http.Header{
+			"Impersonate-User":  {"alice"},
+			"Impersonate-Group": {"capsule.clastix.io"},
+		}},
+	}
+
+	for _, eachTest := range tests {
+		eachTest := eachTest
+		t.Run(eachTest.name, func(t *testing.T) {
+			t.Parallel()
+
+			transformers := req.DefaultTransformers()
+			if len(eachTest.deny) > 0 {
+				transformers.Groups = req.RegexGroupsTransformer(nil, regexp.MustCompile(eachTest.deny))
+			}
+			// The bypass user skips the SubjectAccessReviews of the impersonation
+			n := kubeFilter{
+				log:                 logr.Discard(),
+				bearerToken:         "proxy-token",
+				authenticators:      []req.Authenticator{headerAuthenticator{username: "alice"}},
+				impersonationBypass: sets.NewString("alice"),
+				groupsSeparator:     eachTest.separator,
+				transformers:        transformers,
+				serverOptions:       fakeServerOptions{},
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+			r.Header = eachTest.header.Clone()
+			r.Header.Set("X-Api-Key", "secret")
+
+			n.impersonateHandler(httptest.NewRecorder(), r)
+
+			if got := impersonationHeaders(r); !reflect.DeepEqual(got, eachTest.want) {
+				t.Errorf("got headers %v, want %v", got, eachTest.want)
+			}
+
+			if got := r.Header.Get("Authorization"); got != "Bearer proxy-token" {
+				t.Errorf("got Authorization %q, want the proxy credentials", got)
+			}
+		})
+	}
+}
+
+// reviewCountingClient allows the SubjectAccessReviews, counting them.
+type reviewCountingClient struct {
+	client.Client
+	reviews *int64
+}
+
+func (c reviewCountingClient) Create(_ context.Context, obj client.Object, _ ...client.CreateOption) error {
+	if review, ok := obj.(*authorizationv1.SubjectAccessReview); ok {
+		atomic.AddInt64(c.reviews, 1)
+		review.Status.Allowed = true
+	}
+
+	return nil
+}
+
+func TestImpersonationOncePerRequest(t *testing.T) {
+	t.Parallel()
+
+	var reviews int64
+
+	n := kubeFilter{
+		log:               logr.Discard(),
+		authenticators:    []req.Authenticator{headerAuthenticator{username: "alice"}},
+		transformers:      req.DefaultTransformers(),
+		ignoredUserGroups: sets.NewString("system:masters"),
+		serverOptions:     fakeServerOptions{},
+		client:            reviewCountingClient{reviews: &reviews},
+	}
+	// The module middlewares and the handler retrieve the identity of the same request
+	var handler http.Handler = http.HandlerFunc(n.impersonateHandler)
+	handler = middleware.CheckUserInCapsuleGroupMiddleware(n.client, n.log, n.newHTTP, n.impersonateHandler)(handler)
+	handler = middleware.CheckUserInIgnoredGroupMiddleware(n.client, n.log, n.newHTTP, n.ignoredUserGroups, n.impersonateHandler)(handler)
+	handler = middleware.IdentityCache()(handler)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("X-Api-Key", "secret")
+	r.Header.Set("Impersonate-User", "bob")
+
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if reviews != 1 {
+		t.Errorf("got %d SubjectAccessReviews, want the impersonation checked once per request", reviews)
+	}
+
+	if got := r.Header.Get("Impersonate-User"); got != "bob" {
+		t.Errorf("got Impersonate-User %q, want bob", got)
+	}
+}
+
+func TestHandleRequestImpersonationHeaders(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+	r.Header.Set("Impersonate-User", "bob")
+	r.Header.Set("Impersonate-Uid", "7")
+	r.Header.Set("Impersonate-Extra-Scopes", "admin")
+
+	(kubeFilter{log: logr.Discard()}).handleRequest(r, labels.Everything())
+
+	if got := impersonationHeaders(r); len(got) > 0 {
+		t.Errorf("got headers %v, want the filtered request to be performed with the proxy credentials only", got)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2020-2021 Clastix Labs
+// SPDX-License-Identifier: Apache-2.0
+
+package webserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	req "github.com/clastix/capsule-proxy/internal/request"
+	server "github.com/clastix/capsule-proxy/internal/webserver/errors"
+)
+
+const whoamiPath = "/debug/whoami"
+
+type whoamiClaims struct {
+	Username       string   `json:"username,omitempty"`
+	Groups         []string `json:"groups,omitempty"`
+	UsernameFields []string `json:"usernameFields"`
+	GroupsFields   []string `json:"groupsFields"`
+}
+
+type whoami struct {
+	Username string        `json:"username"`
+	Groups   []string      `json:"groups"`
+	AuthType string        `json:"authType"`
+	Tenants  []string      `json:"tenants"`
+	Claims   *whoamiClaims `json:"claims,omitempty"`
+}
+
+// whoamiHandler replies with the identity and the Tenants the proxy resolves for the request, without proxying it:
+// the credentials and the impersonation headers are processed as for the proxied requests.
+func (n kubeFilter) whoamiHandler(writer http.ResponseWriter, request *http.Request) {
+	identity, err := n.newHTTP(request).GetIdentity()
+	if err != nil {
+		var t *req.ErrUnauthorized
+		if errors.As(err, &t) && n.serverOptions.VerboseAuthErrors() && len(t.Details()) > 0 {
+			err = fmt.Errorf("%w: %s", err, t.Details())
+		}
+
+		server.HandleRequestError(writer, err, "cannot retrieve user and group")
+	}
+
+	proxyTenants, err := n.getTenantsForOwner(request.Context(), identity.Username, identity.Groups)
+	if err != nil {
+		server.HandleError(writer, err, "cannot list Tenant resources")
+	}
+
+	response := whoami{
+		Username: identity.Username,
+		Groups:   identity.Groups,
+		AuthType: identity.AuthType,
+		Tenants:  make([]string, 0, len(proxyTenants)),
+	}
+
+	for _, proxyTenant := range proxyTenants {
+		response.Tenants = append(response.Tenants, proxyTenant.Tenant.GetName())
+	}
+
+	token := req.RequestBearerToken(request, n.tokenQueryParameter)
+
+	if mapping, err := n.claimMappings.ForToken(token); err == nil && identity.AuthType == req.AuthTypeJWT {
+		response.Claims = &whoamiClaims{
+			UsernameFields: mapping.UsernameFields,
+			GroupsFields:   mapping.GroupsFields,
+		}
+		response.Claims.Username, response.Claims.Groups = mapping.MatchedClaims(token)
+	}
+
+	writer.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(writer).Encode(response)
+}
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"context"
 	goflag "flag"
 	"fmt"
 	"os"
@@ -20,11 +21,17 @@ import (
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 
 	capsuleproxyv1beta1 "github.com/clastix/capsule-proxy/api/v1beta1"
+	"github.com/clastix/capsule-proxy/internal/audit"
 	"github.com/clastix/capsule-proxy/internal/controllers"
 	"github.com/clastix/capsule-proxy/internal/indexer"
 	"github.com/clastix/capsule-proxy/internal/options"
+	"github.com/clastix/capsule-proxy/internal/pprof"
+	"github.com/clastix/capsule-proxy/internal/request"
+	"github.com/clastix/capsule-proxy/internal/tracing"
+	"github.com/clastix/capsule-proxy/internal/version"
 	"github.com/clastix/capsule-proxy/internal/webserver"
 )
 
@@ -48,9 +55,41 @@ func main() {
 
 	var ignoredUserGroups []string
 
+	var audiences []string
+
+	var jwtRequiredAudiences []string
+
+	var anonymousAllowedPaths []string
+
 	var listeningPort uint
 
-	var usernameClaimField string
+	var usernameClaimFields []string
+
+	var groupsClaimFields []string
+
+	var requireGroupsClaim bool
+
+	var usernamePrefix string
+
+	var groupsPrefix string
+
+	var groupsSeparator string
+
+	var usernameClaimFallbackSub bool
+
+	var usernameLowercaseEmail bool
+
+	var certUsernameSource string
+
+	var certGroupsSources []string
+
+	var certURIPattern, certURITemplate string
+
+	var disableClientCertAuth bool
+
+	var trustedProxies []string
+
+	var tokenQueryParameter string
 
 	var bindSsl bool
 
@@ -58,17 +97,227 @@ func main() {
 
 	var keyPath string
 
+	var clientCAPath string
+
+	var tlsMinVersion string
+
+	var tlsCipherSuites []string
+
 	var rolebindingsResyncPeriod time.Duration
 
+	var jwksURL string
+
+	var jwksRefreshInterval time.Duration
+
+	var oidcIssuerURL string
+
+	var oidcDiscoveryRefreshInterval time.Duration
+
+	var jwtClockSkew time.Duration
+
+	var serviceAccountTokenLeeway time.Duration
+
+	var serviceAccountIssuers []string
+
+	var tokenReviewCacheTTL time.Duration
+
+	var circuitBreakerThreshold int
+
+	var circuitBreakerWindow, circuitBreakerCooldown time.Duration
+
+	var upstreamTimeout time.Duration
+
+	var tokenReviewRetries int
+
+	var tokenReviewRetryBackoff time.Duration
+
+	var addAuthenticatedGroup bool
+
+	var additionalGroups []string
+
+	var issuersConfigPath string
+
+	var strictIssuers bool
+
+	var trustedIssuers []string
+
+	var impersonationBypassUsers []string
+
+	var impersonationDeniedUsers, impersonationDeniedGroups []string
+
+	var disableImpersonation bool
+
+	var disableServiceAccountImpersonation bool
+
+	var namespacedImpersonationChecks bool
+
+	var forwardUserExtra bool
+
+	var impersonateGroupsSeparator string
+
+	var serviceAccountNamespaceLabels []string
+
+	var groupsAllowRegex, groupsDenyRegex string
+
+	var forwardIdentityHeaders bool
+
+	var filteredListWarning bool
+
+	var readOnly bool
+
+	var readOnlyMessage string
+
+	var rateLimitQPS float64
+
+	var rateLimitBurst int
+
+	var rateLimitGroups []string
+
+	var tokenHeader string
+
+	var unauthenticatedMessage string
+
+	var shutdownTimeout, shutdownStreamsGracePeriod time.Duration
+
+	var userInfoURL string
+
+	var discoverUserInfo bool
+
+	var userInfoCacheTTL time.Duration
+
+	var introspectionURL, introspectionClientID, introspectionClientSecretPath string
+
+	var introspectionUsernameClaims, introspectionGroupsClaims []string
+
+	var introspectionCacheTTL time.Duration
+
+	var groupResolverURL string
+
+	var groupResolverCacheTTL time.Duration
+
+	var upstreamProtocol string
+
+	var upstreamsConfigPath string
+
+	var upstreamMaxIdleConns int
+
+	var upstreamIdleConnTimeout, upstreamKeepAlive time.Duration
+
+	var enablePprof bool
+
+	var pprofBindAddress string
+
+	var verboseAuthErrors bool
+
+	var trustClientIP bool
+
+	var authenticateRealm string
+
+	var maxRequestBodyBytes int64
+
+	var auditLogPath, auditLogLevel string
+
+	var tracingExporter, tracingOTLPEndpoint string
+
+	var tracingSamplingRatio float64
+
 	flag.StringVar(&capsuleConfigurationName, "capsule-configuration-name", "default", "Name of the CapsuleConfiguration used to retrieve the Capsule user groups names")
 	flag.StringSliceVar(&capsuleUserGroups, "capsule-user-group", []string{}, "Names of the groups for capsule users (deprecated: use capsule-configuration-name)")
 	flag.StringSliceVar(&ignoredUserGroups, "ignored-user-group", []string{}, "Names of the groups which requests must be ignored and proxy-passed to the upstream server")
+	flag.StringSliceVar(&audiences, "audience", []string{}, "Audiences the tokens verified by the TokenReview API must be issued for, if empty the API server ones are used")
+	flag.StringSliceVar(&jwtRequiredAudiences, "jwt-required-audience", []string{}, "Audiences the JWT aud claim must contain at least one of, such as the API server or capsule-proxy one, repeatable: the legacy service account tokens carry no audience, thus are not checked (default: none)")
+	flag.StringSliceVar(&anonymousAllowedPaths, "anonymous-allowed-paths", []string{}, "Path prefixes the requests without credentials can reach, forwarded as the anonymous user, such as /healthz,/version,/openapi")
 	flag.UintVar(&listeningPort, "listening-port", 9001, "HTTP port the proxy listens to (default: 9001)")
-	flag.StringVar(&usernameClaimField, "oidc-username-claim", "preferred_username", "The OIDC field name used to identify the user (default: preferred_username)")
+	flag.StringSliceVar(&usernameClaimFields, "oidc-username-claim", []string{"preferred_username"}, "The OIDC field names used to identify the user, tried in order until one is present (default: preferred_username)")
+	flag.StringSliceVar(&groupsClaimFields, "oidc-groups-claim", []string{"groups"}, "The OIDC field names used to retrieve the user groups, merged when more than one (default: groups)")
+	flag.StringVar(&usernamePrefix, "oidc-username-prefix", "", "Prefix prepended to the OIDC username, matching the API server --oidc-username-prefix")
+	flag.StringVar(&groupsPrefix, "oidc-groups-prefix", "", "Prefix prepended to the OIDC groups, matching the API server --oidc-groups-prefix")
+	flag.StringVar(&groupsSeparator, "oidc-groups-separator", " ", "Separator splitting the OIDC groups claim emitted as a single string, such as , for comma-delimited groups: any whitespace when blank, no splitting when empty (default: whitespace)")
+	flag.StringVar(&issuersConfigPath, "oidc-issuers-config", "", "Path of the YAML file listing the claim mappings of the trusted OIDC issuers, matched with the JWT iss claim: each one made of issuer, usernameClaims, groupsClaim, groupsSeparator, usernamePrefix, groupsPrefix, requireGroupsClaim, and usernameLowercaseEmail")
+	flag.BoolVar(&strictIssuers, "oidc-strict-issuers", false, "Reject the JWT issued by an issuer not listed in --oidc-issuers-config, rather than using the default claim mapping (default: false)")
+	flag.StringSliceVar(&trustedIssuers, "oidc-trusted-issuers", []string{}, "Issuers of the accepted OIDC JWT, matched with the iss claim: the ones listed in --oidc-issuers-config are trusted as well, while the service account tokens are not affected (default: any issuer)")
+	flag.BoolVar(&usernameClaimFallbackSub, "username-claim-fallback-sub", false, "Resolve the username from the sub claim when none of the OIDC username claims is present in the JWT (default: false)")
+	flag.BoolVar(&usernameLowercaseEmail, "oidc-username-lowercase-email", false, "Lowercase the OIDC usernames shaped as an email, such as User@Example.com, before the prefix is prepended: the RoleBindings must refer to the lowercase form (default: false)")
+	flag.BoolVar(&requireGroupsClaim, "require-groups-claim", false, "Reject the JWT missing the groups claim, rather than considering the user without groups (default: false)")
+	flag.StringVar(&certUsernameSource, "client-cert-username-source", "cn", "The client certificate field used to identify the user: cn, email for the first email SAN, uri for the first URI SAN matching --client-cert-uri-pattern, such as a SPIFFE ID, or the dotted OID of a subject attribute (default: cn)")
+	flag.StringVar(&certURIPattern, "client-cert-uri-pattern", request.DefaultCertificateURIPattern, "Regular expression the URI SAN must match with the uri username source, its named submatches are available to the username template")
+	flag.StringVar(&certURITemplate, "client-cert-uri-username-template", request.DefaultCertificateURIUsernameTemplate, "Template of the username mapped from the URI SAN with the uri username source, referring to the pattern submatches as ${name}")
+	flag.BoolVar(&disableClientCertAuth, "disable-client-cert-auth", false, "Ignore the client certificates, authenticating the requests with the bearer tokens only, or as anonymous on the allowed paths, even when a certificate is presented, such as the mesh-injected ones (default: false)")
+	flag.StringSliceVar(&certGroupsSources, "client-cert-groups-source", []string{"o"}, "The client certificate subject fields used to retrieve the user groups, merged when more than one: o for Organization, ou for Organizational Unit (default: o)")
+	flag.StringVar(&tokenQueryParameter, "token-query-parameter", "access_token", "Query parameter carrying the bearer token when the Authorization header is missing, as for WebSocket clients, disabled when empty (default: access_token)")
 	flag.BoolVar(&bindSsl, "enable-ssl", true, "Enable the bind on HTTPS for secure communication (default: true)")
 	flag.StringVar(&certPath, "ssl-cert-path", "", "Path to the TLS certificate (default: /opt/capsule-proxy/tls.crt)")
 	flag.StringVar(&keyPath, "ssl-key-path", "", "Path to the TLS certificate key (default: /opt/capsule-proxy/tls.key)")
+	flag.StringSliceVar(&trustedProxies, "trusted-proxy-common-name", []string{}, "Common Names of the client certificates identifying a trusted proxy rather than the user, resolved from the bearer token instead")
+	flag.StringVar(&tlsMinVersion, "tls-min-version", options.TLSVersion12, "Minimum TLS version accepted by the HTTPS listener, VersionTLS12 or VersionTLS13 (default: VersionTLS12)")
+	flag.StringSliceVar(&tlsCipherSuites, "tls-cipher-suites", []string{}, "Cipher suites allowed by the HTTPS listener up to TLS 1.2, by their IANA name such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, the Go defaults when empty: the insecure ones are rejected")
+	flag.StringVar(&clientCAPath, "client-cert-ca", "", "Path to the CA the client certificates must be issued by, if empty the Kubernetes one is used for the TLS handshake only")
 	flag.DurationVar(&rolebindingsResyncPeriod, "rolebindings-resync-period", 10*time.Hour, "Resync period for rolebindings reflector")
+	flag.StringVar(&jwksURL, "oidc-jwks-url", "", "URL of the JWKS used to verify the OIDC JWT signature, while the service account tokens are verified by the TokenReview API: if empty, any JWT is verified by the TokenReview API")
+	flag.StringVar(&oidcIssuerURL, "oidc-issuer-url", "", "URL of the OIDC issuer the discovery document is retrieved from, deriving the JWKS URL, the issuer the JWT must be issued by, and, with --oidc-discover-userinfo, the UserInfo endpoint: the --oidc-jwks-url and --oidc-userinfo-url take precedence, disabled when empty")
+	flag.DurationVar(&oidcDiscoveryRefreshInterval, "oidc-discovery-refresh-interval", time.Hour, "Refresh interval of the OIDC discovery document retrieved from the issuer URL (default: 1h)")
+	flag.DurationVar(&jwksRefreshInterval, "oidc-jwks-refresh-interval", time.Hour, "Refresh interval of the keys retrieved from the JWKS URL, when the provider response has no Cache-Control max-age")
+	flag.StringVar(&userInfoURL, "oidc-userinfo-url", "", "URL of the OIDC UserInfo endpoint resolving the identity of the opaque access tokens, the ones that are not a JWT, mapping its claims as the JWT ones: disabled when empty")
+	flag.BoolVar(&discoverUserInfo, "oidc-discover-userinfo", false, "Resolve the opaque access tokens with the UserInfo endpoint of the --oidc-issuer-url discovery document, when --oidc-userinfo-url is not set: these tokens are sent to the identity provider")
+	flag.DurationVar(&userInfoCacheTTL, "oidc-userinfo-cache-ttl", time.Minute, "Time to live of the identities resolved by the OIDC UserInfo endpoint, the cache is disabled when zero (default: 1m)")
+	flag.StringVar(&introspectionURL, "oidc-introspection-url", "", "URL of the OAuth2 token introspection endpoint (RFC 7662) resolving the identity of the opaque access tokens, the ones that are not a JWT, as an alternative to the TokenReview API: disabled when empty")
+	flag.StringVar(&introspectionClientID, "oidc-introspection-client-id", "", "Client ID authenticating the introspection requests with HTTP Basic authentication, omitted when empty")
+	flag.StringVar(&introspectionClientSecretPath, "oidc-introspection-client-secret-path", "", "Path of the file containing the client secret authenticating the introspection requests")
+	flag.StringSliceVar(&introspectionUsernameClaims, "oidc-introspection-username-claim", []string{"username"}, "The introspection response fields used to identify the user, tried in order until one is present (default: username)")
+	flag.StringSliceVar(&introspectionGroupsClaims, "oidc-introspection-groups-claim", []string{"scope"}, "The introspection response fields used to retrieve the user groups, split by whitespace when a single string as the scope one (default: scope)")
+	flag.DurationVar(&introspectionCacheTTL, "oidc-introspection-cache-ttl", 5*time.Minute, "Time to live of the identities resolved by the introspection endpoint, bounded by the exp field of the response: the cache is disabled when zero (default: 5m)")
+	flag.StringVar(&groupResolverURL, "groups-resolver-url", "", "URL of the group-membership service resolving the groups of the users whose credentials carry none, queried with the user parameter and replying with a JSON object holding the groups array: disabled when empty")
+	flag.DurationVar(&groupResolverCacheTTL, "groups-resolver-cache-ttl", time.Minute, "Time to live of the groups resolved by the group-membership service, the cache is disabled when zero (default: 1m)")
+	flag.DurationVar(&jwtClockSkew, "jwt-clock-skew", 30*time.Second, "Clock skew tolerated validating the exp and nbf claims of the JWT verified with the JWKS URL, both before nbf and after exp (default: 30s)")
+	flag.DurationVar(&serviceAccountTokenLeeway, "serviceaccount-token-leeway", 5*time.Second, "Further tolerance of the service account tokens iat and nbf claims in the future, on top of the JWT clock skew, since the freshly minted ones could be issued slightly ahead of the proxy clock (default: 5s)")
+	flag.StringSliceVar(&serviceAccountIssuers, "serviceaccount-issuers", []string{request.DefaultServiceAccountIssuer}, "Issuers of the projected service account tokens, matching the API server --service-account-issuer: only their JWT carrying the kubernetes.io claim, and the legacy ones, are mapped to a service account, the other ones are OIDC tokens (default: https://kubernetes.default.svc.cluster.local)")
+	flag.BoolVar(&verboseAuthErrors, "verbose-auth-errors", false, "Return to the clients the authentication failure reason, such as the TokenReview error (default: false)")
+	flag.StringVar(&auditLogPath, "audit-log-path", "", "Path of the file the audit events of the proxied requests are appended to as JSON lines, stdout or - for the standard output, disabled when empty")
+	flag.StringVar(&auditLogLevel, "audit-log-level", audit.LevelMetadata, "Level of the audit events: metadata, or full to record the user groups and the request URL too (default: metadata)")
+	flag.StringVar(&tracingExporter, "tracing-exporter", tracing.ExporterNone, "Exporter of the OpenTelemetry spans of the authentication and of the proxied requests: none, otlp over HTTP, or stdout (default: none)")
+	flag.StringVar(&tracingOTLPEndpoint, "tracing-otlp-endpoint", "", "Host and port of the OTLP HTTP collector the spans are exported to, such as otel-collector:4318, defaulting to the OTEL_EXPORTER_OTLP_ENDPOINT environment variable")
+	flag.Float64Var(&tracingSamplingRatio, "tracing-sampling-ratio", 1, "Ratio of the traces sampled when the incoming request carries no traceparent header, otherwise the client sampling decision is honoured (default: 1)")
+	flag.IntVar(&tokenReviewRetries, "token-review-retries", 0, "Retries of the TokenReview requests failed for transient errors, such as 503 or a connection reset, bounded by --upstream-timeout: the authentication denials are never retried (default: 0)")
+	flag.DurationVar(&tokenReviewRetryBackoff, "token-review-retry-backoff", 100*time.Millisecond, "Delay of the first TokenReview retry, doubled at each one (default: 100ms)")
+	flag.DurationVar(&upstreamTimeout, "upstream-timeout", 10*time.Second, "Timeout of the TokenReview and SubjectAccessReview requests performed to authenticate the users, replying with 504 when exceeded, disabled when zero (default: 10s)")
+	flag.StringVar(&upstreamProtocol, "upstream-protocol", options.UpstreamProtocolHTTP1, "Protocol of the requests proxied to the API server: http1, http2 negotiating HTTP/2 over TLS, or h2c for HTTP/2 over a plaintext upstream, multiplexing the streaming requests on a single connection: the upgraded connections, such as exec, are always sent with HTTP/1.1 (default: http1)")
+	flag.StringVar(&upstreamsConfigPath, "upstreams-config", "", "Path of the YAML file listing the upstream API servers, such as virtual clusters, the authenticated requests are routed to: each one made of group, or user, and the kubeconfig whose credentials must be allowed to impersonate the users. The first matching route is used, defaulting to the primary API server (default: disabled)")
+	flag.IntVar(&upstreamMaxIdleConns, "upstream-max-idle-conns", 0, "Idle connections to the API server kept open by the client performing the TokenReview and SubjectAccessReview requests, the client-go default of 25 when zero (default: 0)")
+	flag.DurationVar(&upstreamIdleConnTimeout, "upstream-idle-conn-timeout", 0, "Time an idle connection to the API server is kept open by the client performing the TokenReview and SubjectAccessReview requests, the client-go default of 90s when zero (default: 0)")
+	flag.DurationVar(&upstreamKeepAlive, "upstream-keepalive", 0, "TCP keepalive period of the connections to the API server of the client performing the TokenReview and SubjectAccessReview requests, the client-go default of 30s when zero (default: 0)")
+	flag.BoolVar(&addAuthenticatedGroup, "add-authenticated-group", true, "Add the system:authenticated group to the resolved groups, or system:unauthenticated for the anonymous user, as the API server does (default: true)")
+	flag.StringSliceVar(&additionalGroups, "additional-groups", []string{}, "Groups added to the resolved ones of every authenticated user, such as a baseline shared-readers one, regardless of the identity provider and after the impersonation: never added to the anonymous user")
+	flag.BoolVar(&enablePprof, "enable-pprof", false, "Serve the pprof profiling endpoints on a dedicated listener, never on the proxy one (default: false)")
+	flag.StringVar(&pprofBindAddress, "pprof-bind-address", "127.0.0.1:6060", "Address the pprof profiling endpoints are served on, when enabled (default: 127.0.0.1:6060)")
+	flag.BoolVar(&trustClientIP, "trust-client-ip", false, "Forward the client IP to the API server with the X-Forwarded-For and X-Real-IP headers, appending it to the X-Forwarded-For chain of the load balancers in front of the proxy: if disabled, these headers are dropped (default: false)")
+	flag.StringSliceVar(&impersonationBypassUsers, "impersonation-bypass-users", []string{}, "Users allowed to impersonate without the SubjectAccessReview check, such as trusted controllers, relying on the configured RBAC policy")
+	flag.StringSliceVar(&impersonationDeniedUsers, "impersonation-denied-users", []string{}, "Users that cannot be impersonated through the proxy, rejected with 403 regardless of the RBAC policy, even for the bypass users")
+	flag.StringSliceVar(&impersonationDeniedGroups, "impersonation-denied-groups", []string{"system:masters"}, "Groups that cannot be impersonated through the proxy, rejected with 403 regardless of the RBAC policy, even for the bypass users (default: system:masters)")
+	flag.BoolVar(&disableServiceAccountImpersonation, "disable-serviceaccount-impersonation", false, "Reject with 403 the requests authenticated with a service account token carrying the Impersonate-* headers, almost always a misconfiguration or an attack (default: false)")
+	flag.BoolVar(&forwardUserExtra, "forward-user-extra", false, "Forward the UID and the extras of the users authenticated with the TokenReview, such as the scopes, to the upstream with the Impersonate-Uid and Impersonate-Extra-* headers: the proxy must be allowed to impersonate the uids and the userextras (default: false)")
+	flag.StringVar(&impersonateGroupsSeparator, "impersonate-groups-separator", "", "Separator splitting each Impersonate-Group header into multiple groups, such as , for the clients sending the groups joined in a single header: each group is checked on its own, no splitting when empty as for the API server (default: none)")
+	flag.BoolVar(&namespacedImpersonationChecks, "impersonation-namespaced-checks", false, "Check the impersonation of the namespaced requests in their Namespace rather than cluster-wide, letting the RoleBindings grant the impersonation per Namespace (default: false)")
+	flag.BoolVar(&disableImpersonation, "disable-impersonation", false, "Reject with 403 any request carrying the Impersonate-* headers, regardless of the RBAC policy and the impersonation bypass users (default: false)")
+	flag.StringVar(&authenticateRealm, "www-authenticate-realm", "", "Realm of the WWW-Authenticate Bearer challenge returned along with the 401 responses, omitted when empty")
+	flag.Int64Var(&maxRequestBodyBytes, "max-request-body-bytes", 0, "Size limit of the POST, PUT, and PATCH requests body, replying with 413 when exceeded: exec, attach, and port-forward are not limited, disabled when zero (default: 0)")
+	flag.StringVar(&tokenHeader, "token-header", "Authorization", "Header the bearer token is read from: a header other than Authorization carries the raw token, with no Bearer scheme, as X-Forwarded-Access-Token forwarded by oauth2-proxy, and takes precedence over the Authorization one (default: Authorization)")
+	flag.StringVar(&unauthenticatedMessage, "unauthenticated-message", request.DefaultUnauthenticatedMessage, "Message of the Status returned to the requests rejected for the missing credentials (default: authentication required)")
+	flag.BoolVar(&forwardIdentityHeaders, "forward-identity-headers", false, "Forward the resolved identity to the upstream with the X-Capsule-Proxy-User and X-Capsule-Proxy-Groups headers, the latter comma-separated, for the logging sidecars: the identity is sensitive, enable it only on trusted internal networks. The client-supplied ones are always dropped (default: false)")
+	flag.BoolVar(&readOnly, "read-only", false, "Reject with 403 the write requests, such as create, update, patch, and delete, once the user is authenticated, while the read ones are proxied: meant for the cluster maintenance (default: false)")
+	flag.StringVar(&readOnlyMessage, "read-only-message", "the cluster is under maintenance, only the read requests are allowed", "Message of the Status returned to the write requests rejected in the read-only mode")
+	flag.Float64Var(&rateLimitQPS, "rate-limit-qps", 0, "Requests per second allowed to each user, replying with 429 along with the Retry-After header when exceeded: the watch requests are not limited, being long-running (default: disabled)")
+	flag.IntVar(&rateLimitBurst, "rate-limit-burst", 20, "Requests allowed to each user in a burst, on top of --rate-limit-qps (default: 20)")
+	flag.StringSliceVar(&rateLimitGroups, "rate-limit-groups", []string{}, "Groups whose members share a rate limit too, with the same requests per second and burst, such as the Tenant owners groups, on top of their own one (default: [])")
+	flag.BoolVar(&filteredListWarning, "filtered-list-warning", false, "Append a Warning header to the list responses filtered to the resources of the user Tenants, next to the API server ones, such as the deprecation notices, shown by kubectl (default: false)")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "Time the in-flight requests are waited for upon shutdown, while no new connections are accepted, before forcibly closing them (default: 30s)")
+	flag.DurationVar(&shutdownStreamsGracePeriod, "shutdown-streams-grace-period", 10*time.Second, "Time the long-running requests, such as watches, exec, and port-forward, are kept open upon shutdown before being closed, bounded by the shutdown timeout (default: 10s)")
+	flag.StringSliceVar(&serviceAccountNamespaceLabels, "serviceaccount-namespace-label-groups", []string{}, "Labels of the service accounts Namespace added as groups in the form <label>:<value>, such as team, for the JWT service account tokens")
+	flag.StringVar(&groupsAllowRegex, "groups-allow-regex", "", "Regular expression the resolved groups must match to be honored, the other ones are dropped, such as ^capsule-: anchor it to match the whole group name, disabled when empty")
+	flag.StringVar(&groupsDenyRegex, "groups-deny-regex", "", "Regular expression of the resolved groups that are never honored, neither authorizing the impersonation, such as ^system:masters$, taking precedence over --groups-allow-regex: disabled when empty")
+	flag.DurationVar(&tokenReviewCacheTTL, "token-review-cache-ttl", 0, "Time to live of the identities resolved by the TokenReview API, the cache is disabled when zero (default: 0)")
+	flag.IntVar(&circuitBreakerThreshold, "token-review-circuit-breaker-threshold", 0, "Consecutive TokenReview failures within --token-review-circuit-breaker-window opening the circuit, replying with 503 for the cooldown without querying the API server: disabled when zero (default: 0)")
+	flag.DurationVar(&circuitBreakerWindow, "token-review-circuit-breaker-window", 30*time.Second, "Time window the consecutive TokenReview failures are counted within (default: 30s)")
+	flag.DurationVar(&circuitBreakerCooldown, "token-review-circuit-breaker-cooldown", 30*time.Second, "Time the open circuit fast-fails the TokenReview requests before letting a trial one through (default: 30s)")
 
 	opts := zap.Options{
 		EncoderConfigOptions: append([]zap.EncoderConfigOption{}, func(config *zapcore.EncoderConfig) {
@@ -85,6 +334,8 @@ func main() {
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
 	log.Info("---")
+	buildInfo := version.Get()
+	log.Info(fmt.Sprintf("Capsule Proxy version %s, commit %s", buildInfo.Version, buildInfo.GitCommit))
 	log.Info(fmt.Sprintf("Manager listening on port %d", listeningPort))
 	log.Info(fmt.Sprintf("Listening on HTTPS: %t", bindSsl))
 
@@ -96,6 +347,9 @@ func main() {
 		case len(keyPath) > 0:
 			log.Info("cannot use a Certificate key when TLS/SSL mode is disabled")
 			os.Exit(1)
+		case len(tlsCipherSuites) > 0:
+			log.Info("cannot use the TLS cipher suites when TLS/SSL mode is disabled")
+			os.Exit(1)
 		}
 	}
 
@@ -107,13 +361,37 @@ func main() {
 	}
 
 	log.Info(fmt.Sprintf("The ignored User Groups are %v", ignoredUserGroups))
-	log.Info(fmt.Sprintf("The OIDC username selected is %s", usernameClaimField))
+	log.Info(fmt.Sprintf("The OIDC username claims selected are %v", usernameClaimFields))
+	log.Info(fmt.Sprintf("The OIDC groups claims selected are %v", groupsClaimFields))
 	log.Info("---")
 	log.Info("Creating the manager")
 
-	mgr, err = ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:                 scheme,
-		HealthProbeBindAddress: ":8081",
+	upstreamConfig, err := options.UpstreamConfig(ctrl.GetConfigOrDie(), upstreamMaxIdleConns, upstreamIdleConnTimeout, upstreamKeepAlive)
+	if err != nil {
+		log.Error(err, "cannot create the upstream client configuration")
+		os.Exit(1)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracingExporter, tracingOTLPEndpoint, tracingSamplingRatio)
+	if err != nil {
+		log.Error(err, "cannot set up the tracing")
+		os.Exit(1)
+	}
+
+	if len(tracingExporter) > 0 && tracingExporter != tracing.ExporterNone {
+		log.Info(fmt.Sprintf("Exporting the traces with the %s exporter, sampling %v of them", tracingExporter, tracingSamplingRatio))
+		// Tracing the TokenReview and SubjectAccessReview requests as well
+		upstreamConfig.Wrap(tracing.WrapTransport)
+	}
+
+	// Leaving the proxy the time to drain the in-flight requests before giving up
+	gracefulShutdownTimeout := shutdownTimeout + 5*time.Second
+
+	// The probes are served by the NamespaceFilter, replying with 503 rather than 500 when not ready
+	mgr, err = ctrl.NewManager(upstreamConfig, ctrl.Options{
+		Scheme:                  scheme,
+		HealthProbeBindAddress:  "0",
+		GracefulShutdownTimeout: &gracefulShutdownTimeout,
 	})
 	if err != nil {
 		log.Error(err, "cannot create new Manager")
@@ -135,6 +413,80 @@ func main() {
 		os.Exit(1)
 	}
 
+	var discovery *request.Discovery
+
+	if len(oidcIssuerURL) > 0 {
+		log.Info("Retrieving the OIDC discovery document", "issuer", oidcIssuerURL)
+
+		discovery = request.NewDiscovery(oidcIssuerURL, oidcDiscoveryRefreshInterval)
+
+		if err = discovery.Refresh(context.Background()); err != nil {
+			log.Error(err, "cannot retrieve the OIDC discovery document", "issuer", oidcIssuerURL)
+			os.Exit(1)
+		}
+
+		if err = mgr.Add(discovery); err != nil {
+			log.Error(err, "cannot add OIDC discovery as Runnable")
+			os.Exit(1)
+		}
+	}
+
+	var keySet *request.KeySet
+
+	switch {
+	case len(jwksURL) > 0:
+		log.Info("Adding the JWKS key set to the Manager", "url", jwksURL)
+
+		keySet = request.NewKeySet(jwksURL, jwksRefreshInterval)
+	case discovery != nil:
+		log.Info("Adding the discovered JWKS key set to the Manager", "url", discovery.JWKSURL())
+
+		keySet = request.NewDiscoveryKeySet(discovery, jwksRefreshInterval)
+	}
+
+	if keySet != nil {
+		if err = mgr.Add(keySet); err != nil {
+			log.Error(err, "cannot add JWKS key set as Runnable")
+			os.Exit(1)
+		}
+	}
+
+	if enablePprof {
+		log.Info("Adding the pprof server to the Manager", "address", pprofBindAddress)
+
+		if err = mgr.Add(pprof.NewServer(pprofBindAddress)); err != nil {
+			log.Error(err, "cannot add pprof server as Runnable")
+			os.Exit(1)
+		}
+	}
+
+	var tokenReviewCache *request.TokenReviewCache
+
+	if tokenReviewCacheTTL > 0 {
+		log.Info(fmt.Sprintf("Caching the TokenReview results for %s", tokenReviewCacheTTL))
+
+		tokenReviewCache = request.NewTokenReviewCache(tokenReviewCacheTTL)
+	}
+
+	var circuitBreaker *request.CircuitBreaker
+
+	if circuitBreakerThreshold > 0 {
+		log.Info(fmt.Sprintf("Opening the TokenReview circuit for %s after %d consecutive failures within %s", circuitBreakerCooldown, circuitBreakerThreshold, circuitBreakerWindow))
+
+		circuitBreaker = request.NewCircuitBreaker(circuitBreakerThreshold, circuitBreakerWindow, circuitBreakerCooldown)
+	}
+
+	var auditLogger *audit.Logger
+
+	if len(auditLogPath) > 0 {
+		log.Info(fmt.Sprintf("Writing the audit events to %s", auditLogPath))
+
+		if auditLogger, err = audit.NewLogger(auditLogPath, auditLogLevel); err != nil {
+			log.Error(err, "cannot create the audit logger")
+			os.Exit(1)
+		}
+	}
+
 	ctx := ctrl.SetupSignalHandler()
 
 	log.Info("Creating the Field Indexer")
@@ -158,19 +510,106 @@ func main() {
 
 	var listenerOpts options.ListenerOpts
 
-	if listenerOpts, err = options.NewKube(ignoredUserGroups, usernameClaimField, ctrl.GetConfigOrDie()); err != nil {
+	if listenerOpts, err = options.NewKube(options.Kube{
+		IgnoredGroups:                 ignoredUserGroups,
+		Audiences:                     audiences,
+		RequiredAudiences:             jwtRequiredAudiences,
+		UsernameClaims:                usernameClaimFields,
+		GroupsClaims:                  groupsClaimFields,
+		UsernamePrefix:                usernamePrefix,
+		GroupsPrefix:                  groupsPrefix,
+		GroupsSeparator:               groupsSeparator,
+		RequireGroupsClaim:            requireGroupsClaim,
+		UsernameFallbackToSub:         usernameClaimFallbackSub,
+		UsernameLowercaseEmail:        usernameLowercaseEmail,
+		CertUsernameSource:            certUsernameSource,
+		CertGroupsSources:             certGroupsSources,
+		CertURIPattern:                certURIPattern,
+		CertURITemplate:               certURITemplate,
+		CertAuthDisabled:              disableClientCertAuth,
+		TrustedProxies:                trustedProxies,
+		TokenQueryParameter:           tokenQueryParameter,
+		AnonymousPaths:                anonymousAllowedPaths,
+		ClockSkew:                     jwtClockSkew,
+		ServiceAccountLeeway:          serviceAccountTokenLeeway,
+		ServiceAccountIssuers:         serviceAccountIssuers,
+		UpstreamTimeout:               upstreamTimeout,
+		TokenReviewRetries:            tokenReviewRetries,
+		TokenReviewRetryBackoff:       tokenReviewRetryBackoff,
+		AuthenticatedGroup:            addAuthenticatedGroup,
+		AdditionalGroups:              additionalGroups,
+		IssuersConfig:                 issuersConfigPath,
+		TrustedIssuers:                trustedIssuers,
+		StrictIssuers:                 strictIssuers,
+		ImpersonationDisabled:         disableImpersonation,
+		SAImpersonationDisabled:       disableServiceAccountImpersonation,
+		NamespacedImpersonation:       namespacedImpersonationChecks,
+		ForwardUserExtra:              forwardUserExtra,
+		ImpersonateGroupsSeparator:    impersonateGroupsSeparator,
+		BypassUsers:                   impersonationBypassUsers,
+		DeniedUsers:                   impersonationDeniedUsers,
+		DeniedGroups:                  impersonationDeniedGroups,
+		NamespaceLabels:               serviceAccountNamespaceLabels,
+		GroupsAllowRegex:              groupsAllowRegex,
+		GroupsDenyRegex:               groupsDenyRegex,
+		UserInfoURL:                   userInfoURL,
+		DiscoverUserInfo:              discoverUserInfo,
+		UserInfoCacheTTL:              userInfoCacheTTL,
+		IntrospectionURL:              introspectionURL,
+		IntrospectionClientID:         introspectionClientID,
+		IntrospectionClientSecretPath: introspectionClientSecretPath,
+		IntrospectionUsernameClaims:   introspectionUsernameClaims,
+		IntrospectionGroupsClaims:     introspectionGroupsClaims,
+		IntrospectionCacheTTL:         introspectionCacheTTL,
+		GroupResolverURL:              groupResolverURL,
+		GroupResolverCacheTTL:         groupResolverCacheTTL,
+		UpstreamProtocol:              upstreamProtocol,
+		UpstreamsConfig:               upstreamsConfigPath,
+	}, ctrl.GetConfigOrDie()); err != nil {
 		log.Error(err, "cannot create Kubernetes options")
 		os.Exit(1)
 	}
 
 	var serverOpts options.ServerOptions
 
-	if serverOpts, err = options.NewServer(bindSsl, listeningPort, certPath, keyPath, ctrl.GetConfigOrDie()); err != nil {
+	if serverOpts, err = options.NewServer(options.Server{
+		TLS:               bindSsl,
+		Port:              listeningPort,
+		CertPath:          certPath,
+		KeyPath:           keyPath,
+		ClientCAPath:      clientCAPath,
+		TLSMinVersion:     tlsMinVersion,
+		TLSCipherSuites:   tlsCipherSuites,
+		VerboseAuthErrors: verboseAuthErrors,
+		TrustClientIP:     trustClientIP,
+		Realm:             authenticateRealm,
+		MaxBodyBytes:      maxRequestBodyBytes,
+		IdentityHeaders:   forwardIdentityHeaders,
+		FilteredWarning:   filteredListWarning,
+		ReadOnly:          readOnly,
+		ReadOnlyMessage:   readOnlyMessage,
+		ShutdownTimeout:   shutdownTimeout,
+		StreamsGrace:      shutdownStreamsGracePeriod,
+		TokenHeader:       tokenHeader,
+		Unauthenticated:   unauthenticatedMessage,
+		RateLimitQPS:      rateLimitQPS,
+		RateLimitBurst:    rateLimitBurst,
+		RateLimitGroups:   rateLimitGroups,
+	}, ctrl.GetConfigOrDie()); err != nil {
 		log.Error(err, "cannot create Kubernetes options")
 		os.Exit(1)
 	}
 
-	r, err = webserver.NewKubeFilter(listenerOpts, serverOpts, rbReflector)
+	r, err = webserver.NewKubeFilter(webserver.Options{
+		Listener:             listenerOpts,
+		Server:               serverOpts,
+		RoleBindingReflector: rbReflector,
+		KeySet:               keySet,
+		Discovery:            discovery,
+		TokenReviewCache:     tokenReviewCache,
+		CircuitBreaker:       circuitBreaker,
+		AuditLogger:          auditLogger,
+	})
 	if err != nil {
 		log.Error(err, "cannot create NamespaceFilter runner")
 		os.Exit(1)
@@ -191,13 +630,18 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = mgr.AddHealthzCheck("healthz", r.LivenessProbe); err != nil {
-		log.Error(err, "cannot create healthcheck probe")
+	if err = mgr.Add(webserver.NewProbeServer(":8081", r)); err != nil {
+		log.Error(err, "cannot create the probes server")
 		os.Exit(1)
 	}
 
-	if err = mgr.AddReadyzCheck("ready", r.ReadinessProbe); err != nil {
-		log.Error(err, "cannot create readiness probe")
+	// Flushing the pending spans once the Manager is stopped
+	if err = mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		<-ctx.Done()
+
+		return shutdownTracing(context.Background())
+	})); err != nil {
+		log.Error(err, "cannot add the tracing shutdown as Runnable")
 		os.Exit(1)
 	}
 